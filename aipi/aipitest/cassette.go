@@ -0,0 +1,330 @@
+package aipitest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/somtojf/trio-server/aipi"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+)
+
+type CassetteMode string
+
+const (
+	// CASSETTE_MODE_REPLAY only answers from recordings and fails on a miss
+	CASSETTE_MODE_REPLAY CassetteMode = "replay"
+	// CASSETTE_MODE_RECORD calls the wrapped client every time and overwrites recordings
+	CASSETTE_MODE_RECORD CassetteMode = "record"
+	// CASSETTE_MODE_RECORD_MISSING replays recordings and records the requests it has none for
+	CASSETTE_MODE_RECORD_MISSING CassetteMode = "record_missing"
+)
+
+type callKind string
+
+const (
+	callKindCompletion callKind = "completion"
+	callKindStream     callKind = "stream"
+	callKindEmbedding  callKind = "embedding"
+	callKindEmbeddings callKind = "embeddings"
+)
+
+var ErrCassetteMiss = errors.New("no recording for request")
+
+// Cassette records request/response pairs of a wrapped client to disk and
+// replays them later. Recordings are keyed by a hash of the request, with
+// the user id left out so the same conversation replays for every user.
+type Cassette struct {
+	inner aipi.AIPIClient
+	dir   string
+	mode  CassetteMode
+	mx    sync.Mutex
+}
+
+var _ aipi.AIPIClient = (*Cassette)(nil)
+
+// NewCassette stores recordings in dir. inner may be nil in replay mode.
+func NewCassette(inner aipi.AIPIClient, dir string, mode CassetteMode) (*Cassette, error) {
+	switch mode {
+	case CASSETTE_MODE_REPLAY:
+	case CASSETTE_MODE_RECORD, CASSETTE_MODE_RECORD_MISSING:
+		if inner == nil {
+			return nil, fmt.Errorf("cassette mode %s needs a client to record", mode)
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("error creating cassette directory: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown cassette mode %q", mode)
+	}
+
+	return &Cassette{inner: inner, dir: dir, mode: mode}, nil
+}
+
+type recordedChunk struct {
+	Chunk aipitypes.AIPIStreamChunk `json:"chunk"`
+	Error string                    `json:"error,omitempty"`
+}
+
+type recording struct {
+	Kind       callKind                `json:"kind"`
+	Request    json.RawMessage         `json:"request"`
+	Response   *aipitypes.AIPIResponse `json:"response,omitempty"`
+	Chunks     []recordedChunk         `json:"chunks,omitempty"`
+	Embedding  []float32               `json:"embedding,omitempty"`
+	Embeddings [][]float32             `json:"embeddings,omitempty"`
+	Error      string                  `json:"error,omitempty"`
+}
+
+func (c *Cassette) GetCompletion(ctx context.Context, request aipitypes.AIPIRequest) (aipitypes.AIPIResponse, error) {
+	key, requestJSON, err := completionKey(callKindCompletion, request)
+	if err != nil {
+		return aipitypes.AIPIResponse{}, err
+	}
+
+	if c.mode != CASSETTE_MODE_RECORD {
+		recorded, err := c.load(key)
+		if err == nil {
+			if recorded.Error != "" {
+				return aipitypes.AIPIResponse{}, errors.New(recorded.Error)
+			}
+			return *recorded.Response, nil
+		}
+		if c.mode == CASSETTE_MODE_REPLAY || !errors.Is(err, ErrCassetteMiss) {
+			return aipitypes.AIPIResponse{}, err
+		}
+	}
+
+	response, callErr := c.inner.GetCompletion(ctx, request)
+	if ctx.Err() != nil {
+		return response, callErr
+	}
+
+	recorded := recording{Kind: callKindCompletion, Request: requestJSON}
+	if callErr != nil {
+		recorded.Error = callErr.Error()
+	} else {
+		recorded.Response = &response
+	}
+	if err := c.save(key, recorded); err != nil {
+		return aipitypes.AIPIResponse{}, err
+	}
+	return response, callErr
+}
+
+func (c *Cassette) GetCompletionAsync(ctx context.Context, request aipitypes.AIPIRequest) (<-chan aipitypes.AIPIStreamChunk, error) {
+	key, requestJSON, err := completionKey(callKindStream, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.mode != CASSETTE_MODE_RECORD {
+		recorded, err := c.load(key)
+		if err == nil {
+			if recorded.Error != "" {
+				return nil, errors.New(recorded.Error)
+			}
+			return replayChunks(ctx, recorded.Chunks), nil
+		}
+		if c.mode == CASSETTE_MODE_REPLAY || !errors.Is(err, ErrCassetteMiss) {
+			return nil, err
+		}
+	}
+
+	chunks, err := c.inner.GetCompletionAsync(ctx, request)
+	if err != nil {
+		if ctx.Err() == nil {
+			if saveErr := c.save(key, recording{Kind: callKindStream, Request: requestJSON, Error: err.Error()}); saveErr != nil {
+				return nil, saveErr
+			}
+		}
+		return nil, err
+	}
+
+	forwarded := make(chan aipitypes.AIPIStreamChunk)
+	go func() {
+		defer close(forwarded)
+
+		recorded := recording{Kind: callKindStream, Request: requestJSON}
+		for chunk := range chunks {
+			entry := recordedChunk{Chunk: chunk}
+			if chunk.Err != nil {
+				entry.Error = chunk.Err.Error()
+			}
+			recorded.Chunks = append(recorded.Chunks, entry)
+
+			if !aipitypes.SendChunk(ctx, forwarded, chunk) {
+				// An interrupted stream is incomplete and not worth replaying
+				for range chunks {
+				}
+				return
+			}
+		}
+
+		if err := c.save(key, recorded); err != nil {
+			aipitypes.SendChunk(ctx, forwarded, aipitypes.AIPIStreamChunk{Err: err})
+		}
+	}()
+	return forwarded, nil
+}
+
+func (c *Cassette) GetEmbedding(ctx context.Context, request aipitypes.EmbeddingRequest) ([]float32, error) {
+	keyed := request
+	keyed.IdUser = 0
+	key, requestJSON, err := hashRequest(callKindEmbedding, keyed)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.mode != CASSETTE_MODE_RECORD {
+		recorded, err := c.load(key)
+		if err == nil {
+			if recorded.Error != "" {
+				return nil, errors.New(recorded.Error)
+			}
+			return recorded.Embedding, nil
+		}
+		if c.mode == CASSETTE_MODE_REPLAY || !errors.Is(err, ErrCassetteMiss) {
+			return nil, err
+		}
+	}
+
+	embedding, callErr := c.inner.GetEmbedding(ctx, request)
+	if ctx.Err() != nil {
+		return embedding, callErr
+	}
+
+	recorded := recording{Kind: callKindEmbedding, Request: requestJSON, Embedding: embedding}
+	if callErr != nil {
+		recorded.Error = callErr.Error()
+	}
+	if err := c.save(key, recorded); err != nil {
+		return nil, err
+	}
+	return embedding, callErr
+}
+
+func (c *Cassette) GetEmbeddings(ctx context.Context, request aipitypes.EmbeddingRequest) ([][]float32, error) {
+	keyed := request
+	keyed.IdUser = 0
+	key, requestJSON, err := hashRequest(callKindEmbeddings, keyed)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.mode != CASSETTE_MODE_RECORD {
+		recorded, err := c.load(key)
+		if err == nil {
+			if recorded.Error != "" {
+				return nil, errors.New(recorded.Error)
+			}
+			return recorded.Embeddings, nil
+		}
+		if c.mode == CASSETTE_MODE_REPLAY || !errors.Is(err, ErrCassetteMiss) {
+			return nil, err
+		}
+	}
+
+	embeddings, callErr := c.inner.GetEmbeddings(ctx, request)
+	if ctx.Err() != nil {
+		return embeddings, callErr
+	}
+
+	recorded := recording{Kind: callKindEmbeddings, Request: requestJSON, Embeddings: embeddings}
+	if callErr != nil {
+		recorded.Error = callErr.Error()
+	}
+	if err := c.save(key, recorded); err != nil {
+		return nil, err
+	}
+	return embeddings, callErr
+}
+
+func replayChunks(ctx context.Context, recorded []recordedChunk) <-chan aipitypes.AIPIStreamChunk {
+	chunks := make(chan aipitypes.AIPIStreamChunk)
+	go func() {
+		defer close(chunks)
+		for _, entry := range recorded {
+			chunk := entry.Chunk
+			if entry.Error != "" {
+				chunk.Err = errors.New(entry.Error)
+			}
+			if !aipitypes.SendChunk(ctx, chunks, chunk) {
+				return
+			}
+		}
+	}()
+	return chunks
+}
+
+// completionKey hashes a completion request. The response schema is not
+// serialized with the request, so its name and definition are added.
+func completionKey(kind callKind, request aipitypes.AIPIRequest) (string, json.RawMessage, error) {
+	request.IdUser = 0
+	keyed := struct {
+		Request aipitypes.AIPIRequest     `json:"request"`
+		Schema  *aipitypes.ResponseSchema `json:"schema,omitempty"`
+	}{Request: request, Schema: request.ResponseSchema}
+	return hashRequest(kind, keyed)
+}
+
+func hashRequest(kind callKind, request any) (string, json.RawMessage, error) {
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		return "", nil, fmt.Errorf("error marshalling request for cassette: %w", err)
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(kind))
+	hash.Write(requestJSON)
+	return string(kind) + "-" + hex.EncodeToString(hash.Sum(nil)), requestJSON, nil
+}
+
+func (c *Cassette) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *Cassette) load(key string) (recording, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	data, err := os.ReadFile(c.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return recording{}, fmt.Errorf("%w %s", ErrCassetteMiss, key)
+	}
+	if err != nil {
+		return recording{}, fmt.Errorf("error reading cassette: %w", err)
+	}
+
+	var recorded recording
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return recording{}, fmt.Errorf("error parsing cassette %s: %w", key, err)
+	}
+	return recorded, nil
+}
+
+func (c *Cassette) save(key string, recorded recording) error {
+	data, err := json.MarshalIndent(recorded, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling cassette: %w", err)
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	// Write to a temporary file first so a crash never leaves half a recording
+	tmp := c.path(key) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("error writing cassette: %w", err)
+	}
+	if err := os.Rename(tmp, c.path(key)); err != nil {
+		return fmt.Errorf("error writing cassette: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package aipitest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+)
+
+func TestCassetteGetCompletion(t *testing.T) {
+	recorded := aipitypes.AIPIRequest{Model: "m", UserMessage: "recorded", IdUser: 1}
+	// Recordings are shared between users
+	otherUser := aipitypes.AIPIRequest{Model: "m", UserMessage: "recorded", IdUser: 2}
+	unrecorded := aipitypes.AIPIRequest{Model: "m", UserMessage: "unrecorded"}
+
+	tests := []struct {
+		name string
+		mode CassetteMode
+		// steps are the fresh answers of the wrapped client
+		steps     []Step
+		request   aipitypes.AIPIRequest
+		want      string
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "replay hit", mode: CASSETTE_MODE_REPLAY, request: otherUser, want: "original"},
+		{name: "replay miss", mode: CASSETTE_MODE_REPLAY, request: unrecorded, wantErr: ErrCassetteMiss},
+		{name: "record missing hit", mode: CASSETTE_MODE_RECORD_MISSING, steps: []Step{Reply("fresh")}, request: recorded, want: "original"},
+		{name: "record missing miss", mode: CASSETTE_MODE_RECORD_MISSING, steps: []Step{Reply("fresh")}, request: unrecorded, want: "fresh", wantCalls: 1},
+		{name: "record overwrites", mode: CASSETTE_MODE_RECORD, steps: []Step{Reply("fresh")}, request: recorded, want: "fresh", wantCalls: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			recorder, err := NewCassette(NewFake(Reply("original")), dir, CASSETTE_MODE_RECORD)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := recorder.GetCompletion(context.Background(), recorded); err != nil {
+				t.Fatal(err)
+			}
+
+			inner := NewFake(test.steps...)
+			cassette, err := NewCassette(inner, dir, test.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := cassette.GetCompletion(context.Background(), test.request)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			if response.Data != test.want {
+				t.Errorf("got %q, want %q", response.Data, test.want)
+			}
+			if got := len(inner.Requests()); got != test.wantCalls {
+				t.Errorf("wrapped client got %d calls, want %d", got, test.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCassetteReplaysStreamsAndErrors(t *testing.T) {
+	failure := errors.New("rate limited")
+
+	tests := []struct {
+		name    string
+		step    Step
+		stream  bool
+		want    string
+		wantErr string
+	}{
+		{name: "stream", step: Reply("a streamed reply"), stream: true, want: "a streamed reply"},
+		{name: "completion error", step: Fail(failure), wantErr: failure.Error()},
+		{name: "stream error", step: Fail(failure), stream: true, wantErr: failure.Error()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			request := aipitypes.AIPIRequest{Model: "m", UserMessage: test.name}
+			call := func(cassette *Cassette) (string, error) {
+				if !test.stream {
+					response, err := cassette.GetCompletion(context.Background(), request)
+					return response.Data, err
+				}
+				chunks, err := cassette.GetCompletionAsync(context.Background(), request)
+				if err != nil {
+					return "", err
+				}
+				var data strings.Builder
+				for chunk := range chunks {
+					if chunk.Err != nil {
+						return "", chunk.Err
+					}
+					data.WriteString(chunk.Delta)
+				}
+				return data.String(), nil
+			}
+
+			recorder, err := NewCassette(NewFake(test.step), dir, CASSETTE_MODE_RECORD)
+			if err != nil {
+				t.Fatal(err)
+			}
+			call(recorder)
+
+			player, err := NewCassette(nil, dir, CASSETTE_MODE_REPLAY)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := call(player)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %s", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewCassette(t *testing.T) {
+	tests := []struct {
+		name       string
+		withClient bool
+		mode       CassetteMode
+		wantErr    bool
+	}{
+		{name: "replay without client", mode: CASSETTE_MODE_REPLAY},
+		{name: "record without client", mode: CASSETTE_MODE_RECORD, wantErr: true},
+		{name: "record missing", withClient: true, mode: CASSETTE_MODE_RECORD_MISSING},
+		{name: "unknown mode", withClient: true, mode: "rewind", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error
+			if test.withClient {
+				_, err = NewCassette(NewFake(), t.TempDir(), test.mode)
+			} else {
+				_, err = NewCassette(nil, t.TempDir(), test.mode)
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
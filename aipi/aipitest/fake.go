@@ -0,0 +1,242 @@
+// Package aipitest provides AIPIClient implementations for running the server
+// and its handlers without calling OpenAI or Gemini: a scripted fake, a
+// cassette recorder/replayer and a fault injecting wrapper.
+package aipitest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/somtojf/trio-server/aipi"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+)
+
+const DEFAULT_EMBEDDING_DIMENSIONS = 1536
+
+var ErrScriptExhausted = errors.New("fake provider has no scripted response left")
+
+// Step is one scripted reply of the fake. Either Err or Response is used.
+type Step struct {
+	Response aipitypes.AIPIResponse
+	Err      error
+	// Match restricts the step to requests it returns true for. Steps without
+	// Match answer any request.
+	Match func(request aipitypes.AIPIRequest) bool
+}
+
+// Reply is a step answering with text.
+func Reply(data string) Step {
+	return Step{Response: aipitypes.AIPIResponse{Data: data}}
+}
+
+// Fail is a step answering with an error.
+func Fail(err error) Step {
+	return Step{Err: err}
+}
+
+// CallTools is a step where the model asks for tools to be run.
+func CallTools(calls ...aipitypes.ToolCall) Step {
+	return Step{Response: aipitypes.AIPIResponse{ToolCalls: calls}}
+}
+
+// Fake answers completions from a script, in order, and remembers every
+// request it received. Embeddings are derived from a hash of the input, so
+// equal inputs get equal vectors.
+type Fake struct {
+	mx       sync.Mutex
+	steps    []Step
+	requests []aipitypes.AIPIRequest
+	embedded []aipitypes.EmbeddingRequest
+	// Model is reported as the answering model when a step doesn't set one
+	Model string
+}
+
+var _ aipi.AIPIClient = (*Fake)(nil)
+
+func NewFake(steps ...Step) *Fake {
+	return &Fake{steps: steps, Model: "fake-model"}
+}
+
+// Enqueue appends steps to the script.
+func (f *Fake) Enqueue(steps ...Step) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.steps = append(f.steps, steps...)
+}
+
+// Requests returns the completion requests received so far.
+func (f *Fake) Requests() []aipitypes.AIPIRequest {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return append([]aipitypes.AIPIRequest(nil), f.requests...)
+}
+
+// EmbeddingRequests returns the embedding requests received so far.
+func (f *Fake) EmbeddingRequests() []aipitypes.EmbeddingRequest {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return append([]aipitypes.EmbeddingRequest(nil), f.embedded...)
+}
+
+// Remaining is the number of steps that have not been used yet.
+func (f *Fake) Remaining() int {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return len(f.steps)
+}
+
+// next takes the first step that matches the request off the script.
+func (f *Fake) next(request aipitypes.AIPIRequest) (aipitypes.AIPIResponse, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	f.requests = append(f.requests, request)
+	for i, step := range f.steps {
+		if step.Match != nil && !step.Match(request) {
+			continue
+		}
+		f.steps = append(f.steps[:i:i], f.steps[i+1:]...)
+		if step.Err != nil {
+			return aipitypes.AIPIResponse{}, step.Err
+		}
+
+		response := step.Response
+		if response.Model == "" {
+			response.Model = f.Model
+		}
+		if response.Usage == (aipitypes.AIPIUsage{}) {
+			response.Usage = estimateUsage(request, response)
+		}
+		return response, nil
+	}
+	return aipitypes.AIPIResponse{}, fmt.Errorf("%w for model %s", ErrScriptExhausted, request.Model)
+}
+
+func (f *Fake) GetCompletion(ctx context.Context, request aipitypes.AIPIRequest) (aipitypes.AIPIResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return aipitypes.AIPIResponse{}, err
+	}
+	return f.next(request)
+}
+
+// GetCompletionAsync streams the scripted reply word by word, followed by its
+// tool calls and usage.
+func (f *Fake) GetCompletionAsync(ctx context.Context, request aipitypes.AIPIRequest) (<-chan aipitypes.AIPIStreamChunk, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	response, err := f.next(request)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := make(chan aipitypes.AIPIStreamChunk)
+	go func() {
+		defer close(chunks)
+		for _, chunk := range ResponseChunks(response) {
+			if !aipitypes.SendChunk(ctx, chunks, chunk) {
+				return
+			}
+		}
+	}()
+	return chunks, nil
+}
+
+func (f *Fake) GetEmbedding(ctx context.Context, request aipitypes.EmbeddingRequest) ([]float32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f.mx.Lock()
+	f.embedded = append(f.embedded, request)
+	f.mx.Unlock()
+
+	dimensions := request.Dimensions
+	if dimensions <= 0 {
+		dimensions = DEFAULT_EMBEDDING_DIMENSIONS
+	}
+	return HashEmbedding(fmt.Sprint(request.Input), dimensions), nil
+}
+
+func (f *Fake) GetEmbeddings(ctx context.Context, request aipitypes.EmbeddingRequest) ([][]float32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	inputs, err := request.Inputs()
+	if err != nil {
+		return nil, err
+	}
+
+	f.mx.Lock()
+	f.embedded = append(f.embedded, request)
+	f.mx.Unlock()
+
+	dimensions := request.Dimensions
+	if dimensions <= 0 {
+		dimensions = DEFAULT_EMBEDDING_DIMENSIONS
+	}
+	embeddings := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		embeddings[i] = HashEmbedding(input, dimensions)
+	}
+	return embeddings, nil
+}
+
+// ResponseChunks splits a response into the chunks a provider would stream.
+func ResponseChunks(response aipitypes.AIPIResponse) []aipitypes.AIPIStreamChunk {
+	var chunks []aipitypes.AIPIStreamChunk
+	for _, word := range strings.SplitAfter(response.Data, " ") {
+		if word != "" {
+			chunks = append(chunks, aipitypes.AIPIStreamChunk{Delta: word, Model: response.Model})
+		}
+	}
+	if len(response.ToolCalls) > 0 {
+		chunks = append(chunks, aipitypes.AIPIStreamChunk{ToolCalls: response.ToolCalls, Model: response.Model})
+	}
+
+	usage := response.Usage
+	chunks = append(chunks, aipitypes.AIPIStreamChunk{Usage: &usage, Model: response.Model})
+	return chunks
+}
+
+// HashEmbedding returns a deterministic unit vector for the text.
+func HashEmbedding(text string, dimensions int) []float32 {
+	embedding := make([]float32, dimensions)
+	var norm float64
+	block := sha256.Sum256([]byte(text))
+	for i := range embedding {
+		if i > 0 && i%8 == 0 {
+			block = sha256.Sum256(block[:])
+		}
+		value := binary.BigEndian.Uint32(block[(i%8)*4:])
+		component := float64(value)/math.MaxUint32*2 - 1
+		embedding[i] = float32(component)
+		norm += component * component
+	}
+
+	norm = math.Sqrt(norm)
+	for i := range embedding {
+		embedding[i] = float32(float64(embedding[i]) / norm)
+	}
+	return embedding
+}
+
+// estimateUsage approximates token counts at four characters per token so
+// usage recording and quotas see plausible numbers.
+func estimateUsage(request aipitypes.AIPIRequest, response aipitypes.AIPIResponse) aipitypes.AIPIUsage {
+	var input int
+	for _, message := range request.Conversation() {
+		input += len(message.Content)
+	}
+	output := len(response.Data)
+	for _, call := range response.ToolCalls {
+		output += len(call.Name) + len(call.Arguments)
+	}
+	return aipitypes.AIPIUsage{InputTokens: (input + 3) / 4, OutputTokens: (output + 3) / 4}
+}
@@ -0,0 +1,179 @@
+package aipitest
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+)
+
+func TestFakeGetCompletion(t *testing.T) {
+	failure := errors.New("provider down")
+	forModel := func(model string) func(aipitypes.AIPIRequest) bool {
+		return func(request aipitypes.AIPIRequest) bool { return request.Model == model }
+	}
+
+	tests := []struct {
+		name     string
+		steps    []Step
+		requests []aipitypes.AIPIRequest
+		want     []string
+		wantErr  []error
+	}{
+		{
+			name:     "answers in order",
+			steps:    []Step{Reply("first"), Reply("second")},
+			requests: []aipitypes.AIPIRequest{{Model: "a"}, {Model: "a"}},
+			want:     []string{"first", "second"},
+			wantErr:  []error{nil, nil},
+		},
+		{
+			name:     "matches steps to requests",
+			steps:    []Step{{Response: aipitypes.AIPIResponse{Data: "for b"}, Match: forModel("b")}, Reply("for anyone")},
+			requests: []aipitypes.AIPIRequest{{Model: "a"}, {Model: "b"}},
+			want:     []string{"for anyone", "for b"},
+			wantErr:  []error{nil, nil},
+		},
+		{
+			name:     "fails with the scripted error",
+			steps:    []Step{Fail(failure), Reply("after")},
+			requests: []aipitypes.AIPIRequest{{Model: "a"}, {Model: "a"}},
+			want:     []string{"", "after"},
+			wantErr:  []error{failure, nil},
+		},
+		{
+			name:     "fails once the script is used",
+			steps:    []Step{Reply("only")},
+			requests: []aipitypes.AIPIRequest{{Model: "a"}, {Model: "a"}},
+			want:     []string{"only", ""},
+			wantErr:  []error{nil, ErrScriptExhausted},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := NewFake(test.steps...)
+			for i, request := range test.requests {
+				response, err := fake.GetCompletion(context.Background(), request)
+				if !errors.Is(err, test.wantErr[i]) {
+					t.Fatalf("request %d: got error %v, want %v", i, err, test.wantErr[i])
+				}
+				if response.Data != test.want[i] {
+					t.Errorf("request %d: got %q, want %q", i, response.Data, test.want[i])
+				}
+			}
+			if got := len(fake.Requests()); got != len(test.requests) {
+				t.Errorf("recorded %d requests, want %d", got, len(test.requests))
+			}
+		})
+	}
+}
+
+func TestFakeFillsModelAndUsage(t *testing.T) {
+	fake := NewFake(Reply("eight chars"), Step{Response: aipitypes.AIPIResponse{Data: "x", Model: "scripted", Usage: aipitypes.AIPIUsage{InputTokens: 7, OutputTokens: 9}}})
+	request := aipitypes.AIPIRequest{UserMessage: "sixteen chars!!!"}
+
+	tests := []struct {
+		name      string
+		wantModel string
+		wantUsage aipitypes.AIPIUsage
+	}{
+		{name: "estimated", wantModel: "fake-model", wantUsage: aipitypes.AIPIUsage{InputTokens: 4, OutputTokens: 3}},
+		{name: "scripted", wantModel: "scripted", wantUsage: aipitypes.AIPIUsage{InputTokens: 7, OutputTokens: 9}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := fake.GetCompletion(context.Background(), request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Model != test.wantModel {
+				t.Errorf("got model %q, want %q", response.Model, test.wantModel)
+			}
+			if response.Usage != test.wantUsage {
+				t.Errorf("got usage %+v, want %+v", response.Usage, test.wantUsage)
+			}
+		})
+	}
+}
+
+func TestFakeGetCompletionAsync(t *testing.T) {
+	tests := []struct {
+		name      string
+		step      Step
+		wantData  string
+		wantTools int
+	}{
+		{name: "text", step: Reply("streamed word by word"), wantData: "streamed word by word"},
+		{name: "tool calls", step: CallTools(aipitypes.ToolCall{ID: "1", Name: "calculator", Arguments: "{}"}), wantTools: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunks, err := NewFake(test.step).GetCompletionAsync(context.Background(), aipitypes.AIPIRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var data strings.Builder
+			var tools int
+			var last aipitypes.AIPIStreamChunk
+			for chunk := range chunks {
+				if chunk.Err != nil {
+					t.Fatal(chunk.Err)
+				}
+				data.WriteString(chunk.Delta)
+				tools += len(chunk.ToolCalls)
+				last = chunk
+			}
+			if data.String() != test.wantData {
+				t.Errorf("got %q, want %q", data.String(), test.wantData)
+			}
+			if tools != test.wantTools {
+				t.Errorf("got %d tool calls, want %d", tools, test.wantTools)
+			}
+			if last.Usage == nil {
+				t.Error("stream didn't end with usage")
+			}
+		})
+	}
+}
+
+func TestHashEmbedding(t *testing.T) {
+	tests := []struct {
+		name       string
+		a, b       string
+		dimensions int
+		wantEqual  bool
+	}{
+		{name: "same text", a: "hello", b: "hello", dimensions: 16, wantEqual: true},
+		{name: "different text", a: "hello", b: "world", dimensions: 16, wantEqual: false},
+		{name: "odd dimensions", a: "hello", b: "hello", dimensions: 13, wantEqual: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := HashEmbedding(test.a, test.dimensions)
+			b := HashEmbedding(test.b, test.dimensions)
+			if len(a) != test.dimensions {
+				t.Fatalf("got %d dimensions, want %d", len(a), test.dimensions)
+			}
+
+			var norm float64
+			equal := true
+			for i := range a {
+				norm += float64(a[i]) * float64(a[i])
+				equal = equal && a[i] == b[i]
+			}
+			if math.Abs(norm-1) > 1e-5 {
+				t.Errorf("got norm %f, want a unit vector", norm)
+			}
+			if equal != test.wantEqual {
+				t.Errorf("got equal %v, want %v", equal, test.wantEqual)
+			}
+		})
+	}
+}
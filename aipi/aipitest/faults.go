@@ -0,0 +1,196 @@
+package aipitest
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/somtojf/trio-server/aipi"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+)
+
+var ErrInjectedFault = errors.New("injected provider fault")
+
+// FaultConfig describes the faults to inject. Rates are probabilities between 0 and 1.
+type FaultConfig struct {
+	// Latency is added before every call and between streamed chunks
+	Latency time.Duration
+	// ErrorRate is the chance a call fails with Err before reaching the wrapped client
+	ErrorRate float64
+	// StreamErrorRate is the chance a stream breaks with Err after its first chunk
+	StreamErrorRate float64
+	// MalformedJSONRate is the chance the text of a completion is cut in half
+	MalformedJSONRate float64
+	// Err is the injected error, ErrInjectedFault when nil
+	Err error
+	// Seed makes the injected faults reproducible
+	Seed int64
+}
+
+// Faulty wraps a client and injects latency, errors and malformed replies.
+type Faulty struct {
+	inner  aipi.AIPIClient
+	config FaultConfig
+	mx     sync.Mutex
+	random *rand.Rand
+}
+
+var _ aipi.AIPIClient = (*Faulty)(nil)
+
+func NewFaulty(inner aipi.AIPIClient, config FaultConfig) *Faulty {
+	if config.Err == nil {
+		config.Err = ErrInjectedFault
+	}
+	return &Faulty{inner: inner, config: config, random: rand.New(rand.NewSource(config.Seed))}
+}
+
+func (f *Faulty) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.random.Float64() < rate
+}
+
+func (f *Faulty) delay(ctx context.Context) error {
+	if f.config.Latency <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(f.config.Latency)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *Faulty) GetCompletion(ctx context.Context, request aipitypes.AIPIRequest) (aipitypes.AIPIResponse, error) {
+	if err := f.delay(ctx); err != nil {
+		return aipitypes.AIPIResponse{}, err
+	}
+	if f.chance(f.config.ErrorRate) {
+		return aipitypes.AIPIResponse{}, f.config.Err
+	}
+
+	response, err := f.inner.GetCompletion(ctx, request)
+	if err == nil && f.chance(f.config.MalformedJSONRate) {
+		response.Data = malform(response.Data)
+	}
+	return response, err
+}
+
+func (f *Faulty) GetCompletionAsync(ctx context.Context, request aipitypes.AIPIRequest) (<-chan aipitypes.AIPIStreamChunk, error) {
+	if err := f.delay(ctx); err != nil {
+		return nil, err
+	}
+	if f.chance(f.config.ErrorRate) {
+		return nil, f.config.Err
+	}
+
+	chunks, err := f.inner.GetCompletionAsync(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	breakStream := f.chance(f.config.StreamErrorRate)
+	malformed := f.chance(f.config.MalformedJSONRate)
+	if malformed {
+		chunks = malformStream(ctx, chunks)
+	}
+
+	forwarded := make(chan aipitypes.AIPIStreamChunk)
+	go func() {
+		defer close(forwarded)
+		defer func() {
+			// Let the wrapped stream finish when we stop early
+			for range chunks {
+			}
+		}()
+
+		sent := 0
+		for chunk := range chunks {
+			if sent > 0 {
+				if err := f.delay(ctx); err != nil {
+					return
+				}
+			}
+			if breakStream && sent == 1 {
+				aipitypes.SendChunk(ctx, forwarded, aipitypes.AIPIStreamChunk{Err: f.config.Err})
+				return
+			}
+			if !aipitypes.SendChunk(ctx, forwarded, chunk) {
+				return
+			}
+			sent++
+		}
+	}()
+	return forwarded, nil
+}
+
+func (f *Faulty) GetEmbedding(ctx context.Context, request aipitypes.EmbeddingRequest) ([]float32, error) {
+	if err := f.delay(ctx); err != nil {
+		return nil, err
+	}
+	if f.chance(f.config.ErrorRate) {
+		return nil, f.config.Err
+	}
+	return f.inner.GetEmbedding(ctx, request)
+}
+
+func (f *Faulty) GetEmbeddings(ctx context.Context, request aipitypes.EmbeddingRequest) ([][]float32, error) {
+	if err := f.delay(ctx); err != nil {
+		return nil, err
+	}
+	if f.chance(f.config.ErrorRate) {
+		return nil, f.config.Err
+	}
+	return f.inner.GetEmbeddings(ctx, request)
+}
+
+// malform cuts the text in half, which leaves any JSON object unterminated.
+func malform(data string) string {
+	if data == "" {
+		return "{"
+	}
+	return data[:len(data)/2]
+}
+
+// malformStream collects a stream and replays it with its text cut in half.
+func malformStream(ctx context.Context, chunks <-chan aipitypes.AIPIStreamChunk) <-chan aipitypes.AIPIStreamChunk {
+	malformed := make(chan aipitypes.AIPIStreamChunk)
+	go func() {
+		defer close(malformed)
+
+		var data strings.Builder
+		var response aipitypes.AIPIResponse
+		for chunk := range chunks {
+			if chunk.Err != nil {
+				aipitypes.SendChunk(ctx, malformed, chunk)
+				return
+			}
+			data.WriteString(chunk.Delta)
+			if chunk.Model != "" {
+				response.Model = chunk.Model
+			}
+			if chunk.Usage != nil {
+				response.Usage = *chunk.Usage
+			}
+			response.ToolCalls = append(response.ToolCalls, chunk.ToolCalls...)
+		}
+
+		response.Data = malform(data.String())
+		for _, chunk := range ResponseChunks(response) {
+			if !aipitypes.SendChunk(ctx, malformed, chunk) {
+				return
+			}
+		}
+	}()
+	return malformed
+}
@@ -0,0 +1,113 @@
+package aipitest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+)
+
+func TestFaultyGetCompletion(t *testing.T) {
+	const reply = `{"content": "an answer"}`
+
+	tests := []struct {
+		name    string
+		config  FaultConfig
+		want    string
+		wantErr error
+	}{
+		{name: "no faults", want: reply},
+		{name: "error", config: FaultConfig{ErrorRate: 1}, wantErr: ErrInjectedFault},
+		{name: "custom error", config: FaultConfig{ErrorRate: 1, Err: context.DeadlineExceeded}, wantErr: context.DeadlineExceeded},
+		{name: "malformed json", config: FaultConfig{MalformedJSONRate: 1}, want: reply[:len(reply)/2]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			faulty := NewFaulty(NewFake(Reply(reply)), test.config)
+			response, err := faulty.GetCompletion(context.Background(), aipitypes.AIPIRequest{})
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			if response.Data != test.want {
+				t.Errorf("got %q, want %q", response.Data, test.want)
+			}
+		})
+	}
+}
+
+func TestFaultyGetCompletionAsync(t *testing.T) {
+	const reply = "one two three four"
+
+	tests := []struct {
+		name    string
+		config  FaultConfig
+		want    string
+		wantErr error
+	}{
+		{name: "no faults", want: reply},
+		{name: "broken stream", config: FaultConfig{StreamErrorRate: 1}, want: "one ", wantErr: ErrInjectedFault},
+		{name: "malformed json", config: FaultConfig{MalformedJSONRate: 1}, want: reply[:len(reply)/2]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			faulty := NewFaulty(NewFake(Reply(reply)), test.config)
+			chunks, err := faulty.GetCompletionAsync(context.Background(), aipitypes.AIPIRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var data strings.Builder
+			var streamErr error
+			for chunk := range chunks {
+				if chunk.Err != nil {
+					streamErr = chunk.Err
+					continue
+				}
+				data.WriteString(chunk.Delta)
+			}
+			if !errors.Is(streamErr, test.wantErr) {
+				t.Fatalf("got error %v, want %v", streamErr, test.wantErr)
+			}
+			if data.String() != test.want {
+				t.Errorf("got %q, want %q", data.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestFaultySeedIsReproducible(t *testing.T) {
+	outcomes := func(seed int64) []bool {
+		faulty := NewFaulty(NewFake(), FaultConfig{ErrorRate: 0.5, Seed: seed})
+		var failed []bool
+		for range 32 {
+			_, err := faulty.GetEmbedding(context.Background(), aipitypes.EmbeddingRequest{Input: "text", Dimensions: 4})
+			failed = append(failed, errors.Is(err, ErrInjectedFault))
+		}
+		return failed
+	}
+
+	tests := []struct {
+		name      string
+		a, b      int64
+		wantEqual bool
+	}{
+		{name: "same seed", a: 42, b: 42, wantEqual: true},
+		{name: "different seeds", a: 42, b: 43, wantEqual: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := outcomes(test.a), outcomes(test.b)
+			equal := true
+			for i := range a {
+				equal = equal && a[i] == b[i]
+			}
+			if equal != test.wantEqual {
+				t.Errorf("got equal outcomes %v, want %v", equal, test.wantEqual)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package aipitypes
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// ResponseSchema constrains a JSON response to a schema derived from a Go struct.
+type ResponseSchema struct {
+	// Name identifies the schema to the provider and may only contain letters, digits, _ and -
+	Name   string
+	Schema *jsonschema.Definition
+}
+
+// NewResponseSchema derives a schema from the json and description tags of v.
+// Fields tagged json:"-" are left out.
+func NewResponseSchema(name string, v any) (*ResponseSchema, error) {
+	definition, err := jsonschema.GenerateSchemaForType(v)
+	if err != nil {
+		return nil, fmt.Errorf("error generating schema %s: %w", name, err)
+	}
+	removeIgnoredFields(definition)
+
+	return &ResponseSchema{Name: name, Schema: definition}, nil
+}
+
+// MustResponseSchema is like NewResponseSchema but panics on error. It is
+// meant for package level schema variables.
+func MustResponseSchema(name string, v any) *ResponseSchema {
+	schema, err := NewResponseSchema(name, v)
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// Unmarshal validates data against the schema and decodes it into v. The
+// returned error describes the first mismatch so it can be shown to the model.
+func (s *ResponseSchema) Unmarshal(data string, v any) error {
+	data = stripCodeFence(data)
+
+	var value any
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	if err := validateValue(*s.Schema, value, "$"); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+// removeIgnoredFields drops the properties jsonschema generates for fields
+// tagged json:"-", which encoding/json never reads or writes.
+func removeIgnoredFields(definition *jsonschema.Definition) {
+	if _, ok := definition.Properties["-"]; ok {
+		delete(definition.Properties, "-")
+		required := definition.Required[:0]
+		for _, name := range definition.Required {
+			if name != "-" {
+				required = append(required, name)
+			}
+		}
+		definition.Required = required
+	}
+
+	for name, property := range definition.Properties {
+		removeIgnoredFields(&property)
+		definition.Properties[name] = property
+	}
+	if definition.Items != nil {
+		removeIgnoredFields(definition.Items)
+	}
+}
+
+func validateValue(definition jsonschema.Definition, value any, path string) error {
+	switch definition.Type {
+	case jsonschema.Object:
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s must be an object", path)
+		}
+		for _, name := range definition.Required {
+			if _, ok := object[name]; !ok {
+				return fmt.Errorf("%s is missing required field %q", path, name)
+			}
+		}
+		for name, field := range object {
+			property, ok := definition.Properties[name]
+			if !ok {
+				if definition.AdditionalProperties == false {
+					return fmt.Errorf("%s has unexpected field %q", path, name)
+				}
+				continue
+			}
+			if err := validateValue(property, field, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case jsonschema.Array:
+		items, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("%s must be an array", path)
+		}
+		if definition.Items != nil {
+			for i, item := range items {
+				if err := validateValue(*definition.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case jsonschema.String:
+		text, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", path)
+		}
+		if len(definition.Enum) > 0 && !containsString(definition.Enum, text) {
+			return fmt.Errorf("%s must be one of %s", path, strings.Join(definition.Enum, ", "))
+		}
+	case jsonschema.Number:
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s must be a number", path)
+		}
+	case jsonschema.Integer:
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			return fmt.Errorf("%s must be an integer", path)
+		}
+	case jsonschema.Boolean:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", path)
+		}
+	case jsonschema.Null:
+		if value != nil {
+			return fmt.Errorf("%s must be null", path)
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// stripCodeFence removes the markdown code fence some models wrap JSON in.
+func stripCodeFence(data string) string {
+	trimmed := strings.TrimSpace(data)
+	if !strings.HasPrefix(trimmed, "```") {
+		return data
+	}
+
+	trimmed = strings.TrimPrefix(trimmed, "```")
+	trimmed = strings.TrimPrefix(trimmed, "json")
+	trimmed = strings.TrimSuffix(trimmed, "```")
+	return strings.TrimSpace(trimmed)
+}
@@ -0,0 +1,20 @@
+package aipitypes
+
+import "github.com/sashabaranov/go-openai/jsonschema"
+
+// ToolDefinition describes a function the model may call. Parameters is the
+// JSON schema of the arguments object.
+type ToolDefinition struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  *jsonschema.Definition `json:"parameters"`
+}
+
+// ToolCall is a function call requested by the model. Arguments is a JSON
+// object. Providers without call ids get a generated one so results can be
+// matched to calls the same way for every provider.
+type ToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
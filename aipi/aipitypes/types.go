@@ -1,25 +1,156 @@
 package aipitypes
 
+import (
+	"context"
+	"fmt"
+)
+
+type AIPIUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
 type AIPIResponse struct {
-	Data string `json:"data"`
+	Data  string    `json:"data"`
+	Usage AIPIUsage `json:"usage"`
+	// Model is the model that produced the response, which may be a fallback
+	Model string `json:"model"`
+	// ToolCalls are set when the model wants tools to be run before it answers
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
 }
 
 type ResponseFormat string
 
 const AIPI_RESPONSE_FORMAT_JSON = "json_object"
 const AIPI_RESPONSE_FORMAT_TEXT = "text"
+const AIPI_RESPONSE_FORMAT_JSON_SCHEMA = "json_schema"
+
+type MessageRole string
+
+const (
+	MESSAGE_ROLE_SYSTEM    MessageRole = "system"
+	MESSAGE_ROLE_USER      MessageRole = "user"
+	MESSAGE_ROLE_ASSISTANT MessageRole = "assistant"
+	MESSAGE_ROLE_TOOL      MessageRole = "tool"
+)
+
+// AIPIMessage is a single turn of a conversation. Name tells participants
+// sharing a role apart, e.g. the different agents of a group chat, and is the
+// tool name for tool messages.
+type AIPIMessage struct {
+	Role    MessageRole `json:"role"`
+	Name    string      `json:"name,omitempty"`
+	Content string      `json:"content"`
+	// ToolCalls are the calls an assistant message requested
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID is the call a tool message answers
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	// Images are sent with user messages to models that support vision
+	Images []ImagePart `json:"images,omitempty"`
+}
+
+// ImagePart is an image attached to a message.
+type ImagePart struct {
+	MIMEType string `json:"mime_type"`
+	Data     []byte `json:"data"`
+}
 
 type AIPIRequest struct {
-	SystemMessage  string `json:"system_message"`
-	UserMessage    string `json:"user_message"`
-	Model          string `json:"model"`
-	IdUser         uint   `json:"id_user"`
-	ResponseFormat string `json:"response_format"`
+	SystemMessage string `json:"system_message"`
+	// Messages are the conversation turns, oldest first, sent between SystemMessage and UserMessage
+	Messages       []AIPIMessage `json:"messages,omitempty"`
+	UserMessage    string        `json:"user_message"`
+	Model          string        `json:"model"`
+	IdUser         uint          `json:"id_user"`
+	ResponseFormat string        `json:"response_format"`
+	// ResponseSchema is required when ResponseFormat is AIPI_RESPONSE_FORMAT_JSON_SCHEMA
+	ResponseSchema *ResponseSchema `json:"-"`
+	// Tools the model may call instead of answering
+	Tools    []ToolDefinition `json:"tools,omitempty"`
+	Sampling Sampling         `json:"sampling"`
+}
+
+// Sampling tunes how the model generates its reply. Nil fields keep the
+// provider's defaults.
+type Sampling struct {
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	// Seed makes sampling repeatable where the provider supports it
+	Seed *int `json:"seed,omitempty"`
+}
+
+// Conversation returns the whole request as a list of messages: SystemMessage,
+// then Messages, then UserMessage. Empty system and user messages are left out.
+func (r AIPIRequest) Conversation() []AIPIMessage {
+	conversation := make([]AIPIMessage, 0, len(r.Messages)+2)
+	if r.SystemMessage != "" {
+		conversation = append(conversation, AIPIMessage{Role: MESSAGE_ROLE_SYSTEM, Content: r.SystemMessage})
+	}
+	conversation = append(conversation, r.Messages...)
+	if r.UserMessage != "" {
+		conversation = append(conversation, AIPIMessage{Role: MESSAGE_ROLE_USER, Content: r.UserMessage})
+	}
+	return conversation
+}
+
+// HasImages reports whether any message of the request carries images.
+func (r AIPIRequest) HasImages() bool {
+	for _, message := range r.Messages {
+		if len(message.Images) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// AIPIStreamChunk is a single incremental piece of a streamed completion.
+// A chunk with a non-nil Err is always the last one sent before the channel closes.
+// Usage is only set on chunks that carry token counts, usually the final one.
+// ToolCalls are only sent once they have been received completely.
+type AIPIStreamChunk struct {
+	Delta     string     `json:"delta"`
+	Model     string     `json:"model"`
+	Usage     *AIPIUsage `json:"usage,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	Err       error      `json:"-"`
 }
 
 type EmbeddingRequest struct {
+	// Input is a string or a []string
 	Input          any
 	Model          string
 	EncodingFormat string
-	Dimensions     int
+	// Dimensions shortens the embeddings, 0 keeps the model's native size
+	Dimensions int
+	IdUser     uint
+}
+
+// Inputs returns the texts to embed.
+func (r EmbeddingRequest) Inputs() ([]string, error) {
+	switch input := r.Input.(type) {
+	case string:
+		return []string{input}, nil
+	case []string:
+		return input, nil
+	default:
+		return nil, fmt.Errorf("unsupported embedding input %T", r.Input)
+	}
+}
+
+// EmbeddingResponse holds one embedding per input, in input order.
+type EmbeddingResponse struct {
+	Embeddings [][]float32
+	Usage      AIPIUsage
+}
+
+// SendChunk delivers a chunk unless the context is cancelled first.
+// It returns false when the consumer has gone away and the producer should stop.
+func SendChunk(ctx context.Context, chunks chan<- AIPIStreamChunk, chunk AIPIStreamChunk) bool {
+	select {
+	case chunks <- chunk:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
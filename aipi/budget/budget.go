@@ -0,0 +1,125 @@
+// Package budget fits prompts into the context window of the model they are
+// sent to, dropping the least important content first.
+package budget
+
+import (
+	"log/slog"
+
+	"github.com/somtojf/trio-server/aipi/registry"
+	"github.com/somtojf/trio-server/env"
+)
+
+const (
+	// MESSAGE_OVERHEAD_TOKENS approximates what a chat message costs beyond its content
+	MESSAGE_OVERHEAD_TOKENS = 4
+	// DEFAULT_PROMPT_TOKEN_LIMIT caps prompts for models with very large
+	// context windows, so a long chat doesn't get expensive. PROMPT_TOKEN_LIMIT overrides it.
+	DEFAULT_PROMPT_TOKEN_LIMIT = 16000
+	// DEFAULT_OUTPUT_RESERVE is kept free for the reply of models without a configured max output
+	DEFAULT_OUTPUT_RESERVE = 4096
+	// IMAGE_TOKENS approximates what an attached image costs, a 1024 pixel square
+	// image on OpenAI. Gemini charges less per image.
+	IMAGE_TOKENS = 765
+)
+
+// Budgeter hands out prompt budgets for the models of the registry.
+type Budgeter struct {
+	registry    *registry.Registry
+	promptLimit int
+}
+
+func NewBudgeter(models *registry.Registry) *Budgeter {
+	return &Budgeter{registry: models, promptLimit: env.Int("PROMPT_TOKEN_LIMIT", DEFAULT_PROMPT_TOKEN_LIMIT, 1)}
+}
+
+// Budget is the space a prompt for one model may take.
+type Budget struct {
+	Model     string
+	Tokenizer Tokenizer
+	// Limit is the most tokens the prompt may use
+	Limit int
+}
+
+// ForModel returns the budget of a chat model: its context window minus the
+// space its reply needs, capped at the prompt token limit. maxTokens is the
+// reply's limit when the request sets one.
+func (b *Budgeter) ForModel(id string, maxTokens *int) (Budget, error) {
+	model, err := b.registry.Resolve(id, registry.MODEL_KIND_CHAT)
+	if err != nil {
+		return Budget{}, err
+	}
+
+	reserve := model.MaxOutputTokens
+	if maxTokens != nil {
+		reserve = *maxTokens
+	}
+	if reserve <= 0 {
+		reserve = DEFAULT_OUTPUT_RESERVE
+	}
+	limit := min(model.ContextWindow-reserve, b.promptLimit)
+	if limit <= 0 {
+		// A misconfigured window shouldn't stop the chat, send the prompt untrimmed
+		limit = b.promptLimit
+	}
+
+	return Budget{Model: model.ID, Tokenizer: TokenizerFor(model), Limit: limit}, nil
+}
+
+// Count returns the tokens of texts sent as messages.
+func (b Budget) Count(texts ...string) int {
+	tokens := 0
+	for _, text := range texts {
+		tokens += b.Tokenizer.Count(text) + MESSAGE_OVERHEAD_TOKENS
+	}
+	return tokens
+}
+
+// Section is prompt content that may be cut, such as the chat history.
+type Section struct {
+	Name string
+	// Share is the part of the space left next to the fixed prompt the section
+	// is guaranteed before other sections may use it
+	Share float64
+	// Items are the texts of the section, most important first
+	Items []string
+}
+
+// Fit returns how many leading items of each section fit next to fixedTokens
+// of content that is always sent. Every section first fills its share of the
+// remaining space. Space a section leaves unused then goes to the sections in
+// the order they are passed, so earlier sections are cut last.
+func (b Budget) Fit(fixedTokens int, sections ...Section) []int {
+	available := b.Limit - fixedTokens
+	kept := make([]int, len(sections))
+	costs := make([][]int, len(sections))
+	used := 0
+
+	for i, section := range sections {
+		costs[i] = make([]int, len(section.Items))
+		for j, item := range section.Items {
+			costs[i][j] = b.Count(item)
+		}
+
+		share := int(float64(available) * section.Share)
+		spent := 0
+		for kept[i] < len(section.Items) && spent+costs[i][kept[i]] <= share {
+			spent += costs[i][kept[i]]
+			kept[i]++
+		}
+		used += spent
+	}
+
+	for i := range sections {
+		for kept[i] < len(costs[i]) && used+costs[i][kept[i]] <= available {
+			used += costs[i][kept[i]]
+			kept[i]++
+		}
+	}
+
+	for i, section := range sections {
+		if dropped := len(section.Items) - kept[i]; dropped > 0 {
+			slog.Info("Trimmed prompt to fit budget", "model", b.Model, "section", section.Name, "dropped", dropped, "kept", kept[i], "limit", b.Limit)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,54 @@
+package budget
+
+// HISTORY_CANDIDATE_LIMIT is how many recent messages of a chat are loaded for
+// a prompt. The prompt budget decides how many of them are sent.
+const HISTORY_CANDIDATE_LIMIT = 50
+
+// ChatPrompt is the content of a chat prompt that may be cut to fit a budget,
+// as the texts sent for it. Each section has a share of the space, see Section.
+type ChatPrompt struct {
+	// Iterations are a reflection's previous answers, oldest first. They are
+	// cut last.
+	Iterations      []string
+	IterationsShare float64
+	// History is the latest messages of the chat, oldest first
+	History      []string
+	HistoryShare float64
+	// Context is retrieved messages, most relevant first. It is cut first.
+	Context      []string
+	ContextShare float64
+}
+
+// ChatKept is how many texts of each section of a ChatPrompt fit.
+type ChatKept struct {
+	Iterations int
+	History    int
+	Context    int
+}
+
+// FitChat keeps the latest iterations, the newest chat history and the most
+// relevant context that fit next to fixedTokens. Use Latest to cut the
+// iterations and the history to what was kept.
+func (b Budget) FitChat(fixedTokens int, prompt ChatPrompt) ChatKept {
+	kept := b.Fit(fixedTokens,
+		Section{Name: "previous_responses", Share: prompt.IterationsShare, Items: newestFirst(prompt.Iterations)},
+		Section{Name: "chat_history", Share: prompt.HistoryShare, Items: newestFirst(prompt.History)},
+		Section{Name: "relevant_context", Share: prompt.ContextShare, Items: prompt.Context},
+	)
+	return ChatKept{Iterations: kept[0], History: kept[1], Context: kept[2]}
+}
+
+// Latest returns the last n items, the ones FitChat keeps of a section given
+// oldest first.
+func Latest[T any](items []T, n int) []T {
+	return items[len(items)-n:]
+}
+
+// newestFirst reverses texts so the oldest are dropped first.
+func newestFirst(texts []string) []string {
+	reversed := make([]string, len(texts))
+	for i, text := range texts {
+		reversed[len(reversed)-1-i] = text
+	}
+	return reversed
+}
@@ -0,0 +1,104 @@
+package budget
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEFAULT_ENCODING_CACHE_DIR keeps the tiktoken encodings unless
+// TIKTOKEN_CACHE_DIR is set.
+const DEFAULT_ENCODING_CACHE_DIR = "tiktoken-cache"
+
+// ENCODING_DOWNLOAD_TIMEOUT bounds the download of an encoding missing from the
+// cache, token counting waits for it.
+const ENCODING_DOWNLOAD_TIMEOUT = 30 * time.Second
+
+// encodingCache loads tiktoken encodings from a directory, downloading an
+// encoding there the first time a model needs it. Only the encodings of the
+// models in use are fetched, none are shipped with the binary.
+type encodingCache struct {
+	dir    string
+	client *http.Client
+}
+
+func newEncodingCache() *encodingCache {
+	dir := os.Getenv("TIKTOKEN_CACHE_DIR")
+	if dir == "" {
+		dir = DEFAULT_ENCODING_CACHE_DIR
+	}
+	return &encodingCache{dir: dir, client: &http.Client{Timeout: ENCODING_DOWNLOAD_TIMEOUT}}
+}
+
+// LoadTiktokenBpe returns the token ranks of the encoding file at url.
+func (c *encodingCache) LoadTiktokenBpe(url string) (map[string]int, error) {
+	contents, err := c.read(url)
+	if err != nil {
+		return nil, err
+	}
+
+	ranks := make(map[string]int)
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line == "" {
+			continue
+		}
+		token, rank, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid encoding line %q", line)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encoding token %q: %w", token, err)
+		}
+		parsed, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encoding rank %q: %w", rank, err)
+		}
+		ranks[string(decoded)] = parsed
+	}
+	return ranks, nil
+}
+
+func (c *encodingCache) read(url string) ([]byte, error) {
+	cached := filepath.Join(c.dir, path.Base(url))
+	contents, err := os.ReadFile(cached)
+	if err == nil {
+		return contents, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading encoding cache: %w", err)
+	}
+
+	response, err := c.client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading encoding: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error downloading encoding: %s", response.Status)
+	}
+	contents, err = io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading encoding: %w", err)
+	}
+
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error writing encoding cache: %w", err)
+	}
+	tmp := cached + ".tmp"
+	if err := os.WriteFile(tmp, contents, 0o644); err != nil {
+		return nil, fmt.Errorf("error writing encoding cache: %w", err)
+	}
+	if err := os.Rename(tmp, cached); err != nil {
+		return nil, fmt.Errorf("error writing encoding cache: %w", err)
+	}
+	return contents, nil
+}
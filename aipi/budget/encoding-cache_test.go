@@ -0,0 +1,32 @@
+package budget
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEncodingCacheDownloadsOnce(t *testing.T) {
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		// "a" and "b" base64 encoded
+		w.Write([]byte("YQ== 0\nYg== 1\n"))
+	}))
+	defer server.Close()
+
+	cache := &encodingCache{dir: t.TempDir(), client: server.Client()}
+	url := server.URL + "/encodings/test_base.tiktoken"
+	for range 2 {
+		ranks, err := cache.LoadTiktokenBpe(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ranks) != 2 || ranks["a"] != 0 || ranks["b"] != 1 {
+			t.Errorf("got ranks %v, want a: 0, b: 1", ranks)
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("downloaded %d times, want once", downloads)
+	}
+}
@@ -0,0 +1,82 @@
+package budget
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pkoukk/tiktoken-go"
+	"github.com/somtojf/trio-server/aipi/registry"
+)
+
+// DEFAULT_OPENAI_ENCODING is used for OpenAI models tiktoken has no mapping for.
+const DEFAULT_OPENAI_ENCODING = "o200k_base"
+
+// CHARACTERS_PER_TOKEN is the estimate used when no local tokenizer is available.
+const CHARACTERS_PER_TOKEN = 4
+
+// Tokenizer counts the tokens a model sees for a text.
+type Tokenizer interface {
+	Count(text string) int
+}
+
+// ENCODING_RETRY_INTERVAL is how long the tokens of a model are estimated after
+// its encoding failed to load, before loading it is tried again.
+const ENCODING_RETRY_INTERVAL = 5 * time.Minute
+
+var (
+	encodingsMx sync.Mutex
+	encodings   = make(map[string]*tiktoken.Tiktoken)
+	// failedAt is when loading the encoding of a model last failed
+	failedAt = make(map[string]time.Time)
+	// The loader reads TIKTOKEN_CACHE_DIR, which is only set once the
+	// environment is loaded
+	loaderOnce sync.Once
+)
+
+type tiktokenTokenizer struct {
+	encoding *tiktoken.Tiktoken
+}
+
+func (t tiktokenTokenizer) Count(text string) int {
+	return len(t.encoding.EncodeOrdinary(text))
+}
+
+// estimateTokenizer is used for Gemini, whose tokenizer is only available
+// through an API call.
+type estimateTokenizer struct{}
+
+func (estimateTokenizer) Count(text string) int {
+	return (len(text) + CHARACTERS_PER_TOKEN - 1) / CHARACTERS_PER_TOKEN
+}
+
+// TokenizerFor returns the tokenizer of a model. OpenAI models are counted
+// exactly with tiktoken, other providers are estimated.
+func TokenizerFor(model registry.ModelConfig) Tokenizer {
+	if model.Provider != registry.PROVIDER_OPENAI {
+		return estimateTokenizer{}
+	}
+
+	encodingsMx.Lock()
+	defer encodingsMx.Unlock()
+
+	if encoding, ok := encodings[model.ID]; ok {
+		return tiktokenTokenizer{encoding}
+	}
+	if time.Since(failedAt[model.ID]) < ENCODING_RETRY_INTERVAL {
+		return estimateTokenizer{}
+	}
+
+	loaderOnce.Do(func() { tiktoken.SetBpeLoader(newEncodingCache()) })
+	encoding, err := tiktoken.EncodingForModel(model.ID)
+	if err != nil {
+		encoding, err = tiktoken.GetEncoding(DEFAULT_OPENAI_ENCODING)
+	}
+	if err != nil {
+		slog.Error("Failed to load tokenizer, estimating tokens", "model", model.ID, "error", err)
+		failedAt[model.ID] = time.Now()
+		return estimateTokenizer{}
+	}
+	encodings[model.ID] = encoding
+	return tiktokenTokenizer{encoding}
+}
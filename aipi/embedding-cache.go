@@ -0,0 +1,169 @@
+package aipi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/somtojf/trio-server/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// EmbeddingCacheKey identifies an embedding: the same text embedded by the same
+// model at the same size always gives the same vector.
+type EmbeddingCacheKey struct {
+	Model       string
+	Dimensions  int
+	ContentHash string
+}
+
+func newEmbeddingCacheKey(model string, dimensions int, text string) EmbeddingCacheKey {
+	hash := sha256.Sum256([]byte(text))
+	return EmbeddingCacheKey{Model: model, Dimensions: dimensions, ContentHash: hex.EncodeToString(hash[:])}
+}
+
+// EmbeddingCache stores embeddings so identical text is only paid for once.
+type EmbeddingCache interface {
+	// Get returns the cached embeddings of the keys it has
+	Get(ctx context.Context, keys []EmbeddingCacheKey) (map[EmbeddingCacheKey][]float32, error)
+	Put(ctx context.Context, embeddings map[EmbeddingCacheKey][]float32) error
+}
+
+// PostgresEmbeddingCache keeps embeddings in the embedding_cache_entries table.
+type PostgresEmbeddingCache struct {
+	db *gorm.DB
+}
+
+func NewPostgresEmbeddingCache(db *gorm.DB) *PostgresEmbeddingCache {
+	return &PostgresEmbeddingCache{db: db}
+}
+
+func (c *PostgresEmbeddingCache) Get(ctx context.Context, keys []EmbeddingCacheKey) (map[EmbeddingCacheKey][]float32, error) {
+	found := make(map[EmbeddingCacheKey][]float32)
+	if len(keys) == 0 {
+		return found, nil
+	}
+
+	// Keys of one batch usually share model and size, so this is one query
+	type group struct {
+		model      string
+		dimensions int
+	}
+	hashes := make(map[group][]string)
+	for _, key := range keys {
+		g := group{key.Model, key.Dimensions}
+		hashes[g] = append(hashes[g], key.ContentHash)
+	}
+
+	for g, contentHashes := range hashes {
+		var entries []models.EmbeddingCacheEntry
+		err := c.db.WithContext(ctx).
+			Where("model_name = ? AND dimensions = ? AND content_hash IN ?", g.model, g.dimensions, contentHashes).
+			Find(&entries).Error
+		if err != nil {
+			return nil, fmt.Errorf("error reading embedding cache: %w", err)
+		}
+		for _, entry := range entries {
+			key := EmbeddingCacheKey{Model: entry.ModelName, Dimensions: entry.Dimensions, ContentHash: entry.ContentHash}
+			found[key] = entry.Embedding
+		}
+	}
+	return found, nil
+}
+
+func (c *PostgresEmbeddingCache) Put(ctx context.Context, embeddings map[EmbeddingCacheKey][]float32) error {
+	if len(embeddings) == 0 {
+		return nil
+	}
+
+	entries := make([]models.EmbeddingCacheEntry, 0, len(embeddings))
+	for key, embedding := range embeddings {
+		entries = append(entries, models.EmbeddingCacheEntry{
+			ModelName:   key.Model,
+			Dimensions:  key.Dimensions,
+			ContentHash: key.ContentHash,
+			Embedding:   embedding,
+		})
+	}
+
+	err := c.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&entries).Error
+	if err != nil {
+		return fmt.Errorf("error writing embedding cache: %w", err)
+	}
+	return nil
+}
+
+var unsafePathCharacters = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// DiskEmbeddingCache keeps one file of little endian float32 values per
+// embedding in a directory per model and size.
+type DiskEmbeddingCache struct {
+	dir string
+}
+
+func NewDiskEmbeddingCache(dir string) (*DiskEmbeddingCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating embedding cache directory: %w", err)
+	}
+	return &DiskEmbeddingCache{dir: dir}, nil
+}
+
+func (c *DiskEmbeddingCache) path(key EmbeddingCacheKey) string {
+	model := unsafePathCharacters.ReplaceAllString(key.Model, "_")
+	return filepath.Join(c.dir, fmt.Sprintf("%s-%d", model, key.Dimensions), key.ContentHash+".bin")
+}
+
+func (c *DiskEmbeddingCache) Get(ctx context.Context, keys []EmbeddingCacheKey) (map[EmbeddingCacheKey][]float32, error) {
+	found := make(map[EmbeddingCacheKey][]float32)
+	for _, key := range keys {
+		data, err := os.ReadFile(c.path(key))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading embedding cache: %w", err)
+		}
+		if len(data) != key.Dimensions*4 {
+			// A truncated write, embed the text again
+			continue
+		}
+
+		embedding := make([]float32, key.Dimensions)
+		for i := range embedding {
+			embedding[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:]))
+		}
+		found[key] = embedding
+	}
+	return found, nil
+}
+
+func (c *DiskEmbeddingCache) Put(ctx context.Context, embeddings map[EmbeddingCacheKey][]float32) error {
+	for key, embedding := range embeddings {
+		path := c.path(key)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("error writing embedding cache: %w", err)
+		}
+
+		data := make([]byte, len(embedding)*4)
+		for i, value := range embedding {
+			binary.LittleEndian.PutUint32(data[i*4:], math.Float32bits(value))
+		}
+
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0o644); err != nil {
+			return fmt.Errorf("error writing embedding cache: %w", err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return fmt.Errorf("error writing embedding cache: %w", err)
+		}
+	}
+	return nil
+}
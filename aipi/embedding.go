@@ -0,0 +1,164 @@
+package aipi
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+	openaiHelper "github.com/somtojf/trio-server/aipi/openai"
+	"github.com/somtojf/trio-server/aipi/registry"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MAX_EMBEDDING_BATCH_SIZE is the most inputs sent to a backend in one call.
+const MAX_EMBEDDING_BATCH_SIZE = 256
+
+// EmbeddingBackend computes embeddings for the models of one registry provider.
+type EmbeddingBackend interface {
+	// GetEmbeddings returns one embedding per input of the request, in input order
+	GetEmbeddings(ctx context.Context, request aipitypes.EmbeddingRequest) (aipitypes.EmbeddingResponse, error)
+}
+
+// NewLocalEmbeddingBackend talks to an OpenAI compatible embedding server,
+// such as Ollama or text-embeddings-inference, at baseURL.
+func NewLocalEmbeddingBackend(baseURL string, apiKey string) EmbeddingBackend {
+	config := openaiHelper.NewConfig(apiKey)
+	config.BaseURL = baseURL
+	return openaiHelper.NewClient(openai.NewClientWithConfig(config))
+}
+
+// RegisterEmbeddingBackend routes the embedding models of a provider to backend,
+// replacing the backend registered before.
+func (p *Provider) RegisterEmbeddingBackend(provider registry.ProviderName, backend EmbeddingBackend) {
+	p.embedders[provider] = backend
+	if _, ok := p.breakers[provider]; !ok {
+		p.breakers[provider] = NewCircuitBreaker()
+	}
+}
+
+// SetEmbeddingCache makes GetEmbeddings look embeddings up in cache before
+// calling a backend. A nil cache turns caching off.
+func (p *Provider) SetEmbeddingCache(cache EmbeddingCache) {
+	p.embeddingCache = cache
+}
+
+func (p *Provider) GetEmbedding(ctx context.Context, request aipitypes.EmbeddingRequest) ([]float32, error) {
+	input, ok := request.Input.(string)
+	if !ok {
+		return nil, fmt.Errorf("GetEmbedding takes a single string input, got %T", request.Input)
+	}
+	request.Input = []string{input}
+
+	embeddings, err := p.GetEmbeddings(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+// GetEmbeddings embeds every input of the request and returns the embeddings
+// in input order. Cached and repeated texts are only embedded once, the rest
+// is sent to the backend in batches of MAX_EMBEDDING_BATCH_SIZE.
+func (p *Provider) GetEmbeddings(ctx context.Context, request aipitypes.EmbeddingRequest) ([][]float32, error) {
+	model, err := p.registry.Resolve(request.Model, registry.MODEL_KIND_EMBEDDING)
+	if err != nil {
+		return nil, err
+	}
+	backend, ok := p.embedders[model.Provider]
+	if !ok {
+		return nil, fmt.Errorf("no embedding backend configured for provider %s of model %s", model.Provider, request.Model)
+	}
+	if request.Dimensions > model.EmbeddingDimensions {
+		return nil, fmt.Errorf("model %s supports at most %d dimensions", request.Model, model.EmbeddingDimensions)
+	}
+	inputs, err := request.Inputs()
+	if err != nil {
+		return nil, err
+	}
+
+	dimensions := request.Dimensions
+	if dimensions == 0 || dimensions == model.EmbeddingDimensions {
+		// Not every model accepts a dimensions parameter, and the native size needs none
+		dimensions = model.EmbeddingDimensions
+		request.Dimensions = 0
+	}
+
+	keys := make([]EmbeddingCacheKey, len(inputs))
+	for i, input := range inputs {
+		keys[i] = newEmbeddingCacheKey(model.ID, dimensions, input)
+	}
+
+	found := make(map[EmbeddingCacheKey][]float32)
+	if p.embeddingCache != nil {
+		cached, err := p.embeddingCache.Get(ctx, keys)
+		if err != nil {
+			// The cache only saves money, a broken cache must not break retrieval
+			slog.Warn("Embedding cache lookup failed", "model", model.ID, "error", err)
+		} else {
+			found = cached
+		}
+	}
+
+	var missing []string
+	var missingKeys []EmbeddingCacheKey
+	for i, key := range keys {
+		if _, ok := found[key]; ok {
+			continue
+		}
+		found[key] = nil
+		missing = append(missing, inputs[i])
+		missingKeys = append(missingKeys, key)
+	}
+
+	computed := make(map[EmbeddingCacheKey][]float32, len(missing))
+	for start := 0; start < len(missing); start += MAX_EMBEDDING_BATCH_SIZE {
+		end := min(start+MAX_EMBEDDING_BATCH_SIZE, len(missing))
+		batch := request
+		batch.Input = missing[start:end]
+
+		characters := 0
+		for _, input := range missing[start:end] {
+			characters += len(input)
+		}
+		response, err := withRetry(ctx, p.breaker(model.Provider), func() (response aipitypes.EmbeddingResponse, err error) {
+			callCtx, call := startModelCall(ctx, OPERATION_EMBEDDINGS, model, request.IdUser, attribute.Int("aipi.inputs", end-start))
+			defer func() { call.end(response.Usage, err) }()
+
+			reservation, err := p.limiter.Acquire(callCtx, model, request.IdUser, (characters+3)/4)
+			if err != nil {
+				return aipitypes.EmbeddingResponse{}, err
+			}
+			call.span.AddEvent("rate limit capacity acquired")
+			response, err = backend.GetEmbeddings(callCtx, batch)
+			reservation.Settle(response.Usage)
+			return response, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(response.Embeddings) != end-start {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", end-start, len(response.Embeddings))
+		}
+		p.recordUsage(model, request.IdUser, response.Usage, false, false)
+
+		for i, embedding := range response.Embeddings {
+			key := missingKeys[start+i]
+			found[key] = embedding
+			computed[key] = embedding
+		}
+	}
+
+	if p.embeddingCache != nil && len(computed) > 0 {
+		if err := p.embeddingCache.Put(ctx, computed); err != nil {
+			slog.Warn("Embedding cache write failed", "model", model.ID, "error", err)
+		}
+	}
+
+	embeddings := make([][]float32, len(keys))
+	for i, key := range keys {
+		embeddings[i] = found[key]
+	}
+	return embeddings, nil
+}
@@ -2,10 +2,14 @@ package gemini
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/google/generative-ai-go/genai"
+	"github.com/google/uuid"
 	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"google.golang.org/api/iterator"
 )
 
 type Client struct {
@@ -17,12 +21,13 @@ func NewClient(genaiClient *genai.Client) *Client {
 }
 
 func (c *Client) GetCompletion(ctx context.Context, request aipitypes.AIPIRequest) (aipitypes.AIPIResponse, error) {
-	model := c.client.GenerativeModel(request.Model)
-	prompt := []genai.Part{
-		genai.Text(request.SystemMessage + "\n" + request.UserMessage),
+	model := c.generativeModel(request)
+	chat, parts, err := startChat(model, request)
+	if err != nil {
+		return aipitypes.AIPIResponse{}, err
 	}
 
-	resp, err := model.GenerateContent(ctx, prompt...)
+	resp, err := chat.SendMessage(ctx, parts...)
 	if err != nil {
 		return aipitypes.AIPIResponse{}, err
 	}
@@ -31,7 +36,231 @@ func (c *Client) GetCompletion(ctx context.Context, request aipitypes.AIPIReques
 		return aipitypes.AIPIResponse{}, fmt.Errorf("no response generated")
 	}
 
+	toolCalls, err := candidateToolCalls(resp)
+	if err != nil {
+		return aipitypes.AIPIResponse{}, err
+	}
+
 	return aipitypes.AIPIResponse{
-		Data: string(resp.Candidates[0].Content.Parts[0].(genai.Text)),
+		Data:      candidateText(resp),
+		Usage:     usageFromMetadata(resp.UsageMetadata),
+		ToolCalls: toolCalls,
 	}, nil
 }
+
+func (c *Client) GetCompletionAsync(ctx context.Context, request aipitypes.AIPIRequest) (<-chan aipitypes.AIPIStreamChunk, error) {
+	model := c.generativeModel(request)
+	chat, parts, err := startChat(model, request)
+	if err != nil {
+		return nil, err
+	}
+	iter := chat.SendMessageStream(ctx, parts...)
+
+	chunks := make(chan aipitypes.AIPIStreamChunk)
+	go func() {
+		defer close(chunks)
+
+		for {
+			resp, err := iter.Next()
+			if err == iterator.Done {
+				return
+			}
+			if err != nil {
+				aipitypes.SendChunk(ctx, chunks, aipitypes.AIPIStreamChunk{Err: err})
+				return
+			}
+
+			toolCalls, err := candidateToolCalls(resp)
+			if err != nil {
+				aipitypes.SendChunk(ctx, chunks, aipitypes.AIPIStreamChunk{Err: err})
+				return
+			}
+
+			chunk := aipitypes.AIPIStreamChunk{Delta: candidateText(resp), ToolCalls: toolCalls}
+			// Every streamed response carries the running token counts, the last one wins
+			if resp.UsageMetadata != nil {
+				usage := usageFromMetadata(resp.UsageMetadata)
+				chunk.Usage = &usage
+			}
+			if chunk.Delta == "" && chunk.Usage == nil && len(chunk.ToolCalls) == 0 {
+				continue
+			}
+			if !aipitypes.SendChunk(ctx, chunks, chunk) {
+				return
+			}
+		}
+	}()
+
+	return chunks, nil
+}
+
+func (c *Client) generativeModel(request aipitypes.AIPIRequest) *genai.GenerativeModel {
+	model := c.client.GenerativeModel(request.Model)
+	model.Tools = buildTools(request.Tools)
+
+	// The SDK has no seed, so Gemini replies are not repeatable
+	if request.Sampling.Temperature != nil {
+		model.SetTemperature(*request.Sampling.Temperature)
+	}
+	if request.Sampling.TopP != nil {
+		model.SetTopP(*request.Sampling.TopP)
+	}
+	if request.Sampling.MaxTokens != nil {
+		model.SetMaxOutputTokens(int32(*request.Sampling.MaxTokens))
+	}
+
+	switch request.ResponseFormat {
+	case aipitypes.AIPI_RESPONSE_FORMAT_JSON_SCHEMA:
+		model.ResponseMIMEType = "application/json"
+		model.ResponseSchema = schemaFromDefinition(request.ResponseSchema.Schema)
+	case aipitypes.AIPI_RESPONSE_FORMAT_JSON:
+		model.ResponseMIMEType = "application/json"
+	}
+
+	return model
+}
+
+// startChat maps the request's conversation onto a chat session: system
+// messages become the model's system instruction, the earlier turns its history
+// and the parts of the last turn are returned to be sent.
+func startChat(model *genai.GenerativeModel, request aipitypes.AIPIRequest) (*genai.ChatSession, []genai.Part, error) {
+	var systemParts []genai.Part
+	var contents []*genai.Content
+	for _, message := range request.Conversation() {
+		if message.Role == aipitypes.MESSAGE_ROLE_SYSTEM {
+			systemParts = append(systemParts, genai.Text(message.Content))
+			continue
+		}
+
+		role, parts, err := contentParts(message)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Gemini expects turns to alternate, consecutive messages of a role are merged
+		if len(contents) > 0 && contents[len(contents)-1].Role == role {
+			contents[len(contents)-1].Parts = append(contents[len(contents)-1].Parts, parts...)
+			continue
+		}
+		contents = append(contents, &genai.Content{Role: role, Parts: parts})
+	}
+
+	if len(contents) == 0 {
+		return nil, nil, fmt.Errorf("request has no messages to send")
+	}
+	last := contents[len(contents)-1]
+	if last.Role != "user" {
+		return nil, nil, fmt.Errorf("the last message must be from the user or a tool")
+	}
+
+	if len(systemParts) > 0 {
+		model.SystemInstruction = &genai.Content{Parts: systemParts}
+	}
+	chat := model.StartChat()
+	chat.History = contents[:len(contents)-1]
+
+	return chat, last.Parts, nil
+}
+
+func contentParts(message aipitypes.AIPIMessage) (role string, parts []genai.Part, err error) {
+	switch message.Role {
+	case aipitypes.MESSAGE_ROLE_ASSISTANT:
+		if message.Content != "" {
+			parts = append(parts, genai.Text(message.Content))
+		}
+		for _, call := range message.ToolCalls {
+			var args map[string]any
+			if err := json.Unmarshal([]byte(call.Arguments), &args); err != nil {
+				return "", nil, fmt.Errorf("invalid arguments for tool call %s: %w", call.Name, err)
+			}
+			parts = append(parts, genai.FunctionCall{Name: call.Name, Args: args})
+		}
+		return "model", parts, nil
+	case aipitypes.MESSAGE_ROLE_TOOL:
+		return "user", []genai.Part{genai.FunctionResponse{
+			Name:     message.Name,
+			Response: map[string]any{"content": message.Content},
+		}}, nil
+	default:
+		// Gemini has no participant names, so they are written into the text
+		text := message.Content
+		if message.Name != "" {
+			text = message.Name + ": " + message.Content
+		}
+		parts = append(parts, genai.Text(text))
+		for _, image := range message.Images {
+			parts = append(parts, genai.ImageData(strings.TrimPrefix(image.MIMEType, "image/"), image.Data))
+		}
+		return "user", parts, nil
+	}
+}
+
+func buildTools(definitions []aipitypes.ToolDefinition) []*genai.Tool {
+	if len(definitions) == 0 {
+		return nil
+	}
+
+	declarations := make([]*genai.FunctionDeclaration, 0, len(definitions))
+	for _, definition := range definitions {
+		declaration := &genai.FunctionDeclaration{
+			Name:        definition.Name,
+			Description: definition.Description,
+		}
+		// Gemini rejects an empty object schema for functions without parameters
+		if definition.Parameters != nil && len(definition.Parameters.Properties) > 0 {
+			declaration.Parameters = schemaFromDefinition(definition.Parameters)
+		}
+		declarations = append(declarations, declaration)
+	}
+	return []*genai.Tool{{FunctionDeclarations: declarations}}
+}
+
+// candidateToolCalls returns the function calls of the first candidate. Gemini
+// has no call ids, so each call gets a generated one.
+func candidateToolCalls(resp *genai.GenerateContentResponse) ([]aipitypes.ToolCall, error) {
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return nil, nil
+	}
+
+	var calls []aipitypes.ToolCall
+	for _, part := range resp.Candidates[0].Content.Parts {
+		functionCall, ok := part.(genai.FunctionCall)
+		if !ok {
+			continue
+		}
+		arguments, err := json.Marshal(functionCall.Args)
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling arguments of %s: %w", functionCall.Name, err)
+		}
+		calls = append(calls, aipitypes.ToolCall{
+			ID:        "call_" + uuid.NewString(),
+			Name:      functionCall.Name,
+			Arguments: string(arguments),
+		})
+	}
+	return calls, nil
+}
+
+// candidateText joins the text parts of the first candidate of a response.
+func candidateText(resp *genai.GenerateContentResponse) string {
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return ""
+	}
+
+	var text string
+	for _, part := range resp.Candidates[0].Content.Parts {
+		if t, ok := part.(genai.Text); ok {
+			text += string(t)
+		}
+	}
+	return text
+}
+
+func usageFromMetadata(metadata *genai.UsageMetadata) aipitypes.AIPIUsage {
+	if metadata == nil {
+		return aipitypes.AIPIUsage{}
+	}
+	return aipitypes.AIPIUsage{
+		InputTokens:  int(metadata.PromptTokenCount),
+		OutputTokens: int(metadata.CandidatesTokenCount),
+	}
+}
@@ -0,0 +1,88 @@
+package gemini
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+)
+
+// MAX_EMBEDDING_BATCH is the most contents BatchEmbedContents accepts per call.
+const MAX_EMBEDDING_BATCH = 100
+
+// GetEmbeddings embeds the inputs with EmbedContent, or BatchEmbedContents when
+// there is more than one. The embedding API reports no token counts, so the
+// returned usage is empty.
+func (c *Client) GetEmbeddings(ctx context.Context, request aipitypes.EmbeddingRequest) (aipitypes.EmbeddingResponse, error) {
+	inputs, err := request.Inputs()
+	if err != nil {
+		return aipitypes.EmbeddingResponse{}, err
+	}
+
+	model := c.client.EmbeddingModel(request.Model)
+	embeddings := make([][]float32, 0, len(inputs))
+
+	if len(inputs) == 1 {
+		resp, err := model.EmbedContent(ctx, genai.Text(inputs[0]))
+		if err != nil {
+			return aipitypes.EmbeddingResponse{}, fmt.Errorf("error creating embedding: %w", err)
+		}
+		if resp.Embedding == nil {
+			return aipitypes.EmbeddingResponse{}, fmt.Errorf("no embedding generated")
+		}
+		embeddings = append(embeddings, resp.Embedding.Values)
+	} else {
+		for start := 0; start < len(inputs); start += MAX_EMBEDDING_BATCH {
+			end := min(start+MAX_EMBEDDING_BATCH, len(inputs))
+			batch := model.NewBatch()
+			for _, input := range inputs[start:end] {
+				batch.AddContent(genai.Text(input))
+			}
+
+			resp, err := model.BatchEmbedContents(ctx, batch)
+			if err != nil {
+				return aipitypes.EmbeddingResponse{}, fmt.Errorf("error creating embeddings: %w", err)
+			}
+			if len(resp.Embeddings) != end-start {
+				return aipitypes.EmbeddingResponse{}, fmt.Errorf("expected %d embeddings, got %d", end-start, len(resp.Embeddings))
+			}
+			for _, embedding := range resp.Embeddings {
+				embeddings = append(embeddings, embedding.Values)
+			}
+		}
+	}
+
+	if request.Dimensions > 0 {
+		for i, embedding := range embeddings {
+			embeddings[i] = truncateEmbedding(embedding, request.Dimensions)
+		}
+	}
+
+	return aipitypes.EmbeddingResponse{Embeddings: embeddings}, nil
+}
+
+// truncateEmbedding shortens an embedding and scales it back to unit length.
+// The SDK cannot ask for a smaller output dimensionality, and Gemini embedding
+// models are trained so that a prefix of the vector is itself an embedding.
+func truncateEmbedding(embedding []float32, dimensions int) []float32 {
+	if dimensions >= len(embedding) {
+		return embedding
+	}
+
+	truncated := make([]float32, dimensions)
+	var norm float64
+	for i := range truncated {
+		truncated[i] = embedding[i]
+		norm += float64(embedding[i]) * float64(embedding[i])
+	}
+	norm = math.Sqrt(norm)
+	if norm == 0 {
+		return truncated
+	}
+	for i := range truncated {
+		truncated[i] = float32(float64(truncated[i]) / norm)
+	}
+	return truncated
+}
@@ -0,0 +1,52 @@
+package gemini
+
+import (
+	"github.com/google/generative-ai-go/genai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// schemaFromDefinition converts a JSON schema into Gemini's OpenAPI subset.
+// Gemini has no additionalProperties, unknown fields are rejected by validation instead.
+func schemaFromDefinition(definition *jsonschema.Definition) *genai.Schema {
+	if definition == nil {
+		return nil
+	}
+
+	schema := &genai.Schema{
+		Type:        schemaType(definition.Type),
+		Description: definition.Description,
+		Enum:        definition.Enum,
+		Required:    definition.Required,
+		Items:       schemaFromDefinition(definition.Items),
+	}
+	if len(definition.Properties) > 0 {
+		schema.Properties = make(map[string]*genai.Schema, len(definition.Properties))
+		for name, property := range definition.Properties {
+			schema.Properties[name] = schemaFromDefinition(&property)
+		}
+	}
+	if len(definition.Enum) > 0 {
+		schema.Format = "enum"
+	}
+
+	return schema
+}
+
+func schemaType(dataType jsonschema.DataType) genai.Type {
+	switch dataType {
+	case jsonschema.Object:
+		return genai.TypeObject
+	case jsonschema.Array:
+		return genai.TypeArray
+	case jsonschema.String:
+		return genai.TypeString
+	case jsonschema.Number:
+		return genai.TypeNumber
+	case jsonschema.Integer:
+		return genai.TypeInteger
+	case jsonschema.Boolean:
+		return genai.TypeBoolean
+	default:
+		return genai.TypeUnspecified
+	}
+}
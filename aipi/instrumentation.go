@@ -0,0 +1,64 @@
+package aipi
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/aipi/registry"
+	"github.com/somtojf/trio-server/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Operation names of model call spans, following the OpenTelemetry
+// semantic conventions for generative AI.
+const (
+	OPERATION_CHAT       = "chat"
+	OPERATION_EMBEDDINGS = "embeddings"
+)
+
+var tracer = otel.Tracer("github.com/somtojf/trio-server/aipi")
+
+// modelCall traces and measures one call to a model. Retries and fallbacks
+// are a call each, and a call includes the wait for rate limit capacity.
+type modelCall struct {
+	span      trace.Span
+	model     registry.ModelConfig
+	operation string
+	started   time.Time
+}
+
+func startModelCall(ctx context.Context, operation string, model registry.ModelConfig, idUser uint, attributes ...attribute.KeyValue) (context.Context, *modelCall) {
+	attributes = append(attributes,
+		attribute.String("gen_ai.operation.name", operation),
+		attribute.String("gen_ai.system", string(model.Provider)),
+		attribute.String("gen_ai.request.model", model.ID),
+		attribute.Int("aipi.user_id", int(idUser)),
+	)
+	ctx, span := tracer.Start(ctx, operation+" "+model.ID, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+	return ctx, &modelCall{span: span, model: model, operation: operation, started: time.Now()}
+}
+
+// end records the token counts and the error of the call. Calls cancelled
+// by the client are not counted as errors.
+func (c *modelCall) end(usage aipitypes.AIPIUsage, err error) {
+	c.span.SetAttributes(
+		attribute.Int("gen_ai.usage.input_tokens", usage.InputTokens),
+		attribute.Int("gen_ai.usage.output_tokens", usage.OutputTokens),
+	)
+	if err != nil {
+		c.span.RecordError(err)
+		c.span.SetStatus(codes.Error, err.Error())
+	}
+	c.span.End()
+
+	provider := string(c.model.Provider)
+	metrics.ModelCallSeconds.WithLabelValues(provider, c.model.ID, c.operation).Observe(time.Since(c.started).Seconds())
+	if err != nil && !errors.Is(err, context.Canceled) {
+		metrics.ModelErrors.WithLabelValues(provider, c.model.ID, c.operation).Inc()
+	}
+}
@@ -2,7 +2,11 @@ package openai
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
 
 	"github.com/sashabaranov/go-openai"
 	"github.com/somtojf/trio-server/aipi/aipitypes"
@@ -17,34 +21,257 @@ func NewClient(openaiClient *openai.Client) *Client {
 }
 
 func (c *Client) GetCompletion(ctx context.Context, request aipitypes.AIPIRequest) (aipitypes.AIPIResponse, error) {
-	resp, err := c.client.CreateChatCompletion(
-		ctx,
-		openai.ChatCompletionRequest{
-			Model: request.Model,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    "system",
-					Content: request.SystemMessage,
-				},
-				{
-					Role:    "user",
-					Content: request.UserMessage,
-				},
-			},
-		},
-	)
+	resp, err := c.client.CreateChatCompletion(withTemperature(ctx, request), buildChatRequest(request))
 	if err != nil {
 		return aipitypes.AIPIResponse{}, err
 	}
+	if len(resp.Choices) == 0 {
+		return aipitypes.AIPIResponse{}, fmt.Errorf("no response generated")
+	}
 
 	return aipitypes.AIPIResponse{
 		Data: resp.Choices[0].Message.Content,
+		Usage: aipitypes.AIPIUsage{
+			InputTokens:  resp.Usage.PromptTokens,
+			OutputTokens: resp.Usage.CompletionTokens,
+		},
+		ToolCalls: fromToolCalls(resp.Choices[0].Message.ToolCalls),
 	}, nil
 }
 
-func (p *Client) GetEmbedding(ctx context.Context, request aipitypes.EmbeddingRequest) ([]float32, error) {
+func (c *Client) GetCompletionAsync(ctx context.Context, request aipitypes.AIPIRequest) (<-chan aipitypes.AIPIStreamChunk, error) {
+	chatRequest := buildChatRequest(request)
+	chatRequest.Stream = true
+	chatRequest.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+
+	stream, err := c.client.CreateChatCompletionStream(withTemperature(ctx, request), chatRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := make(chan aipitypes.AIPIStreamChunk)
+	go func() {
+		defer close(chunks)
+		defer stream.Close()
+
+		// Tool calls arrive in fragments keyed by index and are sent once the stream ends
+		var toolCalls []openai.ToolCall
+		for {
+			resp, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				if len(toolCalls) > 0 {
+					aipitypes.SendChunk(ctx, chunks, aipitypes.AIPIStreamChunk{ToolCalls: fromToolCalls(toolCalls)})
+				}
+				return
+			}
+			if err != nil {
+				aipitypes.SendChunk(ctx, chunks, aipitypes.AIPIStreamChunk{Err: err})
+				return
+			}
+
+			// With IncludeUsage set, the last chunk has no choices and only carries token counts
+			if resp.Usage != nil {
+				usage := &aipitypes.AIPIUsage{
+					InputTokens:  resp.Usage.PromptTokens,
+					OutputTokens: resp.Usage.CompletionTokens,
+				}
+				if !aipitypes.SendChunk(ctx, chunks, aipitypes.AIPIStreamChunk{Usage: usage}) {
+					return
+				}
+			}
+
+			if len(resp.Choices) == 0 {
+				continue
+			}
+			toolCalls = mergeToolCallDeltas(toolCalls, resp.Choices[0].Delta.ToolCalls)
+			if resp.Choices[0].Delta.Content == "" {
+				continue
+			}
+			if !aipitypes.SendChunk(ctx, chunks, aipitypes.AIPIStreamChunk{Delta: resp.Choices[0].Delta.Content}) {
+				return
+			}
+		}
+	}()
+
+	return chunks, nil
+}
+
+func buildChatRequest(request aipitypes.AIPIRequest) openai.ChatCompletionRequest {
+	chatRequest := openai.ChatCompletionRequest{
+		Model:          request.Model,
+		Messages:       buildMessages(request.Conversation()),
+		ResponseFormat: buildResponseFormat(request),
+		Tools:          buildTools(request.Tools),
+		Seed:           request.Sampling.Seed,
+	}
+
+	// A temperature of 0 is dropped by omitempty, temperatureDoer sends it
+	if request.Sampling.Temperature != nil {
+		chatRequest.Temperature = *request.Sampling.Temperature
+	}
+	if request.Sampling.TopP != nil {
+		chatRequest.TopP = *request.Sampling.TopP
+	}
+	if request.Sampling.MaxTokens != nil {
+		chatRequest.MaxCompletionTokens = *request.Sampling.MaxTokens
+	}
+
+	return chatRequest
+}
+
+func buildTools(definitions []aipitypes.ToolDefinition) []openai.Tool {
+	if len(definitions) == 0 {
+		return nil
+	}
+
+	tools := make([]openai.Tool, 0, len(definitions))
+	for _, definition := range definitions {
+		tools = append(tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        definition.Name,
+				Description: definition.Description,
+				Parameters:  definition.Parameters,
+			},
+		})
+	}
+	return tools
+}
+
+func toToolCalls(calls []aipitypes.ToolCall) []openai.ToolCall {
+	var toolCalls []openai.ToolCall
+	for _, call := range calls {
+		toolCalls = append(toolCalls, openai.ToolCall{
+			ID:       call.ID,
+			Type:     openai.ToolTypeFunction,
+			Function: openai.FunctionCall{Name: call.Name, Arguments: call.Arguments},
+		})
+	}
+	return toolCalls
+}
+
+func fromToolCalls(toolCalls []openai.ToolCall) []aipitypes.ToolCall {
+	var calls []aipitypes.ToolCall
+	for _, toolCall := range toolCalls {
+		calls = append(calls, aipitypes.ToolCall{
+			ID:        toolCall.ID,
+			Name:      toolCall.Function.Name,
+			Arguments: toolCall.Function.Arguments,
+		})
+	}
+	return calls
+}
+
+// mergeToolCallDeltas adds the streamed fragments of tool calls to the calls
+// received so far. The first fragment of a call carries its id and name, the
+// following ones pieces of the arguments.
+func mergeToolCallDeltas(toolCalls []openai.ToolCall, deltas []openai.ToolCall) []openai.ToolCall {
+	for _, delta := range deltas {
+		index := len(toolCalls)
+		if delta.Index != nil {
+			index = *delta.Index
+		}
+		for len(toolCalls) <= index {
+			toolCalls = append(toolCalls, openai.ToolCall{Type: openai.ToolTypeFunction})
+		}
+
+		if delta.ID != "" {
+			toolCalls[index].ID = delta.ID
+		}
+		toolCalls[index].Function.Name += delta.Function.Name
+		toolCalls[index].Function.Arguments += delta.Function.Arguments
+	}
+	return toolCalls
+}
+
+func buildMessages(conversation []aipitypes.AIPIMessage) []openai.ChatCompletionMessage {
+	messages := make([]openai.ChatCompletionMessage, 0, len(conversation))
+	for _, message := range conversation {
+		chatMessage := openai.ChatCompletionMessage{
+			Role:    string(message.Role),
+			Content: message.Content,
+			Name:    messageName(message.Name),
+		}
+		if message.Role == aipitypes.MESSAGE_ROLE_ASSISTANT {
+			chatMessage.ToolCalls = toToolCalls(message.ToolCalls)
+		}
+		if message.Role == aipitypes.MESSAGE_ROLE_TOOL {
+			// Tool results are matched to their call by id, the name is not part of the message
+			chatMessage.Name = ""
+			chatMessage.ToolCallID = message.ToolCallID
+		}
+		if len(message.Images) > 0 {
+			// Content and MultiContent are exclusive, the text becomes the first part
+			chatMessage.Content = ""
+			chatMessage.MultiContent = imageContent(message)
+		}
+		messages = append(messages, chatMessage)
+	}
+	return messages
+}
+
+// imageContent sends the images of a message inline as data URLs.
+func imageContent(message aipitypes.AIPIMessage) []openai.ChatMessagePart {
+	parts := make([]openai.ChatMessagePart, 0, len(message.Images)+1)
+	if message.Content != "" {
+		parts = append(parts, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: message.Content})
+	}
+	for _, image := range message.Images {
+		parts = append(parts, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{
+				URL:    "data:" + image.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(image.Data),
+				Detail: openai.ImageURLDetailAuto,
+			},
+		})
+	}
+	return parts
+}
+
+// messageName makes a participant name fit the API's ^[a-zA-Z0-9_-]{1,64}$ pattern.
+func messageName(name string) string {
+	var sanitized strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			sanitized.WriteRune(r)
+		case r == ' ' || r == '.':
+			sanitized.WriteRune('_')
+		}
+		if sanitized.Len() == 64 {
+			break
+		}
+	}
+	return sanitized.String()
+}
+
+func buildResponseFormat(request aipitypes.AIPIRequest) *openai.ChatCompletionResponseFormat {
+	switch request.ResponseFormat {
+	case aipitypes.AIPI_RESPONSE_FORMAT_JSON_SCHEMA:
+		return &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+				Name:   request.ResponseSchema.Name,
+				Schema: request.ResponseSchema.Schema,
+				Strict: true,
+			},
+		}
+	case aipitypes.AIPI_RESPONSE_FORMAT_JSON:
+		return &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+	default:
+		return nil
+	}
+}
+
+// GetEmbeddings embeds all inputs of the request in one call.
+func (p *Client) GetEmbeddings(ctx context.Context, request aipitypes.EmbeddingRequest) (aipitypes.EmbeddingResponse, error) {
+	inputs, err := request.Inputs()
+	if err != nil {
+		return aipitypes.EmbeddingResponse{}, err
+	}
+
 	embReq := &openai.EmbeddingRequest{
-		Input:          request.Input,
+		Input:          inputs,
 		Model:          openai.EmbeddingModel(request.Model),
 		EncodingFormat: openai.EmbeddingEncodingFormat(request.EncodingFormat),
 		Dimensions:     request.Dimensions,
@@ -52,7 +279,26 @@ func (p *Client) GetEmbedding(ctx context.Context, request aipitypes.EmbeddingRe
 
 	response, err := p.client.CreateEmbeddings(ctx, embReq)
 	if err != nil {
-		return nil, fmt.Errorf("error creating embedding: %w", err)
+		return aipitypes.EmbeddingResponse{}, fmt.Errorf("error creating embedding: %w", err)
+	}
+
+	embeddings := make([][]float32, len(inputs))
+	for _, data := range response.Data {
+		if data.Index < 0 || data.Index >= len(inputs) {
+			return aipitypes.EmbeddingResponse{}, fmt.Errorf("embedding response has unexpected index %d", data.Index)
+		}
+		embeddings[data.Index] = data.Embedding
+	}
+	for i, embedding := range embeddings {
+		if embedding == nil {
+			return aipitypes.EmbeddingResponse{}, fmt.Errorf("embedding response is missing input %d", i)
+		}
 	}
-	return response.Data[0].Embedding, nil
+
+	return aipitypes.EmbeddingResponse{
+		Embeddings: embeddings,
+		Usage: aipitypes.AIPIUsage{
+			InputTokens: response.Usage.PromptTokens,
+		},
+	}, nil
 }
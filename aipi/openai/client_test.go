@@ -0,0 +1,28 @@
+package openai
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+)
+
+func TestGetCompletionWithoutChoices(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [], "usage": {"prompt_tokens": 3, "completion_tokens": 0}}`))
+	}))
+	defer server.Close()
+
+	config := NewConfig("test-key")
+	config.BaseURL = server.URL
+	client := NewClient(openai.NewClientWithConfig(config))
+
+	request := aipitypes.AIPIRequest{Model: "gpt-4o-mini", UserMessage: "Hi"}
+	if _, err := client.GetCompletion(context.Background(), request); err == nil {
+		t.Error("got no error for a response without choices")
+	}
+}
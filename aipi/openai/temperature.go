@@ -0,0 +1,64 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+)
+
+// zeroTemperatureKey marks the context of a chat request whose temperature is
+// 0. go-openai drops a zero temperature with omitempty, and the API would use
+// its default of 1 instead.
+type zeroTemperatureKey struct{}
+
+func withTemperature(ctx context.Context, request aipitypes.AIPIRequest) context.Context {
+	if temperature := request.Sampling.Temperature; temperature != nil && *temperature == 0 {
+		return context.WithValue(ctx, zeroTemperatureKey{}, true)
+	}
+	return ctx
+}
+
+// temperatureDoer adds the temperature go-openai dropped to the body of
+// requests marked with zeroTemperatureKey.
+type temperatureDoer struct {
+	doer openai.HTTPDoer
+}
+
+func (d temperatureDoer) Do(req *http.Request) (*http.Response, error) {
+	if req.Context().Value(zeroTemperatureKey{}) == nil || req.Body == nil {
+		return d.doer.Do(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	fields["temperature"] = json.RawMessage("0")
+	body, err = json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	req.ContentLength = int64(len(body))
+	return d.doer.Do(req)
+}
+
+// NewConfig returns the go-openai config for apiKey. Clients passed to
+// NewClient need it for a temperature of 0 to reach the API.
+func NewConfig(apiKey string) openai.ClientConfig {
+	config := openai.DefaultConfig(apiKey)
+	config.HTTPClient = temperatureDoer{doer: config.HTTPClient}
+	return config
+}
@@ -2,7 +2,9 @@ package aipi
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"strings"
 
 	"github.com/google/generative-ai-go/genai"
@@ -10,47 +12,400 @@ import (
 	"github.com/somtojf/trio-server/aipi/aipitypes"
 	"github.com/somtojf/trio-server/aipi/gemini"
 	openaiHelper "github.com/somtojf/trio-server/aipi/openai"
+	"github.com/somtojf/trio-server/aipi/registry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
 )
 
 type Provider struct {
 	genaiClient  *gemini.Client
 	openaiClient *openaiHelper.Client
+	db           *gorm.DB
+	registry     *registry.Registry
+	breakers     map[registry.ProviderName]*CircuitBreaker
+	embedders    map[registry.ProviderName]EmbeddingBackend
+	// embeddingCache is nil when embeddings are not cached
+	embeddingCache EmbeddingCache
+	// completionCache is nil when completions are not cached
+	completionCache CompletionCache
+	limiter         *RateLimiter
 }
 
-func NewProvider(genaiClient *genai.Client, openaiClient *openai.Client) *Provider {
-	return &Provider{
+func NewProvider(genaiClient *genai.Client, openaiClient *openai.Client, db *gorm.DB, modelRegistry *registry.Registry) *Provider {
+	provider := &Provider{
 		genaiClient:  gemini.NewClient(genaiClient),
 		openaiClient: openaiHelper.NewClient(openaiClient),
+		db:           db,
+		registry:     modelRegistry,
+		breakers: map[registry.ProviderName]*CircuitBreaker{
+			registry.PROVIDER_OPENAI: NewCircuitBreaker(),
+			registry.PROVIDER_GEMINI: NewCircuitBreaker(),
+		},
+		embedders: make(map[registry.ProviderName]EmbeddingBackend),
+		limiter:   NewRateLimiter(modelRegistry),
 	}
+	provider.RegisterEmbeddingBackend(registry.PROVIDER_OPENAI, provider.openaiClient)
+	provider.RegisterEmbeddingBackend(registry.PROVIDER_GEMINI, provider.genaiClient)
+	return provider
 }
 
+// AIPIClient is what the rest of the server needs from a model provider.
+// Provider implements it against the real APIs, the aipitest package has
+// fakes that work without network access.
 type AIPIClient interface {
 	GetCompletion(ctx context.Context, request aipitypes.AIPIRequest) (aipitypes.AIPIResponse, error)
-	GetCompletionAsync(ctx context.Context, request aipitypes.AIPIRequest) (string, error)
-	GetEmbedding(ctx context.Context, request aipitypes.AIPIRequest) (aipitypes.EmbeddingRequest, error)
+	GetCompletionAsync(ctx context.Context, request aipitypes.AIPIRequest) (<-chan aipitypes.AIPIStreamChunk, error)
+	GetEmbedding(ctx context.Context, request aipitypes.EmbeddingRequest) ([]float32, error)
+	// GetEmbeddings takes a []string input and returns one embedding per input, in order
+	GetEmbeddings(ctx context.Context, request aipitypes.EmbeddingRequest) ([][]float32, error)
 }
 
-type AIPIClientFactory struct {
-	geminiClient *genai.Client
-	openaiClient *openai.Client
+var _ AIPIClient = (*Provider)(nil)
+
+// SetCompletionCache answers similar prompts from cache, nil turns caching off.
+func (p *Provider) SetCompletionCache(cache CompletionCache) {
+	p.completionCache = cache
 }
 
+// GetCompletion retries transient failures with backoff and falls back to the
+// model's configured fallbacks in order. The model that answered is set on the response.
 func (p *Provider) GetCompletion(ctx context.Context, request aipitypes.AIPIRequest) (aipitypes.AIPIResponse, error) {
-	if strings.HasPrefix(request.Model, "gemini") {
+	candidates, err := p.candidateModels(request)
+	if err != nil {
+		return aipitypes.AIPIResponse{}, err
+	}
+	if response, ok := p.cachedCompletion(ctx, request, false); ok {
+		return response, nil
+	}
+
+	var lastErr error
+	for _, candidate := range candidates {
+		attempt := request
+		attempt.Model = candidate.requestModel
+
+		response, err := withRetry(ctx, p.breaker(candidate.config.Provider), func() (response aipitypes.AIPIResponse, err error) {
+			callCtx, call := startModelCall(ctx, OPERATION_CHAT, candidate.config, request.IdUser)
+			defer func() { call.end(response.Usage, err) }()
+
+			reservation, err := p.limiter.Acquire(callCtx, candidate.config, request.IdUser, estimateTokens(attempt))
+			if err != nil {
+				return aipitypes.AIPIResponse{}, err
+			}
+			call.span.AddEvent("rate limit capacity acquired")
+			response, err = p.complete(callCtx, candidate.config, attempt)
+			reservation.Settle(response.Usage)
+			return response, err
+		})
+		if err == nil {
+			response.Model = attempt.Model
+			p.recordUsage(candidate.config, request.IdUser, response.Usage, false, false)
+			p.storeCompletion(ctx, request, response)
+			return response, nil
+		}
+		if !shouldFallBack(ctx, err) {
+			return aipitypes.AIPIResponse{}, err
+		}
+
+		slog.Warn("Model failed, trying fallback", "model", attempt.Model, "error", err)
+		lastErr = err
+	}
+
+	return aipitypes.AIPIResponse{}, fmt.Errorf("all models failed: %w", lastErr)
+}
+
+func (p *Provider) complete(ctx context.Context, model registry.ModelConfig, request aipitypes.AIPIRequest) (aipitypes.AIPIResponse, error) {
+	switch model.Provider {
+	case registry.PROVIDER_GEMINI:
 		return p.genaiClient.GetCompletion(ctx, request)
-	} else if strings.HasPrefix(request.Model, "gpt") {
+	case registry.PROVIDER_OPENAI:
 		return p.openaiClient.GetCompletion(ctx, request)
+	default:
+		return aipitypes.AIPIResponse{}, fmt.Errorf("unsupported provider %s for model %s", model.Provider, request.Model)
+	}
+}
+
+// GetCompletionAsync streams the completion as it is generated. The returned
+// channel is closed once the model has finished or an error chunk was sent.
+// Failures before the first delta are retried and fall back like GetCompletion;
+// once text has been streamed an error is passed on to the consumer.
+func (p *Provider) GetCompletionAsync(ctx context.Context, request aipitypes.AIPIRequest) (<-chan aipitypes.AIPIStreamChunk, error) {
+	candidates, err := p.candidateModels(request)
+	if err != nil {
+		return nil, err
+	}
+
+	forwarded := make(chan aipitypes.AIPIStreamChunk)
+	if response, ok := p.cachedCompletion(ctx, request, true); ok {
+		go func() {
+			defer close(forwarded)
+			aipitypes.SendChunk(ctx, forwarded, aipitypes.AIPIStreamChunk{Delta: response.Data, Model: response.Model, Usage: &response.Usage})
+		}()
+		return forwarded, nil
+	}
+
+	go func() {
+		defer close(forwarded)
+
+		var lastErr error
+		for _, candidate := range candidates {
+			attempt := request
+			attempt.Model = candidate.requestModel
+
+			capture := &streamCapture{}
+			started, err := p.streamWithRetry(ctx, candidate.config, attempt, forwarded, capture)
+			if err == nil {
+				p.storeCompletion(ctx, request, capture.response(attempt.Model))
+				return
+			}
+			if started || !shouldFallBack(ctx, err) {
+				aipitypes.SendChunk(ctx, forwarded, aipitypes.AIPIStreamChunk{Err: err})
+				return
+			}
+
+			slog.Warn("Model failed, trying fallback", "model", attempt.Model, "error", err)
+			lastErr = err
+		}
+
+		aipitypes.SendChunk(ctx, forwarded, aipitypes.AIPIStreamChunk{Err: fmt.Errorf("all models failed: %w", lastErr)})
+	}()
+
+	return forwarded, nil
+}
+
+// streamWithRetry streams one model into forwarded, retrying transient errors
+// that happen before any text was sent. started reports whether text was sent.
+func (p *Provider) streamWithRetry(ctx context.Context, model registry.ModelConfig, request aipitypes.AIPIRequest, forwarded chan<- aipitypes.AIPIStreamChunk, capture *streamCapture) (started bool, err error) {
+	breaker := p.breaker(model.Provider)
+
+	for attempt := 0; attempt < MAX_ATTEMPTS_PER_MODEL; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, backoffDelay(attempt-1)); err != nil {
+				return false, err
+			}
+		}
+		if err := breaker.Allow(); err != nil {
+			return false, err
+		}
+
+		started, err = p.streamOnce(ctx, model, request, forwarded, capture)
+		if err == nil {
+			breaker.RecordSuccess()
+			return started, nil
+		}
+		if !isRetryable(ctx, err) {
+			breaker.Release()
+			return started, err
+		}
+
+		breaker.RecordFailure()
+		if started {
+			return started, err
+		}
 	}
-	return aipitypes.AIPIResponse{}, fmt.Errorf("unsupported model: %s", request.Model)
+
+	return false, fmt.Errorf("giving up after %d attempts: %w", MAX_ATTEMPTS_PER_MODEL, err)
 }
 
-func (p *Provider) GetEmbedding(ctx context.Context, request aipitypes.EmbeddingRequest) ([]float32, error) {
-	if strings.HasPrefix(request.Model, "text-") || strings.HasPrefix(request.Model, "code-") {
-		return p.openaiClient.GetEmbedding(ctx, request)
+func (p *Provider) streamOnce(ctx context.Context, model registry.ModelConfig, request aipitypes.AIPIRequest, forwarded chan<- aipitypes.AIPIStreamChunk, capture *streamCapture) (started bool, err error) {
+	capture.reset()
+	var usage aipitypes.AIPIUsage
+	ctx, call := startModelCall(ctx, OPERATION_CHAT, model, request.IdUser, attribute.Bool("aipi.streamed", true))
+	defer func() { call.end(usage, err) }()
+
+	reservation, err := p.limiter.Acquire(ctx, model, request.IdUser, estimateTokens(request))
+	if err != nil {
+		return false, err
+	}
+	call.span.AddEvent("rate limit capacity acquired")
+
+	var chunks <-chan aipitypes.AIPIStreamChunk
+	switch model.Provider {
+	case registry.PROVIDER_GEMINI:
+		chunks, err = p.genaiClient.GetCompletionAsync(ctx, request)
+	case registry.PROVIDER_OPENAI:
+		chunks, err = p.openaiClient.GetCompletionAsync(ctx, request)
+	default:
+		return false, fmt.Errorf("unsupported provider %s for model %s", model.Provider, request.Model)
 	}
-	return nil, fmt.Errorf("unsupported model: %s", request.Model)
+	if err != nil {
+		reservation.Settle(aipitypes.AIPIUsage{})
+		return false, err
+	}
+
+	defer func() {
+		reservation.Settle(usage)
+		if started || usage != (aipitypes.AIPIUsage{}) {
+			p.recordUsage(model, request.IdUser, usage, true, false)
+		}
+	}()
+
+	for chunk := range chunks {
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
+		if chunk.Err != nil {
+			return started, chunk.Err
+		}
+
+		chunk.Model = request.Model
+		if chunk.Delta != "" {
+			started = true
+		}
+		capture.add(chunk)
+		if !aipitypes.SendChunk(ctx, forwarded, chunk) {
+			// Drain so the client goroutine can exit and report final usage
+			for chunk := range chunks {
+				if chunk.Usage != nil {
+					usage = *chunk.Usage
+				}
+			}
+			return started, ctx.Err()
+		}
+	}
+
+	return started, nil
+}
+
+// streamCapture collects a streamed reply so it can be cached once complete.
+type streamCapture struct {
+	content   strings.Builder
+	toolCalls []aipitypes.ToolCall
+}
+
+func (c *streamCapture) reset() {
+	c.content.Reset()
+	c.toolCalls = nil
 }
 
-func (p *Provider) GetCompletionAsync(ctx context.Context, request aipitypes.AIPIRequest) (string, error) {
-	return "", nil
+func (c *streamCapture) add(chunk aipitypes.AIPIStreamChunk) {
+	c.content.WriteString(chunk.Delta)
+	c.toolCalls = append(c.toolCalls, chunk.ToolCalls...)
+}
+
+func (c *streamCapture) response(model string) aipitypes.AIPIResponse {
+	return aipitypes.AIPIResponse{Data: c.content.String(), Model: model, ToolCalls: c.toolCalls}
+}
+
+// cachedCompletion looks the request up in the completion cache and records
+// the hit. Cache errors are logged and the request goes to the model.
+func (p *Provider) cachedCompletion(ctx context.Context, request aipitypes.AIPIRequest, streamed bool) (aipitypes.AIPIResponse, bool) {
+	if p.completionCache == nil || !cacheablePrompt(request) {
+		return aipitypes.AIPIResponse{}, false
+	}
+
+	ctx, span := tracer.Start(ctx, "completion cache lookup", trace.WithAttributes(attribute.String("gen_ai.request.model", request.Model)))
+	defer span.End()
+
+	response, ok, err := p.completionCache.Lookup(ctx, request)
+	span.SetAttributes(attribute.Bool("aipi.cache_hit", ok))
+	if err != nil {
+		span.RecordError(err)
+		slog.Warn("Failed to read completion cache", "model", request.Model, "error", err)
+		return aipitypes.AIPIResponse{}, false
+	}
+	if !ok {
+		return aipitypes.AIPIResponse{}, false
+	}
+
+	model, found := p.registry.Get(response.Model)
+	if !found {
+		model = registry.ModelConfig{ID: response.Model}
+	}
+	p.recordUsage(model, request.IdUser, aipitypes.AIPIUsage{}, streamed, true)
+	return response, true
+}
+
+// storeCompletion caches a reply to a request without a response schema.
+// Replies to a schema are cached by CacheCompletion once the caller validated
+// them, or an invalid reply would be served again.
+func (p *Provider) storeCompletion(ctx context.Context, request aipitypes.AIPIRequest, response aipitypes.AIPIResponse) {
+	if request.ResponseSchema != nil {
+		return
+	}
+	p.CacheCompletion(ctx, request, response)
+}
+
+// CacheCompletion caches a reply the caller accepted for request. It is stored
+// in the background so the caller isn't delayed.
+func (p *Provider) CacheCompletion(ctx context.Context, request aipitypes.AIPIRequest, response aipitypes.AIPIResponse) {
+	if p.completionCache == nil || !cacheablePrompt(request) || len(response.ToolCalls) > 0 || response.Data == "" {
+		return
+	}
+
+	// The request may be over by the time the prompt is embedded, and its
+	// queue observer would report to a closed stream
+	ctx = WithQueueObserver(context.WithoutCancel(ctx), nil)
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, SEMANTIC_CACHE_STORE_TIMEOUT)
+		defer cancel()
+		if err := p.completionCache.Store(ctx, request, response); err != nil {
+			slog.Warn("Failed to write completion cache", "model", request.Model, "error", err)
+		}
+	}()
+}
+
+// Registry returns the model registry the provider routes with.
+func (p *Provider) Registry() *registry.Registry {
+	return p.registry
+}
+
+type candidateModel struct {
+	requestModel string
+	config       registry.ModelConfig
+}
+
+// candidateModels returns the requested model followed by its usable fallbacks.
+func (p *Provider) candidateModels(request aipitypes.AIPIRequest) ([]candidateModel, error) {
+	if request.ResponseFormat == aipitypes.AIPI_RESPONSE_FORMAT_JSON_SCHEMA && request.ResponseSchema == nil {
+		return nil, fmt.Errorf("response format %s requires a response schema", request.ResponseFormat)
+	}
+
+	primary, err := p.resolveChatModel(request.Model, request)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []candidateModel{{requestModel: request.Model, config: primary}}
+	for _, id := range primary.Fallbacks {
+		fallback, err := p.resolveChatModel(id, request)
+		if err != nil {
+			slog.Warn("Skipping unusable fallback model", "model", request.Model, "fallback", id, "error", err)
+			continue
+		}
+		candidates = append(candidates, candidateModel{requestModel: fallback.ID, config: fallback})
+	}
+
+	return candidates, nil
+}
+
+// resolveChatModel looks up a chat model and checks it supports the features the request uses.
+func (p *Provider) resolveChatModel(id string, request aipitypes.AIPIRequest) (registry.ModelConfig, error) {
+	model, err := p.registry.Resolve(id, registry.MODEL_KIND_CHAT)
+	if err != nil {
+		return registry.ModelConfig{}, err
+	}
+	isJSON := request.ResponseFormat == aipitypes.AIPI_RESPONSE_FORMAT_JSON || request.ResponseFormat == aipitypes.AIPI_RESPONSE_FORMAT_JSON_SCHEMA
+	if isJSON && !model.SupportsJSONMode {
+		return registry.ModelConfig{}, fmt.Errorf("model %s does not support JSON responses", id)
+	}
+	if len(request.Tools) > 0 && !model.SupportsTools {
+		return registry.ModelConfig{}, fmt.Errorf("model %s does not support tools", id)
+	}
+	if request.HasImages() && !model.SupportsVision {
+		return registry.ModelConfig{}, fmt.Errorf("model %s does not support images", id)
+	}
+	return model, nil
+}
+
+// breaker returns the circuit breaker shared by all models of a provider.
+func (p *Provider) breaker(provider registry.ProviderName) *CircuitBreaker {
+	return p.breakers[provider]
+}
+
+func shouldFallBack(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return isRetryable(ctx, err) || errors.Is(err, ErrCircuitOpen)
 }
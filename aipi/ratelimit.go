@@ -0,0 +1,374 @@
+package aipi
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/aipi/budget"
+	"github.com/somtojf/trio-server/aipi/registry"
+)
+
+// QueueObserver is told how many requests are ahead of a request waiting for
+// rate limit capacity, and told again whenever that number changes.
+type QueueObserver func(ahead int)
+
+type queueObserverKey struct{}
+
+// WithQueueObserver returns a context whose model calls report their queue
+// position to observer while they wait for capacity.
+func WithQueueObserver(ctx context.Context, observer QueueObserver) context.Context {
+	return context.WithValue(ctx, queueObserverKey{}, observer)
+}
+
+func queueObserverFrom(ctx context.Context) QueueObserver {
+	observer, _ := ctx.Value(queueObserverKey{}).(QueueObserver)
+	return observer
+}
+
+// tokenBucket refills continuously up to one minute's worth of capacity.
+type tokenBucket struct {
+	capacity  float64
+	available float64
+	perSecond float64
+	updated   time.Time
+}
+
+// newTokenBucket returns nil for a limit of zero, which means unlimited.
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	capacity := float64(perMinute)
+	return &tokenBucket{capacity: capacity, available: capacity, perSecond: capacity / 60, updated: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.available = math.Min(b.capacity, b.available+elapsed*b.perSecond)
+		b.updated = now
+	}
+}
+
+// delay returns how long until amount is available. Amounts above the
+// capacity only need a full bucket, so oversized requests still go through.
+func (b *tokenBucket) delay(amount float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	amount = math.Min(amount, b.capacity)
+	if b.available >= amount {
+		return 0
+	}
+	return time.Duration((amount - b.available) / b.perSecond * float64(time.Second))
+}
+
+// take removes amount, the balance may go negative when usage exceeded the estimate.
+func (b *tokenBucket) take(amount float64) {
+	if b != nil {
+		b.available -= amount
+	}
+}
+
+type limits struct {
+	requests *tokenBucket
+	tokens   *tokenBucket
+}
+
+type waiter struct {
+	idUser    uint
+	model     registry.ModelConfig
+	tokens    float64
+	granted   chan struct{}
+	positions chan int
+	position  int
+	done      bool
+}
+
+// modelQueue serves the requests waiting for one model fairly: one request
+// per user in turn, so a user sending many messages can't starve the others.
+type modelQueue struct {
+	users   []uint
+	waiting map[uint][]*waiter
+	next    int
+}
+
+// order returns the waiters in the order they will be served.
+func (q *modelQueue) order() []*waiter {
+	var ordered []*waiter
+	for round := 0; ; round++ {
+		added := false
+		for i := range q.users {
+			user := q.users[(q.next+i)%len(q.users)]
+			if round < len(q.waiting[user]) {
+				ordered = append(ordered, q.waiting[user][round])
+				added = true
+			}
+		}
+		if !added {
+			return ordered
+		}
+	}
+}
+
+func (q *modelQueue) push(w *waiter) {
+	if len(q.waiting[w.idUser]) == 0 {
+		// The rotation ends just before next, so a newly waiting user is
+		// served after everyone already waiting
+		q.users = slices.Insert(q.users, q.next, w.idUser)
+		if len(q.users) > 1 {
+			q.next++
+		}
+	}
+	q.waiting[w.idUser] = append(q.waiting[w.idUser], w)
+}
+
+func (q *modelQueue) remove(w *waiter) {
+	waiting := q.waiting[w.idUser]
+	for i, candidate := range waiting {
+		if candidate == w {
+			q.waiting[w.idUser] = append(waiting[:i:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(q.waiting[w.idUser]) > 0 {
+		return
+	}
+
+	delete(q.waiting, w.idUser)
+	for i, user := range q.users {
+		if user == w.idUser {
+			q.users = append(q.users[:i], q.users[i+1:]...)
+			if i < q.next {
+				q.next--
+			}
+			break
+		}
+	}
+	if len(q.users) == 0 || q.next >= len(q.users) {
+		q.next = 0
+	}
+}
+
+// RateLimiter keeps the calls to each model and provider within the requests
+// and tokens per minute of the registry. Requests that have to wait are queued
+// per model and served round robin across users.
+type RateLimiter struct {
+	mx        sync.Mutex
+	registry  *registry.Registry
+	models    map[string]*limits
+	providers map[registry.ProviderName]*limits
+	queues    map[string]*modelQueue
+	timer     *time.Timer
+}
+
+func NewRateLimiter(modelRegistry *registry.Registry) *RateLimiter {
+	return &RateLimiter{
+		registry:  modelRegistry,
+		models:    make(map[string]*limits),
+		providers: make(map[registry.ProviderName]*limits),
+		queues:    make(map[string]*modelQueue),
+	}
+}
+
+// Reservation is the capacity taken for one call. Settle it with the call's
+// usage so the token buckets reflect what was actually used.
+type Reservation struct {
+	limiter *RateLimiter
+	model   registry.ModelConfig
+	tokens  float64
+}
+
+// Settle charges the difference between the estimated and the used tokens.
+func (r *Reservation) Settle(usage aipitypes.AIPIUsage) {
+	if r == nil {
+		return
+	}
+	r.limiter.mx.Lock()
+	defer r.limiter.mx.Unlock()
+
+	difference := float64(usage.InputTokens+usage.OutputTokens) - r.tokens
+	modelLimits, providerLimits := r.limiter.limitsFor(r.model, time.Now())
+	modelLimits.tokens.take(difference)
+	providerLimits.tokens.take(difference)
+	r.limiter.dispatch(time.Now())
+}
+
+// Acquire waits until the model and its provider have capacity for a call of
+// about tokens tokens. While waiting, the queue position is reported to the
+// QueueObserver of ctx.
+func (l *RateLimiter) Acquire(ctx context.Context, model registry.ModelConfig, idUser uint, tokens int) (*Reservation, error) {
+	reservation := &Reservation{limiter: l, model: model, tokens: float64(tokens)}
+	now := time.Now()
+
+	l.mx.Lock()
+	queue := l.queue(model.ID)
+	if len(queue.users) == 0 && l.delay(model, reservation.tokens, now) == 0 {
+		l.take(model, reservation.tokens, now)
+		l.mx.Unlock()
+		return reservation, nil
+	}
+
+	w := &waiter{
+		idUser:    idUser,
+		model:     model,
+		tokens:    reservation.tokens,
+		granted:   make(chan struct{}),
+		positions: make(chan int, 1),
+		position:  -1,
+	}
+	queue.push(w)
+	l.dispatch(now)
+	l.mx.Unlock()
+
+	observer := queueObserverFrom(ctx)
+	for {
+		select {
+		case <-w.granted:
+			return reservation, nil
+		case ahead := <-w.positions:
+			if observer != nil {
+				observer(ahead)
+			}
+		case <-ctx.Done():
+			l.mx.Lock()
+			if w.done {
+				// Granted while cancelling, give the capacity back
+				l.refund(model, reservation.tokens)
+			} else {
+				queue.remove(w)
+			}
+			l.dispatch(time.Now())
+			l.mx.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (l *RateLimiter) queue(model string) *modelQueue {
+	queue, ok := l.queues[model]
+	if !ok {
+		queue = &modelQueue{waiting: make(map[uint][]*waiter)}
+		l.queues[model] = queue
+	}
+	return queue
+}
+
+func (l *RateLimiter) limitsFor(model registry.ModelConfig, now time.Time) (*limits, *limits) {
+	modelLimits, ok := l.models[model.ID]
+	if !ok {
+		modelLimits = &limits{
+			requests: newTokenBucket(model.RateLimit.RequestsPerMinute, now),
+			tokens:   newTokenBucket(model.RateLimit.TokensPerMinute, now),
+		}
+		l.models[model.ID] = modelLimits
+	}
+
+	providerLimits, ok := l.providers[model.Provider]
+	if !ok {
+		rateLimit := l.registry.Provider(model.Provider).RateLimit
+		providerLimits = &limits{
+			requests: newTokenBucket(rateLimit.RequestsPerMinute, now),
+			tokens:   newTokenBucket(rateLimit.TokensPerMinute, now),
+		}
+		l.providers[model.Provider] = providerLimits
+	}
+	return modelLimits, providerLimits
+}
+
+// delay returns how long until a call of tokens fits every limit of the model.
+func (l *RateLimiter) delay(model registry.ModelConfig, tokens float64, now time.Time) time.Duration {
+	modelLimits, providerLimits := l.limitsFor(model, now)
+	return max(
+		modelLimits.requests.delay(1, now),
+		modelLimits.tokens.delay(tokens, now),
+		providerLimits.requests.delay(1, now),
+		providerLimits.tokens.delay(tokens, now),
+	)
+}
+
+func (l *RateLimiter) take(model registry.ModelConfig, tokens float64, now time.Time) {
+	modelLimits, providerLimits := l.limitsFor(model, now)
+	modelLimits.requests.take(1)
+	modelLimits.tokens.take(tokens)
+	providerLimits.requests.take(1)
+	providerLimits.tokens.take(tokens)
+}
+
+func (l *RateLimiter) refund(model registry.ModelConfig, tokens float64) {
+	modelLimits, providerLimits := l.limitsFor(model, time.Now())
+	modelLimits.requests.take(-1)
+	modelLimits.tokens.take(-tokens)
+	providerLimits.requests.take(-1)
+	providerLimits.tokens.take(-tokens)
+}
+
+// dispatch grants queued requests that fit, reports the new queue positions
+// and schedules the next dispatch for when capacity frees up. l.mx must be held.
+func (l *RateLimiter) dispatch(now time.Time) {
+	var wait time.Duration
+	for _, queue := range l.queues {
+		for len(queue.users) > 0 {
+			head := queue.waiting[queue.users[queue.next]][0]
+			delay := l.delay(head.model, head.tokens, now)
+			if delay > 0 {
+				if wait == 0 || delay < wait {
+					wait = delay
+				}
+				break
+			}
+
+			l.take(head.model, head.tokens, now)
+			head.done = true
+			close(head.granted)
+			served := queue.users[queue.next]
+			queue.remove(head)
+			if len(queue.users) > 0 && queue.users[queue.next] == served {
+				queue.next = (queue.next + 1) % len(queue.users)
+			}
+		}
+
+		for ahead, w := range queue.order() {
+			if w.position != ahead {
+				w.position = ahead
+				select {
+				case <-w.positions:
+				default:
+				}
+				w.positions <- ahead
+			}
+		}
+	}
+
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	if wait > 0 {
+		l.timer = time.AfterFunc(wait, func() {
+			l.mx.Lock()
+			defer l.mx.Unlock()
+			l.dispatch(time.Now())
+		})
+	}
+}
+
+// estimateTokens approximates the input tokens of a request at four
+// characters per token. Reservations are settled with the real usage.
+func estimateTokens(request aipitypes.AIPIRequest) int {
+	characters := 0
+	images := 0
+	for _, message := range request.Conversation() {
+		characters += len(message.Content)
+		for _, call := range message.ToolCalls {
+			characters += len(call.Arguments)
+		}
+		images += len(message.Images)
+	}
+	return (characters+3)/4 + images*budget.IMAGE_TOKENS
+}
@@ -0,0 +1,228 @@
+package registry
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type ProviderName string
+
+const (
+	PROVIDER_OPENAI ProviderName = "openai"
+	PROVIDER_GEMINI ProviderName = "gemini"
+	// PROVIDER_LOCAL is an OpenAI compatible embedding server, see LOCAL_EMBEDDING_BASE_URL
+	PROVIDER_LOCAL ProviderName = "local"
+)
+
+// DEFAULT_CHEAP_MODEL does short background tasks, like picking speakers,
+// judging consensus, moderation, extracting memories and summarizing, unless
+// CHEAP_MODEL is set.
+const DEFAULT_CHEAP_MODEL = "gpt-4.1-nano-2025-04-14"
+
+// TaskModel returns the model in key for a background task, or the cheap model
+// when it is not set.
+func TaskModel(key string) string {
+	if model := os.Getenv(key); model != "" {
+		return model
+	}
+	if model := os.Getenv("CHEAP_MODEL"); model != "" {
+		return model
+	}
+	return DEFAULT_CHEAP_MODEL
+}
+
+type ModelKind string
+
+const (
+	MODEL_KIND_CHAT      ModelKind = "chat"
+	MODEL_KIND_EMBEDDING ModelKind = "embedding"
+)
+
+// ModelConfig describes a model the server may call. Prices are in USD per
+// million tokens.
+type ModelConfig struct {
+	ID                    string       `json:"id"`
+	Aliases               []string     `json:"aliases,omitempty"`
+	DisplayName           string       `json:"displayName"`
+	Provider              ProviderName `json:"provider"`
+	Kind                  ModelKind    `json:"kind"`
+	ContextWindow         int          `json:"contextWindow"`
+	MaxOutputTokens       int          `json:"maxOutputTokens,omitempty"`
+	InputPricePerMillion  float64      `json:"inputPricePerMillion"`
+	OutputPricePerMillion float64      `json:"outputPricePerMillion"`
+	SupportsJSONMode      bool         `json:"supportsJsonMode"`
+	SupportsTools         bool         `json:"supportsTools"`
+	SupportsVision        bool         `json:"supportsVision"`
+	EmbeddingDimensions   int          `json:"embeddingDimensions,omitempty"`
+	RateLimit             RateLimit    `json:"rateLimit"`
+	Fallbacks             []string     `json:"fallbacks,omitempty"`
+	Selectable            bool         `json:"selectable"`
+	GuestAllowed          bool         `json:"guestAllowed"`
+}
+
+// RateLimit caps the calls made to a model or provider. Zero means no limit.
+type RateLimit struct {
+	RequestsPerMinute int `json:"requestsPerMinute,omitempty"`
+	TokensPerMinute   int `json:"tokensPerMinute,omitempty"`
+}
+
+// ProviderConfig holds the limits shared by all models of a provider.
+type ProviderConfig struct {
+	Name      ProviderName `json:"name"`
+	RateLimit RateLimit    `json:"rateLimit"`
+}
+
+// Cost prices a call to the model.
+func (m ModelConfig) Cost(inputTokens int, outputTokens int) (inputCost float64, outputCost float64) {
+	inputCost = float64(inputTokens) * m.InputPricePerMillion / 1_000_000
+	outputCost = float64(outputTokens) * m.OutputPricePerMillion / 1_000_000
+	return inputCost, outputCost
+}
+
+type registryFile struct {
+	Providers []ProviderConfig `json:"providers,omitempty"`
+	Models    []ModelConfig    `json:"models"`
+}
+
+//go:embed models.json
+var defaultModels []byte
+
+type Registry struct {
+	models    []ModelConfig
+	byID      map[string]ModelConfig
+	providers map[ProviderName]ProviderConfig
+}
+
+// Load reads the registry from the file in MODEL_REGISTRY_PATH, or the
+// embedded default registry when it is not set.
+func Load() (*Registry, error) {
+	path := os.Getenv("MODEL_REGISTRY_PATH")
+	if path == "" {
+		return Parse(defaultModels)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading model registry: %w", err)
+	}
+	return Parse(data)
+}
+
+func Parse(data []byte) (*Registry, error) {
+	var file registryFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing model registry: %w", err)
+	}
+
+	registry := &Registry{byID: make(map[string]ModelConfig), providers: make(map[ProviderName]ProviderConfig)}
+	for _, provider := range file.Providers {
+		if _, exists := registry.providers[provider.Name]; exists {
+			return nil, fmt.Errorf("duplicate provider in registry: %s", provider.Name)
+		}
+		registry.providers[provider.Name] = provider
+	}
+	for _, model := range file.Models {
+		if err := validateConfig(model); err != nil {
+			return nil, err
+		}
+
+		ids := append([]string{model.ID}, model.Aliases...)
+		for _, id := range ids {
+			if _, exists := registry.byID[id]; exists {
+				return nil, fmt.Errorf("duplicate model id in registry: %s", id)
+			}
+			registry.byID[id] = model
+		}
+		registry.models = append(registry.models, model)
+	}
+
+	return registry, nil
+}
+
+func validateConfig(model ModelConfig) error {
+	if model.ID == "" {
+		return fmt.Errorf("model registry entry without an id")
+	}
+
+	switch model.Provider {
+	case PROVIDER_OPENAI, PROVIDER_GEMINI:
+	case PROVIDER_LOCAL:
+		if model.Kind != MODEL_KIND_EMBEDDING {
+			return fmt.Errorf("model %s: provider %s only serves embedding models", model.ID, model.Provider)
+		}
+	default:
+		return fmt.Errorf("model %s has unknown provider %q", model.ID, model.Provider)
+	}
+
+	switch model.Kind {
+	case MODEL_KIND_CHAT:
+	case MODEL_KIND_EMBEDDING:
+		if model.EmbeddingDimensions <= 0 {
+			return fmt.Errorf("embedding model %s has no dimensions", model.ID)
+		}
+	default:
+		return fmt.Errorf("model %s has unknown kind %q", model.ID, model.Kind)
+	}
+
+	return nil
+}
+
+// Get looks a model up by its id or one of its aliases.
+func (r *Registry) Get(id string) (ModelConfig, bool) {
+	model, ok := r.byID[id]
+	return model, ok
+}
+
+// Resolve returns the model config and checks that it is of the expected kind.
+func (r *Registry) Resolve(id string, kind ModelKind) (ModelConfig, error) {
+	model, ok := r.Get(id)
+	if !ok {
+		return ModelConfig{}, fmt.Errorf("unsupported model: %s", id)
+	}
+	if model.Kind != kind {
+		return ModelConfig{}, fmt.Errorf("model %s is not a %s model", id, kind)
+	}
+	return model, nil
+}
+
+// Provider returns the configuration of a provider. Providers without an
+// entry have no limits.
+func (r *Registry) Provider(name ProviderName) ProviderConfig {
+	if provider, ok := r.providers[name]; ok {
+		return provider
+	}
+	return ProviderConfig{Name: name}
+}
+
+func (r *Registry) List() []ModelConfig {
+	return append([]ModelConfig(nil), r.models...)
+}
+
+// Selectable returns the chat models a user may pick, in registry order.
+func (r *Registry) Selectable(isGuest bool) []ModelConfig {
+	var models []ModelConfig
+	for _, model := range r.models {
+		if model.Kind != MODEL_KIND_CHAT || !model.Selectable {
+			continue
+		}
+		if isGuest && !model.GuestAllowed {
+			continue
+		}
+		models = append(models, model)
+	}
+	return models
+}
+
+// ResolveSelectable returns a chat model the user may pick, see Selectable.
+func (r *Registry) ResolveSelectable(id string, isGuest bool) (ModelConfig, error) {
+	model, err := r.Resolve(id, MODEL_KIND_CHAT)
+	if err != nil {
+		return ModelConfig{}, err
+	}
+	if !model.Selectable || (isGuest && !model.GuestAllowed) {
+		return ModelConfig{}, fmt.Errorf("model %s is not available", id)
+	}
+	return model, nil
+}
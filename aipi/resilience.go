@@ -0,0 +1,191 @@
+package aipi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const MAX_ATTEMPTS_PER_MODEL = 3
+const RETRY_BASE_DELAY = 500 * time.Millisecond
+const RETRY_MAX_DELAY = 8 * time.Second
+
+const BREAKER_FAILURE_THRESHOLD = 5
+const BREAKER_COOLDOWN = 30 * time.Second
+
+var ErrCircuitOpen = errors.New("provider circuit breaker is open")
+
+// isRetryable reports whether an error is transient, e.g. rate limiting, a
+// server error or a network timeout, and the call is worth repeating. Nothing
+// is once ctx is done: the caller gave up, the provider didn't fail.
+func isRetryable(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return isRetryableStatus(apiErr.HTTPStatusCode)
+	}
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return isRetryableStatus(requestErr.HTTPStatusCode)
+	}
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return isRetryableStatus(googleErr.Code)
+	}
+	if grpcStatus, ok := status.FromError(err); ok {
+		switch grpcStatus.Code() {
+		case codes.ResourceExhausted, codes.Unavailable, codes.Internal, codes.DeadlineExceeded:
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusRequestTimeout || code >= http.StatusInternalServerError
+}
+
+// backoffDelay is an exponential backoff with full jitter for the given
+// zero-based attempt.
+func backoffDelay(attempt int) time.Duration {
+	ceiling := RETRY_BASE_DELAY << attempt
+	if ceiling <= 0 || ceiling > RETRY_MAX_DELAY {
+		ceiling = RETRY_MAX_DELAY
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withRetry runs call until it succeeds, fails with a non-retryable error or
+// runs out of attempts. Successes and transient failures are reported to the
+// breaker.
+func withRetry[T any](ctx context.Context, breaker *CircuitBreaker, call func() (T, error)) (T, error) {
+	var zero T
+	var lastErr error
+
+	for attempt := 0; attempt < MAX_ATTEMPTS_PER_MODEL; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, backoffDelay(attempt-1)); err != nil {
+				return zero, err
+			}
+		}
+
+		if err := breaker.Allow(); err != nil {
+			return zero, err
+		}
+
+		result, err := call()
+		if err == nil {
+			breaker.RecordSuccess()
+			return result, nil
+		}
+		if !isRetryable(ctx, err) {
+			// The request itself is at fault, or the caller gave up, which says
+			// nothing about the provider
+			breaker.Release()
+			return zero, err
+		}
+
+		breaker.RecordFailure()
+		lastErr = err
+	}
+
+	return zero, fmt.Errorf("giving up after %d attempts: %w", MAX_ATTEMPTS_PER_MODEL, lastErr)
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// CircuitBreaker stops calls to a provider after repeated transient failures
+// and lets a single probe call through once the cooldown has passed.
+type CircuitBreaker struct {
+	mx                  sync.Mutex
+	state               breakerState
+	consecutiveFailures int
+	openedAt            time.Time
+}
+
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{}
+}
+
+func (b *CircuitBreaker) Allow() error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < BREAKER_COOLDOWN {
+			return ErrCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		return nil
+	case breakerHalfOpen:
+		// A probe call is already in flight
+		return ErrCircuitOpen
+	default:
+		return nil
+	}
+}
+
+func (b *CircuitBreaker) RecordSuccess() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.state = breakerClosed
+	b.consecutiveFailures = 0
+}
+
+// Release ends a call whose outcome says nothing about the provider's health,
+// like a rejected request. A probe call leaves the next call to probe.
+func (b *CircuitBreaker) Release() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
+
+func (b *CircuitBreaker) RecordFailure() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.consecutiveFailures++
+	if b.state == breakerHalfOpen || b.consecutiveFailures >= BREAKER_FAILURE_THRESHOLD {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
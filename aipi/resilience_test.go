@@ -0,0 +1,68 @@
+package aipi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// timeoutError is a network timeout, like a provider not answering in time.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestIsRetryable(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{name: "rate limited", ctx: context.Background(), err: &openai.APIError{HTTPStatusCode: 429}, want: true},
+		{name: "bad request", ctx: context.Background(), err: &openai.APIError{HTTPStatusCode: 400}, want: false},
+		{name: "network timeout", ctx: context.Background(), err: timeoutError{}, want: true},
+		{name: "caller canceled", ctx: canceled, err: context.Canceled, want: false},
+		{name: "caller gave up during a timeout", ctx: canceled, err: timeoutError{}, want: false},
+		{name: "caller gave up during a server error", ctx: canceled, err: &openai.APIError{HTTPStatusCode: 503}, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isRetryable(test.ctx, test.err); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWithRetryStopsWhenCallerGivesUp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	breaker := NewCircuitBreaker()
+
+	calls := 0
+	_, err := withRetry(ctx, breaker, func() (string, error) {
+		calls++
+		cancel()
+		return "", timeoutError{}
+	})
+
+	if !errors.Is(err, timeoutError{}) {
+		t.Errorf("got error %v, want the call's", err)
+	}
+	if calls != 1 {
+		t.Errorf("called %d times, want once", calls)
+	}
+	if breaker.consecutiveFailures != 0 {
+		t.Errorf("breaker recorded %d failures, want none", breaker.consecutiveFailures)
+	}
+}
@@ -0,0 +1,189 @@
+package aipi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/qdrant/go-client/qdrant"
+	"github.com/sashabaranov/go-openai"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/types/qdranttypes"
+)
+
+const (
+	DEFAULT_SEMANTIC_CACHE_THRESHOLD = 0.97
+	DEFAULT_SEMANTIC_CACHE_TTL       = 24 * time.Hour
+	// MAX_SEMANTIC_CACHE_PROMPT_CHARACTERS is how much of the end of a prompt is
+	// embedded, which stays within the input limit of the embedding models.
+	// Everything before it has to match exactly.
+	MAX_SEMANTIC_CACHE_PROMPT_CHARACTERS = 16000
+	SEMANTIC_CACHE_STORE_TIMEOUT         = 30 * time.Second
+)
+
+// CompletionCache answers completion requests with the replies to earlier
+// requests that were close enough.
+type CompletionCache interface {
+	Lookup(ctx context.Context, request aipitypes.AIPIRequest) (aipitypes.AIPIResponse, bool, error)
+	Store(ctx context.Context, request aipitypes.AIPIRequest, response aipitypes.AIPIResponse) error
+}
+
+type promptEmbedder interface {
+	GetEmbedding(ctx context.Context, request aipitypes.EmbeddingRequest) ([]float32, error)
+}
+
+// SemanticCache keeps completions in the completion cache collection of Qdrant,
+// embedded by their prompt. A request hits the cache when an unexpired entry of
+// the same user and model scores at least the threshold. Prompts longer than
+// MAX_SEMANTIC_CACHE_PROMPT_CHARACTERS are compared by their end, and entries
+// must have the same beginning, response format and sampling parameters.
+type SemanticCache struct {
+	qdrantDB  *qdrant.Client
+	embedder  promptEmbedder
+	embedding qdranttypes.EmbeddingSettings
+	threshold float32
+	ttl       time.Duration
+}
+
+func NewSemanticCache(qdrantDB *qdrant.Client, embedder promptEmbedder, embedding qdranttypes.EmbeddingSettings, threshold float32, ttl time.Duration) *SemanticCache {
+	return &SemanticCache{qdrantDB: qdrantDB, embedder: embedder, embedding: embedding, threshold: threshold, ttl: ttl}
+}
+
+// cacheablePrompt reports whether a request may be answered from the cache.
+// Tool calls have to run against current data and images aren't embedded.
+func cacheablePrompt(request aipitypes.AIPIRequest) bool {
+	return request.IdUser != 0 && len(request.Tools) == 0 && !request.HasImages()
+}
+
+// splitPrompt renders the request and returns the hash of everything that
+// must match exactly and the text that is compared by similarity.
+func splitPrompt(request aipitypes.AIPIRequest) (prefixHash string, text string) {
+	var header strings.Builder
+	fmt.Fprintf(&header, "format=%s", request.ResponseFormat)
+	if request.ResponseSchema != nil {
+		// The same name may be reused for a changed schema
+		schema, _ := json.Marshal(request.ResponseSchema.Schema)
+		fmt.Fprintf(&header, " schema=%s %s", request.ResponseSchema.Name, schema)
+	}
+	sampling := request.Sampling
+	if sampling.Temperature != nil {
+		fmt.Fprintf(&header, " temperature=%g", *sampling.Temperature)
+	}
+	if sampling.TopP != nil {
+		fmt.Fprintf(&header, " top_p=%g", *sampling.TopP)
+	}
+	if sampling.MaxTokens != nil {
+		fmt.Fprintf(&header, " max_tokens=%d", *sampling.MaxTokens)
+	}
+	if sampling.Seed != nil {
+		fmt.Fprintf(&header, " seed=%d", *sampling.Seed)
+	}
+	header.WriteString("\n")
+
+	var prompt strings.Builder
+	for _, message := range request.Conversation() {
+		fmt.Fprintf(&prompt, "%s %s: %s\n", message.Role, message.Name, message.Content)
+	}
+	text = prompt.String()
+
+	prefix := ""
+	if len(text) > MAX_SEMANTIC_CACHE_PROMPT_CHARACTERS {
+		cut := len(text) - MAX_SEMANTIC_CACHE_PROMPT_CHARACTERS
+		for cut < len(text) && !utf8.RuneStart(text[cut]) {
+			cut++
+		}
+		prefix, text = text[:cut], text[cut:]
+	}
+
+	hash := sha256.Sum256([]byte(header.String() + prefix))
+	return hex.EncodeToString(hash[:]), text
+}
+
+func (c *SemanticCache) embed(ctx context.Context, request aipitypes.AIPIRequest, text string) ([]float32, error) {
+	return c.embedder.GetEmbedding(ctx, aipitypes.EmbeddingRequest{
+		Input:          text,
+		Model:          c.embedding.Model,
+		EncodingFormat: string(openai.EmbeddingEncodingFormatFloat),
+		Dimensions:     int(c.embedding.VectorSize),
+		IdUser:         request.IdUser,
+	})
+}
+
+func (c *SemanticCache) Lookup(ctx context.Context, request aipitypes.AIPIRequest) (aipitypes.AIPIResponse, bool, error) {
+	prefixHash, text := splitPrompt(request)
+	embedding, err := c.embed(ctx, request, text)
+	if err != nil {
+		return aipitypes.AIPIResponse{}, false, err
+	}
+
+	limit := uint64(1)
+	threshold := c.threshold
+	notBefore := float64(time.Now().Add(-c.ttl).Unix())
+	points, err := c.qdrantDB.Query(ctx, &qdrant.QueryPoints{
+		CollectionName: string(qdranttypes.COLLECTION_NAME_COMPLETION_CACHE),
+		Query:          qdrant.NewQuery(embedding...),
+		Limit:          &limit,
+		ScoreThreshold: &threshold,
+		Filter: &qdrant.Filter{
+			Must: []*qdrant.Condition{
+				qdrant.NewMatchInt("user_id", int64(request.IdUser)),
+				qdrant.NewMatchKeyword("model", request.Model),
+				qdrant.NewMatchKeyword("prefix_hash", prefixHash),
+				qdrant.NewRange("created_at", &qdrant.Range{Gte: &notBefore}),
+			},
+		},
+		WithPayload: qdrant.NewWithPayload(true),
+	})
+	if err != nil {
+		return aipitypes.AIPIResponse{}, false, fmt.Errorf("error searching completion cache: %w", err)
+	}
+	if len(points) == 0 {
+		return aipitypes.AIPIResponse{}, false, nil
+	}
+
+	payload := points[0].GetPayload()
+	slog.Info("Answered from completion cache", "model", request.Model, "score", points[0].GetScore())
+	return aipitypes.AIPIResponse{
+		Data:  payload["response"].GetStringValue(),
+		Model: payload["response_model"].GetStringValue(),
+	}, true, nil
+}
+
+func (c *SemanticCache) Store(ctx context.Context, request aipitypes.AIPIRequest, response aipitypes.AIPIResponse) error {
+	prefixHash, text := splitPrompt(request)
+	embedding, err := c.embed(ctx, request, text)
+	if err != nil {
+		return err
+	}
+
+	payload, err := qdrant.TryValueMap(map[string]any{
+		"user_id":        int64(request.IdUser),
+		"model":          request.Model,
+		"prefix_hash":    prefixHash,
+		"response":       response.Data,
+		"response_model": response.Model,
+		"created_at":     time.Now().Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("error writing completion cache: %w", err)
+	}
+	_, err = c.qdrantDB.Upsert(ctx, &qdrant.UpsertPoints{
+		CollectionName: string(qdranttypes.COLLECTION_NAME_COMPLETION_CACHE),
+		Points: []*qdrant.PointStruct{{
+			Id:      qdrant.NewID(uuid.New().String()),
+			Vectors: qdrant.NewVectors(embedding...),
+			Payload: payload,
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("error writing completion cache: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package aipi
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+)
+
+// MAX_STRUCTURED_REPAIRS is how often a reply that does not match its schema
+// is sent back to the model before giving up.
+const MAX_STRUCTURED_REPAIRS = 2
+
+// completionCacher is implemented by clients that cache the replies their
+// callers accepted.
+type completionCacher interface {
+	CacheCompletion(ctx context.Context, request aipitypes.AIPIRequest, response aipitypes.AIPIResponse)
+}
+
+// GetStructuredCompletion requests a response matching request.ResponseSchema
+// and decodes it into out, re-asking the model when the reply does not validate.
+func GetStructuredCompletion(ctx context.Context, client AIPIClient, request aipitypes.AIPIRequest, out any) (aipitypes.AIPIResponse, error) {
+	if request.ResponseSchema == nil {
+		return aipitypes.AIPIResponse{}, fmt.Errorf("structured completion requires a response schema")
+	}
+	request.ResponseFormat = aipitypes.AIPI_RESPONSE_FORMAT_JSON_SCHEMA
+
+	response, err := client.GetCompletion(ctx, request)
+	if err != nil {
+		return aipitypes.AIPIResponse{}, err
+	}
+	return RepairStructuredResponse(ctx, client, request, response, out)
+}
+
+// RepairStructuredResponse decodes a response that was already generated for
+// request, e.g. a streamed one, into out. Invalid replies are sent back to the
+// model together with the validation error, at most MAX_STRUCTURED_REPAIRS times.
+// The returned response is the one that was decoded, and it is cached as the
+// reply to request by clients that cache completions.
+func RepairStructuredResponse(ctx context.Context, client AIPIClient, request aipitypes.AIPIRequest, response aipitypes.AIPIResponse, out any) (aipitypes.AIPIResponse, error) {
+	if request.ResponseSchema == nil {
+		return aipitypes.AIPIResponse{}, fmt.Errorf("structured completion requires a response schema")
+	}
+	request.ResponseFormat = aipitypes.AIPI_RESPONSE_FORMAT_JSON_SCHEMA
+
+	for repairs := 0; ; repairs++ {
+		validationErr := request.ResponseSchema.Unmarshal(response.Data, out)
+		if validationErr == nil {
+			if cacher, ok := client.(completionCacher); ok {
+				cacher.CacheCompletion(ctx, request, response)
+			}
+			return response, nil
+		}
+		if repairs == MAX_STRUCTURED_REPAIRS {
+			return aipitypes.AIPIResponse{}, fmt.Errorf("response does not match schema %s after %d repairs: %w", request.ResponseSchema.Name, repairs, validationErr)
+		}
+
+		slog.Warn("Structured response failed validation, asking for a repair", "model", response.Model, "schema", request.ResponseSchema.Name, "error", validationErr)
+
+		repairRequest := buildRepairRequest(request, response.Data, validationErr)
+
+		var err error
+		response, err = client.GetCompletion(ctx, repairRequest)
+		if err != nil {
+			return aipitypes.AIPIResponse{}, err
+		}
+	}
+}
+
+// buildRepairRequest continues the conversation with the invalid reply and the
+// reason it was rejected.
+func buildRepairRequest(request aipitypes.AIPIRequest, invalidResponse string, validationErr error) aipitypes.AIPIRequest {
+	repairRequest := request
+	repairRequest.SystemMessage = ""
+	repairRequest.UserMessage = ""
+	repairRequest.Messages = append(request.Conversation(),
+		aipitypes.AIPIMessage{Role: aipitypes.MESSAGE_ROLE_ASSISTANT, Content: invalidResponse},
+		aipitypes.AIPIMessage{
+			Role:    aipitypes.MESSAGE_ROLE_USER,
+			Content: fmt.Sprintf("Your reply was rejected because: %s\nReply again with only a JSON object that matches the required schema.", validationErr),
+		},
+	)
+	return repairRequest
+}
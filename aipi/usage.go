@@ -0,0 +1,46 @@
+package aipi
+
+import (
+	"log/slog"
+
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/aipi/registry"
+	"github.com/somtojf/trio-server/metrics"
+	"github.com/somtojf/trio-server/models"
+)
+
+// recordUsage counts the tokens and cost of a model call and stores an
+// AIPIRecord for it, or for a reply served from the completion cache when
+// cached is set. Failing to record usage never fails the call itself, it is
+// only logged.
+func (p *Provider) recordUsage(model registry.ModelConfig, idUser uint, usage aipitypes.AIPIUsage, streamed bool, cached bool) {
+	inputCost, outputCost := model.Cost(usage.InputTokens, usage.OutputTokens)
+	provider := string(model.Provider)
+	metrics.ModelTokens.WithLabelValues(provider, model.ID, "input").Add(float64(usage.InputTokens))
+	metrics.ModelTokens.WithLabelValues(provider, model.ID, "output").Add(float64(usage.OutputTokens))
+	metrics.ModelCost.WithLabelValues(provider, model.ID).Add(inputCost + outputCost)
+
+	if p.db == nil {
+		return
+	}
+	if idUser == 0 {
+		slog.Warn("Skipping usage record for call without a user", "model", model.ID)
+		return
+	}
+
+	record := models.AIPIRecord{
+		ModelName:        model.ID,
+		InputTokenCount:  usage.InputTokens,
+		OutputTokenCount: usage.OutputTokens,
+		InputCost:        inputCost,
+		OutputCost:       outputCost,
+		TotalCost:        inputCost + outputCost,
+		Streamed:         streamed,
+		Cached:           cached,
+		UserID:           idUser,
+	}
+
+	if err := p.db.Create(&record).Error; err != nil {
+		slog.Error("Failed to record model usage", "model", model.ID, "error", err)
+	}
+}
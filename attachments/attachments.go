@@ -0,0 +1,252 @@
+// Package attachments stores the images users send with their messages.
+package attachments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/blobstore"
+	"github.com/somtojf/trio-server/models"
+	"gorm.io/gorm"
+)
+
+const (
+	MAX_ATTACHMENT_SIZE         = 5 << 20
+	MAX_ATTACHMENTS_PER_MESSAGE = 4
+	// MULTIPART_FIELD is the form field images are uploaded in
+	MULTIPART_FIELD = "images"
+)
+
+// allowedContentTypes are the image types every vision model accepts, with the
+// extension they are stored with.
+var allowedContentTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// InvalidError is returned for uploads and references the user has to fix.
+type InvalidError struct {
+	Reason string
+}
+
+func (e *InvalidError) Error() string {
+	return e.Reason
+}
+
+type Service struct {
+	db    *gorm.DB
+	store blobstore.Store
+}
+
+func NewService(db *gorm.DB, store blobstore.Store) *Service {
+	return &Service{db: db, store: store}
+}
+
+// Upload checks that data is a supported image and stores it for the user.
+// The content type is sniffed from the data rather than trusted from the client.
+func (s *Service) Upload(ctx context.Context, user models.User, fileName string, data []byte) (models.Attachment, error) {
+	if len(data) == 0 {
+		return models.Attachment{}, &InvalidError{Reason: fmt.Sprintf("%s is empty", fileName)}
+	}
+	if len(data) > MAX_ATTACHMENT_SIZE {
+		return models.Attachment{}, &InvalidError{Reason: fmt.Sprintf("%s is larger than %d MB", fileName, MAX_ATTACHMENT_SIZE>>20)}
+	}
+	contentType := http.DetectContentType(data)
+	extension, ok := allowedContentTypes[contentType]
+	if !ok {
+		return models.Attachment{}, &InvalidError{Reason: fmt.Sprintf("%s is not a PNG, JPEG, GIF or WebP image", fileName)}
+	}
+
+	attachment := models.Attachment{
+		ExternalID:  uuid.New(),
+		UserID:      user.IdUser,
+		FileName:    fileName,
+		ContentType: contentType,
+		SizeBytes:   len(data),
+	}
+	attachment.StorageKey = fmt.Sprintf("%d/%s%s", user.IdUser, attachment.ExternalID, extension)
+
+	if err := s.store.Put(ctx, attachment.StorageKey, data, contentType); err != nil {
+		return models.Attachment{}, err
+	}
+	if err := s.db.WithContext(ctx).Create(&attachment).Error; err != nil {
+		s.store.Delete(ctx, attachment.StorageKey)
+		return models.Attachment{}, fmt.Errorf("error saving attachment: %w", err)
+	}
+	return attachment, nil
+}
+
+// UploadFile uploads an image sent as a multipart file.
+func (s *Service) UploadFile(ctx context.Context, user models.User, header *multipart.FileHeader) (models.Attachment, error) {
+	if header.Size > MAX_ATTACHMENT_SIZE {
+		return models.Attachment{}, &InvalidError{Reason: fmt.Sprintf("%s is larger than %d MB", header.Filename, MAX_ATTACHMENT_SIZE>>20)}
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return models.Attachment{}, fmt.Errorf("error reading upload: %w", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, MAX_ATTACHMENT_SIZE+1))
+	if err != nil {
+		return models.Attachment{}, fmt.Errorf("error reading upload: %w", err)
+	}
+	return s.Upload(ctx, user, header.Filename, data)
+}
+
+// FromRequest returns the images sent with a message: the ones referenced by
+// ids, which the user uploaded earlier and has not sent yet, followed by the
+// files of the MULTIPART_FIELD when the request is multipart.
+func (s *Service) FromRequest(c *gin.Context, user models.User, ids []string) ([]models.Attachment, error) {
+	var files []*multipart.FileHeader
+	form, err := c.MultipartForm()
+	if err == nil {
+		files = form.File[MULTIPART_FIELD]
+	} else if !errors.Is(err, http.ErrNotMultipart) {
+		return nil, &InvalidError{Reason: fmt.Sprintf("invalid multipart request: %s", err)}
+	}
+
+	if len(ids)+len(files) > MAX_ATTACHMENTS_PER_MESSAGE {
+		return nil, &InvalidError{Reason: fmt.Sprintf("a message can have at most %d images", MAX_ATTACHMENTS_PER_MESSAGE)}
+	}
+
+	attachments, err := s.Pending(c.Request.Context(), user, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		attachment, err := s.UploadFile(c.Request.Context(), user, file)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, nil
+}
+
+// Pending loads attachments of the user that are not part of a message yet, in
+// the order of ids.
+func (s *Service) Pending(ctx context.Context, user models.User, ids []string) ([]models.Attachment, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	externalIDs := make([]uuid.UUID, len(ids))
+	for i, id := range ids {
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			return nil, &InvalidError{Reason: fmt.Sprintf("invalid attachment id %q", id)}
+		}
+		externalIDs[i] = parsed
+	}
+
+	var found []models.Attachment
+	err := s.db.WithContext(ctx).
+		Where("external_id IN ? AND user_id = ? AND id_basic_message IS NULL AND id_reflection_message IS NULL", externalIDs, user.IdUser).
+		Find(&found).Error
+	if err != nil {
+		return nil, fmt.Errorf("error loading attachments: %w", err)
+	}
+	byID := make(map[uuid.UUID]models.Attachment, len(found))
+	for _, attachment := range found {
+		byID[attachment.ExternalID] = attachment
+	}
+
+	attachments := make([]models.Attachment, 0, len(externalIDs))
+	seen := make(map[uuid.UUID]bool, len(externalIDs))
+	for _, id := range externalIDs {
+		attachment, ok := byID[id]
+		if !ok {
+			return nil, &InvalidError{Reason: fmt.Sprintf("attachment %s not found or already sent", id)}
+		}
+		if !seen[id] {
+			seen[id] = true
+			attachments = append(attachments, attachment)
+		}
+	}
+	return attachments, nil
+}
+
+// Images loads the attachments to send them to a model.
+func (s *Service) Images(ctx context.Context, attachments []models.Attachment) ([]aipitypes.ImagePart, error) {
+	images := make([]aipitypes.ImagePart, 0, len(attachments))
+	for _, attachment := range attachments {
+		data, err := s.store.Get(ctx, attachment.StorageKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading attachment %s: %w", attachment.ExternalID, err)
+		}
+		images = append(images, aipitypes.ImagePart{MIMEType: attachment.ContentType, Data: data})
+	}
+	return images, nil
+}
+
+// AttachToBasicMessage records the attachments as sent with a basic message.
+// It returns an InvalidError when one was sent with another message meanwhile.
+func AttachToBasicMessage(db *gorm.DB, attachments []models.Attachment, idBasicMessage uint) error {
+	return attach(db, attachments, "id_basic_message", idBasicMessage)
+}
+
+// AttachToReflectionMessage records the attachments as sent with a reflection message.
+// It returns an InvalidError when one was sent with another message meanwhile.
+func AttachToReflectionMessage(db *gorm.DB, attachments []models.Attachment, idReflectionMessage uint) error {
+	return attach(db, attachments, "id_reflection_message", idReflectionMessage)
+}
+
+func attach(db *gorm.DB, attachments []models.Attachment, column string, idMessage uint) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(attachments))
+	for i, attachment := range attachments {
+		ids[i] = attachment.IdAttachment
+	}
+	// Only attachments no message claimed yet, so two messages sent at the
+	// same time can't both take an image
+	result := db.Model(&models.Attachment{}).
+		Where("id_attachment IN ? AND id_basic_message IS NULL AND id_reflection_message IS NULL", ids).
+		Update(column, idMessage)
+	if result.Error != nil {
+		return fmt.Errorf("error attaching images: %w", result.Error)
+	}
+	if result.RowsAffected != int64(len(ids)) {
+		return &InvalidError{Reason: "an image was already sent with another message"}
+	}
+	return nil
+}
+
+// Open returns an attachment of the user with its data.
+func (s *Service) Open(ctx context.Context, user models.User, id uuid.UUID) (models.Attachment, []byte, error) {
+	var attachment models.Attachment
+	if err := s.db.WithContext(ctx).Where("external_id = ? AND user_id = ?", id, user.IdUser).First(&attachment).Error; err != nil {
+		return models.Attachment{}, nil, err
+	}
+	data, err := s.store.Get(ctx, attachment.StorageKey)
+	if err != nil {
+		return models.Attachment{}, nil, err
+	}
+	return attachment, data, nil
+}
+
+// Describe notes the images of an earlier message in its prompt text. Only the
+// newest message is sent with its images, so agents still know about older ones.
+func Describe(content string, attachments []models.Attachment) string {
+	if len(attachments) == 0 {
+		return content
+	}
+	names := make([]string, len(attachments))
+	for i, attachment := range attachments {
+		names[i] = attachment.FileName
+	}
+	return fmt.Sprintf("%s\n[Attached images: %s]", content, strings.Join(names, ", "))
+}
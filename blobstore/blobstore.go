@@ -0,0 +1,41 @@
+// Package blobstore keeps uploaded files outside the database.
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	BLOB_STORE_LOCAL       = "local"
+	DEFAULT_BLOB_STORE_DIR = "uploads"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Store saves blobs under keys chosen by the server. Keys may contain slashes
+// to group blobs, e.g. by user.
+type Store interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get returns ErrNotFound for keys that were never stored or were deleted
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Load creates the store picked by BLOB_STORE. Only local, the default, which
+// writes to BLOB_STORE_DIR exists so far. An S3 compatible store only has to
+// implement Store and be added here.
+func Load() (Store, error) {
+	switch kind := os.Getenv("BLOB_STORE"); kind {
+	case "", BLOB_STORE_LOCAL:
+		dir := os.Getenv("BLOB_STORE_DIR")
+		if dir == "" {
+			dir = DEFAULT_BLOB_STORE_DIR
+		}
+		return NewLocalStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", kind)
+	}
+}
@@ -2,30 +2,294 @@ package common
 
 import (
 	"context"
+	"fmt"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/generative-ai-go/genai"
+	"github.com/qdrant/go-client/qdrant"
 	"github.com/sashabaranov/go-openai"
 	"github.com/somtojf/trio-server/aipi"
+	"github.com/somtojf/trio-server/aipi/aipitest"
+	"github.com/somtojf/trio-server/aipi/budget"
+	openaiHelper "github.com/somtojf/trio-server/aipi/openai"
+	"github.com/somtojf/trio-server/aipi/registry"
+	"github.com/somtojf/trio-server/attachments"
+	"github.com/somtojf/trio-server/blobstore"
+	"github.com/somtojf/trio-server/env"
+	"github.com/somtojf/trio-server/memory"
+	"github.com/somtojf/trio-server/moderation"
+	"github.com/somtojf/trio-server/summary"
+	"github.com/somtojf/trio-server/tools"
+	"github.com/somtojf/trio-server/types/qdranttypes"
 	"google.golang.org/api/option"
+	"gorm.io/gorm"
 )
 
 type Dependencies struct {
 	AIPIProvider *aipi.Provider
+	// AIPIClient is what handlers call models through: the provider itself, or
+	// a cassette and fault injection around it depending on AIPI_MODE
+	AIPIClient    aipi.AIPIClient
+	ModelRegistry *registry.Registry
+	ToolRegistry  *tools.Registry
+	// Embedding is the model and size of the vectors stored in Qdrant
+	Embedding   qdranttypes.EmbeddingSettings
+	Budgeter    *budget.Budgeter
+	Attachments *attachments.Service
+	Moderator   *moderation.Moderator
+	// Memory is nil when agent memory is off
+	Memory *memory.Store
+	// Summarizer is nil when conversation summaries are off
+	Summarizer *summary.Summarizer
 }
 
-func NewDependencies(ctx context.Context) (*Dependencies, error) {
-	openaiClient := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
+func NewDependencies(ctx context.Context, db *gorm.DB, qdrantDB *qdrant.Client) (*Dependencies, error) {
+	openaiClient := openai.NewClientWithConfig(openaiHelper.NewConfig(os.Getenv("OPENAI_API_KEY")))
 
 	genaiClient, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
 	if err != nil {
 		return nil, err
 	}
 
+	modelRegistry, err := registry.Load()
+	if err != nil {
+		return nil, err
+	}
+
 	// Create the AIPI provider with both clients
-	aipiProvider := aipi.NewProvider(genaiClient, openaiClient)
+	aipiProvider := aipi.NewProvider(genaiClient, openaiClient, db, modelRegistry)
+	if baseURL := os.Getenv("LOCAL_EMBEDDING_BASE_URL"); baseURL != "" {
+		aipiProvider.RegisterEmbeddingBackend(registry.PROVIDER_LOCAL, aipi.NewLocalEmbeddingBackend(baseURL, os.Getenv("LOCAL_EMBEDDING_API_KEY")))
+	}
+
+	embeddingCache, err := newEmbeddingCache(db)
+	if err != nil {
+		return nil, err
+	}
+	aipiProvider.SetEmbeddingCache(embeddingCache)
+
+	embedding, err := qdranttypes.LoadEmbeddingSettings(modelRegistry)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Using embedding model", "model", embedding.Model, "vectorSize", embedding.VectorSize)
+
+	if completionCache := newSemanticCache(qdrantDB, aipiProvider, embedding); completionCache != nil {
+		aipiProvider.SetCompletionCache(completionCache)
+	}
+
+	aipiClient, err := newAIPIClient(aipiProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	blobStore, err := blobstore.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	classifier, err := newModerationClassifier(openaiClient, aipiClient)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Dependencies{
-		AIPIProvider: aipiProvider,
+		AIPIProvider:  aipiProvider,
+		AIPIClient:    aipiClient,
+		ModelRegistry: modelRegistry,
+		ToolRegistry:  tools.NewRegistry(db),
+		Embedding:     embedding,
+		Budgeter:      budget.NewBudgeter(modelRegistry),
+		Attachments:   attachments.NewService(db, blobStore),
+		Moderator:     moderation.NewModerator(db, classifier),
+		Memory:        newMemoryStore(db, qdrantDB, aipiClient, embedding),
+		Summarizer:    newSummarizer(db, aipiClient),
 	}, nil
 }
+
+// newMemoryStore lets agents remember facts about their users when MEMORY is
+// on. MEMORY_MODEL extracts the memories.
+func newMemoryStore(db *gorm.DB, qdrantDB *qdrant.Client, aipiClient aipi.AIPIClient, embedding qdranttypes.EmbeddingSettings) *memory.Store {
+	switch mode := os.Getenv("MEMORY"); mode {
+	case "", "off":
+		return nil
+	case "on":
+	default:
+		slog.Warn("Ignoring invalid setting", "key", "MEMORY", "value", mode)
+		return nil
+	}
+
+	model := registry.TaskModel("MEMORY_MODEL")
+	slog.Info("Agents remember their users", "model", model)
+	return memory.NewStore(db, qdrantDB, aipiClient, embedding, model)
+}
+
+// newSummarizer keeps rolling summaries of long chats unless SUMMARY is off.
+// SUMMARY_MODEL writes them and SUMMARY_EVERY_N_MESSAGES is how many messages
+// each section covers.
+func newSummarizer(db *gorm.DB, aipiClient aipi.AIPIClient) *summary.Summarizer {
+	switch mode := os.Getenv("SUMMARY"); mode {
+	case "", "on":
+	case "off":
+		return nil
+	default:
+		slog.Warn("Ignoring invalid setting", "key", "SUMMARY", "value", mode)
+		return nil
+	}
+
+	model := registry.TaskModel("SUMMARY_MODEL")
+	every := summary.LoadEveryNMessages()
+	slog.Info("Summarizing long chats", "model", model, "everyNMessages", every)
+	return summary.NewSummarizer(db, aipiClient, model, every)
+}
+
+// newEmbeddingCache picks where embeddings are cached from EMBEDDING_CACHE:
+// postgres (the default), disk, which stores them in EMBEDDING_CACHE_DIR, or off.
+func newEmbeddingCache(db *gorm.DB) (aipi.EmbeddingCache, error) {
+	switch mode := os.Getenv("EMBEDDING_CACHE"); mode {
+	case "", "postgres":
+		return aipi.NewPostgresEmbeddingCache(db), nil
+	case "disk":
+		dir := os.Getenv("EMBEDDING_CACHE_DIR")
+		if dir == "" {
+			dir = "embedding-cache"
+		}
+		return aipi.NewDiskEmbeddingCache(dir)
+	case "off":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown EMBEDDING_CACHE %q", mode)
+	}
+}
+
+// newSemanticCache answers similar prompts from the completion cache collection
+// when SEMANTIC_CACHE is on. SEMANTIC_CACHE_THRESHOLD is the similarity a cached
+// prompt needs and SEMANTIC_CACHE_TTL_HOURS how long its reply is served.
+func newSemanticCache(qdrantDB *qdrant.Client, provider *aipi.Provider, embedding qdranttypes.EmbeddingSettings) *aipi.SemanticCache {
+	switch mode := os.Getenv("SEMANTIC_CACHE"); mode {
+	case "", "off":
+		return nil
+	case "on":
+	default:
+		slog.Warn("Ignoring invalid setting", "key", "SEMANTIC_CACHE", "value", mode)
+		return nil
+	}
+
+	threshold := float32(aipi.DEFAULT_SEMANTIC_CACHE_THRESHOLD)
+	if value := os.Getenv("SEMANTIC_CACHE_THRESHOLD"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 32)
+		if err != nil || parsed <= 0 || parsed > 1 {
+			slog.Warn("Ignoring invalid setting", "key", "SEMANTIC_CACHE_THRESHOLD", "value", value)
+		} else {
+			threshold = float32(parsed)
+		}
+	}
+
+	ttl := aipi.DEFAULT_SEMANTIC_CACHE_TTL
+	if value := os.Getenv("SEMANTIC_CACHE_TTL_HOURS"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed <= 0 {
+			slog.Warn("Ignoring invalid setting", "key", "SEMANTIC_CACHE_TTL_HOURS", "value", value)
+		} else {
+			ttl = time.Duration(parsed * float64(time.Hour))
+		}
+	}
+
+	slog.Info("Caching completions", "threshold", threshold, "ttl", ttl)
+	return aipi.NewSemanticCache(qdrantDB, provider, embedding, threshold, ttl)
+}
+
+// newModerationClassifier builds the classifiers listed in MODERATION, comma
+// separated and tried in order: openai, judge, which asks MODERATION_JUDGE_MODEL,
+// and keywords, which matches the lines of MODERATION_KEYWORDS_FILE. off
+// turns moderation off. Moderated replies are still streamed, a window of
+// text behind the model, see moderation.Stream.
+func newModerationClassifier(openaiClient *openai.Client, aipiClient aipi.AIPIClient) (moderation.Classifier, error) {
+	mode := os.Getenv("MODERATION")
+	if mode == "" {
+		mode = "openai,judge,keywords"
+	}
+	if mode == "off" {
+		return nil, nil
+	}
+
+	var classifiers []moderation.Classifier
+	for _, name := range strings.Split(mode, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "openai":
+			classifiers = append(classifiers, moderation.NewOpenAIClassifier(openaiClient))
+		case "judge":
+			classifiers = append(classifiers, moderation.NewJudgeClassifier(aipiClient, registry.TaskModel("MODERATION_JUDGE_MODEL")))
+		case "keywords":
+			var keywords []string
+			if path := os.Getenv("MODERATION_KEYWORDS_FILE"); path != "" {
+				loaded, err := moderation.LoadKeywords(path)
+				if err != nil {
+					return nil, err
+				}
+				keywords = loaded
+			}
+			classifiers = append(classifiers, moderation.NewKeywordClassifier(keywords))
+		default:
+			return nil, fmt.Errorf("unknown MODERATION classifier %q", name)
+		}
+	}
+
+	classifier := moderation.NewFallbackClassifier(classifiers...)
+	slog.Info("Moderating messages", "classifiers", classifier.Name())
+	return classifier, nil
+}
+
+// newAIPIClient wraps the provider for offline runs. AIPI_MODE set to record,
+// replay or record_missing stores or replays calls in AIPI_CASSETTE_DIR, and
+// the AIPI_FAULT_* variables inject latency, errors and malformed replies.
+// AIPI_FAULT_SEED repeats the faults of an earlier run.
+func newAIPIClient(provider *aipi.Provider) (aipi.AIPIClient, error) {
+	var client aipi.AIPIClient = provider
+
+	mode := os.Getenv("AIPI_MODE")
+	if mode != "" && mode != "live" {
+		dir := os.Getenv("AIPI_CASSETTE_DIR")
+		if dir == "" {
+			dir = "cassettes"
+		}
+		cassette, err := aipitest.NewCassette(provider, dir, aipitest.CassetteMode(mode))
+		if err != nil {
+			return nil, err
+		}
+		slog.Warn("Model calls go through cassettes", "mode", mode, "dir", dir)
+		client = cassette
+	}
+
+	faults := aipitest.FaultConfig{
+		Latency:           time.Duration(env.Float("AIPI_FAULT_LATENCY_MS", 0, 0) * float64(time.Millisecond)),
+		ErrorRate:         env.Float("AIPI_FAULT_ERROR_RATE", 0, 0),
+		StreamErrorRate:   env.Float("AIPI_FAULT_STREAM_ERROR_RATE", 0, 0),
+		MalformedJSONRate: env.Float("AIPI_FAULT_MALFORMED_JSON_RATE", 0, 0),
+		Seed:              faultSeed(),
+	}
+	if faults.Latency > 0 || faults.ErrorRate > 0 || faults.StreamErrorRate > 0 || faults.MalformedJSONRate > 0 {
+		slog.Warn("Injecting faults into model calls", "latency", faults.Latency, "errorRate", faults.ErrorRate, "streamErrorRate", faults.StreamErrorRate, "malformedJsonRate", faults.MalformedJSONRate, "seed", faults.Seed)
+		client = aipitest.NewFaulty(client, faults)
+	}
+
+	return client, nil
+}
+
+// faultSeed returns AIPI_FAULT_SEED, or a new seed when it is not set. The
+// seed is logged so a run's faults can be injected again.
+func faultSeed() int64 {
+	value := os.Getenv("AIPI_FAULT_SEED")
+	if value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err == nil {
+			return parsed
+		}
+		slog.Warn("Ignoring invalid setting", "key", "AIPI_FAULT_SEED", "value", value)
+	}
+	return time.Now().UnixNano()
+}
@@ -0,0 +1,155 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/somtojf/trio-server/models"
+	"github.com/somtojf/trio-server/quota"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type Endpoint struct {
+	db    *gorm.DB
+	quota *quota.Checker
+}
+
+func NewEndpoint(db *gorm.DB, quota *quota.Checker) *Endpoint {
+	return &Endpoint{db: db, quota: quota}
+}
+
+// UpdateUserLimitsRequest replaces a user's overrides. Omitted fields fall back
+// to the tier default, zero means unlimited.
+type UpdateUserLimitsRequest struct {
+	DailyTokenLimit   *int     `json:"dailyTokenLimit" binding:"omitempty,min=0"`
+	MonthlyTokenLimit *int     `json:"monthlyTokenLimit" binding:"omitempty,min=0"`
+	DailyCostLimit    *float64 `json:"dailyCostLimit" binding:"omitempty,min=0"`
+	MonthlyCostLimit  *float64 `json:"monthlyCostLimit" binding:"omitempty,min=0"`
+}
+
+type UserLimitsResponse struct {
+	UserID    uuid.UUID         `json:"userId"`
+	Tier      quota.Tier        `json:"tier"`
+	Overrides *models.UserQuota `json:"overrides"`
+	Limits    quota.Limits      `json:"limits"`
+	Usage     quota.Usage       `json:"usage"`
+}
+
+// GetUserLimits godoc
+//
+//	@Summary		Get a user's limits
+//	@Description	Returns the effective limits, overrides and current usage of a user
+//	@Tags			admin
+//	@Produce		json
+//	@Param			id	path		string					true	"User ID"
+//	@Success		200	{object}	UserLimitsResponse		"User limits"
+//	@Failure		404	{object}	map[string]interface{}	"User not found"
+//	@Failure		500	{object}	map[string]interface{}	"Internal server error"
+//	@Router			/admin/users/{id}/limits [get]
+func (e *Endpoint) GetUserLimits(c *gin.Context) {
+	user, ok := e.findUser(c)
+	if !ok {
+		return
+	}
+
+	e.respondWithLimits(c, user)
+}
+
+// UpdateUserLimits godoc
+//
+//	@Summary		Update a user's limits
+//	@Description	Replaces the per-user overrides of the tier limits
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string					true	"User ID"
+//	@Param			limits	body		UpdateUserLimitsRequest	true	"New limits"
+//	@Success		200		{object}	UserLimitsResponse		"User limits"
+//	@Failure		400		{object}	map[string]interface{}	"Bad request"
+//	@Failure		404		{object}	map[string]interface{}	"User not found"
+//	@Failure		500		{object}	map[string]interface{}	"Internal server error"
+//	@Router			/admin/users/{id}/limits [put]
+func (e *Endpoint) UpdateUserLimits(c *gin.Context) {
+	var body UpdateUserLimitsRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := e.findUser(c)
+	if !ok {
+		return
+	}
+
+	userQuota := models.UserQuota{
+		UserID:            user.IdUser,
+		DailyTokenLimit:   body.DailyTokenLimit,
+		MonthlyTokenLimit: body.MonthlyTokenLimit,
+		DailyCostLimit:    body.DailyCostLimit,
+		MonthlyCostLimit:  body.MonthlyCostLimit,
+	}
+
+	if err := e.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id_user"}},
+		DoUpdates: clause.AssignmentColumns([]string{"daily_token_limit", "monthly_token_limit", "daily_cost_limit", "monthly_cost_limit", "updated_at"}),
+	}).Create(&userQuota).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update limits"})
+		return
+	}
+
+	e.respondWithLimits(c, user)
+}
+
+func (e *Endpoint) findUser(c *gin.Context) (models.User, bool) {
+	userId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return models.User{}, false
+	}
+
+	var user models.User
+	if err := e.db.Where("external_id = ?", userId).First(&user).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return models.User{}, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return models.User{}, false
+	}
+
+	return user, true
+}
+
+func (e *Endpoint) respondWithLimits(c *gin.Context, user models.User) {
+	var overrides *models.UserQuota
+	var userQuota models.UserQuota
+	err := e.db.Where("id_user = ?", user.IdUser).First(&userQuota).Error
+	if err == nil {
+		overrides = &userQuota
+	} else if err != gorm.ErrRecordNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch limits"})
+		return
+	}
+
+	limits, err := e.quota.LimitsFor(c.Request.Context(), user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch limits"})
+		return
+	}
+
+	usage, err := e.quota.UsageFor(c.Request.Context(), user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": UserLimitsResponse{
+		UserID:    user.ExternalID,
+		Tier:      quota.TierForUser(user),
+		Overrides: overrides,
+		Limits:    limits,
+		Usage:     usage,
+	}})
+}
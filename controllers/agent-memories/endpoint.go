@@ -0,0 +1,187 @@
+package agentmemories
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/somtojf/trio-server/memory"
+	"github.com/somtojf/trio-server/models"
+	"gorm.io/gorm"
+)
+
+type Endpoint struct {
+	db     *gorm.DB
+	memory *memory.Store
+}
+
+func NewEndpoint(db *gorm.DB, memoryStore *memory.Store) *Endpoint {
+	return &Endpoint{db: db, memory: memoryStore}
+}
+
+type UpdateMemoryRequest struct {
+	Content string `json:"content" binding:"required,max=300"`
+}
+
+// GetMemories godoc
+//
+//	@Summary		List an agent's memories
+//	@Description	Lists what an agent of a basic chat remembers about the user, oldest first
+//	@Tags			memories
+//	@Produce		json
+//	@Param			id		path		string					true	"Chat ID"
+//	@Param			agentId	path		string					true	"Agent ID"
+//	@Success		200		{object}	[]models.AgentMemory	"Memories"
+//	@Failure		404		{object}	map[string]interface{}	"Chat or agent not found"
+//	@Router			/basic-chats/{id}/agents/{agentId}/memories [get]
+func (e *Endpoint) GetMemories(c *gin.Context) {
+	agent, ok := e.findAgent(c)
+	if !ok {
+		return
+	}
+
+	memories, err := e.memory.List(c.Request.Context(), agent)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch memories"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": memories})
+}
+
+// UpdateMemory godoc
+//
+//	@Summary		Edit a memory
+//	@Description	Replaces what an agent remembers
+//	@Tags			memories
+//	@Accept			json
+//	@Produce		json
+//	@Param			id			path		string					true	"Chat ID"
+//	@Param			agentId		path		string					true	"Agent ID"
+//	@Param			memoryId	path		string					true	"Memory ID"
+//	@Param			memory		body		UpdateMemoryRequest		true	"New content"
+//	@Success		200			{object}	models.AgentMemory		"Memory"
+//	@Failure		400			{object}	map[string]interface{}	"Bad request"
+//	@Failure		404			{object}	map[string]interface{}	"Memory not found"
+//	@Router			/basic-chats/{id}/agents/{agentId}/memories/{memoryId} [put]
+func (e *Endpoint) UpdateMemory(c *gin.Context) {
+	var body UpdateMemoryRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	agentMemory, ok := e.findMemory(c)
+	if !ok {
+		return
+	}
+
+	if err := e.memory.Update(c.Request.Context(), &agentMemory, body.Content); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update memory"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": agentMemory})
+}
+
+// DeleteMemory godoc
+//
+//	@Summary		Delete a memory
+//	@Description	Makes an agent forget something
+//	@Tags			memories
+//	@Param			id			path		string					true	"Chat ID"
+//	@Param			agentId		path		string					true	"Agent ID"
+//	@Param			memoryId	path		string					true	"Memory ID"
+//	@Success		204			{object}	map[string]interface{}	"Memory deleted"
+//	@Failure		404			{object}	map[string]interface{}	"Memory not found"
+//	@Router			/basic-chats/{id}/agents/{agentId}/memories/{memoryId} [delete]
+func (e *Endpoint) DeleteMemory(c *gin.Context) {
+	agentMemory, ok := e.findMemory(c)
+	if !ok {
+		return
+	}
+
+	if err := e.memory.Delete(c.Request.Context(), agentMemory); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete memory"})
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{"message": "Memory deleted successfully"})
+}
+
+// findAgent looks up the agent of the path among the chats of the current
+// user.
+func (e *Endpoint) findAgent(c *gin.Context) (memory.Agent, bool) {
+	if e.memory == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent memory is turned off"})
+		return memory.Agent{}, false
+	}
+
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return memory.Agent{}, false
+	}
+	user := currentUser.(models.User)
+
+	chatId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chatId"})
+		return memory.Agent{}, false
+	}
+	agentId, err := uuid.Parse(c.Param("agentId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agentId"})
+		return memory.Agent{}, false
+	}
+
+	var chat models.BasicChat
+	if err := e.db.Where("external_id = ? AND user_id = ?", chatId, user.IdUser).First(&chat).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+			return memory.Agent{}, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat"})
+		return memory.Agent{}, false
+	}
+
+	var agent models.BasicAgent
+	if err := e.db.Where("external_id = ? AND id_basic_chat = ?", agentId, chat.IdBasicChat).First(&agent).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+			return memory.Agent{}, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch agent"})
+		return memory.Agent{}, false
+	}
+
+	return memory.Agent{IdUser: user.IdUser, IdChat: chat.IdBasicChat, Name: agent.AgentName}, true
+}
+
+// findMemory looks up the memory of the path among the agent's memories.
+func (e *Endpoint) findMemory(c *gin.Context) (models.AgentMemory, bool) {
+	agent, ok := e.findAgent(c)
+	if !ok {
+		return models.AgentMemory{}, false
+	}
+
+	memoryId, err := uuid.Parse(c.Param("memoryId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid memoryId"})
+		return models.AgentMemory{}, false
+	}
+
+	var agentMemory models.AgentMemory
+	err = e.db.Where("external_id = ? AND user_id = ? AND id_basic_chat = ? AND agent_name = ?", memoryId, agent.IdUser, agent.IdChat, agent.Name).
+		First(&agentMemory).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Memory not found"})
+			return models.AgentMemory{}, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch memory"})
+		return models.AgentMemory{}, false
+	}
+
+	return agentMemory, true
+}
@@ -0,0 +1,42 @@
+package agenttools
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/somtojf/trio-server/tools"
+)
+
+type Endpoint struct {
+	tools *tools.Registry
+}
+
+func NewEndpoint(toolRegistry *tools.Registry) *Endpoint {
+	return &Endpoint{tools: toolRegistry}
+}
+
+type ToolResponse struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// GetTools godoc
+//
+//	@Summary		List agent tools
+//	@Description	Lists the tools that can be attached to basic chat agents
+//	@Tags			tools
+//	@Produce		json
+//	@Success		200	{object}	[]ToolResponse			"Available tools"
+//	@Failure		401	{object}	map[string]interface{}	"Unauthorized"
+//	@Router			/tools [get]
+func (e *Endpoint) GetTools(c *gin.Context) {
+	available := make([]ToolResponse, 0)
+	for _, definition := range e.tools.List() {
+		available = append(available, ToolResponse{
+			Name:        definition.Name,
+			Description: definition.Description,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": available})
+}
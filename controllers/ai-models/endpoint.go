@@ -0,0 +1,66 @@
+package aimodels
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/somtojf/trio-server/aipi/registry"
+	"github.com/somtojf/trio-server/models"
+)
+
+type Endpoint struct {
+	registry *registry.Registry
+}
+
+func NewEndpoint(registry *registry.Registry) *Endpoint {
+	return &Endpoint{registry: registry}
+}
+
+type ModelResponse struct {
+	ID                    string                `json:"id"`
+	DisplayName           string                `json:"displayName"`
+	Provider              registry.ProviderName `json:"provider"`
+	ContextWindow         int                   `json:"contextWindow"`
+	MaxOutputTokens       int                   `json:"maxOutputTokens"`
+	InputPricePerMillion  float64               `json:"inputPricePerMillion"`
+	OutputPricePerMillion float64               `json:"outputPricePerMillion"`
+	SupportsJSONMode      bool                  `json:"supportsJsonMode"`
+	SupportsTools         bool                  `json:"supportsTools"`
+	SupportsVision        bool                  `json:"supportsVision"`
+}
+
+// GetModels godoc
+//
+//	@Summary		List models
+//	@Description	Lists the chat models the current user may pick
+//	@Tags			models
+//	@Produce		json
+//	@Success		200	{object}	[]ModelResponse			"Available models"
+//	@Failure		401	{object}	map[string]interface{}	"Unauthorized"
+//	@Router			/models [get]
+func (e *Endpoint) GetModels(c *gin.Context) {
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	available := make([]ModelResponse, 0)
+	for _, model := range e.registry.Selectable(user.IsGuest) {
+		available = append(available, ModelResponse{
+			ID:                    model.ID,
+			DisplayName:           model.DisplayName,
+			Provider:              model.Provider,
+			ContextWindow:         model.ContextWindow,
+			MaxOutputTokens:       model.MaxOutputTokens,
+			InputPricePerMillion:  model.InputPricePerMillion,
+			OutputPricePerMillion: model.OutputPricePerMillion,
+			SupportsJSONMode:      model.SupportsJSONMode,
+			SupportsTools:         model.SupportsTools,
+			SupportsVision:        model.SupportsVision,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": available})
+}
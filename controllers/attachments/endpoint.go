@@ -0,0 +1,102 @@
+package attachments
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/somtojf/trio-server/attachments"
+	"github.com/somtojf/trio-server/blobstore"
+	"github.com/somtojf/trio-server/models"
+	"gorm.io/gorm"
+)
+
+type Endpoint struct {
+	attachments *attachments.Service
+}
+
+func NewEndpoint(attachmentService *attachments.Service) *Endpoint {
+	return &Endpoint{attachments: attachmentService}
+}
+
+// UploadAttachment godoc
+//
+//	@Summary		Upload an image
+//	@Description	Stores an image in the "file" form field. Send its id in attachmentIds with a message to show it to the agents
+//	@Tags			attachments
+//	@Accept			multipart/form-data
+//	@Produce		json
+//	@Param			file	formData	file					true	"PNG, JPEG, GIF or WebP image"
+//	@Success		201		{object}	models.Attachment		"Uploaded attachment"
+//	@Failure		400		{object}	map[string]interface{}	"Invalid image"
+//	@Failure		401		{object}	map[string]interface{}	"Unauthorized"
+//	@Router			/attachments [post]
+func (e *Endpoint) UploadAttachment(c *gin.Context) {
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing file"})
+		return
+	}
+
+	attachment, err := e.attachments.UploadFile(c.Request.Context(), user, file)
+	if err != nil {
+		var invalid *attachments.InvalidError
+		if errors.As(err, &invalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": invalid.Error()})
+			return
+		}
+		slog.Error("Failed to upload attachment", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload attachment"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"data": attachment})
+}
+
+// GetAttachment godoc
+//
+//	@Summary		Download an image
+//	@Description	Returns an image the current user uploaded
+//	@Tags			attachments
+//	@Produce		image/png,image/jpeg,image/gif,image/webp
+//	@Param			id	path		string					true	"Attachment id"
+//	@Success		200	{file}		binary					"Image"
+//	@Failure		404	{object}	map[string]interface{}	"Not found"
+//	@Router			/attachments/{id} [get]
+func (e *Endpoint) GetAttachment(c *gin.Context) {
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment id"})
+		return
+	}
+
+	attachment, data, err := e.attachments.Open(c.Request.Context(), user, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, blobstore.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+			return
+		}
+		slog.Error("Failed to load attachment", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load attachment"})
+		return
+	}
+
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Data(http.StatusOK, attachment.ContentType, data)
+}
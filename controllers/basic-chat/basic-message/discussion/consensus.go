@@ -0,0 +1,56 @@
+package discussion
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/somtojf/trio-server/aipi"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/aipi/registry"
+	"github.com/somtojf/trio-server/controllers/basic-chat/basic-message/response"
+)
+
+const CONSENSUS_SYSTEM_MESSAGE = `You watch a discussion between AI agents about a user's message. Decide whether the agents have reached consensus: they agree on an answer, or their latest replies only repeat or confirm what was said before. Agents that still disagree, raise new points or ask each other questions have not reached consensus.`
+
+type consensusVerdict struct {
+	Consensus bool   `json:"consensus" description:"Whether the agents have reached consensus"`
+	Reason    string `json:"reason" description:"One sentence on why"`
+}
+
+var consensusSchema = aipitypes.MustResponseSchema("discussion_consensus", consensusVerdict{})
+
+// ConsensusJudge asks a model whether the agents of a discussion agree.
+type ConsensusJudge struct {
+	aipi  aipi.AIPIClient
+	model string
+}
+
+// NewConsensusJudge judges with DISCUSSION_JUDGE_MODEL, see registry.TaskModel.
+func NewConsensusJudge(client aipi.AIPIClient) *ConsensusJudge {
+	return &ConsensusJudge{aipi: client, model: registry.TaskModel("DISCUSSION_JUDGE_MODEL")}
+}
+
+// Reached reports whether the replies to the user's message agree. It also
+// returns the tokens the judgement used, which count toward the discussion's
+// token budget.
+func (j *ConsensusJudge) Reached(ctx context.Context, idUser uint, message string, replies []response.HistoryMessage) (bool, aipitypes.AIPIUsage, error) {
+	var prompt strings.Builder
+	fmt.Fprintf(&prompt, "User's message:\n%s\n\nDiscussion so far:\n", message)
+	for _, reply := range replies {
+		fmt.Fprintf(&prompt, "%s: %s\n", reply.SenderName, reply.Content)
+	}
+
+	var verdict consensusVerdict
+	result, err := aipi.GetStructuredCompletion(ctx, j.aipi, aipitypes.AIPIRequest{
+		SystemMessage:  CONSENSUS_SYSTEM_MESSAGE,
+		UserMessage:    prompt.String(),
+		Model:          j.model,
+		IdUser:         idUser,
+		ResponseSchema: consensusSchema,
+	}, &verdict)
+	if err != nil {
+		return false, aipitypes.AIPIUsage{}, fmt.Errorf("error judging consensus: %w", err)
+	}
+	return verdict.Consensus, result.Usage, nil
+}
@@ -0,0 +1,96 @@
+// Package discussion lets the agents of a basic chat keep responding to each
+// other for several rounds after a user message, and decides when to stop.
+package discussion
+
+import (
+	"sync"
+
+	"github.com/somtojf/trio-server/env"
+)
+
+type StopReason string
+
+const (
+	// STOP_ROUND_LIMIT is a discussion that used all rounds of the chat
+	STOP_ROUND_LIMIT StopReason = "round_limit"
+	// STOP_CONSENSUS is a discussion whose agents agreed with each other
+	STOP_CONSENSUS StopReason = "consensus"
+	// STOP_NOTHING_TO_ADD is a round in which no agent replied
+	STOP_NOTHING_TO_ADD StopReason = "nothing_to_add"
+	// STOP_TOKEN_BUDGET is a discussion that used its token budget
+	STOP_TOKEN_BUDGET StopReason = "token_budget"
+	// STOP_INTERRUPTED is a discussion the user interrupted
+	STOP_INTERRUPTED StopReason = "interrupted"
+)
+
+// DEFAULT_TOKEN_BUDGET caps the tokens the agents of a discussion use
+// together unless DISCUSSION_TOKEN_BUDGET is set. The first round always
+// completes, later rounds stop before an agent once the budget is used.
+const DEFAULT_TOKEN_BUDGET = 20000
+
+// LoadTokenBudget returns the token budget of a discussion.
+func LoadTokenBudget() int {
+	return env.Int("DISCUSSION_TOKEN_BUDGET", DEFAULT_TOKEN_BUDGET, 1)
+}
+
+// Discussion is a running discussion, checked for interrupts between rounds.
+type Discussion struct {
+	mx          sync.Mutex
+	interrupted bool
+}
+
+func (d *Discussion) Interrupted() bool {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return d.interrupted
+}
+
+func (d *Discussion) interrupt() {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.interrupted = true
+}
+
+// Registry tracks the running discussions by chat so the user can interrupt
+// them from another request. Discussions are only known to the server
+// instance that runs them.
+type Registry struct {
+	mx          sync.Mutex
+	discussions map[uint]*Discussion
+}
+
+func NewRegistry() *Registry {
+	return &Registry{discussions: make(map[uint]*Discussion)}
+}
+
+// Start registers a discussion for the chat. A discussion started later for
+// the same chat replaces it, so interrupts reach the latest one.
+func (r *Registry) Start(idChat uint) *Discussion {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	discussion := &Discussion{}
+	r.discussions[idChat] = discussion
+	return discussion
+}
+
+// Finish forgets the discussion unless another one replaced it.
+func (r *Registry) Finish(idChat uint, discussion *Discussion) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.discussions[idChat] == discussion {
+		delete(r.discussions, idChat)
+	}
+}
+
+// Interrupt asks the running discussion of the chat to stop after the current
+// round. It reports whether a discussion was running.
+func (r *Registry) Interrupt(idChat uint) bool {
+	r.mx.Lock()
+	discussion, ok := r.discussions[idChat]
+	r.mx.Unlock()
+	if !ok {
+		return false
+	}
+	discussion.interrupt()
+	return true
+}
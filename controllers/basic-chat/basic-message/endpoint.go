@@ -1,12 +1,15 @@
 package basicmessage
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"math/rand"
 	"net/http"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
@@ -16,18 +19,50 @@ import (
 	"github.com/sashabaranov/go-openai"
 	"github.com/somtojf/trio-server/aipi"
 	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/aipi/budget"
+	"github.com/somtojf/trio-server/attachments"
+	"github.com/somtojf/trio-server/controllers/basic-chat/basic-message/discussion"
 	"github.com/somtojf/trio-server/controllers/basic-chat/basic-message/response"
+	"github.com/somtojf/trio-server/controllers/basic-chat/basic-message/turntaking"
+	"github.com/somtojf/trio-server/env"
+	"github.com/somtojf/trio-server/memory"
+	"github.com/somtojf/trio-server/metrics"
 	"github.com/somtojf/trio-server/models"
+	"github.com/somtojf/trio-server/moderation"
+	"github.com/somtojf/trio-server/quota"
+	"github.com/somtojf/trio-server/summary"
+	"github.com/somtojf/trio-server/tools"
 	"github.com/somtojf/trio-server/types/qdranttypes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
 	"gorm.io/gorm"
 )
 
 type Endpoint struct {
-	db           *gorm.DB
-	qdrantDB     *qdrant.Client
-	aipi         *aipi.Provider
-	streamMx     sync.RWMutex
-	streamOutput *SendBasicMessageResponse
+	db          *gorm.DB
+	qdrantDB    *qdrant.Client
+	aipi        aipi.AIPIClient
+	quota       *quota.Checker
+	tools       *tools.Registry
+	embedding   qdranttypes.EmbeddingSettings
+	budgeter    *budget.Budgeter
+	attachments *attachments.Service
+	moderator   *moderation.Moderator
+	memory      *memory.Store
+	summarizer  *summary.Summarizer
+	discussions *discussion.Registry
+	consensus   *discussion.ConsensusJudge
+	tokenBudget int
+	// parallelWorkers limits the agents generating at once in parallel mode
+	parallelWorkers int
+}
+
+// messageStream is the response streamed to one SendBasicMessage request. Every
+// update sends all of it again.
+type messageStream struct {
+	c      *gin.Context
+	mx     sync.Mutex
+	output SendBasicMessageResponse
 }
 
 type ResponseStatus string
@@ -38,13 +73,34 @@ const (
 	ResponseStatusUnderstandingContext ResponseStatus = "understanding context"
 )
 
+type ErrorCode string
+
+const (
+	ErrorCodeQuotaExceeded     ErrorCode = "quota_exceeded"
+	ErrorCodeModerationFlagged ErrorCode = "moderation_flagged"
+)
+
+// SendBasicMessageRequest is sent as JSON, or as a multipart form to upload
+// images with the message in the attachments.MULTIPART_FIELD field.
 type SendBasicMessageRequest struct {
-	Message string `json:"message" binding:"required"`
+	Message string `json:"message" form:"message" binding:"required"`
+	// AttachmentIDs are images uploaded beforehand with POST /attachments
+	AttachmentIDs []string `json:"attachmentIds" form:"attachmentIds"`
 }
 
+// AgentResponse is an agent's reply in a round of the discussion. Agents
+// reply once per round, the first round answers the user. Replies are listed
+// by round and by the agent's Order in it, however the agents finished.
 type AgentResponse struct {
-	AgentName string    `json:"agentName"`
-	Content   string    `json:"content"`
+	AgentName string             `json:"agentName"`
+	Round     int                `json:"round"`
+	Order     int                `json:"order"`
+	Content   string             `json:"content"`
+	ToolCalls []tools.Invocation `json:"toolCalls,omitempty"`
+	IsPartial bool               `json:"isPartial"`
+	// Retracted replaces a partial reply that was shown but failed moderation
+	// once it was complete
+	Retracted bool      `json:"retracted,omitempty"`
 	CreatedAt time.Time `json:"createdAt"`
 }
 
@@ -57,17 +113,36 @@ type SendBasicMessageResponse struct {
 	AgentResponses []AgentResponse `json:"agentResponses"`
 	Status         []Status        `json:"status"`
 	Error          string          `json:"error"`
+	ErrorCode      ErrorCode       `json:"errorCode,omitempty"`
+	// TraceID is set with Error
+	TraceID string `json:"traceId,omitempty"`
+	// Round is the discussion round the agents are in
+	Round int `json:"round"`
+	// StopReason is set once a discussion of more than one round ended
+	StopReason discussion.StopReason `json:"stopReason,omitempty"`
 }
 
-func NewEndpoint(db *gorm.DB, aipi *aipi.Provider, qdrantDB *qdrant.Client) *Endpoint {
-	return &Endpoint{db, qdrantDB, aipi, sync.RWMutex{}, nil}
+func NewEndpoint(db *gorm.DB, aipi aipi.AIPIClient, qdrantDB *qdrant.Client, quota *quota.Checker, toolRegistry *tools.Registry, embedding qdranttypes.EmbeddingSettings, budgeter *budget.Budgeter, attachmentService *attachments.Service, moderator *moderation.Moderator, memoryStore *memory.Store, summarizer *summary.Summarizer) *Endpoint {
+	return &Endpoint{db, qdrantDB, aipi, quota, toolRegistry, embedding, budgeter, attachmentService, moderator, memoryStore, summarizer, discussion.NewRegistry(), discussion.NewConsensusJudge(aipi), discussion.LoadTokenBudget(), loadParallelWorkers()}
 }
 
-const EMBEDDING_MODEL = string(openai.SmallEmbedding3)
+// DEFAULT_PARALLEL_WORKERS limits the agents of a chat that generate at once
+// in parallel mode unless PARALLEL_AGENT_WORKERS is set.
+const DEFAULT_PARALLEL_WORKERS = 3
+
+func loadParallelWorkers() int {
+	return env.Int("PARALLEL_AGENT_WORKERS", DEFAULT_PARALLEL_WORKERS, 1)
+}
+
+// RESPONSE_MODEL answers for agents that have no model of their own
 const RESPONSE_MODEL = "gpt-4.1-nano-2025-04-14"
 const MAX_MESSAGE_LENGTH = 400
 const HISTORYLIMIT = 10
 
+// RETRIEVAL_STATUS is what the status of the search for relevant context is
+// reported as in place of an agent name, the search belongs to no agent
+const RETRIEVAL_STATUS = "retrieval"
+
 func (e *Endpoint) GetBasicMessages(c *gin.Context) {
 	currentUser, exists := c.Get("currentUser")
 	if !exists {
@@ -93,7 +168,7 @@ func (e *Endpoint) GetBasicMessages(c *gin.Context) {
 	}
 
 	var messages []models.BasicMessage
-	if err := e.db.Where("id_basic_chat = ?", chat.IdBasicChat).Find(&messages).Error; err != nil {
+	if err := e.db.Where("id_basic_chat = ?", chat.IdBasicChat).Preload("ToolCalls").Preload("Attachments").Find(&messages).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -102,13 +177,13 @@ func (e *Endpoint) GetBasicMessages(c *gin.Context) {
 }
 
 func (e *Endpoint) SendBasicMessage(c *gin.Context) {
-	// Initialize stream output for this request
-	e.streamMx.Lock()
-	e.streamOutput = &SendBasicMessageResponse{
+	metrics.ActiveStreams.WithLabelValues(metrics.MODE_BASIC).Inc()
+	defer metrics.ActiveStreams.WithLabelValues(metrics.MODE_BASIC).Dec()
+
+	stream := &messageStream{c: c, output: SendBasicMessageResponse{
 		AgentResponses: make([]AgentResponse, 0),
 		Status:         make([]Status, 0),
-	}
-	e.streamMx.Unlock()
+	}}
 
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
@@ -126,12 +201,14 @@ func (e *Endpoint) SendBasicMessage(c *gin.Context) {
 
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 300*time.Second)
 	defer cancel()
+	// Queries run in the request's trace
+	db := e.db.WithContext(ctx)
 
 	go func() {
 		select {
 		case <-ctx.Done():
 			if ctx.Err() == context.DeadlineExceeded {
-				e.streamError(c, "Request timeout exceeded")
+				e.streamError(stream, "Request timeout exceeded")
 			}
 		case <-done:
 			return
@@ -145,40 +222,77 @@ func (e *Endpoint) SendBasicMessage(c *gin.Context) {
 
 	chatId, err := uuid.Parse(c.Param("id"))
 	if err != nil {
-		e.streamError(c, "Invalid chat id")
+		e.streamError(stream, "Invalid chat id")
 		return
 	}
 
 	currentUser, exists := c.Get("currentUser")
 	if !exists {
-		e.streamError(c, "User not authenticated")
+		e.streamError(stream, "User not authenticated")
 		return
 	}
 	user := currentUser.(models.User)
 
 	var request SendBasicMessageRequest
-	if err := c.ShouldBindJSON(&request); err != nil {
-		e.streamError(c, err.Error())
+	if err := c.ShouldBind(&request); err != nil {
+		e.streamError(stream, err.Error())
 		return
 	}
 
 	if len(request.Message) > MAX_MESSAGE_LENGTH {
-		e.streamError(c, "Message too long")
+		e.streamError(stream, "Message too long")
 		return
 	}
 
 	var chat models.BasicChat
-	if err := e.db.Where("external_id = ? AND user_id = ?", chatId, user.IdUser).Preload("ChatAgents").First(&chat).Error; err != nil {
+	err = db.Where("external_id = ? AND user_id = ?", chatId, user.IdUser).
+		Preload("ChatAgents", func(tx *gorm.DB) *gorm.DB { return tx.Order("id_basic_agent") }).
+		First(&chat).Error
+	if err != nil {
 		if err == gorm.ErrRecordNotFound {
-			e.streamError(c, "Chat not found")
+			e.streamError(stream, "Chat not found")
 			return
 		}
-		e.streamError(c, err.Error())
+		e.streamError(stream, err.Error())
 		return
 	}
 
 	if len(chat.ChatAgents) < 1 {
-		e.streamError(c, "There are no agents to respond")
+		e.streamError(stream, "There are no agents to respond")
+		return
+	}
+
+	if err := e.quota.Check(ctx, user); err != nil {
+		var exceeded *quota.ExceededError
+		if errors.As(err, &exceeded) {
+			e.streamErrorWithCode(stream, ErrorCodeQuotaExceeded, exceeded.Error())
+			return
+		}
+		e.streamError(stream, err.Error())
+		return
+	}
+
+	err = e.moderator.Check(ctx, moderation.Item{
+		IdUser:    user.IdUser,
+		Direction: moderation.DIRECTION_INPUT,
+		ChatType:  moderation.CHAT_TYPE_BASIC,
+		ChatID:    chat.IdBasicChat,
+		Author:    user.Username,
+		Content:   request.Message,
+	})
+	if err != nil {
+		e.streamModerationError(stream, err)
+		return
+	}
+
+	attached, err := e.attachments.FromRequest(c, user, request.AttachmentIDs)
+	if err != nil {
+		e.streamError(stream, err.Error())
+		return
+	}
+	images, err := e.attachments.Images(ctx, attached)
+	if err != nil {
+		e.streamError(stream, err.Error())
 		return
 	}
 
@@ -187,24 +301,49 @@ func (e *Endpoint) SendBasicMessage(c *gin.Context) {
 		info := response.AgentInformation{
 			AgentName:   agent.AgentName,
 			AgentTraits: agent.AgentTraits,
+			Tools:       agent.Tools,
+			Description: agent.Description,
+			Model:       agent.Settings.Model(RESPONSE_MODEL),
+			Sampling:    agent.Settings.Sampling(),
 		}
 		agentInformation = append(agentInformation, info)
 	}
 
-	e.streamStatus(c, Status{
-		Status:    fmt.Sprintf("%s is trying to understand the context", agentInformation[0].AgentName),
-		AgentName: agentInformation[0].AgentName,
+	e.streamStatus(stream, Status{
+		Status:    "Looking for relevant context",
+		AgentName: RETRIEVAL_STATUS,
 	})
 
 	var relevantContext []response.HistoryMessage
-	// TODO: Uncomment this
-	relevantContext, err = e.getRelevantContext(c.Request.Context(), request.Message, chat.IdBasicChat, HISTORYLIMIT)
+	contextCtx := e.withQueueStatus(ctx, stream, RETRIEVAL_STATUS, "The context search")
+	relevantContext, err = e.getRelevantContext(contextCtx, request.Message, chat.IdBasicChat, user.IdUser, HISTORYLIMIT)
 	if err != nil {
-		e.streamError(c, err.Error())
+		e.streamError(stream, err.Error())
 		return
 	}
+	e.clearStatus(stream, RETRIEVAL_STATUS)
 
-	agentInformation = shuffleArray(agentInformation)
+	strategy, err := turntaking.New(chat.TurnTaking, e.aipi)
+	if err != nil {
+		e.streamError(stream, err.Error())
+		return
+	}
+	recentHistory, err := e.getChatHistory(ctx, chat.IdBasicChat, turntaking.MODERATOR_HISTORY_LIMIT)
+	if err != nil {
+		e.streamError(stream, err.Error())
+		return
+	}
+	selection, err := strategy.Select(ctx, turntaking.Turn{
+		IdUser:  user.IdUser,
+		Message: request.Message,
+		Number:  chat.TurnCount,
+		Agents:  agentInformation,
+		History: recentHistory,
+	})
+	if err != nil {
+		e.streamError(stream, err.Error())
+		return
+	}
 
 	startTime := time.Now()
 
@@ -214,103 +353,483 @@ func (e *Endpoint) SendBasicMessage(c *gin.Context) {
 		ChatID:     chat.IdBasicChat,
 	}
 
-	if err := e.db.Create(userMessage).Error; err != nil {
-		e.streamError(c, err.Error())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(userMessage).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&chat).UpdateColumn("turn_count", gorm.Expr("turn_count + 1")).Error; err != nil {
+			return err
+		}
+		return attachments.AttachToBasicMessage(tx, attached, userMessage.IdBasicMessage)
+	})
+	if err != nil {
+		e.streamError(stream, err.Error())
 		return
 	}
+	metrics.Messages.WithLabelValues(metrics.MODE_BASIC).Inc()
 
-	for _, agent := range agentInformation {
-		agentStartTime := time.Now()
+	conversationSummary, err := e.summarizer.Prompt(ctx, summary.CHAT_TYPE_BASIC, chat.IdBasicChat)
+	if err != nil {
+		// The agents can answer from the history alone
+		slog.Warn("Failed to load chat summary", "chat", chat.IdBasicChat, "error", err)
+	}
 
-		// Update agent status to thinking
-		e.streamStatus(c, Status{
-			Status:    fmt.Sprintf("%s is thinking", agent.AgentName),
-			AgentName: agent.AgentName,
-		})
+	rounds := max(chat.DiscussionRounds, 1)
+	// Single round chats have nothing to interrupt
+	var running *discussion.Discussion
+	if rounds > 1 {
+		running = e.discussions.Start(chat.IdBasicChat)
+		defer e.discussions.Finish(chat.IdBasicChat, running)
+	}
 
-		chatHistory, err := e.getChatHistory(chat.IdBasicChat, HISTORYLIMIT)
-		if err != nil {
-			e.streamError(c, err.Error())
-			return
+	turn := &agentTurn{
+		stream:          stream,
+		ctx:             ctx,
+		db:              db,
+		user:            user,
+		chat:            chat,
+		message:         request.Message,
+		userMessage:     userMessage,
+		images:          images,
+		agents:          agentInformation,
+		relevantContext: relevantContext,
+		summary:         conversationSummary,
+		chosen:          selection.Chosen,
+	}
+
+	var agentMessages []models.BasicMessage
+	// Replies are stored as they are delivered, so the ones stored before an
+	// agent fails are indexed too. All of them are embedded in one call.
+	defer func() {
+		if err := e.saveToQdrant(context.WithoutCancel(ctx), agentMessages, user.IdUser); err != nil {
+			slog.Error("Failed to index replies", "chat", chat.IdBasicChat, "error", err)
+		}
+	}()
+	var stopReason discussion.StopReason
+	tokensUsed := 0
+	round := 1
+discussionLoop:
+	for ; ; round++ {
+		e.streamRound(stream, round)
+
+		// Later rounds let every agent respond to the others, starting with
+		// the ones turn taking picked
+		speakers := selection.Speakers
+		if round > 1 {
+			speakers = discussionOrder(selection.Speakers, agentInformation)
 		}
 
-		var otherAgents []response.AgentInformation
-		for _, chatAgent := range agentInformation {
-			if chatAgent.AgentName != agent.AgentName {
-				otherAgents = append(otherAgents, chatAgent)
+		replies := 0
+		if chat.GenerationMode == models.GENERATION_MODE_PARALLEL {
+			if round > 1 && tokensUsed >= e.tokenBudget {
+				stopReason = discussion.STOP_TOKEN_BUDGET
+				break
+			}
+			chatHistory, err := e.getChatHistory(ctx, chat.IdBasicChat, budget.HISTORY_CANDIDATE_LIMIT)
+			if err != nil {
+				e.streamError(stream, err.Error())
+				return
+			}
+
+			var runs []*agentRun
+			for order, agent := range speakers {
+				if round > 1 && lastSender(chatHistory) == agent.AgentName {
+					continue
+				}
+				runs = append(runs, &agentRun{agent: agent, order: order, round: round})
+			}
+			if !e.generateParallel(turn, runs, chatHistory) {
+				return
+			}
+			for _, run := range runs {
+				tokensUsed += run.result.Usage.InputTokens + run.result.Usage.OutputTokens
+				message, ok := e.deliver(turn, run)
+				if !ok {
+					return
+				}
+				if message != nil {
+					agentMessages = append(agentMessages, *message)
+					replies++
+				}
+			}
+		} else {
+			for order, agent := range speakers {
+				if round > 1 && tokensUsed >= e.tokenBudget {
+					stopReason = discussion.STOP_TOKEN_BUDGET
+					break discussionLoop
+				}
+
+				// Reloaded for every agent so it sees the replies before its own
+				chatHistory, err := e.getChatHistory(ctx, chat.IdBasicChat, budget.HISTORY_CANDIDATE_LIMIT)
+				if err != nil {
+					e.streamError(stream, err.Error())
+					return
+				}
+				if round > 1 && lastSender(chatHistory) == agent.AgentName {
+					// Nobody responded to the agent's last reply yet
+					continue
+				}
+
+				run := &agentRun{agent: agent, order: order, round: round}
+				if err := e.generate(ctx, turn, run, chatHistory); err != nil {
+					e.streamError(stream, fmt.Sprintf("Agent %s response error: %s", agent.AgentName, err.Error()))
+					return
+				}
+				tokensUsed += run.result.Usage.InputTokens + run.result.Usage.OutputTokens
+				message, ok := e.deliver(turn, run)
+				if !ok {
+					return
+				}
+				if message != nil {
+					agentMessages = append(agentMessages, *message)
+					replies++
+				}
 			}
 		}
 
-		infoBank := response.InfoBank{
-			IdUser:           user.IdUser,
-			NewMessage:       request.Message,
-			AgentInformation: agent,
-			OtherAgents:      otherAgents,
-			ChatHistory:      chatHistory,
-			RelevantContext:  relevantContext,
+		if replies == 0 {
+			stopReason = discussion.STOP_NOTHING_TO_ADD
+			break
+		}
+		if round == rounds {
+			stopReason = discussion.STOP_ROUND_LIMIT
+			break
+		}
+		if running.Interrupted() {
+			stopReason = discussion.STOP_INTERRUPTED
+			break
+		}
+		if tokensUsed >= e.tokenBudget {
+			stopReason = discussion.STOP_TOKEN_BUDGET
+			break
 		}
 
-		response := response.NewResponse(e.db, e.aipi)
-		data, err := response.Run(c.Request.Context(), infoBank, RESPONSE_MODEL)
+		agreed, usage, err := e.consensus.Reached(ctx, user.IdUser, request.Message, discussionReplies(agentMessages))
+		tokensUsed += usage.InputTokens + usage.OutputTokens
 		if err != nil {
-			e.streamError(c, fmt.Sprintf("Agent %s response error: %s", agent.AgentName, err.Error()))
-			return
+			if ctx.Err() != nil {
+				e.streamError(stream, ctx.Err().Error())
+				return
+			}
+			// Without a verdict the other stop conditions still end the discussion
+			slog.Warn("Consensus check failed", "chat", chat.IdBasicChat, "error", err)
+		} else if agreed {
+			stopReason = discussion.STOP_CONSENSUS
+			break
 		}
+	}
+	if rounds > 1 {
+		e.streamStopReason(stream, stopReason)
+		metrics.DiscussionRounds.WithLabelValues(string(stopReason)).Observe(float64(round))
+		slog.Info("Discussion ended", "chat", chat.IdBasicChat, "rounds", round, "reason", stopReason, "tokens", tokensUsed)
+	}
 
-		// Skip empty responses
-		if data.Content == "" {
-			slog.Info("Agent %s skipped response as message was directed to another agent", agent.AgentName)
-			continue
-		}
+	e.memory.RememberAsync(ctx, exchanges(turn, agentMessages))
+	e.summarizer.UpdateAsync(ctx, summary.Chat{Type: summary.CHAT_TYPE_BASIC, IdChat: chat.IdBasicChat, IdUser: user.IdUser, UserName: user.Username})
 
-		newMessage := &models.BasicMessage{
-			SenderName: agent.AgentName,
-			ChatID:     chat.IdBasicChat,
-			Content:    data.Content,
-		}
+	elapsedTime := time.Since(startTime)
+	slog.Info("Total time taken", "seconds", elapsedTime.Seconds())
+}
 
-		tx := e.db.Begin()
-		if tx.Error != nil {
-			e.streamError(c, tx.Error.Error())
-			return
+// agentTurn is what the agents answering a user message share.
+type agentTurn struct {
+	stream          *messageStream
+	ctx             context.Context
+	db              *gorm.DB
+	user            models.User
+	chat            models.BasicChat
+	message         string
+	userMessage     *models.BasicMessage
+	images          []aipitypes.ImagePart
+	agents          []response.AgentInformation
+	relevantContext []response.HistoryMessage
+	// summary summarizes the chat before its latest messages
+	summary string
+	// chosen is set when turn taking picked the speakers of the first round
+	chosen bool
+}
+
+// agentRun is an agent's reply in a round. Order is the agent's place among
+// the speakers of the round, replies are presented and stored in that order.
+type agentRun struct {
+	agent   response.AgentInformation
+	order   int
+	round   int
+	started time.Time
+	elapsed time.Duration
+	result  response.RunResponse
+}
+
+// generate runs the agent on chatHistory and streams its reply as it comes.
+func (e *Endpoint) generate(ctx context.Context, turn *agentTurn, run *agentRun, chatHistory []response.HistoryMessage) error {
+	stream := turn.stream
+	agent := run.agent
+	run.started = time.Now()
+
+	// Update agent status to thinking
+	e.streamStatus(stream, Status{
+		Status:    fmt.Sprintf("%s is thinking", agent.AgentName),
+		AgentName: agent.AgentName,
+	})
+
+	var otherAgents []response.AgentInformation
+	for _, chatAgent := range turn.agents {
+		if chatAgent.AgentName != agent.AgentName {
+			otherAgents = append(otherAgents, chatAgent)
 		}
+	}
 
-		if err := tx.Create(newMessage).Error; err != nil {
-			tx.Rollback()
-			e.streamError(c, err.Error())
-			return
+	infoBank := response.InfoBank{
+		IdUser:           turn.user.IdUser,
+		IdChat:           turn.chat.IdBasicChat,
+		NewMessage:       turn.message,
+		NewMessageID:     turn.userMessage.IdBasicMessage,
+		NewImages:        turn.images,
+		AgentInformation: agent,
+		OtherAgents:      otherAgents,
+		ChosenToSpeak:    turn.chosen && run.round == 1,
+		ChatHistory:      chatHistory,
+		RelevantContext:  turn.relevantContext,
+	}
+	infoBank.ConversationSummary = turn.summary
+	if run.round > 1 {
+		infoBank.DiscussionRound = run.round
+	}
+	remembered, err := e.memory.Recall(ctx, memory.Agent{IdUser: turn.user.IdUser, IdChat: turn.chat.IdBasicChat, Name: agent.AgentName}, turn.message, memory.RECALL_LIMIT)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
+		// The agent can answer without its memories
+		slog.Warn("Failed to recall agent memories", "agent", agent.AgentName, "error", err)
+	}
+	for _, memory := range remembered {
+		infoBank.Memories = append(infoBank.Memories, memory.Content)
+	}
 
-		if err := e.saveToQdrant(c, *newMessage); err != nil {
-			tx.Rollback()
-			e.streamError(c, err.Error())
-			return
+	var toolCalls []tools.Invocation
+	// Only the part of the reply that passed moderation is shown
+	partial := e.moderator.NewStream(ctx, moderation.Item{
+		IdUser:    turn.user.IdUser,
+		Direction: moderation.DIRECTION_OUTPUT,
+		ChatType:  moderation.CHAT_TYPE_BASIC,
+		ChatID:    turn.chat.IdBasicChat,
+		Author:    agent.AgentName,
+	}, func(content string) {
+		e.streamAgentResponses(stream, AgentResponse{
+			AgentName: agent.AgentName,
+			Round:     run.round,
+			Order:     run.order,
+			Content:   content,
+			ToolCalls: toolCalls,
+			IsPartial: true,
+			CreatedAt: run.started,
+		})
+	})
+	response := response.NewResponse(turn.db, e.aipi, e.tools, e.budgeter)
+	data, err := response.RunStream(e.withQueueStatus(ctx, stream, agent.AgentName, agent.AgentName), infoBank, partial.Write, func(invocation tools.Invocation) {
+		// The partial reply starts over with each round of tool calls
+		partial.Reset()
+		toolCalls = append(toolCalls, invocation)
+		e.streamAgentResponses(stream, AgentResponse{
+			AgentName: agent.AgentName,
+			Round:     run.round,
+			Order:     run.order,
+			ToolCalls: toolCalls,
+			IsPartial: true,
+			CreatedAt: run.started,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	run.result = data
+	run.elapsed = time.Since(run.started)
+	return nil
+}
+
+// generateParallel runs the agents at the same time, at most parallelWorkers
+// at once. They all see chatHistory, not each other's replies. It streams
+// the error of the first agent that fails and reports whether all succeeded.
+func (e *Endpoint) generateParallel(turn *agentTurn, runs []*agentRun, chatHistory []response.HistoryMessage) bool {
+	group, ctx := errgroup.WithContext(turn.ctx)
+	group.SetLimit(e.parallelWorkers)
+	for _, run := range runs {
+		e.streamStatus(turn.stream, Status{
+			Status:    fmt.Sprintf("%s is waiting to think", run.agent.AgentName),
+			AgentName: run.agent.AgentName,
+		})
+	}
+	for _, run := range runs {
+		group.Go(func() error {
+			if err := e.generate(ctx, turn, run, chatHistory); err != nil {
+				return fmt.Errorf("Agent %s response error: %w", run.agent.AgentName, err)
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		e.streamError(turn.stream, err.Error())
+		return false
+	}
+	return true
+}
+
+// deliver moderates and stores the agent's reply and streams it as final. It
+// returns nil for an agent that stayed silent, and false once it streamed an
+// error.
+func (e *Endpoint) deliver(turn *agentTurn, run *agentRun) (*models.BasicMessage, bool) {
+	stream := turn.stream
+	agent := run.agent
+	data := run.result
+
+	// Skip empty responses
+	if data.Content == "" {
+		slog.Info("Agent skipped response", "agent", agent.AgentName, "round", run.round)
+		return nil, true
+	}
+
+	err := e.moderator.Check(turn.ctx, moderation.Item{
+		IdUser:    turn.user.IdUser,
+		Direction: moderation.DIRECTION_OUTPUT,
+		ChatType:  moderation.CHAT_TYPE_BASIC,
+		ChatID:    turn.chat.IdBasicChat,
+		Author:    agent.AgentName,
+		Content:   data.Content,
+	})
+	if err != nil {
+		// Take back the partial reply and the agent's tool calls
+		e.streamAgentResponses(stream, AgentResponse{AgentName: agent.AgentName, Round: run.round, Order: run.order, Retracted: true, CreatedAt: run.started})
+		e.streamModerationError(stream, err)
+		return nil, false
+	}
+
+	newMessage := &models.BasicMessage{
+		SenderName: agent.AgentName,
+		ChatID:     turn.chat.IdBasicChat,
+		Content:    data.Content,
+		ModelName:  data.Model,
+	}
+	for _, invocation := range data.ToolCalls {
+		newMessage.ToolCalls = append(newMessage.ToolCalls, models.BasicToolCall{
+			ToolCallID: invocation.ToolCallID,
+			ToolName:   invocation.Name,
+			Arguments:  invocation.Arguments,
+			Result:     invocation.Result,
+			Error:      invocation.Error,
+		})
+	}
+
+	if err := turn.db.Create(newMessage).Error; err != nil {
+		e.streamError(stream, err.Error())
+		return nil, false
+	}
+
+	e.streamAgentResponses(stream, AgentResponse{
+		AgentName: agent.AgentName,
+		Round:     run.round,
+		Order:     run.order,
+		Content:   data.Content,
+		ToolCalls: data.ToolCalls,
+		CreatedAt: newMessage.CreatedAt,
+	})
+	metrics.AgentResponseSeconds.WithLabelValues(metrics.MODE_BASIC, data.Model).Observe(run.elapsed.Seconds())
+	slog.Info("Agent responded", "agent", agent.AgentName, "round", run.round, "seconds", run.elapsed.Seconds())
+	return newMessage, true
+}
+
+// exchanges groups the agents' replies to the user message by agent, for the
+// agents to remember what the user told them.
+func exchanges(turn *agentTurn, agentMessages []models.BasicMessage) []memory.Exchange {
+	var grouped []memory.Exchange
+	for _, message := range agentMessages {
+		index := slices.IndexFunc(grouped, func(exchange memory.Exchange) bool { return exchange.Agent.Name == message.SenderName })
+		if index < 0 {
+			grouped = append(grouped, memory.Exchange{
+				Agent:         memory.Agent{IdUser: turn.user.IdUser, IdChat: turn.chat.IdBasicChat, Name: message.SenderName},
+				UserName:      turn.user.Username,
+				UserMessageID: turn.userMessage.IdBasicMessage,
+				UserMessage:   turn.message,
+			})
+			index = len(grouped) - 1
 		}
+		grouped[index].Replies = append(grouped[index].Replies, message.Content)
+	}
+	return grouped
+}
+
+// lastSender returns who sent the latest message of the history.
+func lastSender(chatHistory []response.HistoryMessage) string {
+	if len(chatHistory) == 0 {
+		return ""
+	}
+	return chatHistory[len(chatHistory)-1].SenderName
+}
+
+// InterruptDiscussion stops the running discussion of the chat after the
+// current round. The stream of the discussion ends with STOP_INTERRUPTED.
+func (e *Endpoint) InterruptDiscussion(c *gin.Context) {
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	chatId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chatId"})
+		return
+	}
 
-		if err := tx.Commit().Error; err != nil {
-			tx.Rollback()
-			e.streamError(c, err.Error())
+	var chat models.BasicChat
+	if err := e.db.Where("external_id = ? AND user_id = ?", chatId, user.IdUser).First(&chat).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
 			return
 		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-		agentResponse := AgentResponse{
-			AgentName: agent.AgentName,
-			Content:   data.Content,
-			CreatedAt: newMessage.CreatedAt,
-		}
+	if !e.discussions.Interrupt(chat.IdBasicChat) {
+		c.JSON(http.StatusConflict, gin.H{"error": "No discussion is running in this chat"})
+		return
+	}
 
-		e.streamAgentResponses(c, agentResponse)
-		agentElapsedTime := time.Since(agentStartTime)
-		slog.Info("Agent %s responded in %vs", agent.AgentName, agentElapsedTime.Seconds())
+	c.JSON(http.StatusOK, gin.H{"message": "The discussion stops after the current round"})
+}
+
+// discussionOrder returns every agent of the chat, the speakers first.
+func discussionOrder(speakers []response.AgentInformation, agents []response.AgentInformation) []response.AgentInformation {
+	order := slices.Clone(speakers)
+	for _, agent := range agents {
+		if !slices.ContainsFunc(order, func(speaker response.AgentInformation) bool { return speaker.AgentName == agent.AgentName }) {
+			order = append(order, agent)
+		}
 	}
+	return order
+}
 
-	elapsedTime := time.Since(startTime)
-	slog.Info("Total time taken: %vs", elapsedTime.Seconds())
+// discussionReplies returns the agents' replies for a consensus check.
+func discussionReplies(messages []models.BasicMessage) []response.HistoryMessage {
+	replies := make([]response.HistoryMessage, len(messages))
+	for i, message := range messages {
+		replies[i] = response.HistoryMessage{
+			ID:         message.IdBasicMessage,
+			SenderName: message.SenderName,
+			Content:    message.Content,
+			SentAt:     message.CreatedAt,
+		}
+	}
+	return replies
 }
 
-func (e *Endpoint) getChatHistory(chatId uint, limit int) ([]response.HistoryMessage, error) {
+// getChatHistory returns the latest messages of the chat, oldest first.
+func (e *Endpoint) getChatHistory(ctx context.Context, chatId uint, limit int) ([]response.HistoryMessage, error) {
 	var messages []models.BasicMessage
-	if err := e.db.Where("id_basic_chat = ?", chatId).
+	if err := e.db.WithContext(ctx).Where("id_basic_chat = ?", chatId).
+		Preload("Attachments").
 		Order("created_at DESC").
 		Limit(limit).
 		Find(&messages).Error; err != nil {
@@ -320,23 +839,26 @@ func (e *Endpoint) getChatHistory(chatId uint, limit int) ([]response.HistoryMes
 	var chatHistory []response.HistoryMessage
 	for _, message := range messages {
 		historyMessage := response.HistoryMessage{
+			ID:         message.IdBasicMessage,
 			SenderName: message.SenderName,
-			Content:    message.Content,
+			Content:    attachments.Describe(message.Content, message.Attachments),
 			SentAt:     message.CreatedAt,
 		}
 		chatHistory = append(chatHistory, historyMessage)
 	}
+	slices.Reverse(chatHistory)
 
 	return chatHistory, nil
 }
 
-func (e *Endpoint) getRelevantContext(c context.Context, message string, chatId uint, limit int) ([]response.HistoryMessage, error) {
+func (e *Endpoint) getRelevantContext(c context.Context, message string, chatId uint, idUser uint, limit int) ([]response.HistoryMessage, error) {
 	limitUint64 := uint64(limit)
 	embeddingRequest := aipitypes.EmbeddingRequest{
 		Input:          message,
-		Model:          EMBEDDING_MODEL,
+		Model:          e.embedding.Model,
 		EncodingFormat: string(openai.EmbeddingEncodingFormatFloat),
-		Dimensions:     int(qdranttypes.VECTOR_SIZE_BASIC_MESSAGE),
+		Dimensions:     int(e.embedding.VectorSize),
+		IdUser:         idUser,
 	}
 	embedding, err := e.aipi.GetEmbedding(c, embeddingRequest)
 	if err != nil {
@@ -349,7 +871,7 @@ func (e *Endpoint) getRelevantContext(c context.Context, message string, chatId
 		Limit:          &limitUint64,
 		Filter: &qdrant.Filter{
 			Must: []*qdrant.Condition{
-				qdrant.NewMatch("chat_id", string(chatId)),
+				qdrant.NewMatch("chat_id", strconv.FormatUint(uint64(chatId), 10)),
 			},
 		},
 		WithPayload: qdrant.NewWithPayload(true),
@@ -360,20 +882,17 @@ func (e *Endpoint) getRelevantContext(c context.Context, message string, chatId
 
 	var relevantContext []response.HistoryMessage
 	for _, point := range searchResult {
-		payload := point.GetPayload()
-		content := payload["content"]
-		senderName := payload["sender_name"]
-		sentAt := payload["created_at"]
-
-		timeValue, err := time.Parse(time.RFC1123, sentAt.String())
+		payload, err := qdranttypes.ParseMessagePayload(point.GetPayload())
 		if err != nil {
-			return nil, err
+			// One broken point shouldn't cost the agent the rest of the context
+			slog.Warn("Skipping malformed message point", "id", point.GetId().GetNum(), "error", err)
+			continue
 		}
 
 		historyMessage := response.HistoryMessage{
-			SenderName: senderName.String(),
-			Content:    content.String(),
-			SentAt:     timeValue,
+			SenderName: payload.SenderName,
+			Content:    payload.Content,
+			SentAt:     payload.CreatedAt,
 		}
 		relevantContext = append(relevantContext, historyMessage)
 	}
@@ -381,50 +900,47 @@ func (e *Endpoint) getRelevantContext(c context.Context, message string, chatId
 	return relevantContext, nil
 }
 
-func shuffleArray[T any](array []T) []T {
-	shuffled := make([]T, len(array))
-	copy(shuffled, array)
-
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-	// Fisher-Yates shuffle algorithm
-	for i := len(shuffled) - 1; i > 0; i-- {
-		j := r.Intn(i + 1)
-		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+// saveToQdrant embeds the messages in one batch and upserts them.
+func (e *Endpoint) saveToQdrant(c context.Context, messages []models.BasicMessage, idUser uint) error {
+	if len(messages) == 0 {
+		return nil
 	}
 
-	return shuffled
-}
-
-func (e *Endpoint) saveToQdrant(c context.Context, message models.BasicMessage) error {
+	contents := make([]string, len(messages))
+	for i, message := range messages {
+		contents[i] = message.Content
+	}
 	embeddingRequest := aipitypes.EmbeddingRequest{
-		Input:          message.Content,
-		Model:          EMBEDDING_MODEL,
+		Input:          contents,
+		Model:          e.embedding.Model,
 		EncodingFormat: string(openai.EmbeddingEncodingFormatFloat),
-		Dimensions:     int(qdranttypes.VECTOR_SIZE_BASIC_MESSAGE),
+		Dimensions:     int(e.embedding.VectorSize),
+		IdUser:         idUser,
 	}
-	embedding, err := e.aipi.GetEmbedding(c, embeddingRequest)
+	embeddings, err := e.aipi.GetEmbeddings(c, embeddingRequest)
 	if err != nil {
 		return err
 	}
 
-	payload := map[string]any{
-		"chat_id":     message.ChatID,
-		"content":     message.Content,
-		"sender_name": message.SenderName,
-		"external_id": message.ExternalID.String(),
-		"created_at":  message.CreatedAt.String(),
+	points := make([]*qdrant.PointStruct, len(messages))
+	for i, message := range messages {
+		payload := qdranttypes.MessagePayload{
+			ChatID:     strconv.FormatUint(uint64(message.ChatID), 10),
+			Content:    message.Content,
+			SenderName: message.SenderName,
+			ExternalID: message.ExternalID.String(),
+			CreatedAt:  message.CreatedAt,
+		}
+		points[i] = &qdrant.PointStruct{
+			Id:      qdrant.NewIDNum(uint64(message.IdBasicMessage)),
+			Vectors: qdrant.NewVectors(embeddings[i]...),
+			Payload: payload.Values(),
+		}
 	}
 
 	_, err = e.qdrantDB.Upsert(c, &qdrant.UpsertPoints{
 		CollectionName: string(qdranttypes.COLLECTION_NAME_BASIC_MESSAGES),
-		Points: []*qdrant.PointStruct{
-			{
-				Id:      qdrant.NewIDNum(uint64(message.IdBasicMessage)),
-				Vectors: qdrant.NewVectors(embedding...),
-				Payload: qdrant.NewValueMap(payload),
-			},
-		},
+		Points:         points,
 	})
 	if err != nil {
 		return err
@@ -433,53 +949,124 @@ func (e *Endpoint) saveToQdrant(c context.Context, message models.BasicMessage)
 	return nil
 }
 
-func (e *Endpoint) streamAgentResponses(c *gin.Context, response AgentResponse) {
-	e.streamMx.Lock()
-	defer e.streamMx.Unlock()
+func (e *Endpoint) streamAgentResponses(stream *messageStream, response AgentResponse) {
+	stream.mx.Lock()
+	defer stream.mx.Unlock()
 
 	found := false
-	for i, existing := range e.streamOutput.AgentResponses {
-		if existing.AgentName == response.AgentName {
-			e.streamOutput.AgentResponses[i] = response
+	for i, existing := range stream.output.AgentResponses {
+		if existing.AgentName == response.AgentName && existing.Round == response.Round {
+			stream.output.AgentResponses[i] = response
 			found = true
 			break
 		}
 	}
 	if !found {
-		e.streamOutput.AgentResponses = append(e.streamOutput.AgentResponses, response)
+		stream.output.AgentResponses = append(stream.output.AgentResponses, response)
+		slices.SortStableFunc(stream.output.AgentResponses, func(a, b AgentResponse) int {
+			return cmp.Or(cmp.Compare(a.Round, b.Round), cmp.Compare(a.Order, b.Order))
+		})
 	}
 
-	e.updateStream(c, *e.streamOutput)
+	e.updateStream(stream.c, stream.output)
 }
 
-func (e *Endpoint) streamStatus(c *gin.Context, status Status) {
-	e.streamMx.Lock()
-	defer e.streamMx.Unlock()
+func (e *Endpoint) streamStatus(stream *messageStream, status Status) {
+	stream.mx.Lock()
+	defer stream.mx.Unlock()
 
 	found := false
-	for i, existing := range e.streamOutput.Status {
+	for i, existing := range stream.output.Status {
 		if existing.AgentName == status.AgentName {
-			e.streamOutput.Status[i] = status
+			stream.output.Status[i] = status
 			found = true
 			break
 		}
 	}
 	if !found {
-		e.streamOutput.Status = append(e.streamOutput.Status, status)
+		stream.output.Status = append(stream.output.Status, status)
 	}
 
-	e.updateStream(c, *e.streamOutput)
+	e.updateStream(stream.c, stream.output)
+}
+
+func (e *Endpoint) streamRound(stream *messageStream, round int) {
+	stream.mx.Lock()
+	defer stream.mx.Unlock()
+
+	stream.output.Round = round
+	e.updateStream(stream.c, stream.output)
+}
+
+func (e *Endpoint) streamStopReason(stream *messageStream, reason discussion.StopReason) {
+	stream.mx.Lock()
+	defer stream.mx.Unlock()
+
+	stream.output.StopReason = reason
+	e.updateStream(stream.c, stream.output)
+}
+
+// clearStatus removes the status reported as name once it is over.
+func (e *Endpoint) clearStatus(stream *messageStream, name string) {
+	stream.mx.Lock()
+	defer stream.mx.Unlock()
+
+	stream.output.Status = slices.DeleteFunc(stream.output.Status, func(status Status) bool {
+		return status.AgentName == name
+	})
+	e.updateStream(stream.c, stream.output)
+}
+
+// withQueueStatus returns ctx with an observer that reports, as the status of
+// name, the position of subject while its model calls wait for rate limit
+// capacity.
+func (e *Endpoint) withQueueStatus(ctx context.Context, stream *messageStream, name string, subject string) context.Context {
+	return aipi.WithQueueObserver(ctx, func(ahead int) {
+		e.streamStatus(stream, Status{
+			Status:    fmt.Sprintf("%s is waiting for capacity (%d ahead)", subject, ahead),
+			AgentName: name,
+		})
+	})
+}
+
+func (e *Endpoint) streamError(stream *messageStream, error string) {
+	stream.mx.Lock()
+	defer stream.mx.Unlock()
+
+	stream.output.Error = error
+	stream.output.TraceID = traceID(stream.c)
+	e.updateStream(stream.c, stream.output)
 }
 
-func (e *Endpoint) streamError(c *gin.Context, error string) {
-	e.streamMx.Lock()
-	defer e.streamMx.Unlock()
+func (e *Endpoint) streamErrorWithCode(stream *messageStream, code ErrorCode, error string) {
+	stream.mx.Lock()
+	defer stream.mx.Unlock()
 
-	if e.streamOutput == nil {
-		e.streamOutput = &SendBasicMessageResponse{}
+	stream.output.Error = error
+	stream.output.ErrorCode = code
+	stream.output.TraceID = traceID(stream.c)
+	e.updateStream(stream.c, stream.output)
+}
+
+// traceID identifies the request's trace so support can look up an error.
+func traceID(c *gin.Context) string {
+	spanContext := trace.SpanContextFromContext(c.Request.Context())
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
+
+// streamModerationError reports content moderation flagged with its own error
+// code. Other errors of the check are logged and reported generically.
+func (e *Endpoint) streamModerationError(stream *messageStream, err error) {
+	var flagged *moderation.FlaggedError
+	if errors.As(err, &flagged) {
+		e.streamErrorWithCode(stream, ErrorCodeModerationFlagged, flagged.Error())
+		return
 	}
-	e.streamOutput.Error = error
-	e.updateStream(c, *e.streamOutput)
+	slog.Error("Failed to moderate message", "error", err)
+	e.streamError(stream, "An error occurred")
 }
 
 func (e *Endpoint) updateStream(c *gin.Context, response SendBasicMessageResponse) {
@@ -495,10 +1082,13 @@ func (e *Endpoint) updateStream(c *gin.Context, response SendBasicMessageRespons
 
 	1. Get the chat history
 	2. Get the relevant context
-	3. For each agent:
-		1. Get the agent information
-		2. Get the Chat History
-		3. Send the message to the agent (response.Run())
-		4. Get the response from the agent
-		5. Stream the response
+	3. For each discussion round:
+		1. For each agent, one after another or in parallel:
+			1. Get the agent information
+			2. Get the Chat History
+			3. Send the message to the agent (response.Run())
+			4. Get the response from the agent
+			5. Stream the response
+		2. Stop when nobody replied, the rounds or token budget are used up,
+		   the user interrupted or the agents agree
 */
@@ -0,0 +1,204 @@
+package basicmessage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qdrant/go-client/qdrant"
+	"github.com/somtojf/trio-server/aipi/aipitest"
+	"github.com/somtojf/trio-server/aipi/budget"
+	"github.com/somtojf/trio-server/aipi/registry"
+	"github.com/somtojf/trio-server/attachments"
+	"github.com/somtojf/trio-server/models"
+	"github.com/somtojf/trio-server/moderation"
+	"github.com/somtojf/trio-server/quota"
+	"github.com/somtojf/trio-server/tools"
+	"github.com/somtojf/trio-server/types/qdranttypes"
+	"google.golang.org/grpc"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// fakeQdrant answers the client's calls without a server, recording the
+// points upserted. Queries find nothing.
+type fakeQdrant struct {
+	mx     sync.Mutex
+	points []*qdrant.PointStruct
+}
+
+func (f *fakeQdrant) intercept(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if upsert, ok := req.(*qdrant.UpsertPoints); ok {
+		f.mx.Lock()
+		f.points = append(f.points, upsert.Points...)
+		f.mx.Unlock()
+	}
+	return nil
+}
+
+func (f *fakeQdrant) upserted() []*qdrant.PointStruct {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.points
+}
+
+// testDB connects to the database in TEST_DATABASE_URL and migrates it. The
+// handler tests are skipped without one.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&models.User{}, &models.BasicChat{}, &models.BasicAgent{}, &models.BasicMessage{}, &models.BasicToolCall{}, &models.UserQuota{}, &models.Attachment{}, &models.ModerationEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSendBasicMessage(t *testing.T) {
+	db := testDB(t)
+
+	// The prompt templates are read relative to the repository root
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("../../.."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	// A moderated reply longer than a window is shown before it is complete
+	longReply := strings.Repeat("word ", moderation.STREAM_WINDOW/5+1) + "end"
+
+	tests := []struct {
+		name        string
+		steps       []aipitest.Step
+		classifier  moderation.Classifier
+		wantReply   string
+		wantPartial bool
+		wantError   string
+		wantStored  int
+		wantIndexed int
+	}{
+		{name: "agent replies", steps: []aipitest.Step{aipitest.Reply("Hello there")}, wantReply: "Hello there", wantPartial: true, wantStored: 2, wantIndexed: 1},
+		{name: "moderated reply streams", steps: []aipitest.Step{aipitest.Reply(longReply)}, classifier: moderation.NewKeywordClassifier(nil), wantReply: longReply, wantPartial: true, wantStored: 2, wantIndexed: 1},
+		{name: "agent stays silent", steps: []aipitest.Step{aipitest.Reply("")}, wantStored: 1},
+		{name: "model fails", steps: []aipitest.Step{aipitest.Fail(context.DeadlineExceeded)}, wantError: "Agent Sam response error", wantStored: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := models.User{Username: "test-" + t.Name()}
+			if err := db.Create(&user).Error; err != nil {
+				t.Fatal(err)
+			}
+			chat := models.BasicChat{ChatName: "test", UserID: user.IdUser, ChatAgents: []models.BasicAgent{{AgentName: "Sam", AgentTraits: []string{"friendly"}}}}
+			if err := db.Create(&chat).Error; err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				db.Unscoped().Where("id_basic_chat = ?", chat.IdBasicChat).Delete(&models.BasicMessage{})
+				db.Unscoped().Where("id_basic_chat = ?", chat.IdBasicChat).Delete(&models.BasicAgent{})
+				db.Unscoped().Delete(&chat)
+				db.Unscoped().Delete(&user)
+			})
+
+			fake := aipitest.NewFake(test.steps...)
+			store := &fakeQdrant{}
+			qdrantDB, err := qdrant.NewClient(&qdrant.Config{GrpcOptions: []grpc.DialOption{grpc.WithUnaryInterceptor(store.intercept)}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			modelRegistry, err := registry.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			embedding := qdranttypes.EmbeddingSettings{Model: "fake-embedding", VectorSize: 8}
+			endpoint := NewEndpoint(db, fake, qdrantDB, quota.NewChecker(db), tools.NewRegistry(db), embedding, budget.NewBudgeter(modelRegistry), attachments.NewService(db, nil), moderation.NewModerator(db, test.classifier), nil, nil)
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/basic-chats/:id/messages", func(c *gin.Context) { c.Set("currentUser", user) }, endpoint.SendBasicMessage)
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodPost, "/basic-chats/"+chat.ExternalID.String()+"/messages", strings.NewReader(`{"message": "Hi Sam"}`))
+			request.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(recorder, request)
+
+			body := recorder.Body.String()
+			if test.wantReply != "" && !strings.Contains(body, test.wantReply) {
+				t.Errorf("stream doesn't contain the reply %q:\n%s", test.wantReply, body)
+			}
+			if test.wantPartial && !strings.Contains(body, `"isPartial":true`) {
+				t.Errorf("stream has no partial reply:\n%s", body)
+			}
+			if test.wantError != "" && !strings.Contains(body, test.wantError) {
+				t.Errorf("stream doesn't contain the error %q:\n%s", test.wantError, body)
+			}
+			if !strings.Contains(body, "event:done") {
+				t.Errorf("stream didn't end:\n%s", body)
+			}
+			if requests := fake.Requests(); len(requests) != 1 || requests[0].Model != RESPONSE_MODEL {
+				t.Errorf("got model requests %+v, want one for %s", requests, RESPONSE_MODEL)
+			}
+
+			var stored int64
+			if err := db.Model(&models.BasicMessage{}).Where("id_basic_chat = ?", chat.IdBasicChat).Count(&stored).Error; err != nil {
+				t.Fatal(err)
+			}
+			if int(stored) != test.wantStored {
+				t.Errorf("stored %d messages, want %d", stored, test.wantStored)
+			}
+			if got := len(store.upserted()); got != test.wantIndexed {
+				t.Errorf("indexed %d replies, want %d", got, test.wantIndexed)
+			}
+		})
+	}
+}
+
+func TestConcurrentStreamsStaySeparate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	endpoint := &Endpoint{}
+
+	agents := []string{"Sam", "Kim"}
+	recorders := make([]*httptest.ResponseRecorder, len(agents))
+	var wg sync.WaitGroup
+	for i, agent := range agents {
+		recorders[i] = httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorders[i])
+		stream := &messageStream{c: c}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for order := range 50 {
+				endpoint.streamAgentResponses(stream, AgentResponse{AgentName: agent, Order: order, Content: agent + " speaking"})
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, agent := range agents {
+		body := recorders[i].Body.String()
+		if !strings.Contains(body, agent+" speaking") {
+			t.Errorf("stream of %s doesn't contain its replies", agent)
+		}
+		for _, other := range agents {
+			if other != agent && strings.Contains(body, other+" speaking") {
+				t.Errorf("stream of %s contains replies of %s", agent, other)
+			}
+		}
+	}
+}
@@ -3,82 +3,297 @@ package response
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/somtojf/trio-server/aipi"
 	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/aipi/budget"
+	"github.com/somtojf/trio-server/summary"
+	"github.com/somtojf/trio-server/tools"
 	"gorm.io/gorm"
 )
 
 type AgentInformation struct {
 	AgentName   string   `json:"agentName"`
 	AgentTraits []string `json:"agentTraits"`
+	Tools       []string `json:"tools"`
+	// Description is the longer background of agents created from a persona
+	Description string `json:"description"`
+	// Model and Sampling are what the agent answers with
+	Model    string             `json:"-"`
+	Sampling aipitypes.Sampling `json:"-"`
 }
 
 type HistoryMessage struct {
+	// ID is the message's database id, 0 for messages that aren't stored
+	ID         uint      `json:"-"`
 	SenderName string    `json:"senderName"`
 	Content    string    `json:"content"`
 	SentAt     time.Time `json:"sentAt"`
 }
 
 type InfoBank struct {
-	IdUser           uint               `json:"idUser"`
-	NewMessage       string             `json:"newMessage"`
-	AgentInformation AgentInformation   `json:"agentInformation"`
-	OtherAgents      []AgentInformation `json:"otherAgents"`
-	ChatHistory      []HistoryMessage   `json:"chatHistory"`
-	RelevantContext  []HistoryMessage   `json:"relevantContext"`
+	IdUser       uint   `json:"idUser"`
+	IdChat       uint   `json:"idChat"`
+	NewMessage   string `json:"newMessage"`
+	NewMessageID uint   `json:"-"`
+	// NewImages are the images sent with the new message
+	NewImages        []aipitypes.ImagePart `json:"-"`
+	AgentInformation AgentInformation      `json:"agentInformation"`
+	OtherAgents      []AgentInformation    `json:"otherAgents"`
+	ChatHistory      []HistoryMessage      `json:"chatHistory"`
+	RelevantContext  []HistoryMessage      `json:"relevantContext"`
+	// ChosenToSpeak is set when turn taking picked the agent for the message
+	ChosenToSpeak bool `json:"chosenToSpeak"`
+	// DiscussionRound is set from the second round of a discussion on, when
+	// the agent responds to the other agents instead of the user
+	DiscussionRound int `json:"discussionRound"`
+	// Memories are what the agent remembers about the user that relates to
+	// the new message
+	Memories []string `json:"memories"`
+	// ConversationSummary summarizes the chat before the messages of its
+	// history
+	ConversationSummary string `json:"conversationSummary"`
 }
 
 type RunResponse struct {
-	Content string `json:"content"`
+	Content   string             `json:"content"`
+	Model     string             `json:"model"`
+	ToolCalls []tools.Invocation `json:"toolCalls"`
+	// Usage adds up the model calls of all tool rounds
+	Usage aipitypes.AIPIUsage `json:"usage"`
 }
 
+// MAX_TOOL_ROUNDS limits how often an agent may call tools before answering.
+const MAX_TOOL_ROUNDS = 4
+
+// Shares of the prompt budget left next to the system prompt. The chat history
+// comes first and retrieved context is cut before it.
+const (
+	HISTORY_BUDGET_SHARE = 0.6
+	CONTEXT_BUDGET_SHARE = 0.4
+)
+
 type Response struct {
-	db   *gorm.DB
-	aipi *aipi.Provider
+	db       *gorm.DB
+	aipi     aipi.AIPIClient
+	tools    *tools.Registry
+	budgeter *budget.Budgeter
+}
+
+func NewResponse(db *gorm.DB, aipi aipi.AIPIClient, toolRegistry *tools.Registry, budgeter *budget.Budgeter) *Response {
+	return &Response{db: db, aipi: aipi, tools: toolRegistry, budgeter: budgeter}
+}
+
+func (r *Response) Run(ctx context.Context, infoBank InfoBank) (RunResponse, error) {
+	return r.runWithTools(ctx, infoBank, nil, func(request aipitypes.AIPIRequest) (aipitypes.AIPIResponse, error) {
+		return r.aipi.GetCompletion(ctx, request)
+	})
+}
+
+// RunStream behaves like Run but calls onDelta with each piece of text the
+// model produces, and onToolCall after each tool the agent called. When the
+// agent calls tools, the text after onToolCall belongs to the next round.
+func (r *Response) RunStream(ctx context.Context, infoBank InfoBank, onDelta func(content string), onToolCall func(invocation tools.Invocation)) (RunResponse, error) {
+	return r.runWithTools(ctx, infoBank, onToolCall, func(request aipitypes.AIPIRequest) (aipitypes.AIPIResponse, error) {
+		return r.stream(ctx, request, onDelta)
+	})
+}
+
+// runWithTools completes the request, running the tools the agent calls and
+// sending their results back until it answers with text.
+func (r *Response) runWithTools(ctx context.Context, infoBank InfoBank, onToolCall func(invocation tools.Invocation), complete func(request aipitypes.AIPIRequest) (aipitypes.AIPIResponse, error)) (RunResponse, error) {
+	toolset, err := r.tools.Resolve(infoBank.AgentInformation.Tools)
+	if err != nil {
+		return RunResponse{}, err
+	}
+	var definitions []aipitypes.ToolDefinition
+	if len(toolset) > 0 {
+		definitions = tools.Definitions(toolset)
+	}
+
+	promptBudget, err := r.budgeter.ForModel(infoBank.AgentInformation.Model, infoBank.AgentInformation.Sampling.MaxTokens)
+	if err != nil {
+		return RunResponse{}, err
+	}
+	infoBank, err = fitToBudget(infoBank, promptBudget, definitions)
+	if err != nil {
+		return RunResponse{}, err
+	}
+
+	request, err := buildRequest(infoBank)
+	if err != nil {
+		return RunResponse{}, err
+	}
+	request.Tools = definitions
+	env := tools.Env{IdUser: infoBank.IdUser, IdChat: infoBank.IdChat}
+
+	var invocations []tools.Invocation
+	var usage aipitypes.AIPIUsage
+	for round := 0; ; round++ {
+		response, err := complete(request)
+		if err != nil {
+			return RunResponse{}, err
+		}
+		usage.InputTokens += response.Usage.InputTokens
+		usage.OutputTokens += response.Usage.OutputTokens
+		if len(response.ToolCalls) == 0 {
+			return RunResponse{Content: response.Data, Model: response.Model, ToolCalls: invocations, Usage: usage}, nil
+		}
+		if round == MAX_TOOL_ROUNDS {
+			return RunResponse{}, fmt.Errorf("agent %s was still calling tools after %d rounds", infoBank.AgentInformation.AgentName, MAX_TOOL_ROUNDS)
+		}
+
+		request.Messages = append(request.Messages, aipitypes.AIPIMessage{
+			Role:      aipitypes.MESSAGE_ROLE_ASSISTANT,
+			Content:   response.Data,
+			ToolCalls: response.ToolCalls,
+		})
+		for _, call := range response.ToolCalls {
+			invocation := tools.Execute(ctx, toolset, env, call)
+			invocations = append(invocations, invocation)
+			request.Messages = append(request.Messages, invocation.Message())
+			if onToolCall != nil {
+				onToolCall(invocation)
+			}
+		}
+	}
 }
 
-func NewResponse(db *gorm.DB, aipi *aipi.Provider) *Response {
-	return &Response{db: db, aipi: aipi}
+func (r *Response) stream(ctx context.Context, request aipitypes.AIPIRequest, onDelta func(content string)) (aipitypes.AIPIResponse, error) {
+	chunks, err := r.aipi.GetCompletionAsync(ctx, request)
+	if err != nil {
+		return aipitypes.AIPIResponse{}, err
+	}
+
+	var content strings.Builder
+	var response aipitypes.AIPIResponse
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			return aipitypes.AIPIResponse{}, chunk.Err
+		}
+		if chunk.Model != "" {
+			response.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			response.Usage = *chunk.Usage
+		}
+		response.ToolCalls = append(response.ToolCalls, chunk.ToolCalls...)
+		if chunk.Delta == "" {
+			continue
+		}
+		content.WriteString(chunk.Delta)
+		onDelta(chunk.Delta)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return aipitypes.AIPIResponse{}, err
+	}
+
+	response.Data = content.String()
+	return response, nil
+}
+
+func buildRequest(infoBank InfoBank) (aipitypes.AIPIRequest, error) {
+	systemMessage, err := renderSystemPrompt(infoBank)
+	if err != nil {
+		return aipitypes.AIPIRequest{}, err
+	}
+
+	return aipitypes.AIPIRequest{
+		Model:         infoBank.AgentInformation.Model,
+		SystemMessage: systemMessage,
+		Messages:      buildConversation(infoBank),
+		IdUser:        infoBank.IdUser,
+		Sampling:      infoBank.AgentInformation.Sampling,
+	}, nil
 }
 
-func (r *Response) Run(ctx context.Context, infoBank InfoBank, model string) (RunResponse, error) {
-	systemTmpl, err := template.ParseFiles("controllers/basic-chat/basic-message/response/prompt/system/prompt.go.tmpl")
+func renderSystemPrompt(infoBank InfoBank) (string, error) {
+	systemTmpl, err := template.ParseFiles("controllers/basic-chat/basic-message/response/prompt/system/prompt.go.tmpl", summary.PROMPT_TEMPLATE)
 	if err != nil {
 		log.Printf("Error parsing system template: %v", err)
-		return RunResponse{}, fmt.Errorf("error parsing system template: %w", err)
+		return "", fmt.Errorf("error parsing system template: %w", err)
 	}
 	var systemBuf bytes.Buffer
 	if err := systemTmpl.Execute(&systemBuf, infoBank); err != nil {
 		log.Printf("Error executing system template: %v", err)
-		return RunResponse{}, fmt.Errorf("error executing system template: %w", err)
+		return "", fmt.Errorf("error executing system template: %w", err)
 	}
+	return systemBuf.String(), nil
+}
 
-	userTmpl, err := template.ParseFiles("controllers/basic-chat/basic-message/response/prompt/user/prompt.go.tmpl")
+// fitToBudget drops the oldest chat history and the least relevant context
+// that don't fit the prompt budget next to the system prompt and tools.
+func fitToBudget(infoBank InfoBank, promptBudget budget.Budget, definitions []aipitypes.ToolDefinition) (InfoBank, error) {
+	bare := infoBank
+	bare.ChatHistory = nil
+	bare.RelevantContext = nil
+	systemMessage, err := renderSystemPrompt(bare)
 	if err != nil {
-		log.Printf("Error parsing user template: %v", err)
-		return RunResponse{}, fmt.Errorf("error parsing user template: %w", err)
+		return InfoBank{}, err
 	}
-	var userBuf bytes.Buffer
-	if err := userTmpl.Execute(&userBuf, infoBank); err != nil {
-		log.Printf("Error executing user template: %v", err)
-		return RunResponse{}, fmt.Errorf("error executing user template: %w", err)
+	fixed := promptBudget.Count(systemMessage, infoBank.NewMessage) + len(infoBank.NewImages)*budget.IMAGE_TOKENS
+	if len(definitions) > 0 {
+		toolsJSON, err := json.Marshal(definitions)
+		if err != nil {
+			return InfoBank{}, fmt.Errorf("error marshalling tool definitions: %w", err)
+		}
+		fixed += promptBudget.Tokenizer.Count(string(toolsJSON))
 	}
 
-	request := &aipitypes.AIPIRequest{
-		Model:         model,
-		SystemMessage: systemBuf.String(),
-		UserMessage:   userBuf.String(),
-		IdUser:        infoBank.IdUser,
+	history := make([]string, len(infoBank.ChatHistory))
+	for i, message := range infoBank.ChatHistory {
+		history[i] = message.SenderName + ": " + message.Content
 	}
-	response, err := r.aipi.GetCompletion(ctx, *request)
-	if err != nil {
-		return RunResponse{}, err
+	relevantContext := make([]string, len(infoBank.RelevantContext))
+	for i, message := range infoBank.RelevantContext {
+		relevantContext[i] = fmt.Sprintf("%s (%s): %s", message.SenderName, message.SentAt, message.Content)
+	}
+
+	kept := promptBudget.FitChat(fixed, budget.ChatPrompt{
+		History:      history,
+		HistoryShare: HISTORY_BUDGET_SHARE,
+		Context:      relevantContext,
+		ContextShare: CONTEXT_BUDGET_SHARE,
+	})
+	infoBank.ChatHistory = budget.Latest(infoBank.ChatHistory, kept.History)
+	infoBank.RelevantContext = infoBank.RelevantContext[:kept.Context]
+	return infoBank, nil
+}
+
+// buildConversation turns the chat history into turns from the point of view
+// of the responding agent: its own messages are assistant turns, everyone
+// else's are named user turns. The images of the new message go with its turn.
+func buildConversation(infoBank InfoBank) []aipitypes.AIPIMessage {
+	var messages []aipitypes.AIPIMessage
+	imagesSent := false
+	for _, message := range infoBank.ChatHistory {
+		if message.SenderName == infoBank.AgentInformation.AgentName {
+			messages = append(messages, aipitypes.AIPIMessage{Role: aipitypes.MESSAGE_ROLE_ASSISTANT, Content: message.Content})
+			continue
+		}
+		turn := aipitypes.AIPIMessage{
+			Role:    aipitypes.MESSAGE_ROLE_USER,
+			Name:    message.SenderName,
+			Content: message.Content,
+		}
+		if message.ID != 0 && message.ID == infoBank.NewMessageID {
+			turn.Images = infoBank.NewImages
+			imagesSent = true
+		}
+		messages = append(messages, turn)
+	}
+
+	// The new message is normally the latest history entry already
+	if (len(infoBank.NewImages) > 0 && !imagesSent) || len(messages) == 0 || messages[len(messages)-1].Role != aipitypes.MESSAGE_ROLE_USER {
+		messages = append(messages, aipitypes.AIPIMessage{Role: aipitypes.MESSAGE_ROLE_USER, Content: infoBank.NewMessage, Images: infoBank.NewImages})
 	}
 
-	return RunResponse{Content: response.Data}, nil
+	return messages
 }
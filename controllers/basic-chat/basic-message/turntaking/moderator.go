@@ -0,0 +1,100 @@
+package turntaking
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/somtojf/trio-server/aipi"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/aipi/registry"
+	"github.com/somtojf/trio-server/controllers/basic-chat/basic-message/response"
+)
+
+// MODERATOR_HISTORY_LIMIT is how many of the latest messages the moderator sees
+const MODERATOR_HISTORY_LIMIT = 10
+
+const MODERATOR_SYSTEM_MESSAGE = `You moderate a group chat between a user and several AI agents. Decide which agents should answer the user's latest message and in what order. Pick the agents the message is addressed to, otherwise the ones whose traits make them most relevant. Pick fewer agents for simple messages; every agent only when the message invites everyone's view. Only use names from the list of agents.`
+
+type moderatorVerdict struct {
+	Speakers []string `json:"speakers" description:"Names of the agents that should answer, in speaking order. At least one"`
+}
+
+var moderatorSchema = aipitypes.MustResponseSchema("turn_moderator", moderatorVerdict{})
+
+// Moderator asks a model who should speak. When the model fails or names no
+// agent of the chat it falls back to the mention strategy.
+type Moderator struct {
+	aipi     aipi.AIPIClient
+	model    string
+	fallback Strategy
+}
+
+// NewModerator picks speakers with TURN_MODERATOR_MODEL, see registry.TaskModel.
+func NewModerator(client aipi.AIPIClient) *Moderator {
+	return &Moderator{aipi: client, model: registry.TaskModel("TURN_MODERATOR_MODEL"), fallback: Mention{}}
+}
+
+func (m *Moderator) Select(ctx context.Context, turn Turn) (Selection, error) {
+	if len(turn.Agents) <= 1 {
+		return Selection{Speakers: turn.Agents, Chosen: true}, nil
+	}
+
+	var verdict moderatorVerdict
+	_, err := aipi.GetStructuredCompletion(ctx, m.aipi, aipitypes.AIPIRequest{
+		SystemMessage:  MODERATOR_SYSTEM_MESSAGE,
+		UserMessage:    moderatorPrompt(turn),
+		Model:          m.model,
+		IdUser:         turn.IdUser,
+		ResponseSchema: moderatorSchema,
+	}, &verdict)
+	if err != nil {
+		if ctx.Err() != nil {
+			return Selection{}, ctx.Err()
+		}
+		slog.Warn("Turn moderator failed, falling back to mentions", "model", m.model, "error", err)
+		return m.fallback.Select(ctx, turn)
+	}
+
+	byName := make(map[string]response.AgentInformation, len(turn.Agents))
+	for _, agent := range turn.Agents {
+		byName[strings.ToLower(agent.AgentName)] = agent
+	}
+	var speakers []response.AgentInformation
+	for _, name := range verdict.Speakers {
+		key := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "@"))
+		if agent, ok := byName[key]; ok {
+			speakers = append(speakers, agent)
+			// An agent speaks once per turn
+			delete(byName, key)
+		}
+	}
+	if len(speakers) == 0 {
+		slog.Warn("Turn moderator picked no agent of the chat, falling back to mentions", "model", m.model, "speakers", verdict.Speakers)
+		return m.fallback.Select(ctx, turn)
+	}
+	return Selection{Speakers: speakers, Chosen: true}, nil
+}
+
+func moderatorPrompt(turn Turn) string {
+	var prompt strings.Builder
+	prompt.WriteString("Agents:\n")
+	for _, agent := range turn.Agents {
+		fmt.Fprintf(&prompt, "- %s: %s\n", agent.AgentName, strings.Join(agent.AgentTraits, ", "))
+	}
+
+	history := turn.History
+	if len(history) > MODERATOR_HISTORY_LIMIT {
+		history = history[len(history)-MODERATOR_HISTORY_LIMIT:]
+	}
+	if len(history) > 0 {
+		prompt.WriteString("\nRecent messages:\n")
+		for _, message := range history {
+			fmt.Fprintf(&prompt, "%s: %s\n", message.SenderName, message.Content)
+		}
+	}
+
+	fmt.Fprintf(&prompt, "\nLatest message from the user:\n%s\n", turn.Message)
+	return prompt.String()
+}
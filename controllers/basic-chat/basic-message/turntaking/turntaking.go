@@ -0,0 +1,167 @@
+// Package turntaking decides which agents of a basic chat answer a message
+// and in what order.
+package turntaking
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/somtojf/trio-server/aipi"
+	"github.com/somtojf/trio-server/controllers/basic-chat/basic-message/response"
+)
+
+type Name string
+
+const (
+	// STRATEGY_RANDOM lets every agent answer in random order. Agents stay
+	// silent themselves when the message is meant for someone else.
+	STRATEGY_RANDOM Name = "random"
+	// STRATEGY_ROUND_ROBIN lets one agent answer each message, in turn
+	STRATEGY_ROUND_ROBIN Name = "round_robin"
+	// STRATEGY_MENTION lets the @mentioned agents answer in the order they are
+	// mentioned, or every agent when nobody is mentioned
+	STRATEGY_MENTION Name = "mention"
+	// STRATEGY_MODERATOR asks a model who should answer
+	STRATEGY_MODERATOR Name = "moderator"
+)
+
+var Names = []Name{STRATEGY_RANDOM, STRATEGY_ROUND_ROBIN, STRATEGY_MENTION, STRATEGY_MODERATOR}
+
+// Turn is a user message waiting for answers.
+type Turn struct {
+	IdUser  uint
+	Message string
+	// Number counts the user messages of the chat before this one
+	Number int
+	// Agents are all agents of the chat, in the order they were added
+	Agents []response.AgentInformation
+	// History is the latest chat history, oldest first
+	History []response.HistoryMessage
+}
+
+// Selection is the agents that answer a turn, in speaking order.
+type Selection struct {
+	Speakers []response.AgentInformation
+	// Chosen is set when the speakers were picked for the message, so they
+	// answer it even when it mentions another agent
+	Chosen bool
+}
+
+type Strategy interface {
+	Select(ctx context.Context, turn Turn) (Selection, error)
+}
+
+// Valid reports whether name is a known strategy. The empty name is the
+// default, STRATEGY_RANDOM.
+func Valid(name string) bool {
+	if name == "" {
+		return true
+	}
+	for _, known := range Names {
+		if Name(name) == known {
+			return true
+		}
+	}
+	return false
+}
+
+// New returns the strategy called name. The moderator strategy asks its
+// model through client.
+func New(name string, client aipi.AIPIClient) (Strategy, error) {
+	switch Name(name) {
+	case "", STRATEGY_RANDOM:
+		return Random{}, nil
+	case STRATEGY_ROUND_ROBIN:
+		return RoundRobin{}, nil
+	case STRATEGY_MENTION:
+		return Mention{}, nil
+	case STRATEGY_MODERATOR:
+		return NewModerator(client), nil
+	default:
+		return nil, fmt.Errorf("unknown turn taking strategy %q", name)
+	}
+}
+
+type Random struct{}
+
+func (Random) Select(ctx context.Context, turn Turn) (Selection, error) {
+	speakers := make([]response.AgentInformation, len(turn.Agents))
+	copy(speakers, turn.Agents)
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	r.Shuffle(len(speakers), func(i, j int) {
+		speakers[i], speakers[j] = speakers[j], speakers[i]
+	})
+	return Selection{Speakers: speakers}, nil
+}
+
+type RoundRobin struct{}
+
+func (RoundRobin) Select(ctx context.Context, turn Turn) (Selection, error) {
+	if len(turn.Agents) == 0 {
+		return Selection{}, nil
+	}
+	next := turn.Agents[turn.Number%len(turn.Agents)]
+	return Selection{Speakers: []response.AgentInformation{next}, Chosen: true}, nil
+}
+
+type Mention struct{}
+
+func (Mention) Select(ctx context.Context, turn Turn) (Selection, error) {
+	speakers := Mentioned(turn.Message, turn.Agents)
+	if len(speakers) == 0 {
+		speakers = turn.Agents
+	}
+	return Selection{Speakers: speakers, Chosen: true}, nil
+}
+
+// Mentioned returns the agents @mentioned in message in the order they are
+// first mentioned. Names match case-insensitively and must not run on into
+// more letters, so @Sam doesn't mention Samantha. The @ must not follow a
+// letter either, so email@sam.com doesn't mention Sam.
+func Mentioned(message string, agents []response.AgentInformation) []response.AgentInformation {
+	lower := strings.ToLower(message)
+
+	type mention struct {
+		agent    response.AgentInformation
+		position int
+	}
+	var mentions []mention
+	for _, agent := range agents {
+		handle := "@" + strings.ToLower(agent.AgentName)
+		for offset := 0; ; {
+			index := strings.Index(lower[offset:], handle)
+			if index < 0 {
+				break
+			}
+			start := offset + index
+			end := start + len(handle)
+			previous, _ := utf8.DecodeLastRuneInString(lower[:start])
+			next, _ := utf8.DecodeRuneInString(lower[end:])
+			if (start == 0 || !isWordRune(previous)) && (end == len(lower) || !isWordRune(next)) {
+				mentions = append(mentions, mention{agent: agent, position: start})
+				break
+			}
+			offset = end
+		}
+	}
+
+	sort.SliceStable(mentions, func(i, j int) bool {
+		return mentions[i].position < mentions[j].position
+	})
+	mentioned := make([]response.AgentInformation, len(mentions))
+	for i, m := range mentions {
+		mentioned[i] = m.agent
+	}
+	return mentioned
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
@@ -2,34 +2,168 @@ package basicchat
 
 import (
 	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/qdrant/go-client/qdrant"
+	"github.com/somtojf/trio-server/aipi/registry"
+	"github.com/somtojf/trio-server/controllers/basic-chat/basic-message/turntaking"
+	"github.com/somtojf/trio-server/memory"
 	"github.com/somtojf/trio-server/models"
+	"github.com/somtojf/trio-server/summary"
+	"github.com/somtojf/trio-server/tools"
+	"github.com/somtojf/trio-server/types/chattypes"
 	"gorm.io/gorm"
 )
 
 type Endpoint struct {
-	db *gorm.DB
+	db        *gorm.DB
+	qdrantDB  *qdrant.Client
+	tools     *tools.Registry
+	registry  *registry.Registry
+	maxAgents int
+	maxRounds int
 }
 
+// Persona modes of an agent created from a persona
+const (
+	// PERSONA_MODE_COPY copies the persona, later changes to it don't reach the agent
+	PERSONA_MODE_COPY = "copy"
+	// PERSONA_MODE_LINK keeps the agent in sync with the persona
+	PERSONA_MODE_LINK = "link"
+)
+
+// CreateAgentRequest describes an agent, or picks a persona with PersonaID.
+// The other fields are ignored for agents created from a persona.
 type CreateAgentRequest struct {
-	AgentName   string   `json:"agentName" binding:"required,max=50"`
-	AgentTraits []string `json:"agentTraits" binding:"required"`
+	AgentName   string   `json:"agentName" binding:"required_without=PersonaID,max=50"`
+	AgentTraits []string `json:"agentTraits" binding:"required_without=PersonaID"`
+	Tools       []string `json:"tools"`
+	PersonaID   string   `json:"personaId"`
+	// PersonaMode is copy by default
+	PersonaMode string `json:"personaMode" binding:"omitempty,oneof=copy link"`
+	chattypes.ModelSettingsRequest
 }
 
 type CreateBasicChatRequest struct {
 	ChatName string               `json:"chatName" binding:"required,max=100"`
 	Agents   []CreateAgentRequest `json:"agents"`
+	// TurnTaking is one of the turntaking strategy names, random by default
+	TurnTaking string `json:"turnTaking"`
+	// DiscussionRounds is 1 by default, a single answer per agent
+	DiscussionRounds int `json:"discussionRounds"`
+	// GenerationMode is sequential by default
+	GenerationMode string `json:"generationMode" binding:"omitempty,oneof=sequential parallel"`
 }
 
 type UpdateBasicChatRequest struct {
 	ChatName string               `json:"chatName" binding:"required,max=100"`
 	Agents   []CreateAgentRequest `json:"agents"`
+	// TurnTaking, DiscussionRounds and GenerationMode are left unchanged
+	// when empty
+	TurnTaking       string `json:"turnTaking"`
+	DiscussionRounds int    `json:"discussionRounds"`
+	GenerationMode   string `json:"generationMode" binding:"omitempty,oneof=sequential parallel"`
+}
+
+func NewEndpoint(db *gorm.DB, qdrantDB *qdrant.Client, toolRegistry *tools.Registry, modelRegistry *registry.Registry) *Endpoint {
+	return &Endpoint{db: db, qdrantDB: qdrantDB, tools: toolRegistry, registry: modelRegistry, maxAgents: chattypes.LoadMaxAgentsPerChat(), maxRounds: chattypes.LoadMaxDiscussionRounds()}
+}
+
+// validRounds reports whether rounds is a discussion rounds setting the chat
+// may have. 0 means discussionRounds was left out, so the default or the
+// current setting is kept.
+func (e *Endpoint) validRounds(rounds int) bool {
+	return rounds >= 0 && rounds <= e.maxRounds
+}
+
+func (e *Endpoint) invalidRoundsError() string {
+	return fmt.Sprintf("discussionRounds must be between 1 and %d, or left out", e.maxRounds)
+}
+
+// deleteMemoryPoints deletes the embeddings of the memories of removed agents.
+// The memories are already gone from Postgres, so the request doesn't fail when
+// this does, the points are only never found again.
+func (e *Endpoint) deleteMemoryPoints(c *gin.Context, idChat uint, names ...string) {
+	if err := memory.DeleteAgentPoints(c.Request.Context(), e.qdrantDB, idChat, names...); err != nil {
+		slog.Warn("Failed to delete agent memories from qdrant", "chat", idChat, "error", err)
+	}
+}
+
+func unknownTurnTakingError() string {
+	names := make([]string, len(turntaking.Names))
+	for i, name := range turntaking.Names {
+		names[i] = string(name)
+	}
+	return fmt.Sprintf("turnTaking must be one of %s", strings.Join(names, ", "))
+}
+
+// buildAgents validates the tools and model settings of the requested agents
+// and returns them without a chat.
+func (e *Endpoint) buildAgents(agents []CreateAgentRequest, user models.User) ([]models.BasicAgent, error) {
+	built := make([]models.BasicAgent, 0, len(agents))
+	for _, agent := range agents {
+		if agent.PersonaID != "" {
+			fromPersona, err := e.agentFromPersona(agent, user)
+			if err != nil {
+				return nil, err
+			}
+			built = append(built, fromPersona)
+			continue
+		}
+
+		if _, err := e.tools.Resolve(agent.Tools); err != nil {
+			return nil, fmt.Errorf("agent %s: %w", agent.AgentName, err)
+		}
+		settings, err := agent.ModelSettingsRequest.Validate(e.registry, user.IsGuest, chattypes.ModelRequirements{Tools: len(agent.Tools) > 0})
+		if err != nil {
+			return nil, fmt.Errorf("agent %s: %w", agent.AgentName, err)
+		}
+
+		built = append(built, models.BasicAgent{
+			AgentName:   agent.AgentName,
+			AgentTraits: agent.AgentTraits,
+			Tools:       agent.Tools,
+			Settings:    settings,
+		})
+	}
+	return built, nil
 }
 
-func NewEndpoint(db *gorm.DB) *Endpoint {
-	return &Endpoint{db: db}
+// agentFromPersona builds the agent from one of the user's personas or a system
+// persona. The persona's model settings are checked again for the user.
+func (e *Endpoint) agentFromPersona(agent CreateAgentRequest, user models.User) (models.BasicAgent, error) {
+	personaId, err := uuid.Parse(agent.PersonaID)
+	if err != nil {
+		return models.BasicAgent{}, fmt.Errorf("invalid persona id %s", agent.PersonaID)
+	}
+
+	var persona models.Persona
+	if err := e.db.Where("external_id = ?", personaId).Where("user_id = ? OR is_system = ?", user.IdUser, true).First(&persona).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return models.BasicAgent{}, fmt.Errorf("persona %s not found", agent.PersonaID)
+		}
+		return models.BasicAgent{}, fmt.Errorf("error fetching persona %s: %w", agent.PersonaID, err)
+	}
+
+	if _, err := e.tools.Resolve(persona.Tools); err != nil {
+		return models.BasicAgent{}, fmt.Errorf("persona %s: %w", persona.Name, err)
+	}
+	settings, err := chattypes.SettingsRequest(persona.Settings).Validate(e.registry, user.IsGuest, chattypes.ModelRequirements{Tools: len(persona.Tools) > 0})
+	if err != nil {
+		return models.BasicAgent{}, fmt.Errorf("persona %s: %w", persona.Name, err)
+	}
+
+	built := persona.Agent()
+	built.Settings = settings
+	if agent.PersonaMode == PERSONA_MODE_LINK {
+		built.PersonaID = &persona.IdPersona
+	}
+	return built, nil
 }
 
 func (e *Endpoint) CreateBasicChat(c *gin.Context) {
@@ -46,14 +180,40 @@ func (e *Endpoint) CreateBasicChat(c *gin.Context) {
 		return
 	}
 
-	if len(body.Agents) > 2 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Maximum of 2 agents allowed per chat"})
+	if len(body.Agents) > e.maxAgents {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Maximum of %d agents allowed per chat", e.maxAgents)})
+		return
+	}
+	if !turntaking.Valid(body.TurnTaking) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": unknownTurnTakingError()})
+		return
+	}
+	if !e.validRounds(body.DiscussionRounds) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": e.invalidRoundsError()})
+		return
+	}
+
+	agents, err := e.buildAgents(body.Agents, user)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	chat := models.BasicChat{
-		ChatName: body.ChatName,
-		UserID:   user.IdUser,
+		ChatName:         body.ChatName,
+		UserID:           user.IdUser,
+		TurnTaking:       body.TurnTaking,
+		DiscussionRounds: body.DiscussionRounds,
+		GenerationMode:   body.GenerationMode,
+	}
+	if chat.TurnTaking == "" {
+		chat.TurnTaking = string(turntaking.STRATEGY_RANDOM)
+	}
+	if chat.DiscussionRounds == 0 {
+		chat.DiscussionRounds = 1
+	}
+	if chat.GenerationMode == "" {
+		chat.GenerationMode = models.GENERATION_MODE_SEQUENTIAL
 	}
 
 	tx := e.db.Begin()
@@ -68,13 +228,9 @@ func (e *Endpoint) CreateBasicChat(c *gin.Context) {
 		return
 	}
 
-	if len(body.Agents) > 0 {
-		for _, agentReq := range body.Agents {
-			agent := models.BasicAgent{
-				AgentName:   agentReq.AgentName,
-				AgentTraits: agentReq.AgentTraits,
-				ChatID:      chat.IdBasicChat,
-			}
+	if len(agents) > 0 {
+		for _, agent := range agents {
+			agent.ChatID = chat.IdBasicChat
 			if err := tx.Create(&agent).Error; err != nil {
 				tx.Rollback()
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create agent"})
@@ -121,7 +277,11 @@ func (e *Endpoint) UpdateBasicChat(c *gin.Context) {
 	}
 	user := currentUser.(models.User)
 
-	chatID := c.Param("id")
+	chatID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chatId"})
+		return
+	}
 
 	var body UpdateBasicChatRequest
 	if err := c.ShouldBindJSON(&body); err != nil {
@@ -129,13 +289,27 @@ func (e *Endpoint) UpdateBasicChat(c *gin.Context) {
 		return
 	}
 
-	if len(body.Agents) > 2 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Maximum of 2 agents allowed per chat"})
+	if len(body.Agents) > e.maxAgents {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Maximum of %d agents allowed per chat", e.maxAgents)})
+		return
+	}
+	if !turntaking.Valid(body.TurnTaking) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": unknownTurnTakingError()})
+		return
+	}
+	if !e.validRounds(body.DiscussionRounds) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": e.invalidRoundsError()})
+		return
+	}
+
+	agents, err := e.buildAgents(body.Agents, user)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	var existingChat models.BasicChat
-	if err := e.db.Where("id_basic_chat = ? AND user_id = ?", chatID, user.IdUser).First(&existingChat).Error; err != nil {
+	if err := e.db.Where("external_id = ? AND user_id = ?", chatID, user.IdUser).First(&existingChat).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found or unauthorized"})
 			return
@@ -144,6 +318,21 @@ func (e *Endpoint) UpdateBasicChat(c *gin.Context) {
 		return
 	}
 
+	// Memories belong to an agent's name, so the agents that keep their name
+	// keep their memories when they are recreated
+	var existingAgents []models.BasicAgent
+	if err := e.db.Where("id_basic_chat = ?", existingChat.IdBasicChat).Find(&existingAgents).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch agents"})
+		return
+	}
+	var removedNames []string
+	for _, existingAgent := range existingAgents {
+		kept := slices.ContainsFunc(agents, func(agent models.BasicAgent) bool { return agent.AgentName == existingAgent.AgentName })
+		if !kept {
+			removedNames = append(removedNames, existingAgent.AgentName)
+		}
+	}
+
 	tx := e.db.Begin()
 	if tx.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
@@ -151,24 +340,31 @@ func (e *Endpoint) UpdateBasicChat(c *gin.Context) {
 	}
 
 	existingChat.ChatName = body.ChatName
+	if body.TurnTaking != "" {
+		existingChat.TurnTaking = body.TurnTaking
+	}
+	if body.DiscussionRounds != 0 {
+		existingChat.DiscussionRounds = body.DiscussionRounds
+	}
+	if body.GenerationMode != "" {
+		existingChat.GenerationMode = body.GenerationMode
+	}
 	if err := tx.Save(&existingChat).Error; err != nil {
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat"})
 		return
 	}
 
-	if err := tx.Where("chat_id = ?", chatID).Delete(&models.BasicAgent{}).Error; err != nil {
+	// The agents are recreated under the same names, which soft deleted rows
+	// would still hold in idx_agent_name_chat
+	if err := tx.Unscoped().Where("id_basic_chat = ?", existingChat.IdBasicChat).Delete(&models.BasicAgent{}).Error; err != nil {
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update agents"})
 		return
 	}
 
-	for _, agentReq := range body.Agents {
-		agent := models.BasicAgent{
-			AgentName:   agentReq.AgentName,
-			AgentTraits: agentReq.AgentTraits,
-			ChatID:      existingChat.IdBasicChat,
-		}
+	for _, agent := range agents {
+		agent.ChatID = existingChat.IdBasicChat
 		if err := tx.Create(&agent).Error; err != nil {
 			tx.Rollback()
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create agent"})
@@ -176,14 +372,26 @@ func (e *Endpoint) UpdateBasicChat(c *gin.Context) {
 		}
 	}
 
+	if len(removedNames) > 0 {
+		if err := memory.DeleteAgents(tx, existingChat.IdBasicChat, removedNames...); err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete agent memories"})
+			return
+		}
+	}
+
 	if err := tx.Commit().Error; err != nil {
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
 		return
 	}
 
+	if len(removedNames) > 0 {
+		e.deleteMemoryPoints(c, existingChat.IdBasicChat, removedNames...)
+	}
+
 	var updatedChat models.BasicChat
-	if err := e.db.Preload("Agents").First(&updatedChat, chatID).Error; err != nil {
+	if err := e.db.Preload("ChatAgents").First(&updatedChat, existingChat.IdBasicChat).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch updated chat"})
 		return
 	}
@@ -199,10 +407,14 @@ func (e *Endpoint) DeleteBasicChat(c *gin.Context) {
 	}
 	user := currentUser.(models.User)
 
-	chatID := c.Param("id")
+	chatID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chatId"})
+		return
+	}
 
 	var chat models.BasicChat
-	if err := e.db.Where("id_basic_chat = ? AND user_id = ?", chatID, user.IdUser).First(&chat).Error; err != nil {
+	if err := e.db.Where("external_id = ? AND user_id = ?", chatID, user.IdUser).First(&chat).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found or unauthorized"})
 			return
@@ -218,7 +430,7 @@ func (e *Endpoint) DeleteBasicChat(c *gin.Context) {
 	}
 
 	// Delete associated agents first (due to foreign key constraint)
-	if err := tx.Where("chat_id = ?", chatID).Delete(&models.BasicAgent{}).Error; err != nil {
+	if err := tx.Where("id_basic_chat = ?", chat.IdBasicChat).Delete(&models.BasicAgent{}).Error; err != nil {
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete associated agents"})
 		return
@@ -230,12 +442,26 @@ func (e *Endpoint) DeleteBasicChat(c *gin.Context) {
 		return
 	}
 
+	if err := summary.DeleteChat(tx, summary.CHAT_TYPE_BASIC, chat.IdBasicChat); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete chat summary"})
+		return
+	}
+
+	if err := memory.DeleteAgents(tx, chat.IdBasicChat); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete agent memories"})
+		return
+	}
+
 	if err := tx.Commit().Error; err != nil {
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
 		return
 	}
 
+	e.deleteMemoryPoints(c, chat.IdBasicChat)
+
 	c.JSON(http.StatusNoContent, gin.H{"message": "Chat deleted successfully"})
 }
 
@@ -0,0 +1,175 @@
+package basicchat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qdrant/go-client/qdrant"
+	"github.com/somtojf/trio-server/aipi/registry"
+	"github.com/somtojf/trio-server/memory"
+	"github.com/somtojf/trio-server/models"
+	"github.com/somtojf/trio-server/summary"
+	"github.com/somtojf/trio-server/tools"
+	"google.golang.org/grpc"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// testDB connects to the database in TEST_DATABASE_URL and migrates it. The
+// handler tests are skipped without one.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&models.User{}, &models.BasicChat{}, &models.BasicAgent{}, &models.AgentMemory{}, &models.ChatSummary{}, &models.ChatSummarySection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testChat creates a user with a chat of one agent, Sam, and serves the
+// endpoint as that user. Qdrant calls succeed without a server.
+func testChat(t *testing.T, db *gorm.DB) (models.BasicChat, *gin.Engine) {
+	t.Helper()
+	user := models.User{Username: "test-" + t.Name()}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	chat := models.BasicChat{ChatName: "test", UserID: user.IdUser, ChatAgents: []models.BasicAgent{{AgentName: "Sam", AgentTraits: []string{"friendly"}}}}
+	if err := db.Create(&chat).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Unscoped().Where("id_basic_chat = ?", chat.IdBasicChat).Delete(&models.AgentMemory{})
+		db.Unscoped().Where("id_basic_chat = ?", chat.IdBasicChat).Delete(&models.BasicAgent{})
+		db.Unscoped().Delete(&chat)
+		db.Unscoped().Delete(&user)
+	})
+
+	qdrantDB, err := qdrant.NewClient(&qdrant.Config{GrpcOptions: []grpc.DialOption{grpc.WithUnaryInterceptor(
+		func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return nil
+		},
+	)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	modelRegistry, err := registry.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := NewEndpoint(db, qdrantDB, tools.NewRegistry(db), modelRegistry)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("currentUser", user) })
+	router.PUT("/basic-chats/:id", endpoint.UpdateBasicChat)
+	router.DELETE("/basic-chats/:id", endpoint.DeleteBasicChat)
+	return chat, router
+}
+
+func TestUpdateBasicChat(t *testing.T) {
+	db := testDB(t)
+	chat, router := testChat(t, db)
+
+	modelRegistry, err := registry.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := modelRegistry.Selectable(false)[0].ID
+	body := fmt.Sprintf(`{"chatName": "renamed", "agents": [{"agentName": "Sam", "agentTraits": ["curious"], "model": %q, "temperature": 0.2}]}`, model)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPut, "/basic-chats/"+chat.ExternalID.String(), strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	var response struct {
+		Data models.BasicChat `json:"data"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Data.ChatName != "renamed" {
+		t.Errorf("got chat name %q, want renamed", response.Data.ChatName)
+	}
+
+	var agents []models.BasicAgent
+	if err := db.Where("id_basic_chat = ?", chat.IdBasicChat).Find(&agents).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 1 {
+		t.Fatalf("got %d agents, want 1", len(agents))
+	}
+	settings := agents[0].Settings
+	if settings.ModelName != model || settings.Temperature == nil || *settings.Temperature != 0.2 {
+		t.Errorf("got settings %+v, want %s at temperature 0.2", settings, model)
+	}
+	if len(response.Data.ChatAgents) != 1 || response.Data.ChatAgents[0].Settings.ModelName != model {
+		t.Errorf("response has agents %+v, want Sam on %s", response.Data.ChatAgents, model)
+	}
+}
+
+func TestDeleteBasicChat(t *testing.T) {
+	db := testDB(t)
+	chat, router := testChat(t, db)
+
+	remembered := models.AgentMemory{UserID: chat.UserID, ChatID: chat.IdBasicChat, AgentName: "Sam", Kind: string(memory.KIND_FACT), Content: "Likes tea"}
+	if err := db.Create(&remembered).Error; err != nil {
+		t.Fatal(err)
+	}
+	chatSummary := models.ChatSummary{ChatType: string(summary.CHAT_TYPE_BASIC), ChatID: chat.IdBasicChat, UserID: chat.UserID, Sections: []models.ChatSummarySection{{Level: 1, Content: "They talked about tea"}}}
+	if err := db.Create(&chatSummary).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Unscoped().Where("id_chat_summary = ?", chatSummary.IdChatSummary).Delete(&models.ChatSummarySection{})
+		db.Unscoped().Delete(&chatSummary)
+	})
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodDelete, "/basic-chats/"+chat.ExternalID.String(), nil)
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusNoContent, recorder.Body.String())
+	}
+	if err := db.First(&models.BasicChat{}, chat.IdBasicChat).Error; err != gorm.ErrRecordNotFound {
+		t.Errorf("chat is still there: %v", err)
+	}
+	var memories int64
+	if err := db.Model(&models.AgentMemory{}).Where("id_basic_chat = ?", chat.IdBasicChat).Count(&memories).Error; err != nil {
+		t.Fatal(err)
+	}
+	if memories != 0 {
+		t.Errorf("%d agent memories are left, want none", memories)
+	}
+	var summaries, sections int64
+	if err := db.Model(&models.ChatSummary{}).Where("id_chat_summary = ?", chatSummary.IdChatSummary).Count(&summaries).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&models.ChatSummarySection{}).Where("id_chat_summary = ?", chatSummary.IdChatSummary).Count(&sections).Error; err != nil {
+		t.Fatal(err)
+	}
+	if summaries != 0 || sections != 0 {
+		t.Errorf("%d summaries and %d sections are left, want none", summaries, sections)
+	}
+}
@@ -0,0 +1,85 @@
+package chatsummaries
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/somtojf/trio-server/models"
+	"github.com/somtojf/trio-server/summary"
+	"gorm.io/gorm"
+)
+
+type Endpoint struct {
+	db         *gorm.DB
+	summarizer *summary.Summarizer
+}
+
+func NewEndpoint(db *gorm.DB, summarizer *summary.Summarizer) *Endpoint {
+	return &Endpoint{db: db, summarizer: summarizer}
+}
+
+// SummaryResponse is the summary agents are prompted with and the sections it
+// is made of, oldest first.
+type SummaryResponse struct {
+	Summary string `json:"summary"`
+	// MessageCount is how many messages are summarized
+	MessageCount int                         `json:"messageCount"`
+	Sections     []models.ChatSummarySection `json:"sections"`
+}
+
+// GetBasicChatSummary godoc
+//
+//	@Summary		Get a chat's summary
+//	@Description	Returns the rolling summary of the earlier messages of a basic chat. Chats too short to summarize have an empty summary
+//	@Tags			summaries
+//	@Produce		json
+//	@Param			id	path		string					true	"Chat ID"
+//	@Success		200	{object}	SummaryResponse			"Summary"
+//	@Failure		404	{object}	map[string]interface{}	"Chat not found"
+//	@Router			/basic-chats/{id}/summary [get]
+func (e *Endpoint) GetBasicChatSummary(c *gin.Context) {
+	if e.summarizer == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation summaries are turned off"})
+		return
+	}
+
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	chatId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chatId"})
+		return
+	}
+
+	var chat models.BasicChat
+	if err := e.db.Where("external_id = ? AND user_id = ?", chatId, user.IdUser).First(&chat).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat"})
+		return
+	}
+
+	chatSummary, err := e.summarizer.Get(c.Request.Context(), summary.CHAT_TYPE_BASIC, chat.IdBasicChat)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch summary"})
+		return
+	}
+
+	sections := chatSummary.Sections
+	if sections == nil {
+		sections = []models.ChatSummarySection{}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": SummaryResponse{
+		Summary:      chatSummary.Content(),
+		MessageCount: chatSummary.MessageCount,
+		Sections:     sections,
+	}})
+}
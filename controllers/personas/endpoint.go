@@ -0,0 +1,366 @@
+package personas
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/somtojf/trio-server/aipi/registry"
+	"github.com/somtojf/trio-server/models"
+	"github.com/somtojf/trio-server/tools"
+	"github.com/somtojf/trio-server/types/chattypes"
+	"gorm.io/gorm"
+)
+
+// linkedAgentColumns are the agent columns that follow a linked persona
+var linkedAgentColumns = []string{"agent_name", "agent_traits", "tools", "model_name", "temperature", "top_p", "max_tokens", "seed", "avatar_url", "description"}
+
+type Endpoint struct {
+	db       *gorm.DB
+	tools    *tools.Registry
+	registry *registry.Registry
+}
+
+func NewEndpoint(db *gorm.DB, toolRegistry *tools.Registry, modelRegistry *registry.Registry) *Endpoint {
+	return &Endpoint{db: db, tools: toolRegistry, registry: modelRegistry}
+}
+
+type PersonaRequest struct {
+	Name      string   `json:"name" binding:"required,max=50"`
+	Traits    []string `json:"traits" binding:"required"`
+	Tools     []string `json:"tools"`
+	AvatarURL string   `json:"avatarUrl" binding:"omitempty,url,max=500"`
+	// Description is a longer background the agent is prompted with
+	Description string `json:"description" binding:"max=2000"`
+	chattypes.ModelSettingsRequest
+}
+
+// GetPersonas godoc
+//
+//	@Summary		List personas
+//	@Description	Lists the user's personas followed by the system personas
+//	@Tags			personas
+//	@Produce		json
+//	@Success		200	{object}	[]models.Persona		"Personas"
+//	@Failure		401	{object}	map[string]interface{}	"Unauthorized"
+//	@Failure		500	{object}	map[string]interface{}	"Internal server error"
+//	@Router			/personas [get]
+func (e *Endpoint) GetPersonas(c *gin.Context) {
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	var personas []models.Persona
+	if err := e.db.Where("user_id = ? OR is_system = ?", user.IdUser, true).Order("is_system, name").Find(&personas).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch personas"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": personas})
+}
+
+// GetPersona godoc
+//
+//	@Summary		Get a persona
+//	@Description	Returns one of the user's personas or a system persona
+//	@Tags			personas
+//	@Produce		json
+//	@Param			id	path		string					true	"Persona ID"
+//	@Success		200	{object}	models.Persona			"Persona"
+//	@Failure		404	{object}	map[string]interface{}	"Persona not found"
+//	@Router			/personas/{id} [get]
+func (e *Endpoint) GetPersona(c *gin.Context) {
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	persona, ok := e.findPersona(c, "user_id = ? OR is_system = ?", user.IdUser, true)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": persona})
+}
+
+// CreatePersona godoc
+//
+//	@Summary		Create a persona
+//	@Description	Saves a persona to the user's library
+//	@Tags			personas
+//	@Accept			json
+//	@Produce		json
+//	@Param			persona	body		PersonaRequest			true	"Persona"
+//	@Success		201		{object}	models.Persona			"Persona"
+//	@Failure		400		{object}	map[string]interface{}	"Bad request"
+//	@Router			/personas [post]
+func (e *Endpoint) CreatePersona(c *gin.Context) {
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	e.createPersona(c, models.Persona{UserID: &user.IdUser}, user.IsGuest)
+}
+
+// UpdatePersona godoc
+//
+//	@Summary		Update a persona
+//	@Description	Replaces one of the user's personas. Agents linked to it follow the change, or are unlinked when their owner may not use its settings
+//	@Tags			personas
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string					true	"Persona ID"
+//	@Param			persona	body		PersonaRequest			true	"Persona"
+//	@Success		200		{object}	models.Persona			"Persona"
+//	@Failure		400		{object}	map[string]interface{}	"Bad request"
+//	@Failure		404		{object}	map[string]interface{}	"Persona not found"
+//	@Router			/personas/{id} [put]
+func (e *Endpoint) UpdatePersona(c *gin.Context) {
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	persona, ok := e.findPersona(c, "user_id = ?", user.IdUser)
+	if !ok {
+		return
+	}
+	e.updatePersona(c, persona, user.IsGuest)
+}
+
+// DeletePersona godoc
+//
+//	@Summary		Delete a persona
+//	@Description	Deletes one of the user's personas. Linked agents keep its last version
+//	@Tags			personas
+//	@Param			id	path		string					true	"Persona ID"
+//	@Success		204	{object}	map[string]interface{}	"Persona deleted"
+//	@Failure		404	{object}	map[string]interface{}	"Persona not found"
+//	@Router			/personas/{id} [delete]
+func (e *Endpoint) DeletePersona(c *gin.Context) {
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	persona, ok := e.findPersona(c, "user_id = ?", user.IdUser)
+	if !ok {
+		return
+	}
+	e.deletePersona(c, persona)
+}
+
+// CreateSystemPersona godoc
+//
+//	@Summary		Create a system persona
+//	@Description	Adds a curated persona every user can pick
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			persona	body		PersonaRequest			true	"Persona"
+//	@Success		201		{object}	models.Persona			"Persona"
+//	@Failure		400		{object}	map[string]interface{}	"Bad request"
+//	@Router			/admin/personas [post]
+func (e *Endpoint) CreateSystemPersona(c *gin.Context) {
+	e.createPersona(c, models.Persona{IsSystem: true}, false)
+}
+
+// UpdateSystemPersona godoc
+//
+//	@Summary		Update a system persona
+//	@Description	Replaces a curated persona. Agents linked to it follow the change, or are unlinked when their owner may not use its settings
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string					true	"Persona ID"
+//	@Param			persona	body		PersonaRequest			true	"Persona"
+//	@Success		200		{object}	models.Persona			"Persona"
+//	@Failure		400		{object}	map[string]interface{}	"Bad request"
+//	@Failure		404		{object}	map[string]interface{}	"Persona not found"
+//	@Router			/admin/personas/{id} [put]
+func (e *Endpoint) UpdateSystemPersona(c *gin.Context) {
+	persona, ok := e.findPersona(c, "is_system = ?", true)
+	if !ok {
+		return
+	}
+	e.updatePersona(c, persona, false)
+}
+
+// DeleteSystemPersona godoc
+//
+//	@Summary		Delete a system persona
+//	@Description	Deletes a curated persona. Linked agents keep its last version
+//	@Tags			admin
+//	@Param			id	path		string					true	"Persona ID"
+//	@Success		204	{object}	map[string]interface{}	"Persona deleted"
+//	@Failure		404	{object}	map[string]interface{}	"Persona not found"
+//	@Router			/admin/personas/{id} [delete]
+func (e *Endpoint) DeleteSystemPersona(c *gin.Context) {
+	persona, ok := e.findPersona(c, "is_system = ?", true)
+	if !ok {
+		return
+	}
+	e.deletePersona(c, persona)
+}
+
+// findPersona looks up the persona of the id parameter among the personas
+// matching the condition.
+func (e *Endpoint) findPersona(c *gin.Context, condition string, args ...any) (models.Persona, bool) {
+	personaId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid persona ID"})
+		return models.Persona{}, false
+	}
+
+	var persona models.Persona
+	if err := e.db.Where("external_id = ?", personaId).Where(condition, args...).First(&persona).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Persona not found"})
+			return models.Persona{}, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch persona"})
+		return models.Persona{}, false
+	}
+
+	return persona, true
+}
+
+// apply validates the request and sets it on the persona.
+func (e *Endpoint) apply(persona *models.Persona, body PersonaRequest, isGuest bool) error {
+	if _, err := e.tools.Resolve(body.Tools); err != nil {
+		return err
+	}
+	settings, err := body.ModelSettingsRequest.Validate(e.registry, isGuest, chattypes.ModelRequirements{Tools: len(body.Tools) > 0})
+	if err != nil {
+		return err
+	}
+
+	persona.Name = body.Name
+	persona.Traits = body.Traits
+	persona.Tools = body.Tools
+	persona.Settings = settings
+	persona.AvatarURL = body.AvatarURL
+	persona.Description = body.Description
+	return nil
+}
+
+func (e *Endpoint) createPersona(c *gin.Context, persona models.Persona, isGuest bool) {
+	var body PersonaRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := e.apply(&persona, body, isGuest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := e.db.Create(&persona).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create persona"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"data": persona})
+}
+
+// updatePersona saves the persona and copies it to the agents linked to it.
+func (e *Endpoint) updatePersona(c *gin.Context, persona models.Persona, isGuest bool) {
+	var body PersonaRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := e.apply(&persona, body, isGuest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&persona).Error; err != nil {
+			return errors.New("Failed to update persona")
+		}
+		return e.syncLinkedAgents(tx, persona)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": persona})
+}
+
+// syncLinkedAgents copies the persona to the agents linked to it. Linked
+// agents belong to other users too, so the settings are checked again for each
+// agent's owner. Agents whose owner may not use them are unlinked and keep the
+// last version of the persona.
+func (e *Endpoint) syncLinkedAgents(tx *gorm.DB, persona models.Persona) error {
+	var linked []struct {
+		IdBasicAgent uint
+		IsGuest      bool
+	}
+	err := tx.Model(&models.BasicAgent{}).
+		Select("basic_agents.id_basic_agent, users.is_guest").
+		Joins("JOIN basic_chats ON basic_chats.id_basic_chat = basic_agents.id_basic_chat").
+		Joins("JOIN users ON users.id_user = basic_chats.user_id").
+		Where("basic_agents.id_persona = ?", persona.IdPersona).
+		Scan(&linked).Error
+	if err != nil {
+		return errors.New("Failed to fetch the agents linked to the persona")
+	}
+
+	agentIds := make(map[bool][]uint)
+	for _, agent := range linked {
+		agentIds[agent.IsGuest] = append(agentIds[agent.IsGuest], agent.IdBasicAgent)
+	}
+	for isGuest, ids := range agentIds {
+		settings, err := chattypes.SettingsRequest(persona.Settings).Validate(e.registry, isGuest, chattypes.ModelRequirements{Tools: len(persona.Tools) > 0})
+		if err != nil {
+			if err := tx.Model(&models.BasicAgent{}).Where("id_basic_agent IN ?", ids).Update("id_persona", nil).Error; err != nil {
+				return errors.New("Failed to unlink agents")
+			}
+			continue
+		}
+
+		agent := persona.Agent()
+		agent.Settings = settings
+		// Linked agents are copies kept in sync, so chats don't join personas
+		if err := tx.Model(&models.BasicAgent{}).Where("id_basic_agent IN ?", ids).
+			Select(linkedAgentColumns).Updates(agent).Error; err != nil {
+			return fmt.Errorf("Failed to update the agents linked to the persona, a chat may already have an agent called %s", persona.Name)
+		}
+	}
+	return nil
+}
+
+// deletePersona deletes the persona and unlinks its agents.
+func (e *Endpoint) deletePersona(c *gin.Context, persona models.Persona) {
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.BasicAgent{}).Where("id_persona = ?", persona.IdPersona).Update("id_persona", nil).Error; err != nil {
+			return errors.New("Failed to unlink agents")
+		}
+		if err := tx.Delete(&persona).Error; err != nil {
+			return errors.New("Failed to delete persona")
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{"message": "Persona deleted successfully"})
+}
@@ -1,25 +1,53 @@
 package reflectionchat
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/somtojf/trio-server/aipi/registry"
 	"github.com/somtojf/trio-server/models"
+	"github.com/somtojf/trio-server/summary"
+	"github.com/somtojf/trio-server/types/chattypes"
 	"gorm.io/gorm"
 )
 
 type Endpoint struct {
-	db *gorm.DB
+	db       *gorm.DB
+	registry *registry.Registry
 }
 
 type CreateReflectionChatRequest struct {
-	ChatName string `json:"chatName" binding:"required"`
+	ChatName  string                         `json:"chatName" binding:"required"`
+	Answerer  chattypes.ModelSettingsRequest `json:"answerer"`
+	Evaluator chattypes.ModelSettingsRequest `json:"evaluator"`
 }
 
-func NewEndpoint(db *gorm.DB) *Endpoint {
-	return &Endpoint{db: db}
+type UpdateReflectionChatRequest struct {
+	ChatName  string                         `json:"chatName" binding:"required"`
+	Answerer  chattypes.ModelSettingsRequest `json:"answerer"`
+	Evaluator chattypes.ModelSettingsRequest `json:"evaluator"`
+}
+
+func NewEndpoint(db *gorm.DB, modelRegistry *registry.Registry) *Endpoint {
+	return &Endpoint{db: db, registry: modelRegistry}
+}
+
+// validateSettings checks the answerer and evaluator settings. Both reply
+// with structured JSON, so their models need JSON mode.
+func (e *Endpoint) validateSettings(answerer chattypes.ModelSettingsRequest, evaluator chattypes.ModelSettingsRequest, user models.User) (models.ModelSettings, models.ModelSettings, error) {
+	requirements := chattypes.ModelRequirements{JSONMode: true}
+	answererSettings, err := answerer.Validate(e.registry, user.IsGuest, requirements)
+	if err != nil {
+		return models.ModelSettings{}, models.ModelSettings{}, fmt.Errorf("answerer: %w", err)
+	}
+	evaluatorSettings, err := evaluator.Validate(e.registry, user.IsGuest, requirements)
+	if err != nil {
+		return models.ModelSettings{}, models.ModelSettings{}, fmt.Errorf("evaluator: %w", err)
+	}
+	return answererSettings, evaluatorSettings, nil
 }
 
 func (e *Endpoint) GetReflectionChats(c *gin.Context) {
@@ -40,10 +68,12 @@ func (e *Endpoint) GetReflectionChats(c *gin.Context) {
 }
 
 type GetReflectionChatResponse struct {
-	ID        string    `json:"id"`
-	ChatName  string    `json:"chatName"`
-	CreatedAt time.Time `json:"createdAt"`
-	UpdatedAt time.Time `json:"updatedAt"`
+	ID        string               `json:"id"`
+	ChatName  string               `json:"chatName"`
+	Answerer  models.ModelSettings `json:"answerer"`
+	Evaluator models.ModelSettings `json:"evaluator"`
+	CreatedAt time.Time            `json:"createdAt"`
+	UpdatedAt time.Time            `json:"updatedAt"`
 }
 
 func (e *Endpoint) GetReflectionChat(c *gin.Context) {
@@ -62,6 +92,8 @@ func (e *Endpoint) GetReflectionChat(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"data": GetReflectionChatResponse{
 		ID:        reflectionChats.ExternalID.String(),
 		ChatName:  reflectionChats.ChatName,
+		Answerer:  reflectionChats.Answerer,
+		Evaluator: reflectionChats.Evaluator,
 		CreatedAt: reflectionChats.CreatedAt,
 		UpdatedAt: reflectionChats.UpdatedAt,
 	}})
@@ -82,7 +114,7 @@ func (e *Endpoint) GetChatReflections(c *gin.Context) {
 
 	var reflections []models.Reflection
 	if err := e.db.
-		Preload("Messages").
+		Preload("Messages.Attachments").
 		Preload("EvaluatorMessages").
 		Where("id_reflection_chat = ?", reflectionChats.IdReflectionChat).
 		Find(&reflections).Error; err != nil {
@@ -107,9 +139,17 @@ func (e *Endpoint) CreateReflectionChat(c *gin.Context) {
 		return
 	}
 
+	answerer, evaluator, err := e.validateSettings(body.Answerer, body.Evaluator, user)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	newChat := models.ReflectionChat{
-		ChatName: body.ChatName,
-		UserID:   user.IdUser,
+		ChatName:  body.ChatName,
+		UserID:    user.IdUser,
+		Answerer:  answerer,
+		Evaluator: evaluator,
 	}
 
 	if err := e.db.Create(&newChat).Error; err != nil {
@@ -120,6 +160,53 @@ func (e *Endpoint) CreateReflectionChat(c *gin.Context) {
 	c.JSON(http.StatusCreated, gin.H{"data": newChat})
 }
 
+func (e *Endpoint) UpdateReflectionChat(c *gin.Context) {
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	chatID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	var body UpdateReflectionChatRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	answerer, evaluator, err := e.validateSettings(body.Answerer, body.Evaluator, user)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var chat models.ReflectionChat
+	if err := e.db.Where("external_id = ? AND user_id = ?", chatID, user.IdUser).First(&chat).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found or unauthorized"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat"})
+		return
+	}
+
+	chat.ChatName = body.ChatName
+	chat.Answerer = answerer
+	chat.Evaluator = evaluator
+	if err := e.db.Save(&chat).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": chat})
+}
+
 func (e *Endpoint) DeleteReflectionChat(c *gin.Context) {
 	currentUser, exists := c.Get("currentUser")
 	if !exists {
@@ -136,7 +223,13 @@ func (e *Endpoint) DeleteReflectionChat(c *gin.Context) {
 		return
 	}
 
-	if err := e.db.Delete(&chat).Error; err != nil {
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&chat).Error; err != nil {
+			return err
+		}
+		return summary.DeleteChat(tx, summary.CHAT_TYPE_REFLECTION, chat.IdReflectionChat)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete chat"})
 		return
 	}
@@ -3,8 +3,12 @@ package reflectionmessage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,28 +17,59 @@ import (
 	"github.com/sashabaranov/go-openai"
 	"github.com/somtojf/trio-server/aipi"
 	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/aipi/budget"
+	"github.com/somtojf/trio-server/attachments"
 	"github.com/somtojf/trio-server/controllers/reflection-chat/reflection-message/response"
+	"github.com/somtojf/trio-server/metrics"
+	"github.com/somtojf/trio-server/moderation"
+	"github.com/somtojf/trio-server/quota"
+	"github.com/somtojf/trio-server/summary"
 	"github.com/somtojf/trio-server/types/qdranttypes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/somtojf/trio-server/models"
 	"gorm.io/gorm"
 )
 
 type Endpoint struct {
-	db           *gorm.DB
-	qdrantDB     *qdrant.Client
-	aipi         *aipi.Provider
-	streamOutput *SendReflectionMessageResponse
+	db          *gorm.DB
+	qdrantDB    *qdrant.Client
+	aipi        aipi.AIPIClient
+	quota       *quota.Checker
+	embedding   qdranttypes.EmbeddingSettings
+	budgeter    *budget.Budgeter
+	attachments *attachments.Service
+	moderator   *moderation.Moderator
+	summarizer  *summary.Summarizer
 }
 
-func NewEndpoint(db *gorm.DB, aipi *aipi.Provider, qdrantDB *qdrant.Client) *Endpoint {
-	return &Endpoint{db: db, aipi: aipi, qdrantDB: qdrantDB}
+// reflectionStream is the response streamed to one SendMessage request. Every
+// update sends all of it again.
+type reflectionStream struct {
+	c      *gin.Context
+	mx     sync.Mutex
+	output SendReflectionMessageResponse
 }
 
+func NewEndpoint(db *gorm.DB, aipi aipi.AIPIClient, qdrantDB *qdrant.Client, quota *quota.Checker, embedding qdranttypes.EmbeddingSettings, budgeter *budget.Budgeter, attachmentService *attachments.Service, moderator *moderation.Moderator, summarizer *summary.Summarizer) *Endpoint {
+	return &Endpoint{db: db, aipi: aipi, qdrantDB: qdrantDB, quota: quota, embedding: embedding, budgeter: budgeter, attachments: attachmentService, moderator: moderator, summarizer: summarizer}
+}
+
+type ErrorCode string
+
+const (
+	ErrorCodeQuotaExceeded     ErrorCode = "quota_exceeded"
+	ErrorCodeModerationFlagged ErrorCode = "moderation_flagged"
+)
+
 type SendReflectionMessageResponse struct {
-	Reflection *models.Reflection `json:"reflection"`
-	Status     []string           `json:"status"`
-	Error      string             `json:"error"`
+	Reflection    *models.Reflection `json:"reflection"`
+	PartialAnswer string             `json:"partialAnswer"`
+	Status        []string           `json:"status"`
+	Error         string             `json:"error"`
+	ErrorCode     ErrorCode          `json:"errorCode,omitempty"`
+	// TraceID is set with Error
+	TraceID string `json:"traceId,omitempty"`
 }
 
 // type MessageData struct {
@@ -58,24 +93,32 @@ type SendReflectionMessageResponse struct {
 // 	EvaluatorMessages []EvaluatorMessageData `json:"evaluatorMessages"`
 // }
 
+// SendMessageRequest is sent as JSON, or as a multipart form to upload images
+// with the message in the attachments.MULTIPART_FIELD field.
 type SendMessageRequest struct {
-	Message string `json:"message" binding:"required"`
+	Message string `json:"message" form:"message" binding:"required"`
+	// AttachmentIDs are images uploaded beforehand with POST /attachments
+	AttachmentIDs []string `json:"attachmentIds" form:"attachmentIds"`
 }
 
-const EMBEDDING_MODEL = string(openai.SmallEmbedding3)
+// ANSWERER_MODEL and EVALUATOR_MODEL are used by chats that pick no model
 const ANSWERER_MODEL = "gpt-4.1-nano-2025-04-14"
 const EVALUATOR_MODEL = "gpt-4.1-nano-2025-04-14"
 const MAX_MESSAGE_LENGTH = 400
+const QUEUE_STATUS = "Waiting for capacity"
 
 func (e *Endpoint) SendMessage(c *gin.Context) {
-	e.streamOutput = &SendReflectionMessageResponse{
+	metrics.ActiveStreams.WithLabelValues(metrics.MODE_REFLECTION).Inc()
+	defer metrics.ActiveStreams.WithLabelValues(metrics.MODE_REFLECTION).Dec()
+
+	stream := &reflectionStream{c: c, output: SendReflectionMessageResponse{
 		Status: make([]string, 0),
-	}
+	}}
 
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Recovered from panic: %v", r)
-			e.streamError(c, "An unexpected error occurred")
+			e.streamError(stream, "An unexpected error occurred")
 		}
 	}()
 
@@ -85,7 +128,7 @@ func (e *Endpoint) SendMessage(c *gin.Context) {
 	go func() {
 		<-ctx.Done()
 		if ctx.Err() == context.DeadlineExceeded {
-			e.streamError(c, "Request timeout exceeded")
+			e.streamError(stream, "Request timeout exceeded")
 		}
 	}()
 
@@ -101,60 +144,103 @@ func (e *Endpoint) SendMessage(c *gin.Context) {
 
 	chatId, err := uuid.Parse(c.Param("id"))
 	if err != nil {
-		e.streamError(c, "Invalid chat id")
+		e.streamError(stream, "Invalid chat id")
 		return
 	}
 
 	currentUser, exists := c.Get("currentUser")
 	if !exists {
-		e.streamError(c, "User not authenticated")
+		e.streamError(stream, "User not authenticated")
 		return
 	}
 	user := currentUser.(models.User)
 
 	var request SendMessageRequest
-	if err := c.ShouldBindJSON(&request); err != nil {
-		e.streamError(c, err.Error())
+	if err := c.ShouldBind(&request); err != nil {
+		e.streamError(stream, err.Error())
 		return
 	}
 
 	var chat models.ReflectionChat
-	if err := e.db.First(&chat, "external_id = ?", chatId).Error; err != nil {
-		e.streamError(c, "Chat not found")
+	if err := e.db.WithContext(ctx).First(&chat, "external_id = ? AND user_id = ?", chatId, user.IdUser).Error; err != nil {
+		e.streamError(stream, "Chat not found")
+		return
+	}
+
+	if err := e.quota.Check(ctx, user); err != nil {
+		var exceeded *quota.ExceededError
+		if errors.As(err, &exceeded) {
+			e.streamErrorWithCode(stream, ErrorCodeQuotaExceeded, exceeded.Error())
+			return
+		}
+		log.Printf("Failed to check quota: %v", err)
+		e.streamError(stream, "An error occurred")
+		return
+	}
+
+	err = e.moderator.Check(ctx, moderation.Item{
+		IdUser:    user.IdUser,
+		Direction: moderation.DIRECTION_INPUT,
+		ChatType:  moderation.CHAT_TYPE_REFLECTION,
+		ChatID:    chat.IdReflectionChat,
+		Author:    user.Username,
+		Content:   request.Message,
+	})
+	if err != nil {
+		e.streamModerationError(stream, err)
+		return
+	}
+
+	attached, err := e.attachments.FromRequest(c, user, request.AttachmentIDs)
+	if err != nil {
+		e.streamError(stream, err.Error())
+		return
+	}
+	images, err := e.attachments.Images(ctx, attached)
+	if err != nil {
+		log.Printf("Failed to load attachments: %v", err)
+		e.streamError(stream, "An error occurred")
 		return
 	}
 
-	e.streamStatus(c, "Reading chat history...")
-	chatHistory, err := e.getChatHistory(chat.IdReflectionChat, 10, user)
+	e.streamStatus(stream, "Reading chat history...")
+	chatHistory, err := e.getChatHistory(ctx, chat.IdReflectionChat, budget.HISTORY_CANDIDATE_LIMIT, user)
 	if err != nil {
-		e.streamError(c, err.Error())
+		e.streamError(stream, err.Error())
 		return
 	}
 
 	time.Sleep(1 * time.Second)
 
-	e.streamStatus(c, "Getting relevant context...")
+	e.streamStatus(stream, "Getting relevant context...")
 
 	time.Sleep(1 * time.Second)
 	// TODO: Uncomment this
-	// relevantContext, err := e.getRelevantContext(ctx, request.Message, chat.ExternalID, 10)
+	// relevantContext, err := e.getRelevantContext(ctx, request.Message, chat.ExternalID, user.IdUser, 10)
 	// if err != nil {
-	// 	e.streamError(c, err.Error())
+	// 	e.streamError(stream, err.Error())
 	// 	return
 	// }
 	relevantContext := []response.HistoryMessage{}
 
+	conversationSummary, err := e.summarizer.Prompt(ctx, summary.CHAT_TYPE_REFLECTION, chat.IdReflectionChat)
+	if err != nil {
+		// The answerer can answer from the history alone
+		log.Printf("Failed to load chat summary: %v", err)
+	}
+
 	optimalResponseGotten := false
 	numberOfIterations := 0
+	outcome := metrics.OUTCOME_OPTIMAL
 
-	tx := e.db.Begin()
+	tx := e.db.WithContext(ctx).Begin()
 	reflection := models.Reflection{
 		ChatID: chat.IdReflectionChat,
 	}
 	if err := tx.Create(&reflection).Error; err != nil {
 		tx.Rollback()
 		log.Printf("Failed to create reflection: %v", err)
-		e.streamError(c, "An error occurred")
+		e.streamError(stream, "An error occurred")
 		return
 	}
 
@@ -166,11 +252,25 @@ func (e *Endpoint) SendMessage(c *gin.Context) {
 	if err := tx.Create(&userMessage).Error; err != nil {
 		tx.Rollback()
 		log.Printf("Failed to create user message: %v", err)
-		e.streamError(c, "An error occured while sending your message")
+		e.streamError(stream, "An error occured while sending your message")
+		return
+	}
+	if err := attachments.AttachToReflectionMessage(tx, attached, userMessage.IdReflectionMessage); err != nil {
+		tx.Rollback()
+		var invalid *attachments.InvalidError
+		if errors.As(err, &invalid) {
+			e.streamError(stream, invalid.Error())
+			return
+		}
+		log.Printf("Failed to attach images: %v", err)
+		e.streamError(stream, "An error occured while sending your message")
 		return
 	}
 
 	previousResponses := []response.PreviousResponse{}
+	ctx = aipi.WithQueueObserver(ctx, func(ahead int) {
+		e.streamQueueStatus(stream, ahead)
+	})
 
 	for !optimalResponseGotten {
 		log.Printf("Iteration %d", numberOfIterations)
@@ -192,35 +292,72 @@ func (e *Endpoint) SendMessage(c *gin.Context) {
 			5. If the response is optimal, break by assigning the optimality value to optimalResponseGotten
 		*/
 
-		responseGenerator := response.NewResponse(e.db, e.aipi)
+		responseGenerator := response.NewResponse(e.db, e.aipi, e.budgeter)
 		answererInfoBank := response.AnswererInfoBank{
-			IdUser:            chat.UserID,
-			ChatHistory:       chatHistory,
-			Context:           relevantContext,
-			Message:           request.Message,
-			PreviousResponses: previousResponses,
+			IdUser:              user.IdUser,
+			ChatHistory:         chatHistory,
+			Context:             relevantContext,
+			ConversationSummary: conversationSummary,
+			Message:             request.Message,
+			Images:              images,
+			PreviousResponses:   previousResponses,
 		}
 
 		if numberOfIterations > 0 {
-			e.streamStatus(c, fmt.Sprintf("Improving on response %d", numberOfIterations))
+			e.streamStatus(stream, fmt.Sprintf("Improving on response %d", numberOfIterations))
 		} else {
-			e.streamStatus(c, fmt.Sprintf("Generating response %d", numberOfIterations+1))
+			e.streamStatus(stream, fmt.Sprintf("Generating response %d", numberOfIterations+1))
 		}
 
-		answererResponse, err := responseGenerator.RunAnswerer(ctx, answererInfoBank, ANSWERER_MODEL)
+		answererStartTime := time.Now()
+		// Only the part of the answer that passed moderation is shown
+		partial := e.moderator.NewStream(ctx, moderation.Item{
+			IdUser:    user.IdUser,
+			Direction: moderation.DIRECTION_OUTPUT,
+			ChatType:  moderation.CHAT_TYPE_REFLECTION,
+			ChatID:    chat.IdReflectionChat,
+			Author:    reflectionMessage.SenderName,
+		}, func(content string) {
+			e.streamPartialAnswer(stream, content)
+		})
+		streamed := ""
+		answererResponse, err := responseGenerator.StreamAnswerer(ctx, answererInfoBank, chat.Answerer.Model(ANSWERER_MODEL), chat.Answerer.Sampling(), func(content string) {
+			// The content decoded so far only grows
+			partial.Write(strings.TrimPrefix(content, streamed))
+			streamed = content
+		})
 		if err != nil {
 			tx.Rollback()
 			log.Printf("Failed to generate response: %v", err)
-			e.streamError(c, "An error occured while sending your message")
+			e.streamError(stream, "An error occured while sending your message")
+			return
+		}
+
+		err = e.moderator.Check(ctx, moderation.Item{
+			IdUser:    user.IdUser,
+			Direction: moderation.DIRECTION_OUTPUT,
+			ChatType:  moderation.CHAT_TYPE_REFLECTION,
+			ChatID:    chat.IdReflectionChat,
+			Author:    reflectionMessage.SenderName,
+			Content:   answererResponse.Content,
+		})
+		if err != nil {
+			tx.Rollback()
+			// Take back the part of the answer that was shown
+			e.streamPartialAnswer(stream, "")
+			e.streamModerationError(stream, err)
 			return
 		}
 
+		metrics.AgentResponseSeconds.WithLabelValues(metrics.MODE_REFLECTION, answererResponse.Model).Observe(time.Since(answererStartTime).Seconds())
+
 		reflectionMessage.Content = answererResponse.Content
 		reflectionMessage.Title = answererResponse.Title
+		reflectionMessage.ModelName = answererResponse.Model
 		if err := tx.Create(&reflectionMessage).Error; err != nil {
 			tx.Rollback()
 			log.Printf("Failed to create reflection message: %v", err)
-			e.streamError(c, "An error occured while sending your message")
+			e.streamError(stream, "An error occured while sending your message")
 			return
 		}
 
@@ -228,30 +365,37 @@ func (e *Endpoint) SendMessage(c *gin.Context) {
 		if err := e.refreshReflection(tx, &reflection); err != nil {
 			tx.Rollback()
 			log.Printf("Failed to reload reflection: %v", err)
-			e.streamError(c, "An error occured while sending your message")
+			e.streamError(stream, "An error occured while sending your message")
 			return
 		}
 
-		e.streamReflection(c, &reflection)
+		e.streamReflection(stream, &reflection)
 
 		evaluatorInfoBank := response.EvaluatorInfoBank{
-			IdUser:            chat.UserID,
-			ChatHistory:       chatHistory,
-			Context:           relevantContext,
-			Message:           request.Message,
-			IterationCount:    numberOfIterations + 1,
-			AnswererResponse:  answererResponse,
-			PreviousResponses: previousResponses,
+			IdUser:              user.IdUser,
+			ChatHistory:         chatHistory,
+			Context:             relevantContext,
+			ConversationSummary: conversationSummary,
+			Message:             request.Message,
+			Images:              images,
+			IterationCount:      numberOfIterations + 1,
+			AnswererResponse:    answererResponse,
+			PreviousResponses:   previousResponses,
 		}
 
-		e.streamStatus(c, fmt.Sprintf("Evaluating response %d", numberOfIterations+1))
-		evaluatorResponse, err := responseGenerator.RunEvaluator(ctx, evaluatorInfoBank, EVALUATOR_MODEL)
+		e.streamStatus(stream, fmt.Sprintf("Evaluating response %d", numberOfIterations+1))
+		evaluatorResponse, err := responseGenerator.RunEvaluator(ctx, evaluatorInfoBank, chat.Evaluator.Model(EVALUATOR_MODEL), chat.Evaluator.Sampling())
 		if err != nil {
 			tx.Rollback()
 			log.Printf("evaluator failed to evaluate response: %v", err)
-			e.streamError(c, "An error occured while sending your message")
+			e.streamError(stream, "An error occured while sending your message")
 			return
 		}
+		if evaluatorResponse.IsOptimal {
+			metrics.EvaluatorVerdicts.WithLabelValues(metrics.VERDICT_OPTIMAL).Inc()
+		} else {
+			metrics.EvaluatorVerdicts.WithLabelValues(metrics.VERDICT_NOT_OPTIMAL).Inc()
+		}
 
 		// Update previous responses
 		currentResponse := response.PreviousResponse{
@@ -262,20 +406,24 @@ func (e *Endpoint) SendMessage(c *gin.Context) {
 
 		if numberOfIterations >= 5 {
 			optimalResponseGotten = true
+			if !evaluatorResponse.IsOptimal {
+				outcome = metrics.OUTCOME_LIMIT
+			}
 
 			evaluatorMessage.Content = evaluatorResponse.Content
 			evaluatorMessage.IsOptimal = true
+			evaluatorMessage.ModelName = evaluatorResponse.Model
 			if err := tx.Create(&evaluatorMessage).Error; err != nil {
 				tx.Rollback()
 				log.Printf("Failed to create evaluator message: %v", err)
-				e.streamError(c, "An error occured while sending your message")
+				e.streamError(stream, "An error occured while sending your message")
 				return
 			}
 
 			if err := tx.Model(&reflectionMessage).Update("is_optimal", true).Error; err != nil {
 				tx.Rollback()
 				log.Printf("Failed to update reflection message optimal status: %v", err)
-				e.streamError(c, "An error occurred while sending your message")
+				e.streamError(stream, "An error occurred while sending your message")
 				return
 			}
 
@@ -283,11 +431,11 @@ func (e *Endpoint) SendMessage(c *gin.Context) {
 			if err := e.refreshReflection(tx, &reflection); err != nil {
 				tx.Rollback()
 				log.Printf("Failed to reload reflection: %v", err)
-				e.streamError(c, "An error occured while sending your message")
+				e.streamError(stream, "An error occured while sending your message")
 				return
 			}
 
-			e.streamReflection(c, &reflection)
+			e.streamReflection(stream, &reflection)
 			continue
 		} else {
 			optimalResponseGotten = evaluatorResponse.IsOptimal
@@ -296,10 +444,11 @@ func (e *Endpoint) SendMessage(c *gin.Context) {
 
 		evaluatorMessage.Content = evaluatorResponse.Content
 		evaluatorMessage.IsOptimal = evaluatorResponse.IsOptimal
+		evaluatorMessage.ModelName = evaluatorResponse.Model
 		if err := tx.Create(&evaluatorMessage).Error; err != nil {
 			tx.Rollback()
 			log.Printf("Failed to create evaluator message: %v", err)
-			e.streamError(c, "An error occured while sending your message")
+			e.streamError(stream, "An error occured while sending your message")
 			return
 		}
 
@@ -307,7 +456,7 @@ func (e *Endpoint) SendMessage(c *gin.Context) {
 			if err := tx.Model(&reflectionMessage).Update("is_optimal", true).Error; err != nil {
 				tx.Rollback()
 				log.Printf("Failed to update reflection message optimal status: %v", err)
-				e.streamError(c, "An error occurred while sending your message")
+				e.streamError(stream, "An error occurred while sending your message")
 				return
 			}
 		}
@@ -316,36 +465,37 @@ func (e *Endpoint) SendMessage(c *gin.Context) {
 		if err := e.refreshReflection(tx, &reflection); err != nil {
 			tx.Rollback()
 			log.Printf("Failed to reload reflection: %v", err)
-			e.streamError(c, "An error occured while sending your message")
+			e.streamError(stream, "An error occured while sending your message")
 			return
 		}
 
-		e.streamReflection(c, &reflection)
+		e.streamReflection(stream, &reflection)
 
 		numberOfIterations += 1
 	}
 
 	// Save reflection messages to Qdrant
 	// TODO: Uncomment this
-	// for _, message := range reflection.Messages {
-	// 	if err := e.saveToQdrant(ctx, message, chat.ExternalID); err != nil {
-	// 		tx.Rollback()
-	// 		log.Printf("Failed to save message to qdrant: %v", err)
-	// 		e.streamError(c, "An error occured while sending your message")
-	// 		return
-	// 	}
+	// if err := e.saveToQdrant(ctx, reflection.Messages, chat.ExternalID, user.IdUser); err != nil {
+	// 	tx.Rollback()
+	// 	log.Printf("Failed to save message to qdrant: %v", err)
+	// 	e.streamError(stream, "An error occured while sending your message")
+	// 	return
 	// }
 
 	if err := tx.Commit().Error; err != nil {
 		tx.Rollback()
 		log.Printf("Failed to commit transaction: %v", err)
-		e.streamError(c, "An error occured while sending your message")
+		e.streamError(stream, "An error occured while sending your message")
 		return
 	}
+	metrics.Messages.WithLabelValues(metrics.MODE_REFLECTION).Inc()
+	metrics.ReflectionIterations.WithLabelValues(outcome).Observe(float64(len(previousResponses)))
+	e.summarizer.UpdateAsync(ctx, summary.Chat{Type: summary.CHAT_TYPE_REFLECTION, IdChat: chat.IdReflectionChat, IdUser: user.IdUser, UserName: user.Username})
 }
 
 func (e *Endpoint) refreshReflection(tx *gorm.DB, reflection *models.Reflection) error {
-	if err := tx.Preload("Messages").Preload("EvaluatorMessages").Where("id_reflection = ?", reflection.IdReflection).First(reflection).Error; err != nil {
+	if err := tx.Preload("Messages.Attachments").Preload("EvaluatorMessages").Where("id_reflection = ?", reflection.IdReflection).First(reflection).Error; err != nil {
 		log.Printf("Failed to load reflection with associations: %v", err)
 		return err
 	}
@@ -353,10 +503,11 @@ func (e *Endpoint) refreshReflection(tx *gorm.DB, reflection *models.Reflection)
 	return nil
 }
 
-// Get the chat history for the reflection chat. Only get the optimal messages
-func (e *Endpoint) getChatHistory(chatId uint, limit int, user models.User) ([]response.HistoryMessage, error) {
+// Get the chat history for the reflection chat, oldest first. Only get the user's messages and the optimal answers
+func (e *Endpoint) getChatHistory(ctx context.Context, chatId uint, limit int, user models.User) ([]response.HistoryMessage, error) {
 	var messages []models.ReflectionMessage
-	if err := e.db.Where("id_reflection IN (SELECT id_reflection FROM reflections WHERE id_reflection_chat = ?) AND is_optimal = ?", chatId, true).
+	if err := e.db.WithContext(ctx).Where("id_reflection IN (SELECT id_reflection FROM reflections WHERE id_reflection_chat = ?) AND (is_optimal = ? OR sender_name = ?)", chatId, true, user.Username).
+		Preload("Attachments").
 		Order("created_at DESC").
 		Limit(limit).
 		Find(&messages).Error; err != nil {
@@ -374,22 +525,24 @@ func (e *Endpoint) getChatHistory(chatId uint, limit int, user models.User) ([]r
 
 		historyMessage := response.HistoryMessage{
 			SenderName: senderName,
-			Content:    message.Content,
+			Content:    attachments.Describe(message.Content, message.Attachments),
 			SentAt:     message.CreatedAt,
 		}
 		chatHistory = append(chatHistory, historyMessage)
 	}
+	slices.Reverse(chatHistory)
 
 	return chatHistory, nil
 }
 
-func (e *Endpoint) getRelevantContext(c context.Context, message string, chatId uuid.UUID, limit int) ([]response.HistoryMessage, error) {
+func (e *Endpoint) getRelevantContext(c context.Context, message string, chatId uuid.UUID, idUser uint, limit int) ([]response.HistoryMessage, error) {
 	limitUint64 := uint64(limit)
 	embeddingRequest := aipitypes.EmbeddingRequest{
 		Input:          message,
-		Model:          EMBEDDING_MODEL,
+		Model:          e.embedding.Model,
 		EncodingFormat: string(openai.EmbeddingEncodingFormatFloat),
-		Dimensions:     int(qdranttypes.VECTOR_SIZE_BASIC_MESSAGE),
+		Dimensions:     int(e.embedding.VectorSize),
+		IdUser:         idUser,
 	}
 	embedding, err := e.aipi.GetEmbedding(c, embeddingRequest)
 	if err != nil {
@@ -413,19 +566,16 @@ func (e *Endpoint) getRelevantContext(c context.Context, message string, chatId
 
 	var relevantContext []response.HistoryMessage
 	for _, point := range searchResult {
-		payload := point.GetPayload()
-		content := payload["content"]
-		sentAt := payload["created_at"]
-
-		timeValue, err := time.Parse(time.RFC1123, sentAt.String())
+		payload, err := qdranttypes.ParseMessagePayload(point.GetPayload())
 		if err != nil {
-			return nil, err
+			// One broken point shouldn't cost the answerer the rest of the context
+			log.Printf("Skipping malformed message point %s: %v", point.GetId().GetUuid(), err)
+			continue
 		}
 
 		historyMessage := response.HistoryMessage{
-
-			Content: content.String(),
-			SentAt:  timeValue,
+			Content: payload.Content,
+			SentAt:  payload.CreatedAt,
 		}
 		relevantContext = append(relevantContext, historyMessage)
 	}
@@ -433,34 +583,48 @@ func (e *Endpoint) getRelevantContext(c context.Context, message string, chatId
 	return relevantContext, nil
 }
 
-func (e *Endpoint) saveToQdrant(c context.Context, message models.ReflectionMessage, chatId uuid.UUID) error {
+// saveToQdrant embeds the messages in one batch and upserts them.
+func (e *Endpoint) saveToQdrant(c context.Context, messages []models.ReflectionMessage, chatId uuid.UUID, idUser uint) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	contents := make([]string, len(messages))
+	for i, message := range messages {
+		contents[i] = message.Content
+	}
 	embeddingRequest := aipitypes.EmbeddingRequest{
-		Input:          message.Content,
-		Model:          EMBEDDING_MODEL,
+		Input:          contents,
+		Model:          e.embedding.Model,
 		EncodingFormat: string(openai.EmbeddingEncodingFormatFloat),
-		Dimensions:     int(qdranttypes.VECTOR_SIZE_BASIC_MESSAGE),
+		Dimensions:     int(e.embedding.VectorSize),
+		IdUser:         idUser,
 	}
-	embedding, err := e.aipi.GetEmbedding(c, embeddingRequest)
+	embeddings, err := e.aipi.GetEmbeddings(c, embeddingRequest)
 	if err != nil {
 		return err
 	}
 
-	payload := map[string]any{
-		"chat_id":     chatId.String(),
-		"content":     message.Content,
-		"external_id": message.ExternalID,
-		"created_at":  message.CreatedAt.String(),
+	points := make([]*qdrant.PointStruct, len(messages))
+	for i, message := range messages {
+		payload := qdranttypes.MessagePayload{
+			ChatID:     chatId.String(),
+			Content:    message.Content,
+			SenderName: message.SenderName,
+			ExternalID: message.ExternalID.String(),
+			CreatedAt:  message.CreatedAt,
+		}
+		points[i] = &qdrant.PointStruct{
+			Id:      qdrant.NewIDUUID(message.ExternalID.String()),
+			Vectors: qdrant.NewVectors(embeddings[i]...),
+			Payload: payload.Values(),
+		}
 	}
 
+	// getRelevantContext searches the reflection collection
 	_, err = e.qdrantDB.Upsert(c, &qdrant.UpsertPoints{
-		CollectionName: string(qdranttypes.COLLECTION_NAME_BASIC_MESSAGES),
-		Points: []*qdrant.PointStruct{
-			{
-				Id:      qdrant.NewIDUUID(message.ExternalID.String()),
-				Vectors: qdrant.NewVectors(embedding...),
-				Payload: qdrant.NewValueMap(payload),
-			},
-		},
+		CollectionName: string(qdranttypes.COLLECTION_NAME_REFLECTION_MESSAGES),
+		Points:         points,
 	})
 	if err != nil {
 		return err
@@ -469,22 +633,85 @@ func (e *Endpoint) saveToQdrant(c context.Context, message models.ReflectionMess
 	return nil
 }
 
-func (e *Endpoint) streamReflection(c *gin.Context, reflection *models.Reflection) {
-	e.streamOutput.Reflection = reflection
-	e.updateStream(c, *e.streamOutput)
+func (e *Endpoint) streamReflection(stream *reflectionStream, reflection *models.Reflection) {
+	stream.mx.Lock()
+	defer stream.mx.Unlock()
+
+	stream.output.Reflection = reflection
+	stream.output.PartialAnswer = ""
+	e.updateStream(stream.c, stream.output)
+}
+
+func (e *Endpoint) streamPartialAnswer(stream *reflectionStream, content string) {
+	stream.mx.Lock()
+	defer stream.mx.Unlock()
+
+	stream.output.PartialAnswer = content
+	e.updateStream(stream.c, stream.output)
+}
+
+func (e *Endpoint) streamStatus(stream *reflectionStream, status string) {
+	stream.mx.Lock()
+	defer stream.mx.Unlock()
+
+	stream.output.Status = append(stream.output.Status, status)
+	e.updateStream(stream.c, stream.output)
 }
 
-func (e *Endpoint) streamStatus(c *gin.Context, status string) {
-	e.streamOutput.Status = append(e.streamOutput.Status, status)
-	e.updateStream(c, *e.streamOutput)
+// streamQueueStatus reports the position of a model call waiting for rate
+// limit capacity, replacing the previous position instead of adding a status.
+func (e *Endpoint) streamQueueStatus(stream *reflectionStream, ahead int) {
+	stream.mx.Lock()
+	defer stream.mx.Unlock()
+
+	status := fmt.Sprintf("%s (%d ahead)", QUEUE_STATUS, ahead)
+	last := len(stream.output.Status) - 1
+	if last >= 0 && strings.HasPrefix(stream.output.Status[last], QUEUE_STATUS) {
+		stream.output.Status[last] = status
+	} else {
+		stream.output.Status = append(stream.output.Status, status)
+	}
+	e.updateStream(stream.c, stream.output)
 }
 
-func (e *Endpoint) streamError(c *gin.Context, error string) {
-	if e.streamOutput == nil {
-		e.streamOutput = &SendReflectionMessageResponse{}
+func (e *Endpoint) streamError(stream *reflectionStream, error string) {
+	stream.mx.Lock()
+	defer stream.mx.Unlock()
+
+	stream.output.Error = error
+	stream.output.TraceID = traceID(stream.c)
+	e.updateStream(stream.c, stream.output)
+}
+
+func (e *Endpoint) streamErrorWithCode(stream *reflectionStream, code ErrorCode, error string) {
+	stream.mx.Lock()
+	defer stream.mx.Unlock()
+
+	stream.output.Error = error
+	stream.output.ErrorCode = code
+	stream.output.TraceID = traceID(stream.c)
+	e.updateStream(stream.c, stream.output)
+}
+
+// traceID identifies the request's trace so support can look up an error.
+func traceID(c *gin.Context) string {
+	spanContext := trace.SpanContextFromContext(c.Request.Context())
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
+
+// streamModerationError reports content moderation flagged with its own error
+// code. Other errors of the check are logged and reported generically.
+func (e *Endpoint) streamModerationError(stream *reflectionStream, err error) {
+	var flagged *moderation.FlaggedError
+	if errors.As(err, &flagged) {
+		e.streamErrorWithCode(stream, ErrorCodeModerationFlagged, flagged.Error())
+		return
 	}
-	e.streamOutput.Error = error
-	e.updateStream(c, *e.streamOutput)
+	log.Printf("Failed to moderate message: %v", err)
+	e.streamError(stream, "An error occurred")
 }
 
 func (e *Endpoint) updateStream(c *gin.Context, response SendReflectionMessageResponse) {
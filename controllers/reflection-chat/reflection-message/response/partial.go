@@ -0,0 +1,71 @@
+package response
+
+import (
+	"strconv"
+	"strings"
+)
+
+// partialJSONString returns the value of a top-level string field from a JSON
+// object that may still be incomplete, e.g. while it is being streamed. It
+// returns whatever part of the value has arrived so far.
+func partialJSONString(data string, field string) string {
+	key := strconv.Quote(field)
+	idx := strings.Index(data, key)
+	if idx == -1 {
+		return ""
+	}
+
+	rest := strings.TrimLeft(data[idx+len(key):], " \t\r\n")
+	if !strings.HasPrefix(rest, ":") {
+		return ""
+	}
+	rest = strings.TrimLeft(rest[1:], " \t\r\n")
+	if !strings.HasPrefix(rest, "\"") {
+		return ""
+	}
+	rest = rest[1:]
+
+	var value strings.Builder
+	for i := 0; i < len(rest); i++ {
+		ch := rest[i]
+		if ch == '"' {
+			break
+		}
+		if ch != '\\' {
+			value.WriteByte(ch)
+			continue
+		}
+
+		// Stop at an escape sequence that has not fully arrived yet
+		if i+1 >= len(rest) {
+			break
+		}
+		i++
+		switch rest[i] {
+		case 'n':
+			value.WriteByte('\n')
+		case 't':
+			value.WriteByte('\t')
+		case 'r':
+			value.WriteByte('\r')
+		case 'b':
+			value.WriteByte('\b')
+		case 'f':
+			value.WriteByte('\f')
+		case 'u':
+			if i+4 >= len(rest) {
+				return value.String()
+			}
+			code, err := strconv.ParseUint(rest[i+1:i+5], 16, 32)
+			if err != nil {
+				return value.String()
+			}
+			value.WriteRune(rune(code))
+			i += 4
+		default:
+			value.WriteByte(rest[i])
+		}
+	}
+
+	return value.String()
+}
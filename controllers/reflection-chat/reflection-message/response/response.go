@@ -7,17 +7,21 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/somtojf/trio-server/aipi"
 	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/aipi/budget"
+	"github.com/somtojf/trio-server/summary"
 	"gorm.io/gorm"
 )
 
 type SenderName string
 
 const (
-	HistoryMessageSenderNameAnswerer SenderName = "Answerer"
+	HistoryMessageSenderNameAnswerer  SenderName = "Answerer"
+	HistoryMessageSenderNameEvaluator SenderName = "Evaluator"
 )
 
 type HistoryMessage struct {
@@ -32,6 +36,11 @@ type AnswererInfoBank struct {
 	Context           []HistoryMessage
 	PreviousResponses []PreviousResponse
 	Message           string
+	// Images are sent with Message
+	Images []aipitypes.ImagePart
+	// ConversationSummary summarizes the chat before the messages of its
+	// history
+	ConversationSummary string
 }
 
 type PreviousResponse struct {
@@ -40,8 +49,9 @@ type PreviousResponse struct {
 }
 
 type AnswererResponse struct {
-	Title   string `json:"title"`
-	Content string `json:"content"`
+	Title   string `json:"title" description:"A short title for the answer"`
+	Content string `json:"content" description:"The answer to the user's message"`
+	Model   string `json:"-"`
 }
 
 type EvaluatorInfoBank struct {
@@ -49,113 +59,326 @@ type EvaluatorInfoBank struct {
 	ChatHistory       []HistoryMessage
 	Context           []HistoryMessage
 	Message           string
+	Images            []aipitypes.ImagePart
 	IterationCount    int
 	PreviousResponses []PreviousResponse
 	AnswererResponse  AnswererResponse
+	// ConversationSummary summarizes the chat before the messages of its
+	// history
+	ConversationSummary string
 }
 
 type EvaluatorResponse struct {
-	Content   string `json:"content"`
-	IsOptimal bool   `json:"isOptimal"`
+	Content   string `json:"content" description:"Feedback on the answer and how to improve it"`
+	IsOptimal bool   `json:"isOptimal" description:"Whether the answer needs no further improvement"`
+	Model     string `json:"-"`
 }
 
+var answererSchema = aipitypes.MustResponseSchema("answerer_response", AnswererResponse{})
+var evaluatorSchema = aipitypes.MustResponseSchema("evaluator_response", EvaluatorResponse{})
+
+// Shares of the prompt budget left next to the system prompt. Earlier
+// iterations matter most to the next one, retrieved context is cut first.
+const (
+	PREVIOUS_RESPONSES_BUDGET_SHARE = 0.4
+	HISTORY_BUDGET_SHARE            = 0.4
+	CONTEXT_BUDGET_SHARE            = 0.2
+)
+
+const (
+	ANSWERER_SYSTEM_TEMPLATE  = "controllers/reflection-chat/reflection-message/response/prompt/answerer/system/prompt.go.tmpl"
+	EVALUATOR_SYSTEM_TEMPLATE = "controllers/reflection-chat/reflection-message/response/prompt/evaluator/system/prompt.go.tmpl"
+)
+
 type Response struct {
-	db   *gorm.DB
-	aipi *aipi.Provider
+	db       *gorm.DB
+	aipi     aipi.AIPIClient
+	budgeter *budget.Budgeter
 }
 
-func NewResponse(db *gorm.DB, aipi *aipi.Provider) *Response {
-	return &Response{db: db, aipi: aipi}
+func NewResponse(db *gorm.DB, aipi aipi.AIPIClient, budgeter *budget.Budgeter) *Response {
+	return &Response{db: db, aipi: aipi, budgeter: budgeter}
 }
 
-func (r *Response) RunAnswerer(ctx context.Context, infoBank AnswererInfoBank, model string) (AnswererResponse, error) {
-	systemTmpl, err := template.ParseFiles("controllers/reflection-chat/reflection-message/response/prompt/answerer/system/prompt.go.tmpl")
+func (r *Response) RunAnswerer(ctx context.Context, infoBank AnswererInfoBank, model string, sampling aipitypes.Sampling) (AnswererResponse, error) {
+	request, err := r.answererRequest(infoBank, model, sampling)
 	if err != nil {
-		log.Printf("Error parsing system template: %v", err)
-		return AnswererResponse{}, fmt.Errorf("error parsing system template: %w", err)
+		return AnswererResponse{}, err
 	}
-	var systemBuf bytes.Buffer
-	if err := systemTmpl.Execute(&systemBuf, infoBank); err != nil {
-		log.Printf("Error executing system template: %v", err)
-		return AnswererResponse{}, fmt.Errorf("error executing system template: %w", err)
+
+	var answererResponse AnswererResponse
+	response, err := aipi.GetStructuredCompletion(ctx, r.aipi, request, &answererResponse)
+	if err != nil {
+		log.Printf("Error getting answerer response: %v", err)
+		return AnswererResponse{}, fmt.Errorf("error getting answerer response: %w", err)
 	}
+	answererResponse.Model = response.Model
 
-	userTmpl, err := template.ParseFiles("controllers/reflection-chat/reflection-message/response/prompt/answerer/user/prompt.go.tmpl")
+	return answererResponse, nil
+}
+
+// StreamAnswerer streams the answerer's reply and calls onContent with the
+// content field decoded so far whenever more of it arrives, the whole value
+// rather than the new part. A streamed reply may not follow the schema, so it
+// is validated once it is complete and repaired with RepairStructuredResponse
+// if needed. The returned answer can then differ from what onContent saw.
+func (r *Response) StreamAnswerer(ctx context.Context, infoBank AnswererInfoBank, model string, sampling aipitypes.Sampling, onContent func(content string)) (AnswererResponse, error) {
+	request, err := r.answererRequest(infoBank, model, sampling)
 	if err != nil {
-		log.Printf("Error parsing user template: %v", err)
-		return AnswererResponse{}, fmt.Errorf("error parsing user template: %w", err)
+		return AnswererResponse{}, err
 	}
-	var userBuf bytes.Buffer
-	if err := userTmpl.Execute(&userBuf, infoBank); err != nil {
-		log.Printf("Error executing user template: %v", err)
-		return AnswererResponse{}, fmt.Errorf("error executing user template: %w", err)
+
+	chunks, err := r.aipi.GetCompletionAsync(ctx, request)
+	if err != nil {
+		return AnswererResponse{}, err
 	}
 
-	request := &aipitypes.AIPIRequest{
-		Model:          model,
-		SystemMessage:  systemBuf.String(),
-		UserMessage:    userBuf.String(),
-		IdUser:         infoBank.IdUser,
-		ResponseFormat: aipitypes.AIPI_RESPONSE_FORMAT_JSON,
+	var data strings.Builder
+	var usedModel string
+	lastContent := ""
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			return AnswererResponse{}, chunk.Err
+		}
+		if chunk.Model != "" {
+			usedModel = chunk.Model
+		}
+		data.WriteString(chunk.Delta)
+
+		content := partialJSONString(data.String(), "content")
+		if content != lastContent {
+			lastContent = content
+			onContent(content)
+		}
 	}
-	response, err := r.aipi.GetCompletion(ctx, *request)
-	if err != nil {
+
+	if err := ctx.Err(); err != nil {
 		return AnswererResponse{}, err
 	}
 
+	// A streamed reply can't be constrained as strictly, so it is validated and repaired afterwards
 	var answererResponse AnswererResponse
-	err = json.Unmarshal([]byte(response.Data), &answererResponse)
+	response, err := aipi.RepairStructuredResponse(ctx, r.aipi, request, aipitypes.AIPIResponse{Data: data.String(), Model: usedModel}, &answererResponse)
 	if err != nil {
-		log.Printf("Error unmarshalling answerer response: %v", err)
-		return AnswererResponse{}, fmt.Errorf("error unmarshalling answerer response: %w", err)
+		log.Printf("Error parsing answerer response: %v", err)
+		return AnswererResponse{}, fmt.Errorf("error parsing answerer response: %w", err)
 	}
+	answererResponse.Model = response.Model
 
 	return answererResponse, nil
 }
 
-func (r *Response) RunEvaluator(ctx context.Context, infoBank EvaluatorInfoBank, model string) (EvaluatorResponse, error) {
-	systemTmpl, err := template.ParseFiles("controllers/reflection-chat/reflection-message/response/prompt/evaluator/system/prompt.go.tmpl")
+// answererRequest builds the answerer request with the history, context and
+// previous iterations that fit the model's prompt budget.
+func (r *Response) answererRequest(infoBank AnswererInfoBank, model string, sampling aipitypes.Sampling) (aipitypes.AIPIRequest, error) {
+	promptBudget, err := r.budgeter.ForModel(model, sampling.MaxTokens)
 	if err != nil {
-		log.Printf("Error parsing system template: %v", err)
-		return EvaluatorResponse{}, fmt.Errorf("error parsing system template: %w", err)
+		return aipitypes.AIPIRequest{}, err
 	}
-	var systemBuf bytes.Buffer
-	if err := systemTmpl.Execute(&systemBuf, infoBank); err != nil {
-		log.Printf("Error executing system template: %v", err)
-		return EvaluatorResponse{}, fmt.Errorf("error executing system template: %w", err)
+
+	bare := infoBank
+	bare.ChatHistory, bare.Context, bare.PreviousResponses = nil, nil, nil
+	systemMessage, err := renderSystemPrompt(ANSWERER_SYSTEM_TEMPLATE, bare)
+	if err != nil {
+		return aipitypes.AIPIRequest{}, err
 	}
 
-	userTmpl, err := template.ParseFiles("controllers/reflection-chat/reflection-message/response/prompt/evaluator/user/prompt.go.tmpl")
+	fixed := promptBudget.Count(systemMessage, infoBank.Message) + len(infoBank.Images)*budget.IMAGE_TOKENS
+	parts := fitToBudget(promptBudget, fixed, promptParts{
+		ChatHistory:       infoBank.ChatHistory,
+		Context:           infoBank.Context,
+		PreviousResponses: infoBank.PreviousResponses,
+	})
+	infoBank.ChatHistory, infoBank.Context, infoBank.PreviousResponses = parts.ChatHistory, parts.Context, parts.PreviousResponses
+	return buildAnswererRequest(infoBank, model, sampling)
+}
+
+func buildAnswererRequest(infoBank AnswererInfoBank, model string, sampling aipitypes.Sampling) (aipitypes.AIPIRequest, error) {
+	systemMessage, err := renderSystemPrompt(ANSWERER_SYSTEM_TEMPLATE, infoBank)
 	if err != nil {
-		log.Printf("Error parsing user template: %v", err)
-		return EvaluatorResponse{}, fmt.Errorf("error parsing user template: %w", err)
+		return aipitypes.AIPIRequest{}, err
 	}
-	var userBuf bytes.Buffer
-	if err := userTmpl.Execute(&userBuf, infoBank); err != nil {
-		log.Printf("Error executing user template: %v", err)
-		return EvaluatorResponse{}, fmt.Errorf("error executing user template: %w", err)
+
+	messages := historyTurns(infoBank.ChatHistory, aipitypes.MESSAGE_ROLE_ASSISTANT)
+	messages = append(messages, aipitypes.AIPIMessage{Role: aipitypes.MESSAGE_ROLE_USER, Content: infoBank.Message, Images: infoBank.Images})
+	for _, previous := range infoBank.PreviousResponses {
+		answer, err := json.Marshal(previous.AnswererResponse)
+		if err != nil {
+			return aipitypes.AIPIRequest{}, fmt.Errorf("error marshalling previous answer: %w", err)
+		}
+		messages = append(messages,
+			aipitypes.AIPIMessage{Role: aipitypes.MESSAGE_ROLE_ASSISTANT, Content: string(answer)},
+			aipitypes.AIPIMessage{
+				Role:    aipitypes.MESSAGE_ROLE_USER,
+				Name:    string(HistoryMessageSenderNameEvaluator),
+				Content: previous.EvaluatorResponse.Content,
+			},
+		)
 	}
 
-	request := &aipitypes.AIPIRequest{
+	return aipitypes.AIPIRequest{
 		Model:          model,
-		SystemMessage:  systemBuf.String(),
-		UserMessage:    userBuf.String(),
+		SystemMessage:  systemMessage,
+		Messages:       messages,
 		IdUser:         infoBank.IdUser,
-		ResponseFormat: aipitypes.AIPI_RESPONSE_FORMAT_JSON,
+		ResponseFormat: aipitypes.AIPI_RESPONSE_FORMAT_JSON_SCHEMA,
+		ResponseSchema: answererSchema,
+		Sampling:       sampling,
+	}, nil
+}
+
+// historyTurns maps the chat history to conversation turns. The answerer's
+// messages get answererRole, the user's messages are named user turns.
+func historyTurns(chatHistory []HistoryMessage, answererRole aipitypes.MessageRole) []aipitypes.AIPIMessage {
+	var messages []aipitypes.AIPIMessage
+	for _, message := range chatHistory {
+		if message.SenderName == string(HistoryMessageSenderNameAnswerer) {
+			turn := aipitypes.AIPIMessage{Role: answererRole, Content: message.Content}
+			if answererRole == aipitypes.MESSAGE_ROLE_USER {
+				turn.Name = message.SenderName
+			}
+			messages = append(messages, turn)
+			continue
+		}
+		messages = append(messages, aipitypes.AIPIMessage{
+			Role:    aipitypes.MESSAGE_ROLE_USER,
+			Name:    message.SenderName,
+			Content: message.Content,
+		})
 	}
+	return messages
+}
 
-	response, err := r.aipi.GetCompletion(ctx, *request)
+func (r *Response) RunEvaluator(ctx context.Context, infoBank EvaluatorInfoBank, model string, sampling aipitypes.Sampling) (EvaluatorResponse, error) {
+	request, err := r.evaluatorRequest(infoBank, model, sampling)
 	if err != nil {
 		return EvaluatorResponse{}, err
 	}
 
 	var evaluatorResponse EvaluatorResponse
-
-	err = json.Unmarshal([]byte(response.Data), &evaluatorResponse)
+	response, err := aipi.GetStructuredCompletion(ctx, r.aipi, request, &evaluatorResponse)
 	if err != nil {
-		log.Printf("Error unmarshalling evaluator response: %v", err)
-		return EvaluatorResponse{}, fmt.Errorf("error unmarshalling evaluator response: %w", err)
+		log.Printf("Error getting evaluator response: %v", err)
+		return EvaluatorResponse{}, fmt.Errorf("error getting evaluator response: %w", err)
 	}
+	evaluatorResponse.Model = response.Model
 
 	return evaluatorResponse, nil
 }
+
+// evaluatorRequest builds the evaluator request with the history, context and
+// previous iterations that fit the model's prompt budget.
+func (r *Response) evaluatorRequest(infoBank EvaluatorInfoBank, model string, sampling aipitypes.Sampling) (aipitypes.AIPIRequest, error) {
+	promptBudget, err := r.budgeter.ForModel(model, sampling.MaxTokens)
+	if err != nil {
+		return aipitypes.AIPIRequest{}, err
+	}
+
+	bare := infoBank
+	bare.ChatHistory, bare.Context, bare.PreviousResponses = nil, nil, nil
+	systemMessage, err := renderSystemPrompt(EVALUATOR_SYSTEM_TEMPLATE, bare)
+	if err != nil {
+		return aipitypes.AIPIRequest{}, err
+	}
+
+	fixed := promptBudget.Count(systemMessage, infoBank.Message, infoBank.AnswererResponse.Content) + len(infoBank.Images)*budget.IMAGE_TOKENS
+	parts := fitToBudget(promptBudget, fixed, promptParts{
+		ChatHistory:       infoBank.ChatHistory,
+		Context:           infoBank.Context,
+		PreviousResponses: infoBank.PreviousResponses,
+	})
+	infoBank.ChatHistory, infoBank.Context, infoBank.PreviousResponses = parts.ChatHistory, parts.Context, parts.PreviousResponses
+	return buildEvaluatorRequest(infoBank, model, sampling)
+}
+
+func buildEvaluatorRequest(infoBank EvaluatorInfoBank, model string, sampling aipitypes.Sampling) (aipitypes.AIPIRequest, error) {
+	systemMessage, err := renderSystemPrompt(EVALUATOR_SYSTEM_TEMPLATE, infoBank)
+	if err != nil {
+		return aipitypes.AIPIRequest{}, err
+	}
+
+	// To the evaluator both the user and the answerer are other participants
+	messages := historyTurns(infoBank.ChatHistory, aipitypes.MESSAGE_ROLE_USER)
+	messages = append(messages, aipitypes.AIPIMessage{Role: aipitypes.MESSAGE_ROLE_USER, Content: infoBank.Message, Images: infoBank.Images})
+	for _, previous := range infoBank.PreviousResponses {
+		feedback, err := json.Marshal(previous.EvaluatorResponse)
+		if err != nil {
+			return aipitypes.AIPIRequest{}, fmt.Errorf("error marshalling previous feedback: %w", err)
+		}
+		messages = append(messages,
+			aipitypes.AIPIMessage{
+				Role:    aipitypes.MESSAGE_ROLE_USER,
+				Name:    string(HistoryMessageSenderNameAnswerer),
+				Content: previous.AnswererResponse.Content,
+			},
+			aipitypes.AIPIMessage{Role: aipitypes.MESSAGE_ROLE_ASSISTANT, Content: string(feedback)},
+		)
+	}
+	messages = append(messages, aipitypes.AIPIMessage{
+		Role:    aipitypes.MESSAGE_ROLE_USER,
+		Name:    string(HistoryMessageSenderNameAnswerer),
+		Content: infoBank.AnswererResponse.Content,
+	})
+
+	return aipitypes.AIPIRequest{
+		Model:          model,
+		SystemMessage:  systemMessage,
+		Messages:       messages,
+		IdUser:         infoBank.IdUser,
+		ResponseFormat: aipitypes.AIPI_RESPONSE_FORMAT_JSON_SCHEMA,
+		ResponseSchema: evaluatorSchema,
+		Sampling:       sampling,
+	}, nil
+}
+
+func renderSystemPrompt(path string, infoBank any) (string, error) {
+	systemTmpl, err := template.ParseFiles(path, summary.PROMPT_TEMPLATE)
+	if err != nil {
+		log.Printf("Error parsing system template: %v", err)
+		return "", fmt.Errorf("error parsing system template: %w", err)
+	}
+	var systemBuf bytes.Buffer
+	if err := systemTmpl.Execute(&systemBuf, infoBank); err != nil {
+		log.Printf("Error executing system template: %v", err)
+		return "", fmt.Errorf("error executing system template: %w", err)
+	}
+	return systemBuf.String(), nil
+}
+
+// promptParts is the content of a prompt that may be cut to fit its budget.
+type promptParts struct {
+	ChatHistory       []HistoryMessage
+	Context           []HistoryMessage
+	PreviousResponses []PreviousResponse
+}
+
+// fitToBudget keeps the latest iterations, the newest chat history and the
+// most relevant context that fit next to fixed tokens of the prompt.
+func fitToBudget(promptBudget budget.Budget, fixed int, parts promptParts) promptParts {
+	previous := make([]string, len(parts.PreviousResponses))
+	for i, response := range parts.PreviousResponses {
+		previous[i] = response.AnswererResponse.Title + "\n" + response.AnswererResponse.Content + "\n" + response.EvaluatorResponse.Content
+	}
+	history := make([]string, len(parts.ChatHistory))
+	for i, message := range parts.ChatHistory {
+		history[i] = message.SenderName + ": " + message.Content
+	}
+	retrieved := make([]string, len(parts.Context))
+	for i, message := range parts.Context {
+		retrieved[i] = fmt.Sprintf("(%s): %s", message.SentAt, message.Content)
+	}
+
+	kept := promptBudget.FitChat(fixed, budget.ChatPrompt{
+		Iterations:      previous,
+		IterationsShare: PREVIOUS_RESPONSES_BUDGET_SHARE,
+		History:         history,
+		HistoryShare:    HISTORY_BUDGET_SHARE,
+		Context:         retrieved,
+		ContextShare:    CONTEXT_BUDGET_SHARE,
+	})
+	return promptParts{
+		PreviousResponses: budget.Latest(parts.PreviousResponses, kept.Iterations),
+		ChatHistory:       budget.Latest(parts.ChatHistory, kept.History),
+		Context:           parts.Context[:kept.Context],
+	}
+}
@@ -0,0 +1,124 @@
+package usage
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/somtojf/trio-server/models"
+	"gorm.io/gorm"
+)
+
+type Endpoint struct {
+	db *gorm.DB
+}
+
+func NewEndpoint(db *gorm.DB) *Endpoint {
+	return &Endpoint{db: db}
+}
+
+const DEFAULT_USAGE_DAYS = 30
+const MAX_USAGE_DAYS = 365
+
+type DailyModelUsage struct {
+	Day              time.Time `json:"day"`
+	ModelName        string    `json:"modelName"`
+	RequestCount     int       `json:"requestCount"`
+	InputTokenCount  int       `json:"inputTokenCount"`
+	OutputTokenCount int       `json:"outputTokenCount"`
+	TotalCost        float64   `json:"totalCost"`
+}
+
+type ModelUsage struct {
+	ModelName        string  `json:"modelName"`
+	RequestCount     int     `json:"requestCount"`
+	InputTokenCount  int     `json:"inputTokenCount"`
+	OutputTokenCount int     `json:"outputTokenCount"`
+	TotalCost        float64 `json:"totalCost"`
+}
+
+type UsageTotal struct {
+	RequestCount     int     `json:"requestCount"`
+	InputTokenCount  int     `json:"inputTokenCount"`
+	OutputTokenCount int     `json:"outputTokenCount"`
+	TotalCost        float64 `json:"totalCost"`
+}
+
+type GetUsageResponse struct {
+	Since  time.Time         `json:"since"`
+	Daily  []DailyModelUsage `json:"daily"`
+	Models []ModelUsage      `json:"models"`
+	Total  UsageTotal        `json:"total"`
+}
+
+// GetUsage godoc
+//
+//	@Summary		Get model usage
+//	@Description	Returns token counts and cost of the current user's model calls, per day and per model
+//	@Tags			users
+//	@Produce		json
+//	@Param			days	query		int						false	"Number of days to look back (default 30)"
+//	@Success		200		{object}	GetUsageResponse		"Usage data"
+//	@Failure		400		{object}	map[string]interface{}	"Bad request"
+//	@Failure		500		{object}	map[string]interface{}	"Internal server error"
+//	@Router			/me/usage [get]
+func (e *Endpoint) GetUsage(c *gin.Context) {
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	days := DEFAULT_USAGE_DAYS
+	if daysParam := c.Query("days"); daysParam != "" {
+		parsed, err := strconv.Atoi(daysParam)
+		if err != nil || parsed < 1 || parsed > MAX_USAGE_DAYS {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "days must be a number between 1 and 365"})
+			return
+		}
+		days = parsed
+	}
+
+	now := time.Now().UTC()
+	since := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -(days - 1))
+	records := e.db.Model(&models.AIPIRecord{}).Where("id_user = ? AND created_at >= ?", user.IdUser, since).Session(&gorm.Session{})
+
+	var daily []DailyModelUsage
+	if err := records.
+		Select("date_trunc('day', created_at AT TIME ZONE 'UTC') AS day, model_name, COUNT(*) AS request_count, " +
+			"SUM(input_token_count) AS input_token_count, SUM(output_token_count) AS output_token_count, SUM(total_cost) AS total_cost").
+		Group("day, model_name").
+		Order("day ASC, model_name ASC").
+		Scan(&daily).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch usage"})
+		return
+	}
+
+	var perModel []ModelUsage
+	if err := records.
+		Select("model_name, COUNT(*) AS request_count, " +
+			"SUM(input_token_count) AS input_token_count, SUM(output_token_count) AS output_token_count, SUM(total_cost) AS total_cost").
+		Group("model_name").
+		Order("total_cost DESC").
+		Scan(&perModel).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch usage"})
+		return
+	}
+
+	var total UsageTotal
+	for _, modelUsage := range perModel {
+		total.RequestCount += modelUsage.RequestCount
+		total.InputTokenCount += modelUsage.InputTokenCount
+		total.OutputTokenCount += modelUsage.OutputTokenCount
+		total.TotalCost += modelUsage.TotalCost
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": GetUsageResponse{
+		Since:  since,
+		Daily:  daily,
+		Models: perModel,
+		Total:  total,
+	}})
+}
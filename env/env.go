@@ -0,0 +1,39 @@
+// Package env reads numeric settings from environment variables. It imports
+// nothing of the server, so every package can use it.
+package env
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+)
+
+// Int returns the integer in key, or def when it is not set. Values that are
+// not integers or are less than min are logged and ignored.
+func Int(key string, def int, min int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < min {
+		slog.Warn("Ignoring invalid setting", "key", key, "value", value)
+		return def
+	}
+	return parsed
+}
+
+// Float returns the number in key, or def when it is not set. Values that are
+// not numbers or are less than min are logged and ignored.
+func Float(key string, def float64, min float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < min {
+		slog.Warn("Ignoring invalid setting", "key", key, "value", value)
+		return def
+	}
+	return parsed
+}
@@ -6,6 +6,7 @@ import (
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/plugin/opentelemetry/tracing"
 )
 
 var DB *gorm.DB
@@ -19,4 +20,9 @@ func ConnectToPostgresDB() {
 	if err != nil {
 		log.Fatal("Failed to connect to database")
 	}
+
+	// Query parameters are left out of spans, they hold user content
+	if err := DB.Use(tracing.NewPlugin(tracing.WithoutMetrics(), tracing.WithoutQueryVariables())); err != nil {
+		log.Fatal("Failed to set up database tracing")
+	}
 }
@@ -8,6 +8,9 @@ import (
 	"strings"
 
 	"github.com/qdrant/go-client/qdrant"
+	"github.com/somtojf/trio-server/metrics"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
 )
 
 var QdrantClient *qdrant.Client
@@ -24,6 +27,10 @@ func ConnectToQdrant() {
 		Port:   6334, // gRPC port
 		APIKey: os.Getenv("QDRANT_DB_API_KEY"),
 		UseTLS: useTLS,
+		GrpcOptions: []grpc.DialOption{
+			grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+			grpc.WithChainUnaryInterceptor(metrics.QdrantInterceptor),
+		},
 	})
 	if err != nil {
 		slog.Error("Failed to connect to qdrant", "error", err)
@@ -0,0 +1,72 @@
+package initializers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// SERVICE_NAME names the server in traces unless OTEL_SERVICE_NAME is set
+const SERVICE_NAME = "trio-server"
+
+// TracerProvider is nil when tracing is off.
+var TracerProvider *sdktrace.TracerProvider
+
+// InitTracing exports traces as OTEL_TRACES_EXPORTER says: otlp sends them over
+// gRPC to OTEL_EXPORTER_OTLP_ENDPOINT, stdout prints them for local development.
+// Unset or none leaves tracing off. The standard OTEL_* variables such as
+// OTEL_TRACES_SAMPLER are read by the SDK.
+func InitTracing() {
+	ctx := context.Background()
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch mode := os.Getenv("OTEL_TRACES_EXPORTER"); mode {
+	case "", "none":
+		return
+	case "otlp":
+		exporter, err = otlptracegrpc.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		log.Fatal(fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", mode))
+	}
+	if err != nil {
+		log.Fatal(fmt.Errorf("error creating trace exporter: %w", err))
+	}
+
+	// Resources given later win, so OTEL_SERVICE_NAME overrides the default name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(SERVICE_NAME)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		log.Fatal(fmt.Errorf("error creating trace resource: %w", err))
+	}
+
+	TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(TracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	slog.Info("Exporting traces", "exporter", os.Getenv("OTEL_TRACES_EXPORTER"))
+}
+
+// ShutdownTracing exports the spans that are still buffered.
+func ShutdownTracing(ctx context.Context) {
+	if TracerProvider == nil {
+		return
+	}
+	if err := TracerProvider.Shutdown(ctx); err != nil {
+		slog.Warn("Failed to flush traces", "error", err)
+	}
+}
@@ -2,28 +2,50 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/somtojf/trio-server/aipi/googlegenai"
 	"github.com/somtojf/trio-server/common"
+	"github.com/somtojf/trio-server/controllers/admin"
+	agentmemories "github.com/somtojf/trio-server/controllers/agent-memories"
+	agenttools "github.com/somtojf/trio-server/controllers/agent-tools"
+	aimodels "github.com/somtojf/trio-server/controllers/ai-models"
+	"github.com/somtojf/trio-server/controllers/attachments"
 	"github.com/somtojf/trio-server/controllers/auth"
 	basicchat "github.com/somtojf/trio-server/controllers/basic-chat"
 	basicmessage "github.com/somtojf/trio-server/controllers/basic-chat/basic-message"
+	chatsummaries "github.com/somtojf/trio-server/controllers/chat-summaries"
 	"github.com/somtojf/trio-server/controllers/health"
+	"github.com/somtojf/trio-server/controllers/personas"
 	reflectionchat "github.com/somtojf/trio-server/controllers/reflection-chat"
 	reflectionmessage "github.com/somtojf/trio-server/controllers/reflection-chat/reflection-message"
+	"github.com/somtojf/trio-server/controllers/usage"
 	"github.com/somtojf/trio-server/initializers"
+	admincheck "github.com/somtojf/trio-server/middleware/admin-check"
 	authcheck "github.com/somtojf/trio-server/middleware/auth-check"
+	"github.com/somtojf/trio-server/quota"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
+// SHUTDOWN_TIMEOUT is how long running requests, like streamed replies, may
+// take to finish once the server is asked to stop
+const SHUTDOWN_TIMEOUT = 30 * time.Second
+
 func init() {
 	log.Println("Initializing server...")
 	initializers.LoadEnvVariables()
+	initializers.InitTracing()
 	initializers.ConnectToPostgresDB()
 	initializers.ConnectToQdrant()
 
@@ -41,18 +63,29 @@ func main() {
 	clientDomain = strings.TrimPrefix(clientDomain, "https://")
 
 	authCheckMiddleware := authcheck.NewMiddleware(initializers.DB)
+	adminCheckMiddleware := admincheck.NewMiddleware()
 	authEndpoint := auth.NewEndpoint(initializers.DB, clientDomain)
-	basicChatEndpoint := basicchat.NewEndpoint(initializers.DB)
-	reflectionChatEndpoint := reflectionchat.NewEndpoint(initializers.DB)
 
-	deps, err := common.NewDependencies(context.Background())
+	deps, err := common.NewDependencies(context.Background(), initializers.DB, initializers.QdrantClient)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	reflectionMessageEndpoint := reflectionmessage.NewEndpoint(initializers.DB, deps.AIPIProvider, initializers.QdrantClient)
-	basicMessageEndpoint := basicmessage.NewEndpoint(initializers.DB, deps.AIPIProvider, initializers.QdrantClient)
-
+	quotaChecker := quota.NewChecker(initializers.DB)
+
+	reflectionChatEndpoint := reflectionchat.NewEndpoint(initializers.DB, deps.ModelRegistry)
+	basicChatEndpoint := basicchat.NewEndpoint(initializers.DB, initializers.QdrantClient, deps.ToolRegistry, deps.ModelRegistry)
+	reflectionMessageEndpoint := reflectionmessage.NewEndpoint(initializers.DB, deps.AIPIClient, initializers.QdrantClient, quotaChecker, deps.Embedding, deps.Budgeter, deps.Attachments, deps.Moderator, deps.Summarizer)
+	basicMessageEndpoint := basicmessage.NewEndpoint(initializers.DB, deps.AIPIClient, initializers.QdrantClient, quotaChecker, deps.ToolRegistry, deps.Embedding, deps.Budgeter, deps.Attachments, deps.Moderator, deps.Memory, deps.Summarizer)
+	adminEndpoint := admin.NewEndpoint(initializers.DB, quotaChecker)
+	aiModelsEndpoint := aimodels.NewEndpoint(deps.ModelRegistry)
+	agentToolsEndpoint := agenttools.NewEndpoint(deps.ToolRegistry)
+	attachmentsEndpoint := attachments.NewEndpoint(deps.Attachments)
+	personasEndpoint := personas.NewEndpoint(initializers.DB, deps.ToolRegistry, deps.ModelRegistry)
+	agentMemoriesEndpoint := agentmemories.NewEndpoint(initializers.DB, deps.Memory)
+	chatSummariesEndpoint := chatsummaries.NewEndpoint(initializers.DB, deps.Summarizer)
+
+	usageEndpoint := usage.NewEndpoint(initializers.DB)
 	healthEndpoint := health.NewEndpoint()
 
 	config := cors.DefaultConfig()
@@ -62,6 +95,7 @@ func main() {
 	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization"}
 
 	r.Use(cors.New(config))
+	r.Use(otelgin.Middleware(initializers.SERVICE_NAME))
 
 	public := r.Group("/")
 	{
@@ -70,6 +104,7 @@ func main() {
 		public.POST("/login/guest", authEndpoint.GuestLogin)
 
 		public.GET("/health", healthEndpoint.HealthCheck)
+		public.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	}
 
 	authenticated := r.Group("/")
@@ -79,11 +114,17 @@ func main() {
 		authenticated.POST("/reset-password", authEndpoint.ResetPassword)
 		authenticated.GET("/completions", authEndpoint.GetCurrentUser)
 		authenticated.GET("/me", authEndpoint.GetCurrentUser)
+		authenticated.GET("/me/usage", usageEndpoint.GetUsage)
+		authenticated.GET("/models", aiModelsEndpoint.GetModels)
+		authenticated.GET("/tools", agentToolsEndpoint.GetTools)
+		authenticated.POST("/attachments", attachmentsEndpoint.UploadAttachment)
+		authenticated.GET("/attachments/:id", attachmentsEndpoint.GetAttachment)
 
 		reflectionChats := authenticated.Group("/reflection-chats")
 		{
 			reflectionChats.GET("/", reflectionChatEndpoint.GetReflectionChats)
 			reflectionChats.POST("/", reflectionChatEndpoint.CreateReflectionChat)
+			reflectionChats.PUT("/:id", reflectionChatEndpoint.UpdateReflectionChat)
 			reflectionChats.DELETE("/:id", reflectionChatEndpoint.DeleteReflectionChat)
 			reflectionChats.POST("/:id/messages", reflectionMessageEndpoint.SendMessage)
 			reflectionChats.GET("/:id", reflectionChatEndpoint.GetReflectionChat)
@@ -100,6 +141,30 @@ func main() {
 			basicChats.DELETE("/:id", basicChatEndpoint.DeleteBasicChat)
 			basicChats.POST("/:id/messages", basicMessageEndpoint.SendBasicMessage)
 			basicChats.GET("/:id/messages", basicMessageEndpoint.GetBasicMessages)
+			basicChats.POST("/:id/interrupt", basicMessageEndpoint.InterruptDiscussion)
+			basicChats.GET("/:id/summary", chatSummariesEndpoint.GetBasicChatSummary)
+			basicChats.GET("/:id/agents/:agentId/memories", agentMemoriesEndpoint.GetMemories)
+			basicChats.PUT("/:id/agents/:agentId/memories/:memoryId", agentMemoriesEndpoint.UpdateMemory)
+			basicChats.DELETE("/:id/agents/:agentId/memories/:memoryId", agentMemoriesEndpoint.DeleteMemory)
+		}
+
+		personaRoutes := authenticated.Group("/personas")
+		{
+			personaRoutes.GET("/", personasEndpoint.GetPersonas)
+			personaRoutes.POST("/", personasEndpoint.CreatePersona)
+			personaRoutes.GET("/:id", personasEndpoint.GetPersona)
+			personaRoutes.PUT("/:id", personasEndpoint.UpdatePersona)
+			personaRoutes.DELETE("/:id", personasEndpoint.DeletePersona)
+		}
+
+		adminRoutes := authenticated.Group("/admin")
+		adminRoutes.Use(adminCheckMiddleware.AdminCheck())
+		{
+			adminRoutes.GET("/users/:id/limits", adminEndpoint.GetUserLimits)
+			adminRoutes.PUT("/users/:id/limits", adminEndpoint.UpdateUserLimits)
+			adminRoutes.POST("/personas", personasEndpoint.CreateSystemPersona)
+			adminRoutes.PUT("/personas/:id", personasEndpoint.UpdateSystemPersona)
+			adminRoutes.DELETE("/personas/:id", personasEndpoint.DeleteSystemPersona)
 		}
 
 	}
@@ -109,8 +174,23 @@ func main() {
 		port = "8080"
 	}
 
-	log.Printf("Starting server on port %s", port)
-	if err := r.Run(":" + port); err != nil {
-		log.Panicf("error: %s", err)
+	server := &http.Server{Addr: ":" + port, Handler: r}
+	go func() {
+		log.Printf("Starting server on port %s", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Panicf("error: %s", err)
+		}
+	}()
+
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	<-stop.Done()
+
+	log.Println("Shutting down server...")
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancelShutdown()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to finish running requests: %v", err)
 	}
+	initializers.ShutdownTracing(ctx)
 }
@@ -0,0 +1,354 @@
+// Package memory lets basic chat agents remember durable facts and
+// preferences of their user beyond the messages in their prompt.
+package memory
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/qdrant/go-client/qdrant"
+	"github.com/sashabaranov/go-openai"
+	"github.com/somtojf/trio-server/aipi"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/models"
+	"github.com/somtojf/trio-server/types/qdranttypes"
+	"gorm.io/gorm"
+)
+
+type Kind string
+
+const (
+	KIND_FACT       Kind = "fact"
+	KIND_PREFERENCE Kind = "preference"
+)
+
+const (
+	// RECALL_LIMIT is how many memories an agent is prompted with
+	RECALL_LIMIT = 5
+	// EXTRACTION_CONTEXT_LIMIT is how many related memories the extraction
+	// sees, so it doesn't extract them again
+	EXTRACTION_CONTEXT_LIMIT = 10
+	// DUPLICATE_THRESHOLD is the similarity from which an extracted memory is
+	// taken for one the agent already has
+	DUPLICATE_THRESHOLD = 0.92
+	MAX_MEMORY_LENGTH   = 300
+	EXTRACTION_TIMEOUT  = 60 * time.Second
+)
+
+const EXTRACTION_SYSTEM_MESSAGE = `You maintain the long-term memory of an AI agent in a group chat. From the latest exchange, extract durable facts about the user and preferences the user has, which the agent should still know in conversations weeks from now: names, relationships, circumstances, goals, likes and dislikes, how the user wants to be addressed or answered. Only extract what the user stated or confirmed, never what the agents claimed. Skip small talk, passing moods, anything about the current task only, and anything the agent already remembers. Write each memory as one short sentence about the user in the third person. Return no memories when there is nothing worth remembering.`
+
+type extraction struct {
+	Memories []extractedMemory `json:"memories" description:"New memories, empty when there is nothing worth remembering"`
+}
+
+type extractedMemory struct {
+	Kind    string `json:"kind" description:"fact or preference"`
+	Content string `json:"content" description:"One short sentence about the user"`
+}
+
+var extractionSchema = aipitypes.MustResponseSchema("agent_memories", extraction{})
+
+// Agent identifies whose memories are meant: an agent of a user's chat.
+type Agent struct {
+	IdUser uint
+	IdChat uint
+	Name   string
+}
+
+// Exchange is a user message and an agent's replies to it.
+type Exchange struct {
+	Agent         Agent
+	UserName      string
+	UserMessageID uint
+	UserMessage   string
+	Replies       []string
+}
+
+// Store keeps memories in Postgres, which is what they are listed and edited
+// from, and their embeddings in the agent memories collection of Qdrant. A nil
+// Store remembers nothing.
+type Store struct {
+	db        *gorm.DB
+	qdrantDB  *qdrant.Client
+	aipi      aipi.AIPIClient
+	embedding qdranttypes.EmbeddingSettings
+	model     string
+}
+
+func NewStore(db *gorm.DB, qdrantDB *qdrant.Client, client aipi.AIPIClient, embedding qdranttypes.EmbeddingSettings, model string) *Store {
+	return &Store{db: db, qdrantDB: qdrantDB, aipi: client, embedding: embedding, model: model}
+}
+
+func (s *Store) embed(ctx context.Context, idUser uint, text string) ([]float32, error) {
+	return s.aipi.GetEmbedding(ctx, aipitypes.EmbeddingRequest{
+		Input:          text,
+		Model:          s.embedding.Model,
+		EncodingFormat: string(openai.EmbeddingEncodingFormatFloat),
+		Dimensions:     int(s.embedding.VectorSize),
+		IdUser:         idUser,
+	})
+}
+
+func agentFilter(agent Agent) *qdrant.Filter {
+	return &qdrant.Filter{
+		Must: []*qdrant.Condition{
+			qdrant.NewMatchInt("user_id", int64(agent.IdUser)),
+			qdrant.NewMatchInt("chat_id", int64(agent.IdChat)),
+			qdrant.NewMatchKeyword("agent_name", agent.Name),
+		},
+	}
+}
+
+// search returns the ids of the agent's memories closest to the embedding,
+// closest first.
+func (s *Store) search(ctx context.Context, agent Agent, embedding []float32, limit int, threshold *float32) ([]uint, error) {
+	limitUint64 := uint64(limit)
+	points, err := s.qdrantDB.Query(ctx, &qdrant.QueryPoints{
+		CollectionName: string(qdranttypes.COLLECTION_NAME_AGENT_MEMORIES),
+		Query:          qdrant.NewQuery(embedding...),
+		Limit:          &limitUint64,
+		ScoreThreshold: threshold,
+		Filter:         agentFilter(agent),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error searching agent memories: %w", err)
+	}
+
+	ids := make([]uint, len(points))
+	for i, point := range points {
+		ids[i] = uint(point.GetId().GetNum())
+	}
+	return ids, nil
+}
+
+// Recall returns the agent's memories most related to text, most related
+// first.
+func (s *Store) Recall(ctx context.Context, agent Agent, text string, limit int) ([]models.AgentMemory, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	embedding, err := s.embed(ctx, agent.IdUser, text)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := s.search(ctx, agent, embedding, limit, nil)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	// Postgres has the current content, Qdrant only finds it
+	var memories []models.AgentMemory
+	if err := s.db.WithContext(ctx).Where("id_agent_memory IN ?", ids).Find(&memories).Error; err != nil {
+		return nil, err
+	}
+	slices.SortFunc(memories, func(a, b models.AgentMemory) int {
+		return slices.Index(ids, a.IdAgentMemory) - slices.Index(ids, b.IdAgentMemory)
+	})
+	return memories, nil
+}
+
+// List returns everything the agent remembers, oldest first.
+func (s *Store) List(ctx context.Context, agent Agent) ([]models.AgentMemory, error) {
+	var memories []models.AgentMemory
+	err := s.db.WithContext(ctx).
+		Where("user_id = ? AND id_basic_chat = ? AND agent_name = ?", agent.IdUser, agent.IdChat, agent.Name).
+		Order("created_at").
+		Find(&memories).Error
+	return memories, err
+}
+
+// Update replaces the content of a memory and embeds it again.
+func (s *Store) Update(ctx context.Context, memory *models.AgentMemory, content string) error {
+	embedding, err := s.embed(ctx, memory.UserID, content)
+	if err != nil {
+		return err
+	}
+
+	memory.Content = content
+	memory.SourceMessageID = nil
+	if err := s.db.WithContext(ctx).Save(memory).Error; err != nil {
+		return err
+	}
+	return s.upsert(ctx, *memory, embedding)
+}
+
+// Delete forgets a memory.
+func (s *Store) Delete(ctx context.Context, memory models.AgentMemory) error {
+	if err := s.db.WithContext(ctx).Delete(&memory).Error; err != nil {
+		return err
+	}
+	_, err := s.qdrantDB.Delete(ctx, &qdrant.DeletePoints{
+		CollectionName: string(qdranttypes.COLLECTION_NAME_AGENT_MEMORIES),
+		Points:         qdrant.NewPointsSelector(qdrant.NewIDNum(uint64(memory.IdAgentMemory))),
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting agent memory from qdrant: %w", err)
+	}
+	return nil
+}
+
+// DeleteAgents deletes the memories of the named agents of a chat, or of all
+// its agents when no names are given. It doesn't need a Store, the agents may
+// have remembered while memory was on. Their embeddings stay in Qdrant until
+// DeleteAgentPoints is called.
+func DeleteAgents(db *gorm.DB, idChat uint, names ...string) error {
+	query := db.Where("id_basic_chat = ?", idChat)
+	if len(names) > 0 {
+		query = query.Where("agent_name IN ?", names)
+	}
+	return query.Delete(&models.AgentMemory{}).Error
+}
+
+// DeleteAgentPoints deletes the embeddings of the memories DeleteAgents
+// deleted. Qdrant isn't part of a transaction, so call it once the deletion
+// is committed.
+func DeleteAgentPoints(ctx context.Context, qdrantDB *qdrant.Client, idChat uint, names ...string) error {
+	filter := &qdrant.Filter{
+		Must: []*qdrant.Condition{qdrant.NewMatchInt("chat_id", int64(idChat))},
+	}
+	if len(names) > 0 {
+		filter.Must = append(filter.Must, qdrant.NewMatchKeywords("agent_name", names...))
+	}
+	_, err := qdrantDB.Delete(ctx, &qdrant.DeletePoints{
+		CollectionName: string(qdranttypes.COLLECTION_NAME_AGENT_MEMORIES),
+		Points:         qdrant.NewPointsSelectorFilter(filter),
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting agent memories from qdrant: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) upsert(ctx context.Context, memory models.AgentMemory, embedding []float32) error {
+	_, err := s.qdrantDB.Upsert(ctx, &qdrant.UpsertPoints{
+		CollectionName: string(qdranttypes.COLLECTION_NAME_AGENT_MEMORIES),
+		Points: []*qdrant.PointStruct{{
+			Id:      qdrant.NewIDNum(uint64(memory.IdAgentMemory)),
+			Vectors: qdrant.NewVectors(embedding...),
+			Payload: qdrant.NewValueMap(map[string]any{
+				"user_id":    int64(memory.UserID),
+				"chat_id":    int64(memory.ChatID),
+				"agent_name": memory.AgentName,
+				"content":    memory.Content,
+			}),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("error storing agent memory in qdrant: %w", err)
+	}
+	return nil
+}
+
+// RememberAsync extracts memories from the exchanges in the background so
+// the reply isn't delayed.
+func (s *Store) RememberAsync(ctx context.Context, exchanges []Exchange) {
+	if s == nil || len(exchanges) == 0 {
+		return
+	}
+
+	// The request may be over by the time the memories are extracted, and its
+	// queue observer would report to a closed stream
+	ctx = aipi.WithQueueObserver(context.WithoutCancel(ctx), nil)
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, EXTRACTION_TIMEOUT)
+		defer cancel()
+		for _, exchange := range exchanges {
+			if err := s.Remember(ctx, exchange); err != nil {
+				slog.Warn("Failed to extract agent memories", "agent", exchange.Agent.Name, "chat", exchange.Agent.IdChat, "error", err)
+			}
+		}
+	}()
+}
+
+// Remember extracts what the agent should remember from the exchange and
+// stores what it doesn't know yet.
+func (s *Store) Remember(ctx context.Context, exchange Exchange) error {
+	if s == nil {
+		return nil
+	}
+	agent := exchange.Agent
+
+	known, err := s.Recall(ctx, agent, exchange.UserMessage, EXTRACTION_CONTEXT_LIMIT)
+	if err != nil {
+		return err
+	}
+
+	var prompt strings.Builder
+	fmt.Fprintf(&prompt, "Agent: %s\n\nThe agent already remembers:\n", agent.Name)
+	if len(known) == 0 {
+		prompt.WriteString("nothing yet\n")
+	}
+	for _, memory := range known {
+		fmt.Fprintf(&prompt, "- %s\n", memory.Content)
+	}
+	fmt.Fprintf(&prompt, "\nLatest exchange:\n%s (the user): %s\n", exchange.UserName, exchange.UserMessage)
+	for _, reply := range exchange.Replies {
+		fmt.Fprintf(&prompt, "%s: %s\n", agent.Name, reply)
+	}
+
+	var extracted extraction
+	_, err = aipi.GetStructuredCompletion(ctx, s.aipi, aipitypes.AIPIRequest{
+		SystemMessage:  EXTRACTION_SYSTEM_MESSAGE,
+		UserMessage:    prompt.String(),
+		Model:          s.model,
+		IdUser:         agent.IdUser,
+		ResponseSchema: extractionSchema,
+	}, &extracted)
+	if err != nil {
+		return fmt.Errorf("error extracting memories: %w", err)
+	}
+
+	for _, candidate := range extracted.Memories {
+		content := strings.TrimSpace(candidate.Content)
+		if content == "" {
+			continue
+		}
+		if len(content) > MAX_MEMORY_LENGTH {
+			cut := MAX_MEMORY_LENGTH
+			for cut > 0 && !utf8.RuneStart(content[cut]) {
+				cut--
+			}
+			content = content[:cut]
+		}
+		kind := Kind(candidate.Kind)
+		if kind != KIND_PREFERENCE {
+			kind = KIND_FACT
+		}
+
+		embedding, err := s.embed(ctx, agent.IdUser, content)
+		if err != nil {
+			return err
+		}
+		threshold := float32(DUPLICATE_THRESHOLD)
+		duplicates, err := s.search(ctx, agent, embedding, 1, &threshold)
+		if err != nil {
+			return err
+		}
+		if len(duplicates) > 0 {
+			continue
+		}
+
+		memory := models.AgentMemory{
+			UserID:          agent.IdUser,
+			ChatID:          agent.IdChat,
+			AgentName:       agent.Name,
+			Kind:            string(kind),
+			Content:         content,
+			SourceMessageID: &exchange.UserMessageID,
+		}
+		if err := s.db.WithContext(ctx).Create(&memory).Error; err != nil {
+			return err
+		}
+		if err := s.upsert(ctx, memory, embedding); err != nil {
+			return err
+		}
+		slog.Info("Agent remembered", "agent", agent.Name, "chat", agent.IdChat, "kind", kind)
+	}
+	return nil
+}
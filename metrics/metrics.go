@@ -0,0 +1,118 @@
+// Package metrics defines the Prometheus metrics of the chat pipeline. They
+// are served on /metrics for alerting and capacity planning.
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const NAMESPACE = "trio"
+
+// Chat modes, the mode label of the chat metrics
+const (
+	MODE_BASIC      = "basic"
+	MODE_REFLECTION = "reflection"
+)
+
+// Evaluator verdicts, the verdict label of EvaluatorVerdicts
+const (
+	VERDICT_OPTIMAL     = "optimal"
+	VERDICT_NOT_OPTIMAL = "not_optimal"
+)
+
+// Reflection outcomes, the outcome label of ReflectionIterations
+const (
+	OUTCOME_OPTIMAL = "optimal"
+	// OUTCOME_LIMIT is a reflection stopped by the iteration limit
+	OUTCOME_LIMIT = "limit"
+)
+
+// modelCallBuckets range from a cached embedding to a long streamed reply
+var modelCallBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80, 160}
+
+var (
+	Messages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "messages_total",
+		Help:      "User messages accepted, by chat mode.",
+	}, []string{"mode"})
+
+	AgentResponseSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "agent_response_seconds",
+		Help:      "Time from an agent or answerer starting until its reply is complete, by chat mode and model.",
+		Buckets:   modelCallBuckets,
+	}, []string{"mode", "model"})
+
+	ReflectionIterations = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "reflection_iterations",
+		Help:      "Answerer iterations a reflection took, by whether the evaluator accepted the answer or the limit was hit.",
+		Buckets:   prometheus.LinearBuckets(1, 1, 6),
+	}, []string{"outcome"})
+
+	DiscussionRounds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "discussion_rounds",
+		Help:      "Rounds basic chat discussions of more than one round took, by why they stopped.",
+		Buckets:   prometheus.LinearBuckets(1, 1, 10),
+	}, []string{"reason"})
+
+	EvaluatorVerdicts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "evaluator_verdicts_total",
+		Help:      "Evaluator verdicts on answers.",
+	}, []string{"verdict"})
+
+	ModelCallSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "llm_call_seconds",
+		Help:      "Duration of model calls including the wait for rate limit capacity, by provider, model and operation.",
+		Buckets:   modelCallBuckets,
+	}, []string{"provider", "model", "operation"})
+
+	ModelErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "llm_errors_total",
+		Help:      "Failed model calls, each retry counted, by provider, model and operation.",
+	}, []string{"provider", "model", "operation"})
+
+	ModelTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "llm_tokens_total",
+		Help:      "Tokens used by model calls, by provider, model and direction (input or output).",
+	}, []string{"provider", "model", "direction"})
+
+	ModelCost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "llm_cost_dollars_total",
+		Help:      "Cost of model calls in dollars, by provider and model.",
+	}, []string{"provider", "model"})
+
+	QdrantSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "qdrant_request_seconds",
+		Help:      "Duration of Qdrant requests, by gRPC method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	ActiveStreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "active_streams",
+		Help:      "SSE message streams currently open, by chat mode.",
+	}, []string{"mode"})
+)
+
+// QdrantInterceptor times the unary gRPC calls of the Qdrant client.
+func QdrantInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	QdrantSeconds.WithLabelValues(method, status.Code(err).String()).Observe(time.Since(start).Seconds())
+	return err
+}
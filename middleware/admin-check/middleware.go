@@ -0,0 +1,36 @@
+package admincheck
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/somtojf/trio-server/models"
+)
+
+type Middleware struct{}
+
+func NewMiddleware() *Middleware {
+	return &Middleware{}
+}
+
+// AdminCheck only lets admins through. It must run after the auth check
+// middleware, which puts the current user in the context.
+func (m *Middleware) AdminCheck() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		currentUser, exists := c.Get("currentUser")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
+		}
+
+		user := currentUser.(models.User)
+		if !user.IsAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strconv"
+
+	"github.com/qdrant/go-client/qdrant"
+	"github.com/somtojf/trio-server/initializers"
+	"github.com/somtojf/trio-server/types/qdranttypes"
+)
+
+// CHAT_IDS_BATCH_SIZE is the number of points scrolled at once.
+const CHAT_IDS_BATCH_SIZE = 500
+
+func init() {
+	initializers.LoadEnvVariables()
+	initializers.ConnectToQdrant()
+}
+
+// Basic messages used to be indexed with an integer chat_id, but the
+// collection's index and the retrieval filter expect a keyword. This rewrites
+// the chat_id of those points as a string without embedding them again. Points
+// that already have a string are left alone, so it can run more than once.
+func main() {
+	ctx := context.Background()
+	client := initializers.QdrantClient
+	collection := string(qdranttypes.COLLECTION_NAME_BASIC_MESSAGES)
+
+	limit := uint32(CHAT_IDS_BATCH_SIZE)
+	wait := true
+	var offset *qdrant.PointId
+	scanned, converted := 0, 0
+	for {
+		points, err := client.Scroll(ctx, &qdrant.ScrollPoints{
+			CollectionName: collection,
+			Offset:         offset,
+			Limit:          &limit,
+			WithPayload:    qdrant.NewWithPayloadInclude("chat_id"),
+		})
+		if err != nil {
+			log.Fatal(fmt.Errorf("error scrolling basic messages: %w", err))
+		}
+		if len(points) == 0 {
+			break
+		}
+		scanned += len(points)
+
+		byChat := make(map[int64][]*qdrant.PointId)
+		for _, point := range points {
+			chatID, ok := point.GetPayload()["chat_id"].GetKind().(*qdrant.Value_IntegerValue)
+			if ok {
+				byChat[chatID.IntegerValue] = append(byChat[chatID.IntegerValue], point.GetId())
+			}
+		}
+		for chatID, ids := range byChat {
+			_, err := client.SetPayload(ctx, &qdrant.SetPayloadPoints{
+				CollectionName: collection,
+				Wait:           &wait,
+				Payload:        qdrant.NewValueMap(map[string]any{"chat_id": strconv.FormatInt(chatID, 10)}),
+				PointsSelector: qdrant.NewPointsSelectorIDs(ids),
+			})
+			if err != nil {
+				log.Fatal(fmt.Errorf("error converting chat_id of chat %d: %w", chatID, err))
+			}
+			converted += len(ids)
+		}
+
+		// Points are scrolled in id order and basic messages have numeric ids
+		offset = qdrant.NewIDNum(points[len(points)-1].GetId().GetNum() + 1)
+	}
+
+	slog.Info("Converted chat_id payloads to strings", "scanned", scanned, "converted", converted)
+}
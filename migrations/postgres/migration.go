@@ -15,7 +15,7 @@ func init() {
 func main() {
 	db := initializers.DB
 
-	error := db.AutoMigrate(&models.User{}, &models.BasicChat{}, &models.ReflectionChat{}, &models.BasicAgent{}, &models.BasicMessage{}, &models.Reflection{}, &models.ReflectionMessage{}, &models.EvaluatorMessage{})
+	error := db.AutoMigrate(&models.User{}, &models.BasicChat{}, &models.ReflectionChat{}, &models.BasicAgent{}, &models.BasicMessage{}, &models.BasicToolCall{}, &models.Reflection{}, &models.ReflectionMessage{}, &models.EvaluatorMessage{}, &models.AIPIRecord{}, &models.UserQuota{}, &models.EmbeddingCacheEntry{}, &models.Attachment{}, &models.ModerationEvent{}, &models.Persona{}, &models.AgentMemory{}, &models.ChatSummary{}, &models.ChatSummarySection{})
 
 	if error != nil {
 		log.Fatal("Error migrating database: ", error)
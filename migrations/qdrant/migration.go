@@ -7,6 +7,7 @@ import (
 	"log/slog"
 
 	"github.com/qdrant/go-client/qdrant"
+	"github.com/somtojf/trio-server/aipi/registry"
 	"github.com/somtojf/trio-server/initializers"
 	"github.com/somtojf/trio-server/types/qdranttypes"
 )
@@ -17,16 +18,29 @@ func init() {
 }
 
 func main() {
-	err := createQdrantCollections(initializers.QdrantClient)
+	modelRegistry, err := registry.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	embedding, err := qdranttypes.LoadEmbeddingSettings(modelRegistry)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Creating collections for embedding model", "model", embedding.Model, "vectorSize", embedding.VectorSize)
+
+	err = createQdrantCollections(initializers.QdrantClient, embedding)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func createQdrantCollections(client *qdrant.Client) error {
+func createQdrantCollections(client *qdrant.Client, embedding qdranttypes.EmbeddingSettings) error {
 	ctx := context.Background()
 	collections := []qdranttypes.CollectionName{
 		qdranttypes.COLLECTION_NAME_BASIC_MESSAGES,
+		qdranttypes.COLLECTION_NAME_REFLECTION_MESSAGES,
+		qdranttypes.COLLECTION_NAME_COMPLETION_CACHE,
+		qdranttypes.COLLECTION_NAME_AGENT_MEMORIES,
 	}
 
 	for _, collection := range collections {
@@ -51,7 +65,7 @@ func createQdrantCollections(client *qdrant.Client) error {
 		err = client.CreateCollection(ctx, &qdrant.CreateCollection{
 			CollectionName: string(collection),
 			VectorsConfig: qdrant.NewVectorsConfig(&qdrant.VectorParams{
-				Size:     uint64(qdranttypes.VECTOR_SIZE_BASIC_MESSAGE),
+				Size:     uint64(embedding.VectorSize),
 				Distance: qdrant.Distance_Cosine,
 			}),
 			OptimizersConfig: &qdrant.OptimizersConfigDiff{
@@ -75,13 +89,33 @@ func createQdrantCollections(client *qdrant.Client) error {
 	return nil
 }
 
-func createIndexes(ctx context.Context, client *qdrant.Client, collection qdranttypes.CollectionName) error {
-	// Define field types for different fields
-	fieldConfigs := map[string]*qdrant.FieldType{
+// collectionIndexes are the payload fields each collection is searched by.
+var collectionIndexes = map[qdranttypes.CollectionName]map[string]*qdrant.FieldType{
+	qdranttypes.COLLECTION_NAME_BASIC_MESSAGES: {
 		"content":     qdrant.FieldType_FieldTypeText.Enum(),
 		"chat_id":     qdrant.FieldType_FieldTypeKeyword.Enum(),
 		"external_id": qdrant.FieldType_FieldTypeKeyword.Enum(),
-	}
+	},
+	qdranttypes.COLLECTION_NAME_REFLECTION_MESSAGES: {
+		"content":     qdrant.FieldType_FieldTypeText.Enum(),
+		"chat_id":     qdrant.FieldType_FieldTypeKeyword.Enum(),
+		"external_id": qdrant.FieldType_FieldTypeKeyword.Enum(),
+	},
+	qdranttypes.COLLECTION_NAME_COMPLETION_CACHE: {
+		"user_id":     qdrant.FieldType_FieldTypeInteger.Enum(),
+		"model":       qdrant.FieldType_FieldTypeKeyword.Enum(),
+		"prefix_hash": qdrant.FieldType_FieldTypeKeyword.Enum(),
+		"created_at":  qdrant.FieldType_FieldTypeInteger.Enum(),
+	},
+	qdranttypes.COLLECTION_NAME_AGENT_MEMORIES: {
+		"user_id":    qdrant.FieldType_FieldTypeInteger.Enum(),
+		"chat_id":    qdrant.FieldType_FieldTypeInteger.Enum(),
+		"agent_name": qdrant.FieldType_FieldTypeKeyword.Enum(),
+	},
+}
+
+func createIndexes(ctx context.Context, client *qdrant.Client, collection qdranttypes.CollectionName) error {
+	fieldConfigs := collectionIndexes[collection]
 
 	// Create payload indexes for common search fields
 	for field, fieldType := range fieldConfigs {
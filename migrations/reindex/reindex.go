@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strconv"
+
+	"github.com/qdrant/go-client/qdrant"
+	"github.com/sashabaranov/go-openai"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/common"
+	"github.com/somtojf/trio-server/initializers"
+	"github.com/somtojf/trio-server/models"
+	"github.com/somtojf/trio-server/types/qdranttypes"
+	"gorm.io/gorm"
+)
+
+// REINDEX_BATCH_SIZE is the number of messages embedded and upserted at once.
+const REINDEX_BATCH_SIZE = 100
+
+func init() {
+	initializers.LoadEnvVariables()
+	initializers.InitTracing()
+	initializers.ConnectToPostgresDB()
+	initializers.ConnectToQdrant()
+}
+
+// Reindexing embeds every agent message of every basic chat again, for
+// example after the qdrant migration recreated the collections for a new
+// embedding model. Texts already in the embedding cache are not paid for twice.
+func main() {
+	ctx := context.Background()
+	defer initializers.ShutdownTracing(ctx)
+
+	deps, err := common.NewDependencies(ctx, initializers.DB, initializers.QdrantClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var chats []models.BasicChat
+	if err := initializers.DB.Find(&chats).Error; err != nil {
+		log.Fatal(fmt.Errorf("error loading chats: %w", err))
+	}
+
+	indexed := 0
+	for _, chat := range chats {
+		var messages []models.BasicMessage
+		// Only agent replies are indexed, user messages have no model
+		err := initializers.DB.Where("id_basic_chat = ? AND model_name <> ''", chat.IdBasicChat).
+			Order("id_basic_message").
+			FindInBatches(&messages, REINDEX_BATCH_SIZE, func(tx *gorm.DB, batch int) error {
+				indexed += len(messages)
+				return reindexMessages(ctx, deps, messages, chat.UserID)
+			}).Error
+		if err != nil {
+			log.Fatal(fmt.Errorf("error reindexing chat %s: %w", chat.ExternalID, err))
+		}
+	}
+
+	slog.Info("Reindexed basic messages", "chats", len(chats), "messages", indexed, "model", deps.Embedding.Model, "vectorSize", deps.Embedding.VectorSize)
+}
+
+func reindexMessages(ctx context.Context, deps *common.Dependencies, messages []models.BasicMessage, idUser uint) error {
+	contents := make([]string, len(messages))
+	for i, message := range messages {
+		contents[i] = message.Content
+	}
+
+	embeddings, err := deps.AIPIClient.GetEmbeddings(ctx, aipitypes.EmbeddingRequest{
+		Input:          contents,
+		Model:          deps.Embedding.Model,
+		EncodingFormat: string(openai.EmbeddingEncodingFormatFloat),
+		Dimensions:     int(deps.Embedding.VectorSize),
+		IdUser:         idUser,
+	})
+	if err != nil {
+		return err
+	}
+
+	points := make([]*qdrant.PointStruct, len(messages))
+	for i, message := range messages {
+		payload := qdranttypes.MessagePayload{
+			ChatID:     strconv.FormatUint(uint64(message.ChatID), 10),
+			Content:    message.Content,
+			SenderName: message.SenderName,
+			ExternalID: message.ExternalID.String(),
+			CreatedAt:  message.CreatedAt,
+		}
+		points[i] = &qdrant.PointStruct{
+			Id:      qdrant.NewIDNum(uint64(message.IdBasicMessage)),
+			Vectors: qdrant.NewVectors(embeddings[i]...),
+			Payload: payload.Values(),
+		}
+	}
+
+	_, err = initializers.QdrantClient.Upsert(ctx, &qdrant.UpsertPoints{
+		CollectionName: string(qdranttypes.COLLECTION_NAME_BASIC_MESSAGES),
+		Points:         points,
+	})
+	return err
+}
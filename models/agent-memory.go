@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// AgentMemory is a durable fact or preference a basic chat agent learned about
+// its user. Memories belong to the agent's name in the chat, so they survive
+// the agents being recreated when the chat is edited. Their embeddings are in
+// the agent memories collection of Qdrant under IdAgentMemory. SourceMessageID
+// is the user message a memory was extracted from, nil for edited memories.
+type AgentMemory struct {
+	IdAgentMemory   uint           `gorm:"primaryKey;column:id_agent_memory;autoIncrement" json:"-"`
+	ExternalID      uuid.UUID      `gorm:"unique;type:uuid;default:gen_random_uuid()" json:"id"`
+	UserID          uint           `gorm:"column:user_id;index:idx_agent_memory_owner" json:"-"`
+	ChatID          uint           `gorm:"column:id_basic_chat;index:idx_agent_memory_owner" json:"-"`
+	AgentName       string         `gorm:"column:agent_name;index:idx_agent_memory_owner" json:"agentName"`
+	Kind            string         `gorm:"column:kind" json:"kind"`
+	Content         string         `gorm:"column:content" json:"content"`
+	SourceMessageID *uint          `gorm:"column:id_basic_message" json:"-"`
+	CreatedAt       time.Time      `json:"createdAt"`
+	UpdatedAt       time.Time      `json:"updatedAt"`
+	DeletedAt       gorm.DeletedAt `gorm:"index" json:"-"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Attachment is an image a user uploaded. It is stored in the blob store under
+// StorageKey and belongs to at most one basic or reflection message; until it
+// is sent with a message both message ids are nil.
+type Attachment struct {
+	IdAttachment        uint           `gorm:"primaryKey;column:id_attachment;autoIncrement" json:"-"`
+	ExternalID          uuid.UUID      `gorm:"unique;type:uuid;default:gen_random_uuid()" json:"id"`
+	UserID              uint           `gorm:"column:user_id;index" json:"-"`
+	StorageKey          string         `gorm:"column:storage_key" json:"-"`
+	FileName            string         `gorm:"column:file_name" json:"fileName"`
+	ContentType         string         `gorm:"column:content_type" json:"contentType"`
+	SizeBytes           int            `gorm:"column:size_bytes" json:"sizeBytes"`
+	BasicMessageID      *uint          `gorm:"column:id_basic_message;index" json:"-"`
+	ReflectionMessageID *uint          `gorm:"column:id_reflection_message;index" json:"-"`
+	CreatedAt           time.Time      `json:"createdAt"`
+	UpdatedAt           time.Time      `json:"updatedAt"`
+	DeletedAt           gorm.DeletedAt `gorm:"index" json:"-"`
+}
@@ -8,12 +8,19 @@ import (
 	"gorm.io/gorm"
 )
 
+// BasicAgent is an agent of one basic chat. Agents created from a persona are
+// copies of it; linked agents keep PersonaID and follow the persona's changes.
 type BasicAgent struct {
 	IdBasicAgent uint           `gorm:"primaryKey;column:id_basic_agent;autoIncrement" json:"-"`
 	ExternalID   uuid.UUID      `gorm:"unique;type:uuid;default:gen_random_uuid()" json:"id"`
 	AgentName    string         `gorm:"column:agent_name;uniqueIndex:idx_agent_name_chat"`
 	AgentTraits  pq.StringArray `gorm:"type:text[]"`
+	Tools        pq.StringArray `gorm:"type:text[]"`
+	Settings     ModelSettings  `gorm:"embedded"`
 	ChatID       uint           `gorm:"column:id_basic_chat;uniqueIndex:idx_agent_name_chat"`
+	AvatarURL    string         `gorm:"column:avatar_url"`
+	Description  string         `gorm:"column:description"`
+	PersonaID    *uint          `gorm:"column:id_persona;index"`
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
 	DeletedAt    gorm.DeletedAt `gorm:"index"`
@@ -7,15 +7,35 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	// GENERATION_MODE_SEQUENTIAL lets the agents of a round reply one after
+	// another, each seeing the replies before its own
+	GENERATION_MODE_SEQUENTIAL = "sequential"
+	// GENERATION_MODE_PARALLEL lets the agents of a round reply at the same
+	// time without seeing each other's replies. Replies are still delivered
+	// in speaking order.
+	GENERATION_MODE_PARALLEL = "parallel"
+)
+
+// BasicChat is a chat between a user and agents. TurnTaking names the strategy
+// that picks which agents answer a message and TurnCount counts the user's
+// messages, which round robin turn taking starts from. DiscussionRounds is how
+// many rounds the agents may respond to each other after a user message.
+// GenerationMode says whether the agents of a round reply one after another
+// or at the same time.
 type BasicChat struct {
-	IdBasicChat uint           `gorm:"primaryKey;column:id_basic_chat;autoIncrement" json:"-"`
-	ExternalID  uuid.UUID      `gorm:"unique;type:uuid;default:gen_random_uuid()" json:"id"`
-	ChatName    string         `gorm:"column:chat_name" json:"chatName"`
-	ChatAgents  []BasicAgent   `gorm:"foreignKey:ChatID" json:"chatAgents"`
-	UserID      uint           `gorm:"column:user_id" json:"userId"`
-	User        User           `gorm:"foreignKey:UserID" json:"user"`
-	Messages    []BasicMessage `gorm:"foreignKey:ChatID" json:"messages"`
-	CreatedAt   time.Time      `gorm:"column:created_at" json:"createdAt"`
-	UpdatedAt   time.Time      `gorm:"column:updated_at" json:"updatedAt"`
-	DeletedAt   gorm.DeletedAt `gorm:"index"`
+	IdBasicChat      uint           `gorm:"primaryKey;column:id_basic_chat;autoIncrement" json:"-"`
+	ExternalID       uuid.UUID      `gorm:"unique;type:uuid;default:gen_random_uuid()" json:"id"`
+	ChatName         string         `gorm:"column:chat_name" json:"chatName"`
+	ChatAgents       []BasicAgent   `gorm:"foreignKey:ChatID" json:"chatAgents"`
+	UserID           uint           `gorm:"column:user_id" json:"userId"`
+	User             User           `gorm:"foreignKey:UserID" json:"user"`
+	Messages         []BasicMessage `gorm:"foreignKey:ChatID" json:"messages"`
+	TurnTaking       string         `gorm:"column:turn_taking;default:random" json:"turnTaking"`
+	TurnCount        int            `gorm:"column:turn_count;default:0" json:"-"`
+	DiscussionRounds int            `gorm:"column:discussion_rounds;default:1" json:"discussionRounds"`
+	GenerationMode   string         `gorm:"column:generation_mode;default:sequential" json:"generationMode"`
+	CreatedAt        time.Time      `gorm:"column:created_at" json:"createdAt"`
+	UpdatedAt        time.Time      `gorm:"column:updated_at" json:"updatedAt"`
+	DeletedAt        gorm.DeletedAt `gorm:"index"`
 }
@@ -8,11 +8,14 @@ import (
 )
 
 type BasicMessage struct {
-	IdBasicMessage uint      `gorm:"primaryKey;column:id_basic_message;autoIncrement" json:"-"`
-	ExternalID     uuid.UUID `gorm:"unique;type:uuid;default:gen_random_uuid()" json:"id"`
-	SenderName     string    `gorm:"column:sender_name" json:"senderName"`
-	ChatID         uint      `gorm:"column:id_basic_chat" json:"chatId"`
-	Content        string    `gorm:"column:content" json:"content"`
+	IdBasicMessage uint            `gorm:"primaryKey;column:id_basic_message;autoIncrement" json:"-"`
+	ExternalID     uuid.UUID       `gorm:"unique;type:uuid;default:gen_random_uuid()" json:"id"`
+	SenderName     string          `gorm:"column:sender_name" json:"senderName"`
+	ChatID         uint            `gorm:"column:id_basic_chat" json:"chatId"`
+	Content        string          `gorm:"column:content" json:"content"`
+	ModelName      string          `gorm:"column:model_name" json:"modelName"`
+	ToolCalls      []BasicToolCall `gorm:"foreignKey:MessageID" json:"toolCalls"`
+	Attachments    []Attachment    `gorm:"foreignKey:BasicMessageID" json:"attachments"`
 	CreatedAt      time.Time
 	UpdatedAt      time.Time
 	DeletedAt      gorm.DeletedAt `gorm:"index"`
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// BasicToolCall is a tool an agent called while writing a basic message.
+type BasicToolCall struct {
+	IdBasicToolCall uint           `gorm:"primaryKey;column:id_basic_tool_call;autoIncrement" json:"-"`
+	ExternalID      uuid.UUID      `gorm:"unique;type:uuid;default:gen_random_uuid()" json:"id"`
+	MessageID       uint           `gorm:"column:id_basic_message;index" json:"-"`
+	ToolCallID      string         `gorm:"column:tool_call_id" json:"toolCallId"`
+	ToolName        string         `gorm:"column:tool_name" json:"toolName"`
+	Arguments       string         `gorm:"column:arguments" json:"arguments"`
+	Result          string         `gorm:"column:result" json:"result"`
+	Error           string         `gorm:"column:error" json:"error,omitempty"`
+	CreatedAt       time.Time      `json:"createdAt"`
+	UpdatedAt       time.Time      `json:"updatedAt"`
+	DeletedAt       gorm.DeletedAt `gorm:"index" json:"-"`
+}
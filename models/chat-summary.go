@@ -0,0 +1,53 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ChatSummary is the rolling summary of a basic or reflection chat. Messages
+// older than the ones prompted with are summarized in sections, and sections
+// of a level are condensed into one of the next level once there are enough
+// of them, so older parts of the chat are summarized more briefly.
+// LastMessageID is the latest message summarized so far.
+type ChatSummary struct {
+	IdChatSummary uint                 `gorm:"primaryKey;column:id_chat_summary;autoIncrement" json:"-"`
+	ExternalID    uuid.UUID            `gorm:"unique;type:uuid;default:gen_random_uuid()" json:"id"`
+	ChatType      string               `gorm:"column:chat_type;uniqueIndex:idx_chat_summary_chat" json:"chatType"`
+	ChatID        uint                 `gorm:"column:chat_id;uniqueIndex:idx_chat_summary_chat" json:"-"`
+	UserID        uint                 `gorm:"column:user_id" json:"-"`
+	LastMessageID uint                 `gorm:"column:last_message_id" json:"-"`
+	MessageCount  int                  `gorm:"column:message_count" json:"messageCount"`
+	Sections      []ChatSummarySection `gorm:"foreignKey:SummaryID" json:"sections"`
+	CreatedAt     time.Time            `json:"createdAt"`
+	UpdatedAt     time.Time            `json:"updatedAt"`
+	DeletedAt     gorm.DeletedAt       `gorm:"index" json:"-"`
+}
+
+// ChatSummarySection summarizes a stretch of a chat. Level 1 sections
+// summarize messages, higher levels condense the sections below them.
+type ChatSummarySection struct {
+	IdChatSummarySection uint           `gorm:"primaryKey;column:id_chat_summary_section;autoIncrement" json:"-"`
+	SummaryID            uint           `gorm:"column:id_chat_summary;index" json:"-"`
+	Level                int            `gorm:"column:level" json:"level"`
+	Content              string         `gorm:"column:content" json:"content"`
+	MessageCount         int            `gorm:"column:message_count" json:"messageCount"`
+	FirstMessageAt       time.Time      `gorm:"column:first_message_at" json:"firstMessageAt"`
+	LastMessageAt        time.Time      `gorm:"column:last_message_at" json:"lastMessageAt"`
+	CreatedAt            time.Time      `json:"createdAt"`
+	UpdatedAt            time.Time      `json:"updatedAt"`
+	DeletedAt            gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// Content joins the sections oldest first. Sections must be ordered by
+// FirstMessageAt.
+func (s ChatSummary) Content() string {
+	contents := make([]string, len(s.Sections))
+	for i, section := range s.Sections {
+		contents[i] = section.Content
+	}
+	return strings.Join(contents, "\n\n")
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// EmbeddingCacheEntry is a computed embedding of a text, keyed by the sha256 of
+// the text, the model and the vector size. Entries can be derived again at any
+// time, so they are deleted for good rather than soft deleted.
+type EmbeddingCacheEntry struct {
+	IdEmbeddingCacheEntry uint            `gorm:"primaryKey;column:id_embedding_cache_entry;autoIncrement" json:"-"`
+	ExternalID            uuid.UUID       `gorm:"unique;type:uuid;default:gen_random_uuid()" json:"id"`
+	ModelName             string          `gorm:"column:model_name;uniqueIndex:idx_embedding_cache_key" json:"modelName"`
+	Dimensions            int             `gorm:"column:dimensions;uniqueIndex:idx_embedding_cache_key" json:"dimensions"`
+	ContentHash           string          `gorm:"column:content_hash;uniqueIndex:idx_embedding_cache_key" json:"contentHash"`
+	Embedding             pq.Float32Array `gorm:"type:real[]" json:"-"`
+	CreatedAt             time.Time       `json:"createdAt"`
+	UpdatedAt             time.Time       `json:"updatedAt"`
+}
@@ -0,0 +1,31 @@
+package models
+
+import "github.com/somtojf/trio-server/aipi/aipitypes"
+
+// ModelSettings are the model and sampling parameters a chat participant
+// answers with. An empty ModelName uses the server default and nil parameters
+// keep the provider defaults.
+type ModelSettings struct {
+	ModelName   string   `gorm:"column:model_name" json:"modelName"`
+	Temperature *float32 `gorm:"column:temperature" json:"temperature"`
+	TopP        *float32 `gorm:"column:top_p" json:"topP"`
+	MaxTokens   *int     `gorm:"column:max_tokens" json:"maxTokens"`
+	Seed        *int     `gorm:"column:seed" json:"seed"`
+}
+
+// Model returns the model to use, fallback when none was picked.
+func (s ModelSettings) Model(fallback string) string {
+	if s.ModelName == "" {
+		return fallback
+	}
+	return s.ModelName
+}
+
+func (s ModelSettings) Sampling() aipitypes.Sampling {
+	return aipitypes.Sampling{
+		Temperature: s.Temperature,
+		TopP:        s.TopP,
+		MaxTokens:   s.MaxTokens,
+		Seed:        s.Seed,
+	}
+}
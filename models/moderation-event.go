@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ModerationEvent is a user message or agent reply that moderation flagged.
+// Flagged input never reaches the models and flagged output is not stored as
+// a message, so Content is the only copy.
+type ModerationEvent struct {
+	IdModerationEvent uint           `gorm:"primaryKey;column:id_moderation_event;autoIncrement" json:"-"`
+	ExternalID        uuid.UUID      `gorm:"unique;type:uuid;default:gen_random_uuid()" json:"id"`
+	UserID            uint           `gorm:"column:user_id;index" json:"-"`
+	Direction         string         `gorm:"column:direction" json:"direction"`
+	ChatType          string         `gorm:"column:chat_type" json:"chatType"`
+	ChatID            uint           `gorm:"column:chat_id" json:"-"`
+	Author            string         `gorm:"column:author" json:"author"`
+	Content           string         `gorm:"column:content;type:text" json:"content"`
+	Categories        pq.StringArray `gorm:"type:text[]" json:"categories"`
+	Classifier        string         `gorm:"column:classifier" json:"classifier"`
+	CreatedAt         time.Time      `json:"createdAt"`
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// Persona is a saved agent that basic chats can be created from. A user's
+// personas belong to them; system personas have no user, are curated by
+// admins and can be used by everyone.
+type Persona struct {
+	IdPersona   uint           `gorm:"primaryKey;column:id_persona;autoIncrement" json:"-"`
+	ExternalID  uuid.UUID      `gorm:"unique;type:uuid;default:gen_random_uuid()" json:"id"`
+	UserID      *uint          `gorm:"column:user_id;index" json:"-"`
+	IsSystem    bool           `gorm:"column:is_system;default:false;index" json:"isSystem"`
+	Name        string         `gorm:"column:name" json:"name"`
+	Traits      pq.StringArray `gorm:"type:text[]" json:"traits"`
+	Tools       pq.StringArray `gorm:"type:text[]" json:"tools"`
+	Settings    ModelSettings  `gorm:"embedded" json:"settings"`
+	AvatarURL   string         `gorm:"column:avatar_url" json:"avatarUrl"`
+	Description string         `gorm:"column:description" json:"description"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// Agent returns the persona as an agent without a chat.
+func (p Persona) Agent() BasicAgent {
+	return BasicAgent{
+		AgentName:   p.Name,
+		AgentTraits: p.Traits,
+		Tools:       p.Tools,
+		Settings:    p.Settings,
+		AvatarURL:   p.AvatarURL,
+		Description: p.Description,
+	}
+}
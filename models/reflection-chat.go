@@ -14,6 +14,8 @@ type ReflectionChat struct {
 	UserID           uint           `gorm:"column:user_id" json:"userId"`
 	User             User           `gorm:"foreignKey:UserID" json:"user"`
 	Reflections      []Reflection   `gorm:"foreignKey:ChatID" json:"reflections"`
+	Answerer         ModelSettings  `gorm:"embedded;embeddedPrefix:answerer_" json:"answerer"`
+	Evaluator        ModelSettings  `gorm:"embedded;embeddedPrefix:evaluator_" json:"evaluator"`
 	CreatedAt        time.Time      `gorm:"column:created_at" json:"createdAt"`
 	UpdatedAt        time.Time      `gorm:"column:updated_at" json:"updatedAt"`
 	DeletedAt        gorm.DeletedAt `gorm:"index"`
@@ -14,7 +14,9 @@ type ReflectionMessage struct {
 	IsOptimal           bool           `gorm:"column:is_optimal" default:"false" json:"isOptimal"`
 	Title               string         `gorm:"column:title" json:"title"`
 	Content             string         `gorm:"column:content" json:"content"`
+	ModelName           string         `gorm:"column:model_name" json:"modelName"`
 	ReflectionID        uint           `gorm:"column:id_reflection" json:"reflectionId"`
+	Attachments         []Attachment   `gorm:"foreignKey:ReflectionMessageID" json:"attachments"`
 	CreatedAt           time.Time      `json:"createdAt"`
 	UpdatedAt           time.Time      `json:"updatedAt"`
 	DeletedAt           gorm.DeletedAt `gorm:"index" json:"-"`
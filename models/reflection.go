@@ -24,6 +24,7 @@ type EvaluatorMessage struct {
 	Title              string         `gorm:"column:title" json:"title"`
 	Content            string         `gorm:"column:content" json:"content"`
 	IsOptimal          bool           `gorm:"column:is_optimal" default:"false" json:"isOptimal"`
+	ModelName          string         `gorm:"column:model_name" json:"modelName"`
 	ReflectionID       uint           `gorm:"column:id_reflection"`
 	CreatedAt          time.Time      `json:"createdAt"`
 	UpdatedAt          time.Time      `json:"updatedAt"`
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// UserQuota overrides the default limits of a user's tier. A nil limit means
+// the tier default applies, zero means unlimited.
+type UserQuota struct {
+	IdUserQuota       uint           `gorm:"primaryKey;column:id_user_quota;autoIncrement" json:"-"`
+	ExternalID        uuid.UUID      `gorm:"unique;type:uuid;default:gen_random_uuid()" json:"id"`
+	UserID            uint           `gorm:"column:id_user;uniqueIndex" json:"-"`
+	User              User           `gorm:"foreignKey:UserID" json:"-"`
+	DailyTokenLimit   *int           `gorm:"column:daily_token_limit" json:"dailyTokenLimit"`
+	MonthlyTokenLimit *int           `gorm:"column:monthly_token_limit" json:"monthlyTokenLimit"`
+	DailyCostLimit    *float64       `gorm:"column:daily_cost_limit" json:"dailyCostLimit"`
+	MonthlyCostLimit  *float64       `gorm:"column:monthly_cost_limit" json:"monthlyCostLimit"`
+	CreatedAt         time.Time      `json:"createdAt"`
+	UpdatedAt         time.Time      `json:"updatedAt"`
+	DeletedAt         gorm.DeletedAt `gorm:"index" json:"-"`
+}
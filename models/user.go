@@ -14,6 +14,7 @@ type User struct {
 	FullName        string           `json:"fullName"`
 	PasswordHash    string           `json:"-"`
 	IsGuest         bool             `gorm:"default:false" json:"isGuest"`
+	IsAdmin         bool             `gorm:"default:false" json:"isAdmin"`
 	CreatedAt       time.Time        `json:"createdAt"`
 	UpdatedAt       time.Time        `json:"updatedAt"`
 	BasicChats      []BasicChat      `gorm:"foreignKey:UserID"`
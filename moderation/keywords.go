@@ -0,0 +1,64 @@
+package moderation
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const KEYWORD_CATEGORY = "keyword"
+
+// KeywordClassifier flags texts containing any of a list of words or phrases.
+// It needs no network, so it works offline and as the last fallback.
+type KeywordClassifier struct {
+	pattern *regexp.Regexp
+}
+
+// NewKeywordClassifier matches the keywords case-insensitively as whole words.
+// Without keywords nothing is flagged.
+func NewKeywordClassifier(keywords []string) *KeywordClassifier {
+	var quoted []string
+	for _, keyword := range keywords {
+		keyword = strings.TrimSpace(keyword)
+		if keyword != "" {
+			quoted = append(quoted, regexp.QuoteMeta(keyword))
+		}
+	}
+	if len(quoted) == 0 {
+		return &KeywordClassifier{}
+	}
+	return &KeywordClassifier{pattern: regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)}
+}
+
+// LoadKeywords reads one keyword per line from path, skipping empty lines and
+// lines starting with #.
+func LoadKeywords(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading moderation keywords: %w", err)
+	}
+
+	var keywords []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			keywords = append(keywords, line)
+		}
+	}
+	return keywords, nil
+}
+
+func (k *KeywordClassifier) Name() string {
+	return "keywords"
+}
+
+func (k *KeywordClassifier) Classify(ctx context.Context, text string, idUser uint) (Result, error) {
+	result := Result{Classifier: k.Name()}
+	if k.pattern != nil && k.pattern.MatchString(text) {
+		result.Flagged = true
+		result.Categories = []string{KEYWORD_CATEGORY}
+	}
+	return result, nil
+}
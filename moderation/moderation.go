@@ -0,0 +1,169 @@
+// Package moderation checks user messages before they reach the models and
+// agent replies before they are stored or shown.
+package moderation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/somtojf/trio-server/models"
+	"gorm.io/gorm"
+)
+
+type Direction string
+
+const (
+	// DIRECTION_INPUT is a message a user sent
+	DIRECTION_INPUT Direction = "input"
+	// DIRECTION_OUTPUT is a reply an agent or answerer generated
+	DIRECTION_OUTPUT Direction = "output"
+)
+
+type ChatType string
+
+const (
+	CHAT_TYPE_BASIC      ChatType = "basic"
+	CHAT_TYPE_REFLECTION ChatType = "reflection"
+)
+
+// Result is what a classifier decided about a text.
+type Result struct {
+	Flagged    bool
+	Categories []string
+	// Classifier is the name of the classifier that decided
+	Classifier string
+}
+
+// Classifier decides whether a text is abusive.
+type Classifier interface {
+	Name() string
+	Classify(ctx context.Context, text string, idUser uint) (Result, error)
+}
+
+// FallbackClassifier asks its classifiers in order and returns the first
+// answer, so a failing remote classifier falls back to the next one.
+type FallbackClassifier struct {
+	classifiers []Classifier
+}
+
+func NewFallbackClassifier(classifiers ...Classifier) *FallbackClassifier {
+	return &FallbackClassifier{classifiers: classifiers}
+}
+
+func (f *FallbackClassifier) Name() string {
+	names := make([]string, len(f.classifiers))
+	for i, classifier := range f.classifiers {
+		names[i] = classifier.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *FallbackClassifier) Classify(ctx context.Context, text string, idUser uint) (Result, error) {
+	var errs []error
+	for _, classifier := range f.classifiers {
+		result, err := classifier.Classify(ctx, text, idUser)
+		if err == nil {
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return Result{}, ctx.Err()
+		}
+		slog.Warn("Moderation classifier failed, falling back", "classifier", classifier.Name(), "error", err)
+		errs = append(errs, err)
+	}
+	return Result{}, fmt.Errorf("every moderation classifier failed: %w", errors.Join(errs...))
+}
+
+// Item is a text to moderate and where it comes from.
+type Item struct {
+	IdUser    uint
+	Direction Direction
+	ChatType  ChatType
+	ChatID    uint
+	// Author is the username for input and the agent name for output
+	Author  string
+	Content string
+}
+
+// FlaggedError is returned by Check when an item was flagged.
+type FlaggedError struct {
+	Direction  Direction
+	Categories []string
+}
+
+func (e *FlaggedError) Error() string {
+	subject := "Your message"
+	if e.Direction == DIRECTION_OUTPUT {
+		subject = "The response"
+	}
+	if len(e.Categories) == 0 {
+		return fmt.Sprintf("%s was flagged by moderation", subject)
+	}
+	return fmt.Sprintf("%s was flagged by moderation for %s", subject, strings.Join(e.Categories, ", "))
+}
+
+// Moderator runs items through a classifier and keeps a ModerationEvent of
+// everything flagged.
+type Moderator struct {
+	db         *gorm.DB
+	classifier Classifier
+}
+
+// NewModerator returns a moderator that lets everything through when
+// classifier is nil.
+func NewModerator(db *gorm.DB, classifier Classifier) *Moderator {
+	return &Moderator{db: db, classifier: classifier}
+}
+
+// Enabled reports whether items are checked at all.
+func (m *Moderator) Enabled() bool {
+	return m != nil && m.classifier != nil
+}
+
+// classify returns what the classifier decided about the item. When no
+// classifier can be reached the item is let through, moderation never takes
+// the chat down.
+func (m *Moderator) classify(ctx context.Context, item Item) (Result, error) {
+	if !m.Enabled() || strings.TrimSpace(item.Content) == "" {
+		return Result{}, nil
+	}
+
+	result, err := m.classifier.Classify(ctx, item.Content, item.IdUser)
+	if err != nil {
+		if ctx.Err() != nil {
+			return Result{}, ctx.Err()
+		}
+		slog.Error("Failed to moderate content, letting it through", "direction", item.Direction, "chatType", item.ChatType, "error", err)
+		return Result{}, nil
+	}
+	return result, nil
+}
+
+// Check returns a *FlaggedError when the item is flagged.
+func (m *Moderator) Check(ctx context.Context, item Item) error {
+	result, err := m.classify(ctx, item)
+	if err != nil || !result.Flagged {
+		return err
+	}
+
+	event := models.ModerationEvent{
+		UserID:     item.IdUser,
+		Direction:  string(item.Direction),
+		ChatType:   string(item.ChatType),
+		ChatID:     item.ChatID,
+		Author:     item.Author,
+		Content:    item.Content,
+		Categories: pq.StringArray(result.Categories),
+		Classifier: result.Classifier,
+	}
+	if err := m.db.WithContext(ctx).Create(&event).Error; err != nil {
+		slog.Error("Failed to record moderation event", "direction", item.Direction, "chatType", item.ChatType, "error", err)
+	}
+	slog.Info("Content flagged by moderation", "direction", item.Direction, "chatType", item.ChatType, "categories", result.Categories, "classifier", result.Classifier)
+
+	return &FlaggedError{Direction: item.Direction, Categories: result.Categories}
+}
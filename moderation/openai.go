@@ -0,0 +1,75 @@
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const OPENAI_MODERATION_MODEL = openai.ModerationOmniLatest
+
+// OpenAIClassifier uses the OpenAI moderation endpoint, which is free to call.
+type OpenAIClassifier struct {
+	client *openai.Client
+}
+
+func NewOpenAIClassifier(client *openai.Client) *OpenAIClassifier {
+	return &OpenAIClassifier{client: client}
+}
+
+func (o *OpenAIClassifier) Name() string {
+	return "openai"
+}
+
+func (o *OpenAIClassifier) Classify(ctx context.Context, text string, idUser uint) (Result, error) {
+	response, err := o.client.Moderations(ctx, openai.ModerationRequest{
+		Input: text,
+		Model: OPENAI_MODERATION_MODEL,
+	})
+	if err != nil {
+		return Result{}, fmt.Errorf("error calling openai moderation: %w", err)
+	}
+	if len(response.Results) == 0 {
+		return Result{}, fmt.Errorf("openai moderation returned no results")
+	}
+
+	result := Result{Classifier: o.Name()}
+	for _, moderation := range response.Results {
+		if !moderation.Flagged {
+			continue
+		}
+		result.Flagged = true
+
+		categories, err := flaggedCategories(moderation.Categories)
+		if err != nil {
+			return Result{}, err
+		}
+		result.Categories = append(result.Categories, categories...)
+	}
+	return result, nil
+}
+
+// flaggedCategories returns the names of the categories that are set, as the
+// API spells them, e.g. "self-harm/intent".
+func flaggedCategories(categories openai.ResultCategories) ([]string, error) {
+	data, err := json.Marshal(categories)
+	if err != nil {
+		return nil, fmt.Errorf("error reading moderation categories: %w", err)
+	}
+	var set map[string]bool
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("error reading moderation categories: %w", err)
+	}
+
+	var names []string
+	for name, flagged := range set {
+		if flagged {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,71 @@
+package moderation
+
+import (
+	"context"
+	"strings"
+)
+
+// STREAM_WINDOW is how many characters of a streamed reply are collected
+// before they are checked and shown.
+const STREAM_WINDOW = 200
+
+// Stream moderates a reply while it is generated, so it can be shown as it
+// arrives instead of only once it is complete. Every STREAM_WINDOW characters
+// the reply so far is checked, and only text that passed is released. The
+// user sees the reply up to a window behind the model, and every window costs
+// a classifier call. Nothing more is released once a window is flagged. The
+// complete reply still has to pass Check, which records the event; when it is
+// flagged the caller takes back what was released.
+type Stream struct {
+	ctx       context.Context
+	moderator *Moderator
+	item      Item
+	release   func(content string)
+	text      strings.Builder
+	checked   int
+	flagged   bool
+}
+
+// NewStream returns a Stream for the reply described by item, whose Content is
+// ignored. release is called with the part of the reply shown so far. Without
+// moderation every delta is released right away.
+func (m *Moderator) NewStream(ctx context.Context, item Item, release func(content string)) *Stream {
+	return &Stream{ctx: ctx, moderator: m, item: item, release: release}
+}
+
+// Write adds the next delta of the reply.
+func (s *Stream) Write(delta string) {
+	s.text.WriteString(delta)
+	if s.flagged {
+		return
+	}
+	if !s.moderator.Enabled() {
+		s.release(s.text.String())
+		return
+	}
+	if s.text.Len()-s.checked < STREAM_WINDOW {
+		return
+	}
+
+	item := s.item
+	item.Content = s.text.String()
+	result, err := s.moderator.classify(s.ctx, item)
+	if err != nil {
+		// The request is over, there is no one to show the reply to
+		return
+	}
+	if result.Flagged {
+		s.flagged = true
+		return
+	}
+	s.checked = len(item.Content)
+	s.release(item.Content)
+}
+
+// Reset starts the reply over, e.g. when the agent called tools and the model
+// answers again.
+func (s *Stream) Reset() {
+	s.text.Reset()
+	s.checked = 0
+	s.flagged = false
+}
@@ -0,0 +1,80 @@
+package moderation
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// wordClassifier flags texts containing word and counts its calls.
+type wordClassifier struct {
+	word  string
+	calls int
+}
+
+func (w *wordClassifier) Name() string { return "word" }
+
+func (w *wordClassifier) Classify(ctx context.Context, text string, idUser uint) (Result, error) {
+	w.calls++
+	return Result{Flagged: strings.Contains(text, w.word), Classifier: w.Name()}, nil
+}
+
+func TestStream(t *testing.T) {
+	window := strings.Repeat("a", STREAM_WINDOW)
+
+	tests := []struct {
+		name      string
+		moderated bool
+		deltas    []string
+		// want are the texts released, in order
+		want      []string
+		wantCalls int
+	}{
+		{name: "unmoderated", deltas: []string{"one ", "two"}, want: []string{"one ", "one two"}},
+		{name: "moderated short reply", moderated: true, deltas: []string{"one ", "two"}},
+		{
+			name:      "moderated windows flow",
+			moderated: true,
+			deltas:    []string{window, "b", window},
+			want:      []string{window, window + "b" + window},
+			wantCalls: 2,
+		},
+		{
+			name:      "flagged window stops the stream",
+			moderated: true,
+			deltas:    []string{window, "bad" + window, window},
+			want:      []string{window},
+			wantCalls: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			classifier := &wordClassifier{word: "bad"}
+			moderator := NewModerator(nil, nil)
+			if test.moderated {
+				moderator = NewModerator(nil, classifier)
+			}
+
+			var released []string
+			stream := moderator.NewStream(context.Background(), Item{Direction: DIRECTION_OUTPUT}, func(content string) {
+				released = append(released, content)
+			})
+			for _, delta := range test.deltas {
+				stream.Write(delta)
+			}
+
+			if len(released) != len(test.want) {
+				t.Fatalf("released %d times, want %d", len(released), len(test.want))
+			}
+			for i := range released {
+				if released[i] != test.want[i] {
+					t.Errorf("release %d is %q, want %q", i, released[i], test.want[i])
+				}
+			}
+			if classifier.calls != test.wantCalls {
+				t.Errorf("classified %d times, want %d", classifier.calls, test.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/somtojf/trio-server/env"
+	"github.com/somtojf/trio-server/models"
+	"gorm.io/gorm"
+)
+
+type Tier string
+
+const (
+	TIER_GUEST Tier = "guest"
+	TIER_FULL  Tier = "full"
+)
+
+type Period string
+
+const (
+	PERIOD_DAILY   Period = "daily"
+	PERIOD_MONTHLY Period = "monthly"
+)
+
+// Limits are the token and cost budgets of a user. A zero value means unlimited.
+type Limits struct {
+	DailyTokens   int     `json:"dailyTokens"`
+	MonthlyTokens int     `json:"monthlyTokens"`
+	DailyCost     float64 `json:"dailyCost"`
+	MonthlyCost   float64 `json:"monthlyCost"`
+}
+
+type Usage struct {
+	DailyTokens   int     `json:"dailyTokens"`
+	MonthlyTokens int     `json:"monthlyTokens"`
+	DailyCost     float64 `json:"dailyCost"`
+	MonthlyCost   float64 `json:"monthlyCost"`
+}
+
+var defaultTierLimits = map[Tier]Limits{
+	TIER_GUEST: {DailyTokens: 50_000, MonthlyTokens: 200_000, DailyCost: 0.05, MonthlyCost: 0.20},
+	TIER_FULL:  {DailyTokens: 500_000, MonthlyTokens: 5_000_000, DailyCost: 1.00, MonthlyCost: 10.00},
+}
+
+// ExceededError is returned by Check when a user has used up one of their budgets.
+type ExceededError struct {
+	Period   Period
+	Limit    string
+	ResetsAt time.Time
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("You have reached your %s %s limit. It resets at %s", e.Period, e.Limit, e.ResetsAt.Format(time.RFC1123))
+}
+
+type Checker struct {
+	db         *gorm.DB
+	tierLimits map[Tier]Limits
+}
+
+func NewChecker(db *gorm.DB) *Checker {
+	return &Checker{db: db, tierLimits: LoadTierLimits()}
+}
+
+// LoadTierLimits returns the default limits of each tier, overridden by
+// QUOTA_<TIER>_<DAILY|MONTHLY>_<TOKENS|COST> environment variables when set.
+func LoadTierLimits() map[Tier]Limits {
+	limits := make(map[Tier]Limits, len(defaultTierLimits))
+	for tier, defaults := range defaultTierLimits {
+		prefix := fmt.Sprintf("QUOTA_%s_", strings.ToUpper(string(tier)))
+		limits[tier] = Limits{
+			DailyTokens:   env.Int(prefix+"DAILY_TOKENS", defaults.DailyTokens, 0),
+			MonthlyTokens: env.Int(prefix+"MONTHLY_TOKENS", defaults.MonthlyTokens, 0),
+			DailyCost:     env.Float(prefix+"DAILY_COST", defaults.DailyCost, 0),
+			MonthlyCost:   env.Float(prefix+"MONTHLY_COST", defaults.MonthlyCost, 0),
+		}
+	}
+	return limits
+}
+
+func TierForUser(user models.User) Tier {
+	if user.IsGuest {
+		return TIER_GUEST
+	}
+	return TIER_FULL
+}
+
+// LimitsFor returns the effective limits of a user: their tier defaults with
+// any per-user overrides applied.
+func (q *Checker) LimitsFor(ctx context.Context, user models.User) (Limits, error) {
+	limits := q.tierLimits[TierForUser(user)]
+
+	var override models.UserQuota
+	err := q.db.WithContext(ctx).Where("id_user = ?", user.IdUser).First(&override).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return limits, nil
+	}
+	if err != nil {
+		return Limits{}, err
+	}
+
+	if override.DailyTokenLimit != nil {
+		limits.DailyTokens = *override.DailyTokenLimit
+	}
+	if override.MonthlyTokenLimit != nil {
+		limits.MonthlyTokens = *override.MonthlyTokenLimit
+	}
+	if override.DailyCostLimit != nil {
+		limits.DailyCost = *override.DailyCostLimit
+	}
+	if override.MonthlyCostLimit != nil {
+		limits.MonthlyCost = *override.MonthlyCostLimit
+	}
+	return limits, nil
+}
+
+// UsageFor sums the user's recorded model usage for the current day and month (UTC).
+func (q *Checker) UsageFor(ctx context.Context, user models.User) (Usage, error) {
+	dayStart, monthStart := periodStarts(time.Now().UTC())
+
+	type totals struct {
+		Tokens int
+		Cost   float64
+	}
+	sum := func(since time.Time) (totals, error) {
+		var result totals
+		err := q.db.WithContext(ctx).Model(&models.AIPIRecord{}).
+			Select("COALESCE(SUM(input_token_count + output_token_count), 0) AS tokens, COALESCE(SUM(total_cost), 0) AS cost").
+			Where("id_user = ? AND created_at >= ?", user.IdUser, since).
+			Scan(&result).Error
+		return result, err
+	}
+
+	daily, err := sum(dayStart)
+	if err != nil {
+		return Usage{}, err
+	}
+	monthly, err := sum(monthStart)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	return Usage{
+		DailyTokens:   daily.Tokens,
+		MonthlyTokens: monthly.Tokens,
+		DailyCost:     daily.Cost,
+		MonthlyCost:   monthly.Cost,
+	}, nil
+}
+
+// Check returns an *ExceededError when the user is over any of their budgets.
+func (q *Checker) Check(ctx context.Context, user models.User) error {
+	limits, err := q.LimitsFor(ctx, user)
+	if err != nil {
+		return err
+	}
+	usage, err := q.UsageFor(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	dayStart, monthStart := periodStarts(time.Now().UTC())
+	nextDay := dayStart.AddDate(0, 0, 1)
+	nextMonth := monthStart.AddDate(0, 1, 0)
+
+	switch {
+	case limits.DailyTokens > 0 && usage.DailyTokens >= limits.DailyTokens:
+		return &ExceededError{Period: PERIOD_DAILY, Limit: "token", ResetsAt: nextDay}
+	case limits.DailyCost > 0 && usage.DailyCost >= limits.DailyCost:
+		return &ExceededError{Period: PERIOD_DAILY, Limit: "spending", ResetsAt: nextDay}
+	case limits.MonthlyTokens > 0 && usage.MonthlyTokens >= limits.MonthlyTokens:
+		return &ExceededError{Period: PERIOD_MONTHLY, Limit: "token", ResetsAt: nextMonth}
+	case limits.MonthlyCost > 0 && usage.MonthlyCost >= limits.MonthlyCost:
+		return &ExceededError{Period: PERIOD_MONTHLY, Limit: "spending", ResetsAt: nextMonth}
+	}
+
+	return nil
+}
+
+func periodStarts(now time.Time) (dayStart time.Time, monthStart time.Time) {
+	dayStart = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return dayStart, monthStart
+}
@@ -0,0 +1,345 @@
+// Package summary keeps a rolling summary of long basic and reflection chats,
+// so their prompts still know what was said before the messages they are
+// sent as history.
+package summary
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/somtojf/trio-server/aipi"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/aipi/budget"
+	"github.com/somtojf/trio-server/attachments"
+	"github.com/somtojf/trio-server/env"
+	"github.com/somtojf/trio-server/models"
+	"gorm.io/gorm"
+)
+
+type ChatType string
+
+const (
+	CHAT_TYPE_BASIC      ChatType = "basic"
+	CHAT_TYPE_REFLECTION ChatType = "reflection"
+)
+
+const (
+	// DEFAULT_EVERY_N_MESSAGES is how many messages a section summarizes
+	// unless SUMMARY_EVERY_N_MESSAGES is set
+	DEFAULT_EVERY_N_MESSAGES = 20
+	// SECTIONS_PER_LEVEL is how many sections of a level are condensed into
+	// one of the next level
+	SECTIONS_PER_LEVEL = 4
+	UPDATE_TIMEOUT     = 120 * time.Second
+	// PROMPT_TEMPLATE defines the conversation_summary template, which the
+	// system prompts of the chats include with the summary
+	PROMPT_TEMPLATE = "summary/prompt/conversation-summary.go.tmpl"
+)
+
+const SECTION_SYSTEM_MESSAGE = `You keep the summary of a long chat between a user and AI agents. Summarize the new messages so the agents can continue the conversation without them: topics discussed, questions asked and the answers given, decisions, open questions, and anything the user said about themselves or asked the agents to keep in mind. Name who said what when it matters. The summary so far is only there for context, don't repeat it. Write one short paragraph of plain text, no headings or lists.`
+
+const CONDENSE_SYSTEM_MESSAGE = `You keep the summary of a long chat between a user and AI agents. Condense the consecutive summaries of parts of the chat into one shorter summary of all of them. Keep what the agents would still need weeks later: main topics, conclusions, decisions, open questions and what the user said about themselves. Drop details that later parts made irrelevant. Write one short paragraph of plain text, no headings or lists.`
+
+// LoadEveryNMessages returns how many messages a section summarizes.
+func LoadEveryNMessages() int {
+	return env.Int("SUMMARY_EVERY_N_MESSAGES", DEFAULT_EVERY_N_MESSAGES, 1)
+}
+
+// Chat identifies the chat to summarize. UserName tells the user's messages
+// apart in reflection chats.
+type Chat struct {
+	Type     ChatType
+	IdChat   uint
+	IdUser   uint
+	UserName string
+}
+
+type chatKey struct {
+	chatType ChatType
+	idChat   uint
+}
+
+type message struct {
+	ID         uint
+	SenderName string
+	Content    string
+	SentAt     time.Time
+}
+
+// Summarizer updates the summaries in the background. A nil Summarizer
+// summarizes nothing.
+type Summarizer struct {
+	db    *gorm.DB
+	aipi  aipi.AIPIClient
+	model string
+	// every is how many messages a section summarizes
+	every   int
+	mx      sync.Mutex
+	running map[chatKey]bool
+}
+
+func NewSummarizer(db *gorm.DB, client aipi.AIPIClient, model string, every int) *Summarizer {
+	return &Summarizer{db: db, aipi: client, model: model, every: every, running: make(map[chatKey]bool)}
+}
+
+// Get returns the summary of the chat with its sections, oldest first. Chats
+// that were never summarized have an empty summary.
+func (s *Summarizer) Get(ctx context.Context, chatType ChatType, idChat uint) (models.ChatSummary, error) {
+	var summary models.ChatSummary
+	err := s.db.WithContext(ctx).
+		Preload("Sections", func(db *gorm.DB) *gorm.DB { return db.Order("first_message_at") }).
+		Where("chat_type = ? AND chat_id = ?", chatType, idChat).
+		Limit(1).
+		Find(&summary).Error
+	return summary, err
+}
+
+// Prompt returns the summary of the chat as prompts are given it, empty when
+// there is none.
+func (s *Summarizer) Prompt(ctx context.Context, chatType ChatType, idChat uint) (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	summary, err := s.Get(ctx, chatType, idChat)
+	if err != nil {
+		return "", err
+	}
+	return summary.Content(), nil
+}
+
+// UpdateAsync updates the summary of the chat in the background so the reply
+// isn't delayed. An update already running for the chat picks up the new
+// messages the next time.
+func (s *Summarizer) UpdateAsync(ctx context.Context, chat Chat) {
+	if s == nil {
+		return
+	}
+	key := chatKey{chat.Type, chat.IdChat}
+	s.mx.Lock()
+	if s.running[key] {
+		s.mx.Unlock()
+		return
+	}
+	s.running[key] = true
+	s.mx.Unlock()
+
+	// The request may be over by the time the chat is summarized, and its
+	// queue observer would report to a closed stream
+	ctx = aipi.WithQueueObserver(context.WithoutCancel(ctx), nil)
+	go func() {
+		defer func() {
+			s.mx.Lock()
+			delete(s.running, key)
+			s.mx.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(ctx, UPDATE_TIMEOUT)
+		defer cancel()
+		if err := s.Update(ctx, chat); err != nil {
+			slog.Warn("Failed to update chat summary", "chatType", chat.Type, "chat", chat.IdChat, "error", err)
+		}
+	}()
+}
+
+// Update summarizes the messages of the chat that aren't summarized yet, every
+// messages at a time. The budget.HISTORY_CANDIDATE_LIMIT latest messages are
+// left out, the prompts may have them as history.
+func (s *Summarizer) Update(ctx context.Context, chat Chat) error {
+	if s == nil {
+		return nil
+	}
+
+	var summary models.ChatSummary
+	err := s.db.WithContext(ctx).
+		Where(models.ChatSummary{ChatType: string(chat.Type), ChatID: chat.IdChat}).
+		Attrs(models.ChatSummary{UserID: chat.IdUser}).
+		FirstOrCreate(&summary).Error
+	if err != nil {
+		return err
+	}
+
+	messages, err := s.unsummarized(ctx, chat, summary.LastMessageID)
+	if err != nil {
+		return err
+	}
+	if len(messages) <= budget.HISTORY_CANDIDATE_LIMIT {
+		return nil
+	}
+	messages = messages[:len(messages)-budget.HISTORY_CANDIDATE_LIMIT]
+
+	for len(messages) >= s.every {
+		if err := s.summarize(ctx, chat, &summary, messages[:s.every]); err != nil {
+			return err
+		}
+		if err := s.condense(ctx, chat, summary); err != nil {
+			return err
+		}
+		messages = messages[s.every:]
+	}
+	return nil
+}
+
+// DeleteChat deletes the summary of a chat with its sections. It doesn't need a
+// Summarizer, the chat may have been summarized while summaries were on.
+func DeleteChat(db *gorm.DB, chatType ChatType, idChat uint) error {
+	summaries := db.Model(&models.ChatSummary{}).Select("id_chat_summary").Where("chat_type = ? AND chat_id = ?", chatType, idChat)
+	if err := db.Where("id_chat_summary IN (?)", summaries).Delete(&models.ChatSummarySection{}).Error; err != nil {
+		return err
+	}
+	return db.Where("chat_type = ? AND chat_id = ?", chatType, idChat).Delete(&models.ChatSummary{}).Error
+}
+
+// unsummarized returns the messages of the chat after afterID, oldest first.
+// Reflection chats only count the user's messages and the optimal answers.
+func (s *Summarizer) unsummarized(ctx context.Context, chat Chat, afterID uint) ([]message, error) {
+	var messages []message
+	switch chat.Type {
+	case CHAT_TYPE_BASIC:
+		var basicMessages []models.BasicMessage
+		if err := s.db.WithContext(ctx).Where("id_basic_chat = ? AND id_basic_message > ?", chat.IdChat, afterID).
+			Preload("Attachments").
+			Order("id_basic_message").
+			Find(&basicMessages).Error; err != nil {
+			return nil, err
+		}
+		for _, basicMessage := range basicMessages {
+			messages = append(messages, message{
+				ID:         basicMessage.IdBasicMessage,
+				SenderName: basicMessage.SenderName,
+				Content:    attachments.Describe(basicMessage.Content, basicMessage.Attachments),
+				SentAt:     basicMessage.CreatedAt,
+			})
+		}
+	case CHAT_TYPE_REFLECTION:
+		var reflectionMessages []models.ReflectionMessage
+		if err := s.db.WithContext(ctx).Where("id_reflection IN (SELECT id_reflection FROM reflections WHERE id_reflection_chat = ?) AND (is_optimal = ? OR sender_name = ?) AND id_reflection_message > ?", chat.IdChat, true, chat.UserName, afterID).
+			Preload("Attachments").
+			Order("id_reflection_message").
+			Find(&reflectionMessages).Error; err != nil {
+			return nil, err
+		}
+		for _, reflectionMessage := range reflectionMessages {
+			senderName := reflectionMessage.SenderName
+			if senderName != chat.UserName {
+				senderName = "Answerer"
+			}
+			messages = append(messages, message{
+				ID:         reflectionMessage.IdReflectionMessage,
+				SenderName: senderName,
+				Content:    attachments.Describe(reflectionMessage.Content, reflectionMessage.Attachments),
+				SentAt:     reflectionMessage.CreatedAt,
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unknown chat type %q", chat.Type)
+	}
+	return messages, nil
+}
+
+// summarize adds a level 1 section for the messages to the summary.
+func (s *Summarizer) summarize(ctx context.Context, chat Chat, summary *models.ChatSummary, messages []message) error {
+	current, err := s.Prompt(ctx, chat.Type, chat.IdChat)
+	if err != nil {
+		return err
+	}
+
+	var prompt strings.Builder
+	prompt.WriteString("Summary so far:\n")
+	if current == "" {
+		prompt.WriteString("nothing yet\n")
+	}
+	prompt.WriteString(current)
+	prompt.WriteString("\n\nNew messages:\n")
+	for _, message := range messages {
+		fmt.Fprintf(&prompt, "%s (%s): %s\n", message.SenderName, message.SentAt.Format(time.RFC1123), message.Content)
+	}
+
+	content, err := s.complete(ctx, chat.IdUser, SECTION_SYSTEM_MESSAGE, prompt.String())
+	if err != nil {
+		return fmt.Errorf("error summarizing messages: %w", err)
+	}
+
+	last := messages[len(messages)-1]
+	section := models.ChatSummarySection{
+		SummaryID:      summary.IdChatSummary,
+		Level:          1,
+		Content:        content,
+		MessageCount:   len(messages),
+		FirstMessageAt: messages[0].SentAt,
+		LastMessageAt:  last.SentAt,
+	}
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&section).Error; err != nil {
+			return err
+		}
+		summary.LastMessageID = last.ID
+		summary.MessageCount += len(messages)
+		return tx.Model(summary).Select("last_message_id", "message_count").Updates(summary).Error
+	})
+}
+
+// condense replaces the sections of a level by one of the next level once
+// there are SECTIONS_PER_LEVEL of them, level by level.
+func (s *Summarizer) condense(ctx context.Context, chat Chat, summary models.ChatSummary) error {
+	for level := 1; ; level++ {
+		var sections []models.ChatSummarySection
+		if err := s.db.WithContext(ctx).Where("id_chat_summary = ? AND level = ?", summary.IdChatSummary, level).
+			Order("first_message_at").
+			Find(&sections).Error; err != nil {
+			return err
+		}
+		if len(sections) < SECTIONS_PER_LEVEL {
+			return nil
+		}
+
+		var prompt strings.Builder
+		condensed := models.ChatSummarySection{
+			SummaryID:      summary.IdChatSummary,
+			Level:          level + 1,
+			FirstMessageAt: sections[0].FirstMessageAt,
+			LastMessageAt:  sections[len(sections)-1].LastMessageAt,
+		}
+		for i, section := range sections {
+			fmt.Fprintf(&prompt, "Part %d (%s to %s):\n%s\n\n", i+1, section.FirstMessageAt.Format(time.RFC1123), section.LastMessageAt.Format(time.RFC1123), section.Content)
+			condensed.MessageCount += section.MessageCount
+		}
+
+		content, err := s.complete(ctx, chat.IdUser, CONDENSE_SYSTEM_MESSAGE, prompt.String())
+		if err != nil {
+			return fmt.Errorf("error condensing summary: %w", err)
+		}
+		condensed.Content = content
+
+		err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Delete(&sections).Error; err != nil {
+				return err
+			}
+			return tx.Create(&condensed).Error
+		})
+		if err != nil {
+			return err
+		}
+		slog.Info("Condensed chat summary", "chatType", chat.Type, "chat", chat.IdChat, "level", level+1)
+	}
+}
+
+func (s *Summarizer) complete(ctx context.Context, idUser uint, systemMessage string, userMessage string) (string, error) {
+	response, err := s.aipi.GetCompletion(ctx, aipitypes.AIPIRequest{
+		SystemMessage:  systemMessage,
+		UserMessage:    userMessage,
+		Model:          s.model,
+		IdUser:         idUser,
+		ResponseFormat: aipitypes.AIPI_RESPONSE_FORMAT_TEXT,
+	})
+	if err != nil {
+		return "", err
+	}
+	content := strings.TrimSpace(response.Data)
+	if content == "" {
+		return "", fmt.Errorf("model returned an empty summary")
+	}
+	return content, nil
+}
@@ -0,0 +1,203 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+)
+
+type calculatorArguments struct {
+	Expression string `json:"expression" description:"Arithmetic expression using numbers, parentheses and + - * / % ^, e.g. (2 + 3) * 4.5"`
+}
+
+// Calculator evaluates arithmetic expressions, which models tend to get wrong.
+type Calculator struct{}
+
+func NewCalculator() *Calculator {
+	return &Calculator{}
+}
+
+func (t *Calculator) Definition() aipitypes.ToolDefinition {
+	return aipitypes.ToolDefinition{
+		Name:        "calculator",
+		Description: "Evaluates an arithmetic expression and returns the result.",
+		Parameters:  parametersFor(calculatorArguments{}),
+	}
+}
+
+func (t *Calculator) Call(ctx context.Context, env Env, arguments string) (string, error) {
+	var args calculatorArguments
+	if err := parseArguments(arguments, &args); err != nil {
+		return "", err
+	}
+
+	result, err := evaluate(args.Expression)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(result, 'g', -1, 64), nil
+}
+
+// evaluate parses the expression with a recursive descent parser:
+//
+//	expression = term { ("+" | "-") term }
+//	term       = unary { ("*" | "/" | "%") unary }
+//	unary      = ( "-" | "+" ) unary | power
+//	power      = primary [ "^" unary ]
+//	primary    = number | "(" expression ")"
+func evaluate(expression string) (float64, error) {
+	p := &expressionParser{input: strings.TrimSpace(expression)}
+	if p.input == "" {
+		return 0, fmt.Errorf("empty expression")
+	}
+
+	result, err := p.expression()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+	}
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		return 0, fmt.Errorf("result is not a finite number")
+	}
+	return result, nil
+}
+
+type expressionParser struct {
+	input string
+	pos   int
+}
+
+func (p *expressionParser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// accept consumes the next non-space character if it is one of ops.
+func (p *expressionParser) accept(ops string) (byte, bool) {
+	p.skipSpaces()
+	if p.pos < len(p.input) && strings.IndexByte(ops, p.input[p.pos]) >= 0 {
+		op := p.input[p.pos]
+		p.pos++
+		return op, true
+	}
+	return 0, false
+}
+
+func (p *expressionParser) expression() (float64, error) {
+	left, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op, ok := p.accept("+-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.term()
+		if err != nil {
+			return 0, err
+		}
+		if op == '+' {
+			left += right
+		} else {
+			left -= right
+		}
+	}
+}
+
+func (p *expressionParser) term() (float64, error) {
+	left, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op, ok := p.accept("*/%")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '*':
+			left *= right
+		case '/':
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			left /= right
+		case '%':
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			left = math.Mod(left, right)
+		}
+	}
+}
+
+func (p *expressionParser) power() (float64, error) {
+	base, err := p.primary()
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := p.accept("^"); !ok {
+		return base, nil
+	}
+	exponent, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	return math.Pow(base, exponent), nil
+}
+
+func (p *expressionParser) unary() (float64, error) {
+	if op, ok := p.accept("+-"); ok {
+		value, err := p.unary()
+		if op == '-' {
+			value = -value
+		}
+		return value, err
+	}
+	return p.power()
+}
+
+func (p *expressionParser) primary() (float64, error) {
+	if _, ok := p.accept("("); ok {
+		value, err := p.expression()
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return 0, fmt.Errorf("missing closing parenthesis")
+		}
+		return value, nil
+	}
+
+	p.skipSpaces()
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsDigit(rune(p.input[p.pos])) || p.input[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos == len(p.input) {
+			return 0, fmt.Errorf("unexpected end of expression")
+		}
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+	}
+
+	value, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", p.input[start:p.pos])
+	}
+	return value, nil
+}
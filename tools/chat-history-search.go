@@ -0,0 +1,72 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"github.com/somtojf/trio-server/models"
+	"gorm.io/gorm"
+)
+
+const CHAT_HISTORY_SEARCH_LIMIT = 10
+
+type chatHistorySearchArguments struct {
+	Query string `json:"query" description:"Word or phrase to look for in earlier messages of this chat"`
+}
+
+// ChatHistorySearch finds earlier messages of the current basic chat that are
+// too old to be part of the prompt.
+type ChatHistorySearch struct {
+	db *gorm.DB
+}
+
+func NewChatHistorySearch(db *gorm.DB) *ChatHistorySearch {
+	return &ChatHistorySearch{db: db}
+}
+
+func (t *ChatHistorySearch) Definition() aipitypes.ToolDefinition {
+	return aipitypes.ToolDefinition{
+		Name:        "search_chat_history",
+		Description: "Searches earlier messages of this chat for a word or phrase and returns the most recent matches.",
+		Parameters:  parametersFor(chatHistorySearchArguments{}),
+	}
+}
+
+func (t *ChatHistorySearch) Call(ctx context.Context, env Env, arguments string) (string, error) {
+	var args chatHistorySearchArguments
+	if err := parseArguments(arguments, &args); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(args.Query) == "" {
+		return "", fmt.Errorf("query must not be empty")
+	}
+	if env.IdChat == 0 {
+		return "", fmt.Errorf("chat history search is only available in chats")
+	}
+
+	var messages []models.BasicMessage
+	if err := t.db.WithContext(ctx).
+		Where("id_basic_chat = ? AND content ILIKE ?", env.IdChat, "%"+escapeLike(args.Query)+"%").
+		Order("created_at DESC").
+		Limit(CHAT_HISTORY_SEARCH_LIMIT).
+		Find(&messages).Error; err != nil {
+		return "", err
+	}
+
+	if len(messages) == 0 {
+		return "No messages found.", nil
+	}
+
+	var result strings.Builder
+	for _, message := range messages {
+		fmt.Fprintf(&result, "%s (%s): %s\n", message.SenderName, message.CreatedAt.Format(time.RFC1123), message.Content)
+	}
+	return result.String(), nil
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
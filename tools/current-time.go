@@ -0,0 +1,47 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+)
+
+type currentTimeArguments struct {
+	Timezone string `json:"timezone" description:"IANA time zone such as Europe/Berlin, or an empty string for UTC"`
+}
+
+// CurrentTime tells models the date and time, which they can't know otherwise.
+type CurrentTime struct{}
+
+func NewCurrentTime() *CurrentTime {
+	return &CurrentTime{}
+}
+
+func (t *CurrentTime) Definition() aipitypes.ToolDefinition {
+	return aipitypes.ToolDefinition{
+		Name:        "current_time",
+		Description: "Returns the current date, time and weekday in a time zone.",
+		Parameters:  parametersFor(currentTimeArguments{}),
+	}
+}
+
+func (t *CurrentTime) Call(ctx context.Context, env Env, arguments string) (string, error) {
+	var args currentTimeArguments
+	if err := parseArguments(arguments, &args); err != nil {
+		return "", err
+	}
+
+	location := time.UTC
+	if args.Timezone != "" {
+		loaded, err := time.LoadLocation(args.Timezone)
+		if err != nil {
+			return "", fmt.Errorf("unknown time zone %q", args.Timezone)
+		}
+		location = loaded
+	}
+
+	now := time.Now().In(location)
+	return fmt.Sprintf("%s (%s)", now.Format(time.RFC3339), now.Weekday()), nil
+}
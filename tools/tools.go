@@ -0,0 +1,156 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+	"github.com/somtojf/trio-server/aipi/aipitypes"
+	"gorm.io/gorm"
+)
+
+// Env is what a tool knows about the conversation it was called from.
+type Env struct {
+	IdUser uint
+	IdChat uint
+}
+
+// Tool is a function agents can call while answering. Call receives the
+// arguments the model produced as a JSON object and returns the text that is
+// sent back to the model.
+type Tool interface {
+	Definition() aipitypes.ToolDefinition
+	Call(ctx context.Context, env Env, arguments string) (string, error)
+}
+
+// Invocation is a tool call made by a model together with its outcome.
+type Invocation struct {
+	ToolCallID string `json:"toolCallId"`
+	Name       string `json:"name"`
+	Arguments  string `json:"arguments"`
+	Result     string `json:"result"`
+	Error      string `json:"error,omitempty"`
+}
+
+type Registry struct {
+	tools map[string]Tool
+	names []string
+}
+
+// NewRegistry returns a registry with all built-in tools.
+func NewRegistry(db *gorm.DB) *Registry {
+	registry := &Registry{tools: make(map[string]Tool)}
+	registry.Register(NewCalculator())
+	registry.Register(NewCurrentTime())
+	registry.Register(NewChatHistorySearch(db))
+	return registry
+}
+
+func (r *Registry) Register(tool Tool) {
+	name := tool.Definition().Name
+	if _, exists := r.tools[name]; !exists {
+		r.names = append(r.names, name)
+	}
+	r.tools[name] = tool
+}
+
+func (r *Registry) Get(name string) (Tool, bool) {
+	tool, ok := r.tools[name]
+	return tool, ok
+}
+
+// Resolve looks up the named tools and fails on the first unknown name.
+func (r *Registry) Resolve(names []string) ([]Tool, error) {
+	toolset := make([]Tool, 0, len(names))
+	for _, name := range names {
+		tool, ok := r.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown tool: %s", name)
+		}
+		toolset = append(toolset, tool)
+	}
+	return toolset, nil
+}
+
+// List returns the definitions of all tools in registration order.
+func (r *Registry) List() []aipitypes.ToolDefinition {
+	definitions := make([]aipitypes.ToolDefinition, 0, len(r.names))
+	for _, name := range r.names {
+		definitions = append(definitions, r.tools[name].Definition())
+	}
+	return definitions
+}
+
+func Definitions(toolset []Tool) []aipitypes.ToolDefinition {
+	definitions := make([]aipitypes.ToolDefinition, 0, len(toolset))
+	for _, tool := range toolset {
+		definitions = append(definitions, tool.Definition())
+	}
+	return definitions
+}
+
+// Execute runs a tool call against the toolset. Failures are reported in the
+// invocation rather than returned, so the model can be told about them and recover.
+func Execute(ctx context.Context, toolset []Tool, env Env, call aipitypes.ToolCall) Invocation {
+	invocation := Invocation{
+		ToolCallID: call.ID,
+		Name:       call.Name,
+		Arguments:  call.Arguments,
+	}
+
+	var tool Tool
+	for _, candidate := range toolset {
+		if candidate.Definition().Name == call.Name {
+			tool = candidate
+			break
+		}
+	}
+	if tool == nil {
+		invocation.Error = fmt.Sprintf("unknown tool: %s", call.Name)
+		return invocation
+	}
+
+	result, err := tool.Call(ctx, env, call.Arguments)
+	if err != nil {
+		slog.Warn("Tool call failed", "tool", call.Name, "arguments", call.Arguments, "error", err)
+		invocation.Error = err.Error()
+		return invocation
+	}
+	invocation.Result = result
+	return invocation
+}
+
+// Message returns the tool message that reports the invocation to the model.
+func (i Invocation) Message() aipitypes.AIPIMessage {
+	content := i.Result
+	if i.Error != "" {
+		content = "Error: " + i.Error
+	}
+	return aipitypes.AIPIMessage{
+		Role:       aipitypes.MESSAGE_ROLE_TOOL,
+		Name:       i.Name,
+		Content:    content,
+		ToolCallID: i.ToolCallID,
+	}
+}
+
+// parametersFor derives a tool's parameter schema from its arguments struct.
+func parametersFor(arguments any) *jsonschema.Definition {
+	definition, err := jsonschema.GenerateSchemaForType(arguments)
+	if err != nil {
+		panic(fmt.Sprintf("invalid tool arguments type %T: %v", arguments, err))
+	}
+	return definition
+}
+
+func parseArguments(arguments string, v any) error {
+	if arguments == "" {
+		arguments = "{}"
+	}
+	if err := json.Unmarshal([]byte(arguments), v); err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package chattypes
+
+import (
+	"fmt"
+
+	"github.com/somtojf/trio-server/aipi/registry"
+	"github.com/somtojf/trio-server/env"
+	"github.com/somtojf/trio-server/models"
+)
+
+const MAX_TEMPERATURE = 2
+
+// DEFAULT_MAX_AGENTS_PER_CHAT caps the agents of a basic chat unless
+// MAX_AGENTS_PER_CHAT is set.
+const DEFAULT_MAX_AGENTS_PER_CHAT = 6
+
+// LoadMaxAgentsPerChat returns how many agents a basic chat may have.
+func LoadMaxAgentsPerChat() int {
+	return env.Int("MAX_AGENTS_PER_CHAT", DEFAULT_MAX_AGENTS_PER_CHAT, 1)
+}
+
+// DEFAULT_MAX_DISCUSSION_ROUNDS caps the discussion rounds of a basic chat
+// unless MAX_DISCUSSION_ROUNDS is set.
+const DEFAULT_MAX_DISCUSSION_ROUNDS = 5
+
+// LoadMaxDiscussionRounds returns how many discussion rounds a basic chat may
+// have.
+func LoadMaxDiscussionRounds() int {
+	return env.Int("MAX_DISCUSSION_ROUNDS", DEFAULT_MAX_DISCUSSION_ROUNDS, 1)
+}
+
+// ModelSettingsRequest picks the model and sampling parameters a chat
+// participant answers with. Fields left out keep the defaults.
+type ModelSettingsRequest struct {
+	Model       string   `json:"model"`
+	Temperature *float32 `json:"temperature"`
+	TopP        *float32 `json:"topP"`
+	MaxTokens   *int     `json:"maxTokens"`
+	Seed        *int     `json:"seed"`
+}
+
+// SettingsRequest turns stored settings back into a request, to validate them
+// again for another user.
+func SettingsRequest(settings models.ModelSettings) ModelSettingsRequest {
+	return ModelSettingsRequest{
+		Model:       settings.ModelName,
+		Temperature: settings.Temperature,
+		TopP:        settings.TopP,
+		MaxTokens:   settings.MaxTokens,
+		Seed:        settings.Seed,
+	}
+}
+
+// ModelRequirements are the capabilities the picked model needs.
+type ModelRequirements struct {
+	Tools    bool
+	JSONMode bool
+}
+
+// Validate checks the settings against the models the user may pick and
+// returns them as they are stored.
+func (r ModelSettingsRequest) Validate(modelRegistry *registry.Registry, isGuest bool, requirements ModelRequirements) (models.ModelSettings, error) {
+	if r.Temperature != nil && (*r.Temperature < 0 || *r.Temperature > MAX_TEMPERATURE) {
+		return models.ModelSettings{}, fmt.Errorf("temperature must be between 0 and %d", MAX_TEMPERATURE)
+	}
+	if r.TopP != nil && (*r.TopP <= 0 || *r.TopP > 1) {
+		return models.ModelSettings{}, fmt.Errorf("topP must be greater than 0 and at most 1")
+	}
+	if r.MaxTokens != nil && *r.MaxTokens <= 0 {
+		return models.ModelSettings{}, fmt.Errorf("maxTokens must be positive")
+	}
+
+	modelName := r.Model
+	if modelName != "" {
+		model, err := modelRegistry.ResolveSelectable(r.Model, isGuest)
+		if err != nil {
+			return models.ModelSettings{}, err
+		}
+		if requirements.Tools && !model.SupportsTools {
+			return models.ModelSettings{}, fmt.Errorf("model %s does not support tools", model.ID)
+		}
+		if requirements.JSONMode && !model.SupportsJSONMode {
+			return models.ModelSettings{}, fmt.Errorf("model %s does not support JSON responses", model.ID)
+		}
+		if r.MaxTokens != nil && model.MaxOutputTokens > 0 && *r.MaxTokens > model.MaxOutputTokens {
+			return models.ModelSettings{}, fmt.Errorf("maxTokens exceeds the %d output tokens of %s", model.MaxOutputTokens, model.ID)
+		}
+		// Store the id rather than an alias
+		modelName = model.ID
+	}
+
+	return models.ModelSettings{
+		ModelName:   modelName,
+		Temperature: r.Temperature,
+		TopP:        r.TopP,
+		MaxTokens:   r.MaxTokens,
+		Seed:        r.Seed,
+	}, nil
+}
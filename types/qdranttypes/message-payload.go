@@ -0,0 +1,55 @@
+package qdranttypes
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/qdrant/go-client/qdrant"
+)
+
+// LEGACY_CREATED_AT_LAYOUT is the format of time.Time.String, which created_at
+// was stored in before it was RFC 3339. Points indexed back then still use it.
+const LEGACY_CREATED_AT_LAYOUT = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// MessagePayload is what a chat message is stored with next to its embedding
+// in the message collections.
+type MessagePayload struct {
+	ChatID     string
+	Content    string
+	SenderName string
+	ExternalID string
+	CreatedAt  time.Time
+}
+
+// Values returns the payload as it is upserted. created_at is stored as RFC 3339
+// in UTC.
+func (p MessagePayload) Values() map[string]*qdrant.Value {
+	return qdrant.NewValueMap(map[string]any{
+		"chat_id":     p.ChatID,
+		"content":     p.Content,
+		"sender_name": p.SenderName,
+		"external_id": p.ExternalID,
+		"created_at":  p.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// ParseMessagePayload reads the payload of a point found in a message
+// collection. It fails when created_at is missing or not a time.
+func ParseMessagePayload(values map[string]*qdrant.Value) (MessagePayload, error) {
+	createdAt := values["created_at"].GetStringValue()
+	sentAt, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		sentAt, err = time.Parse(LEGACY_CREATED_AT_LAYOUT, createdAt)
+	}
+	if err != nil {
+		return MessagePayload{}, fmt.Errorf("invalid created_at %q", createdAt)
+	}
+
+	return MessagePayload{
+		ChatID:     values["chat_id"].GetStringValue(),
+		Content:    values["content"].GetStringValue(),
+		SenderName: values["sender_name"].GetStringValue(),
+		ExternalID: values["external_id"].GetStringValue(),
+		CreatedAt:  sentAt,
+	}, nil
+}
@@ -0,0 +1,58 @@
+package qdranttypes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qdrant/go-client/qdrant"
+)
+
+func TestMessagePayloadRoundTrip(t *testing.T) {
+	createdAt := time.Date(2025, 3, 14, 15, 9, 26, 535897000, time.FixedZone("CET", 3600))
+	stored := MessagePayload{
+		ChatID:     "42",
+		Content:    "Hello there",
+		SenderName: "Sam",
+		ExternalID: "0b7c6f1e-3f0a-4a57-9a3e-5d1f0e6c2b11",
+		CreatedAt:  createdAt,
+	}
+
+	tests := []struct {
+		name    string
+		values  map[string]*qdrant.Value
+		want    MessagePayload
+		wantErr bool
+	}{
+		{name: "stored payload", values: stored.Values(), want: stored},
+		{
+			name: "legacy created_at",
+			values: qdrant.NewValueMap(map[string]any{
+				"chat_id":    "42",
+				"content":    "Hello there",
+				"created_at": createdAt.String(),
+			}),
+			want: MessagePayload{ChatID: "42", Content: "Hello there", CreatedAt: createdAt},
+		},
+		{name: "missing created_at", values: qdrant.NewValueMap(map[string]any{"content": "Hello there"}), wantErr: true},
+		{name: "malformed created_at", values: qdrant.NewValueMap(map[string]any{"created_at": "yesterday"}), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseMessagePayload(test.values)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if !got.CreatedAt.Equal(test.want.CreatedAt) {
+				t.Errorf("got created_at %v, want %v", got.CreatedAt, test.want.CreatedAt)
+			}
+			got.CreatedAt, test.want.CreatedAt = time.Time{}, time.Time{}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -1,13 +1,66 @@
 package qdranttypes
 
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/somtojf/trio-server/aipi/registry"
+)
+
 type CollectionName string
 type VectorSize int
 
 const (
 	COLLECTION_NAME_BASIC_MESSAGES      CollectionName = "basic_messages"
 	COLLECTION_NAME_REFLECTION_MESSAGES CollectionName = "reflection_messages"
+	// COLLECTION_NAME_COMPLETION_CACHE holds completions embedded by their prompt, see aipi.SemanticCache
+	COLLECTION_NAME_COMPLETION_CACHE CollectionName = "completion_cache"
+	// COLLECTION_NAME_AGENT_MEMORIES holds what agents remember about their users, see memory.Store
+	COLLECTION_NAME_AGENT_MEMORIES CollectionName = "agent_memories"
 )
 
 const (
-	VECTOR_SIZE_BASIC_MESSAGE VectorSize = 1536
+	DEFAULT_EMBEDDING_MODEL_OPENAI = "text-embedding-3-small"
+	DEFAULT_EMBEDDING_MODEL_GEMINI = "text-embedding-004"
 )
+
+// EmbeddingSettings is the model the vectors of the collections are computed
+// with and their size. Changing either requires recreating the collections.
+type EmbeddingSettings struct {
+	Model      string
+	VectorSize VectorSize
+}
+
+// LoadEmbeddingSettings reads EMBEDDING_MODEL and EMBEDDING_DIMENSIONS. Without
+// a model, text-embedding-3-small is used when OPENAI_API_KEY is set and
+// text-embedding-004 when only GEMINI_API_KEY is. The vector size defaults to
+// the model's native dimensions.
+func LoadEmbeddingSettings(models *registry.Registry) (EmbeddingSettings, error) {
+	modelID := os.Getenv("EMBEDDING_MODEL")
+	if modelID == "" {
+		modelID = DEFAULT_EMBEDDING_MODEL_OPENAI
+		if os.Getenv("OPENAI_API_KEY") == "" && os.Getenv("GEMINI_API_KEY") != "" {
+			modelID = DEFAULT_EMBEDDING_MODEL_GEMINI
+		}
+	}
+
+	model, err := models.Resolve(modelID, registry.MODEL_KIND_EMBEDDING)
+	if err != nil {
+		return EmbeddingSettings{}, fmt.Errorf("invalid EMBEDDING_MODEL: %w", err)
+	}
+
+	settings := EmbeddingSettings{Model: model.ID, VectorSize: VectorSize(model.EmbeddingDimensions)}
+	if value := os.Getenv("EMBEDDING_DIMENSIONS"); value != "" {
+		dimensions, err := strconv.Atoi(value)
+		if err != nil || dimensions <= 0 {
+			return EmbeddingSettings{}, fmt.Errorf("invalid EMBEDDING_DIMENSIONS %q", value)
+		}
+		if dimensions > model.EmbeddingDimensions {
+			return EmbeddingSettings{}, fmt.Errorf("EMBEDDING_DIMENSIONS %d exceeds the %d dimensions of %s", dimensions, model.EmbeddingDimensions, model.ID)
+		}
+		settings.VectorSize = VectorSize(dimensions)
+	}
+
+	return settings, nil
+}